@@ -1,3 +1,10 @@
 module ai-pdf-renamer
 
 go 1.24.2
+
+require (
+	golang.org/x/image v0.32.0
+	golang.org/x/sys v0.37.0
+	golang.org/x/text v0.30.0
+	golang.org/x/time v0.14.0
+)
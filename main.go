@@ -1,21 +1,51 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"image"
+	"image/draw"
 	"image/jpeg"
+	_ "image/jpeg" // Register JPEG for isImageEmpty
 	"image/png"
 	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/time/rate"
 )
 
 // Exitor defines the interface for program exit behavior
@@ -30,30 +60,419 @@ func (e *DefaultExitor) Exit(code int) {
 	os.Exit(code)
 }
 
-const defaultPrompt = "Extract the most important keywords from this text and create a filename. The filename should be concise (max 64 chars), use only the most important keywords, and separate words with dashes. Do not include any explanations or additional text."
+// defaultDescribePrompt asks for a catalog caption in -describe mode
+const defaultDescribePrompt = "Describe this document in one short sentence for a catalog: what kind of document it is, who it is from and what it is about. Do not include any explanations or additional text."
+
+// defaultScannerPrefixes are filename prefixes that scanners and cameras put in front
+// of their sequence numbers
+const defaultScannerPrefixes = "SKM_,IMG_,Scan_,DOC"
+
+const defaultPrompt = "Extract the most important keywords from this text and create a filename. The filename should be concise (max {max_length} chars), use only the most important keywords, and separate words with dashes. Do not include any explanations or additional text."
+const defaultVisionSuffix = " Analyze these images and create a filename based on their content."
+const defaultTextIntro = " Text: "
 const winErrPre = "On windows dependencies might be tricky. We recommend using a package manager like chocolatey, winget or similar\n\n"
 
 // Config holds the application configuration
 type Config struct {
-	AutoRename   bool
-	CustomPrompt string
-	Model        string
-	FastMode     bool
-	OutputDir    string // New field for output directory
-	Exitor       Exitor // Interface for program exit behavior
+	AutoRename            bool
+	CustomPrompt          string
+	Model                 string
+	FastMode              bool
+	OutputDir             string        // New field for output directory
+	DPI                   int           // Render resolution for full-resolution pages
+	ContextPages          bool          // Render pages after the first FullResPages at ContextDPI
+	FullResPages          int           // Number of leading pages rendered at DPI when ContextPages is set
+	ContextDPI            int           // Render resolution for low-res context pages
+	MinNameLength         int           // Sanitized names shorter than this count as a generation failure
+	CombineGlob           string        // Glob of multi-part scans to merge into a single document before naming
+	CombineByPrefix       bool          // Group CombineGlob matches by their shared name prefix instead of merging all of them
+	CombineRemoveParts    bool          // Delete the parts after the combined document was written
+	DebugImagesDir        string        // Directory that receives the page images sent to the vision model (diagnostic)
+	VisionSuffix          string        // Appended to the prompt in vision mode
+	TextIntro             string        // Placed between the prompt and the extracted text in OCR mode
+	FailFast              bool          // Abort the whole run on the first file error instead of continuing
+	Pages                 string        // Global page spec (e.g. "1-3,5") for vision mode; empty means the first 3 pages
+	PagesMap              string        // File with per-input page specs ("<file> <spec>" per line)
+	EmitMetadata          bool          // Write a <newname>.json sidecar with the readable title next to the output
+	SetTitle              bool          // Set the PDF document Title of the output to the readable name
+	SamplePages           string        // Page selection strategy without a page spec: first, spread or random
+	SampleCount           int           // Number of pages selected by SamplePages
+	SampleSeed            int64         // Seed for the random strategy (0 picks a new seed every run)
+	Manifest              string        // JSON Lines manifest recording the outcome for every source
+	Resume                bool          // Skip sources that a previous run (per the manifest) already renamed
+	OllamaOptionsFile     string        // JSON object merged verbatim into the generate payload options
+	Verbose               bool          // Print additional diagnostic output
+	MaxTextChars          int           // Cap on the OCR text sent to the model (0 = no cap)
+	NumCtx                int           // Fixed Ollama num_ctx for the OCR path (0 = size automatically)
+	MaxNumCtx             int           // Upper bound for the automatically sized num_ctx
+	PostHook              string        // Command run after each successful rename; {src}, {dst} and {mode} are substituted
+	PostHookStrict        bool          // Count a failing post-hook as a failure of the file
+	OnCollision           string        // What to do when the output file already exists: overwrite, suffix or skip
+	DedupeByName          bool          // Report generated names shared by more than one source at the end of the run
+	MaxPageBytes          int           // Re-render a page at StepDownDPI when its PNG is larger than this (0 disables)
+	StepDownDPI           int           // Render resolution used for pages whose PNG exceeds MaxPageBytes
+	AllowInvalidImage     bool          // Send page images that fail PNG validation (but carry a PNG signature) with a warning
+	ListMatches           bool          // Print the files the patterns expand to and exit without processing
+	PromptExplicit        bool          // -prompt was given on the command line, so directory prompt files are ignored
+	CharsBudget           int           // Maximum length of the generated filename, also announced to the model
+	JSONLogs              bool          // Emit structured JSON events on stderr
+	TextAlphaBits         int           // Ghostscript -dTextAlphaBits for page rendering (1, 2 or 4)
+	GraphicsAlphaBits     int           // Ghostscript -dGraphicsAlphaBits for page rendering (1, 2 or 4)
+	FallbackPattern       string        // 'regex=>replacement' applied to the source basename when all AI paths fail
+	Archive               string        // Write renamed files into this .zip, .tar or .tar.gz archive instead of a directory
+	InteractiveBatchEdit  bool          // Review all suggestions at once in $EDITOR instead of per-file prompts
+	OnEmptyPage           string        // What to do with blank pages: skip, error (if all pages are blank) or include
+	NumSuggestions        int           // Number of names to request from the model; the best-scoring one is used
+	ReadabilityScore      int           // Minimum readability score a generated name needs (0 disables the gate)
+	CleanText             string        // Comma-separated OCR text cleanups: urls, emails, digits or all
+	Classify              bool          // Ask the model for the document type after naming
+	Categories            string        // Comma-separated document types offered to the classifier
+	RouteByType           bool          // Write renamed files into a -output subdirectory named after the detected type
+	Lang                  string        // Tesseract language(s) for OCR, e.g. "deu" or "eng+deu" (empty uses the ocrmypdf default)
+	NameFrom              string        // Name source: metadata (PDF Title, model only as fallback), content or both
+	QuietErrors           bool          // Only report per-file errors in the final summary
+	ExamplesFile          string        // JSON file with few-shot {"content", "filename"} examples for the prompt
+	MaxExamples           int           // Maximum number of examples injected into the prompt
+	Charset               string        // Characters kept in filenames: ascii (a-z, 0-9, dash) or unicode (all letters and digits)
+	CanonicalizeUnicode   string        // Unicode normalization for -charset unicode: nfc, nfkc or none
+	GSTimeout             time.Duration // Maximum runtime of a single Ghostscript call (0 disables)
+	OCRTimeout            time.Duration // Maximum runtime of a single ocrmypdf call (0 disables)
+	PreviewImage          bool          // Show a thumbnail of page 1 above the confirmation prompt on supporting terminals
+	SetXattr              bool          // Store the suggested name in an extended attribute instead of renaming
+	XattrKey              string        // Extended attribute used by -set-xattr
+	MinConfidence         int           // Minimum self-rated confidence (1-10) needed to accept a name (0 disables)
+	NormalizeDashes       bool          // Map Unicode dashes, quotes and spaces to ASCII before sanitizing
+	RateLimit             float64       // Maximum Ollama generate requests per second (0 = unlimited)
+	DetectLanguage        bool          // Detect the primary document language
+	LanguagePrefix        bool          // Prefix the filename with the detected language code
+	NoClobberSource       bool          // Refuse to write over another input file of the batch
+	Describe              bool          // Only caption each document, without renaming
+	DescribePrompt        string        // Prompt used in -describe mode
+	DescribeTxt           bool          // Write the -describe caption to <file>.txt
+	SafeNames             bool          // Restrict names to characters safe in URLs and shells
+	OCRJobs               int           // Threads ocrmypdf uses per document (0 = ocrmypdf default)
+	TrimScannerPrefix     bool          // Use the original name without scanner prefixes as a hint and fallback
+	ScannerPrefixes       string        // Comma-separated filename prefixes of scanners and cameras
+	ScannerPrefixesFile   string        // File with one scanner prefix per line, replacing -scanner-prefixes
+	OnlyScannerNames      bool          // Only process files whose name is a scanner default
+	DateSubdir            bool          // File renamed documents into -output/YYYY/MM/ by document date
+	VerifyPDF             bool          // Check the source and written PDF for validity
+	NormalizeCaseInText   bool          // Lowercase ALL-CAPS lines of the OCR text
+	ProgressJSON          bool          // Emit a JSON progress stream on stdout instead of the human-readable output
+	CropTop               float64       // Send only this top fraction of full-resolution pages (0 = whole page)
+	VisionModel           string        // Model for the vision path (empty = -model)
+	TextModel             string        // Model for the OCR text path (empty = -model)
+	OnFailure             string        // What happens to inputs that fail: keep or quarantine
+	QuarantineDir         string        // Directory failed inputs are moved to with -on-failure quarantine
+	DryRun                bool          // Show the suggested names without writing anything
+	DryRunDiff            bool          // With -dry-run, end with an aligned old/new diff of all names
+	NoColor               bool          // Disable colored output
+	AppendPageCount       bool          // Append the page count as -pN to the name
+	PageCountSingle       bool          // With -append-page-count, also mark single-page documents with -p1
+	AllowSpaces           bool          // Keep single spaces between words instead of dashes
+	TitleCase             bool          // Capitalize the first letter of every word in the name
+	NameLang              string        // Language the model should name files in, e.g. English or en
+	EscalateModel         string        // Model for one more attempt when vision and OCR both fail (empty = none)
+	ReportHTML            string        // Write a self-contained HTML summary of the run to this path
+	Numbers               string        // Digit policy for names: keep, strip (drop digit-only words) or collapse (shorten long digit runs)
+	NumbersMaxDigits      int           // With -numbers collapse, digit runs longer than this keep only their last digits
+	InputJSON             string        // JSON batch spec with per-file prompt, model and output overrides
+	DetectDuplicatePages  bool          // Drop page images that look like an earlier page before sending them
+	DuplicateThreshold    int           // Maximum perceptual hash distance (0-64 bits) for two pages to count as duplicates
+	ApplyMap              string        // TSV file of source<TAB>new-name pairs to apply without asking the model
+	ReviewDir             string        // With -min-confidence, copy low-confidence files here with their suggestion
+	FirstPageFastPath     bool          // Count the pages first, so short documents are rendered without probing for more
+	Retries               int           // Extra generate calls when the answer is empty or too short to use
+	TemperatureSchedule   string        // Comma-separated temperatures for the -retries attempts
+	Keywords              int           // Ask for this many keywords per document and write them to <newname>.tags (0 disables)
+	StdinPDF              bool          // Read a single PDF from stdin instead of file arguments
+	StdoutName            bool          // Print only the suggested names on stdout and write nothing
+	MaxMegapixels         float64       // Downscale rendered pages above this many megapixels (0 disables)
+	Scheme                string        // Compose the filename from placeholders like {date}_{type}_{name}
+	ValidateOnly          bool          // Check existing filenames against the naming rules and exit
+	Stream                bool          // Stream the answer from Ollama, echoing it live with -verbose
+	DedupeAgainstOutput   bool          // Skip inputs whose content already exists as a PDF in the output directory
+	MaxWords              int           // Keep at most this many words of the name (0 = no limit)
+	OCROutputType         string        // ocrmypdf --output-type: "none" (text only), "pdf" or "pdfa" (rewrite the input with a text layer)
+	Setup                 bool          // Run the interactive setup wizard and exit
+	AnnotatePageNumbers   bool          // Draw a "Page N" label onto every page image sent to the vision model
+	FailOnModelSwitch     bool          // Fail instead of switching a non-vision -model to qwen2.5vl:7b in vision mode
+	Separator             string        // Word separator in names: "dash" or "underscore"
+	Case                  string        // Letter case of names: "keep" or "lower"
+	StripStopwords        bool          // Drop filler words such as "the", "and" or "der" from names
+	SanitizeProfile       string        // Preset bundle of naming rules: strict, relaxed or dms (empty = none)
+	GSDeviceFallback      string        // Comma-separated Ghostscript PNG devices to retry a page with when png16m fails
+	Stats                 bool          // Print request, data volume and timing statistics at the end and record them per file in the manifest
+	Yes                   bool          // Skip the startup confirmation for destructive -auto runs and lift -max-files
+	PageTextExtract       bool          // Read the embedded text layer before falling back to ocrmypdf
+	MinTextChars          int           // Text layer characters needed to skip OCR with -page-text-extract
+	UseDirContext         bool          // Pass the name of the directory a PDF is in to the model as a hint
+	MaxRuntimePerFile     time.Duration // Time budget for naming one file, across all tools and retries
+	PromptHashInCacheKey  bool          // Let -resume reuse a recorded name only if content, prompt, model and naming options are unchanged
+	JSONErrors            bool          // Report each failed file as a JSON object on stderr
+	AutoMode              bool          // Choose vision or the text path per file from the first page's text layer
+	NormalizeInvoiceDates bool          // Rewrite dates in the model answer as YYYY-MM-DD before sanitizing
+	DateOrder             string        // Order of ambiguous numeric dates like 05/01/23: mdy or dmy
+	MaxFiles              int           // Refuse batches with more matched files than this unless -yes is given (0 = no limit)
+	UseCropBox            bool          // Render pages within their CropBox instead of the MediaBox
+	TextSampling          string        // Which part of the text -max-text-chars keeps: head, head-tail or tail
+	EmitThumbnail         bool          // Write a <newname>.thumb.jpg of page 1 next to the renamed PDF
+	ThumbnailWidth        int           // Width of -emit-thumbnail images in pixels
+	ThumbnailFormat       string        // Image format of -emit-thumbnail: jpg or png
+	GSPageRenderCache     bool          // Keep the pages rendered for a file in memory and reuse them within that file
+	CollisionSuffix       string        // How colliding names are made unique: number (name-1.pdf) or hash (name-<content hash>.pdf)
+	DumpRequest           bool          // Print every generate request as JSON, with the images replaced by their sizes
+	OnCollisionExplicit   bool          // -on-collision was given on the command line or in the settings file
+	Exitor                Exitor        // Interface for program exit behavior
 }
 
 // Global config variable
 var config Config
 
+// batchState tracks the outcome of the current run for the final summary
+type batchState struct {
+	processed int
+	failed    int
+	resumed   int
+	duplicate int // Skipped by -dedupe-against-output
+	aborted   bool
+	quit      bool                 // q or end of input at a confirmation prompt
+	names     map[string][]nameUse // Generated name -> sources that received it
+	nameOrder []string             // Generated names in first-use order
+	pending   []pendingRename      // Suggestions queued for -interactive-batch-edit
+	planned   []plannedRename      // Renames a -dry-run would have made
+	errors    []fileError          // Per-file errors for the final summary
+	sources   map[string]bool      // Absolute paths of the batch inputs, for -no-clobber-source
+
+	report     []reportRow       // Outcomes listed in the -report-html page
+	thumbnails map[string][]byte // First page PNG thumbnail per processed file, for the report
+}
+
+// fileError is a failed file and the reason, listed in the final "Errors" summary
+type fileError struct {
+	source string
+	reason string
+}
+
+// pendingRename is a suggestion waiting for review in -interactive-batch-edit mode
+type pendingRename struct {
+	source string
+	name   GeneratedName
+	mode   string
+}
+
+// plannedRename is a rename shown by -dry-run instead of being made
+type plannedRename struct {
+	source string
+	target string
+}
+
+// nameUse records one source that was given a generated name and what happened on write
+type nameUse struct {
+	source     string
+	output     string
+	resolution string
+}
+
+// recordName remembers that source was given the generated name
+func (b *batchState) recordName(name, source, output, resolution string) {
+	if b.names == nil {
+		b.names = make(map[string][]nameUse)
+	}
+	if _, ok := b.names[name]; !ok {
+		b.nameOrder = append(b.nameOrder, name)
+	}
+	b.names[name] = append(b.names[name], nameUse{source: source, output: output, resolution: resolution})
+}
+
+// nameCollisions returns the generated names that were given to more than one source
+func (b *batchState) nameCollisions() []string {
+	var collisions []string
+	for _, name := range b.nameOrder {
+		if len(b.names[name]) > 1 {
+			collisions = append(collisions, name)
+		}
+	}
+	return collisions
+}
+
+// printNameCollisions reports names shared by several sources (-dedupe-by-name)
+func printNameCollisions() {
+	collisions := batch.nameCollisions()
+	if len(collisions) == 0 {
+		fmt.Println("Name collisions: none")
+		return
+	}
+	fmt.Printf("Name collisions (%d):\n", len(collisions))
+	for _, name := range collisions {
+		fmt.Printf("  %s.pdf\n", name)
+		for _, use := range batch.names[name] {
+			switch {
+			case use.resolution == resolutionSkipped:
+				fmt.Printf("    %s (skipped, original kept)\n", use.source)
+			case use.resolution != resolutionNone:
+				fmt.Printf("    %s -> %s (%s)\n", use.source, use.output, use.resolution)
+			default:
+				fmt.Printf("    %s -> %s\n", use.source, use.output)
+			}
+		}
+	}
+}
+
+// Global batch state, reset at the start of every run
+var batch batchState
+
+// recordFailure reports and counts a failed file and returns whether the run should
+// stop (-fail-fast). The error is printed inline unless -quiet-errors is set and is
+// always listed again in the final summary.
+func (b *batchState) recordFailure(source string, err error) bool {
+	if !config.QuietErrors {
+		fmt.Printf("Error processing %s: %v\n", source, err)
+	}
+	logEvent(slog.LevelError, source, "error", err.Error())
+	if errorOutput != nil {
+		data, _ := json.Marshal(FileFailure{File: source, Phase: filePhase, Code: errorCode(err), Message: err.Error()})
+		fmt.Fprintf(errorOutput, "%s\n", data)
+	}
+	b.errors = append(b.errors, fileError{source: source, reason: err.Error()})
+	b.failed++
+	if config.FailFast {
+		b.aborted = true
+	}
+	return b.aborted
+}
+
+// Errors with a fixed -json-errors code; their messages are part of the wrapping error
+var (
+	errTimeBudget    = errors.New("processing exceeded time budget")
+	errToolTimeout   = errors.New("timed out")
+	errInvalidSource = errors.New("source PDF failed verification")
+	errOllamaAPI     = errors.New("error from Ollama API")
+)
+
+// errorCode classifies a file's failure for -json-errors
+func errorCode(err error) string {
+	var urlErr *url.Error
+	var unusable *unusableAnswerError
+	switch {
+	case errors.Is(err, errTimeBudget):
+		return "time_budget"
+	case errors.Is(err, errToolTimeout):
+		return "tool_timeout"
+	case errors.Is(err, errInvalidSource):
+		return "invalid_pdf"
+	case errors.Is(err, errAllPagesEmpty):
+		return "blank_pages"
+	case errors.As(err, &urlErr):
+		return "ollama_unreachable"
+	case errors.Is(err, errOllamaAPI):
+		return "ollama_error"
+	case errors.As(err, &unusable):
+		return "unusable_answer"
+	}
+	return "failed"
+}
+
+// FileFailure is the line written to stderr for a failed file with -json-errors
+type FileFailure struct {
+	File    string `json:"file"`
+	Phase   string `json:"phase"` // start, extracting, generating or writing
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// filePhase is the pipeline step the current file is in, for -json-errors
+var filePhase string
+
+// errorOutput receives the -json-errors lines (nil otherwise)
+var errorOutput io.Writer
+
+// printBatchSummary prints how the run ended
+func printBatchSummary() {
+	if len(batch.errors) > 0 {
+		fmt.Printf("\nErrors (%d):\n", len(batch.errors))
+		for _, e := range batch.errors {
+			// Multi-line reasons (e.g. install hints) are indented under their file
+			fmt.Printf("  %s: %s\n", e.source, strings.ReplaceAll(e.reason, "\n", "\n    "))
+		}
+		fmt.Println()
+	}
+	if batch.resumed > 0 {
+		fmt.Printf("Resumed: skipped %d file(s) completed in a previous run.\n", batch.resumed)
+	}
+	if batch.duplicate > 0 {
+		fmt.Printf("Duplicates: skipped %d file(s) already in the output directory.\n", batch.duplicate)
+	}
+	switch {
+	case batch.aborted:
+		fmt.Printf("Processing aborted after %d file(s) (-fail-fast).\n", batch.processed)
+	case batch.quit:
+		fmt.Printf("Processing stopped at the confirmation prompt after %d file(s).\n", batch.processed)
+	case batch.failed > 0:
+		fmt.Printf("Processing completed with %d failure(s) out of %d file(s).\n", batch.failed, batch.processed)
+	default:
+		fmt.Println("Processing complete!")
+	}
+}
+
 // OllamaResponse represents the response from Ollama API
 type OllamaResponse struct {
 	Response string `json:"response"`
 	Error    string `json:"error,omitempty"`
 }
 
-// checkDependencies verifies that all required tools are installed
+// checkDependencies verifies that all required tools are installed, Ollama is running
+// and the configured models are available
 func checkDependencies() error {
+	if err := checkTools(); err != nil {
+		return err
+	}
+
+	// Check if the specified model is available
+	names, err := installedModels()
+	if err != nil {
+		return err
+	}
+	installed := make(map[string]bool)
+	for _, model := range names {
+		installed[model] = true
+	}
+	for _, model := range modelsInUse() {
+		if !installed[model] {
+			return fmt.Errorf("error: %s model is not installed in Ollama.\nPlease install it by running: ollama pull %s", model, model)
+		}
+	}
+
+	// A text-only model silently ignores the page images, so refuse it in vision mode
+	if config.FastMode {
+		models := []string{visionModel()}
+		if config.EscalateModel != "" && config.EscalateModel != visionModel() {
+			models = append(models, config.EscalateModel)
+		}
+		for _, model := range jobModels(jobEntries) {
+			if !slices.Contains(models, model) {
+				models = append(models, model)
+			}
+		}
+		for _, model := range models {
+			capabilities, err := modelCapabilities(model)
+			if err != nil {
+				return err
+			}
+			if len(capabilities) == 0 {
+				fmt.Printf("Note: Ollama did not report capabilities for %s; cannot verify that it supports images\n", model)
+			} else if !hasCapability(capabilities, "vision") {
+				return fmt.Errorf("error: %s is not a vision model (capabilities: %s), it would ignore the page images.\nUse -novision for OCR mode or choose a vision model such as qwen2.5vl:7b", model, strings.Join(capabilities, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkTools verifies that the external tools are installed, the requested OCR languages
+// are available and the Ollama service is running
+func checkTools() error {
 	deps := []string{"curl", "jq", "ollama", "gs", "ocrmypdf"} // Always include ocrmypdf
 	for _, dep := range deps {
 		if runtime.GOOS == "windows" {
@@ -70,23 +489,39 @@ func checkDependencies() error {
 		}
 	}
 
+	if config.PageTextExtract || config.AutoMode {
+		if _, err := exec.LookPath("pdftotext"); err != nil {
+			fmt.Println("Note: pdftotext not found, the text layer is read with Ghostscript's txtwrite device")
+		}
+	}
+
+	// A missing language pack would otherwise only fail deep in the batch
+	if config.Lang != "" {
+		if err := checkOCRLanguages(config.Lang); err != nil {
+			return err
+		}
+	}
+
 	// Check if Ollama service is running
 	resp, err := http.Get("http://localhost:11434/api/version")
 	if err != nil {
 		return fmt.Errorf("error: Ollama service is not running. Please start it with 'ollama serve'")
 	}
-	defer resp.Body.Close()
+	resp.Body.Close()
+	return nil
+}
 
-	// Check if the specified model is available
-	resp, err = http.Get("http://localhost:11434/api/tags")
+// installedModels lists the names of the models installed in Ollama
+func installedModels() ([]string, error) {
+	resp, err := http.Get("http://localhost:11434/api/tags")
 	if err != nil {
-		return fmt.Errorf("error checking Ollama models: %v", err)
+		return nil, fmt.Errorf("error checking Ollama models: %v", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("error reading Ollama models response: %v", err)
+		return nil, fmt.Errorf("error reading Ollama models response: %v", err)
 	}
 
 	var models struct {
@@ -95,461 +530,6660 @@ func checkDependencies() error {
 		} `json:"models"`
 	}
 	if err := json.Unmarshal(body, &models); err != nil {
-		return fmt.Errorf("error parsing Ollama models response: %v", err)
+		return nil, fmt.Errorf("error parsing Ollama models response: %v", err)
 	}
-
-	modelFound := false
+	var names []string
 	for _, model := range models.Models {
-		if model.Name == config.Model {
-			modelFound = true
-			break
-		}
+		names = append(names, model.Name)
 	}
+	return names, nil
+}
 
-	if !modelFound {
-		return fmt.Errorf("error: %s model is not installed in Ollama.\nPlease install it by running: ollama pull %s", config.Model, config.Model)
+// modelSwitchError decides for -fail-on-model-switch whether the requested model may be
+// used in vision mode, given its capabilities as reported by modelCapabilities (err is
+// that call's error). Only a model that reports vision support passes.
+func modelSwitchError(model string, capabilities []string, err error) error {
+	switch {
+	case err != nil:
+		return fmt.Errorf("cannot verify that model %s supports images (%v); pass -novision or a vision model", model, err)
+	case len(capabilities) == 0:
+		return fmt.Errorf("Ollama did not report capabilities for model %s, so it can't be verified as a vision model; pass -novision or a vision model", model)
+	case !hasCapability(capabilities, "vision"):
+		return fmt.Errorf("model %s isn't a vision model (capabilities: %s); pass -novision or a vision model", model, strings.Join(capabilities, ", "))
 	}
-
 	return nil
 }
 
-// extractText extracts text from a PDF using ocrmypdf
-func extractText(pdfFile string) (string, error) {
-	textFile := strings.TrimSuffix(pdfFile, ".pdf") + ".txt"
-
-	// Run OCR with sidecar text file
-	cmd := exec.Command("ocrmypdf", pdfFile, pdfFile,
-		"--force-ocr",
-		"--sidecar", textFile,
-		"--optimize", "0",
-		"--output-type", "pdf",
-		"--fast-web-view", "0")
-
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("error: OCR failed for %s: %v", pdfFile, err)
+// visionModel returns the model for page images (-vision-model, else -model)
+func visionModel() string {
+	if config.VisionModel != "" {
+		return config.VisionModel
 	}
+	return config.Model
+}
 
-	// Read the text file
-	content, err := os.ReadFile(textFile)
-	if err != nil {
-		return "", fmt.Errorf("error: Text file not created: %v", err)
+// textModel returns the model for OCR text (-text-model, else -model)
+func textModel() string {
+	if config.TextModel != "" {
+		return config.TextModel
 	}
-
-	// Clean up the text file
-	os.Remove(textFile)
-
-	return string(content), nil
+	return config.Model
 }
 
-// validatePNG checks if the provided byte slice is a valid PNG image
-func validatePNG(data []byte) error {
-	_, err := png.DecodeConfig(bytes.NewReader(data))
-	return err
+// modelsInUse lists the models the configured mode can call: the text model always
+// (-novision or the OCR fallback of vision mode), the vision model in vision mode and
+// the -escalate-model and the -input-json model overrides when set
+func modelsInUse() []string {
+	models := []string{textModel()}
+	if config.FastMode && visionModel() != textModel() {
+		models = append([]string{visionModel()}, models...)
+	}
+	if config.EscalateModel != "" && !slices.Contains(models, config.EscalateModel) {
+		models = append(models, config.EscalateModel)
+	}
+	for _, model := range jobModels(jobEntries) {
+		if !slices.Contains(models, model) {
+			models = append(models, model)
+		}
+	}
+	return models
 }
 
-// extractPageAsPNG extracts a single page from a PDF as a PNG image using Ghostscript, in-memory
-func extractPageAsPNG(pdfPath string, page int) ([]byte, error) {
-	cmd := exec.Command(
-		"gs",
-		"-q",              // Quiet mode (no output)
-		"-dNOPAUSE",       // No pause after page
-		"-sDEVICE=png16m", // PNG format (24-bit color)
-		"-r300",           // 300 DPI resolution
-		"-dFirstPage="+fmt.Sprintf("%d", page),
-		"-dLastPage="+fmt.Sprintf("%d", page),
-		"-sOutputFile=-", // Output to stdout
-		pdfPath,
-	)
-
-	// Create a pipe for stdout
-	stdout, err := cmd.StdoutPipe()
+// modelCapabilities queries Ollama's /api/show for the capabilities of a model
+// (e.g. "completion", "vision"). Older Ollama versions report none.
+func modelCapabilities(model string) ([]string, error) {
+	jsonData, err := json.Marshal(map[string]string{"model": model})
 	if err != nil {
-		return nil, fmt.Errorf("error creating stdout pipe: %v", err)
+		return nil, fmt.Errorf("error creating JSON payload: %v", err)
 	}
 
-	// Capture stderr for debugging
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("error starting Ghostscript: %v", err)
+	resp, err := http.Post("http://localhost:11434/api/show", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error querying model details: %v", err)
 	}
+	defer resp.Body.Close()
 
-	// Pre-allocate a large buffer for PNG data (e.g., 10MB)
-	var out bytes.Buffer
-	out.Grow(10 * 1024 * 1024)
-
-	// Copy stdout to buffer
-	if _, err := io.Copy(&out, stdout); err != nil {
-		return nil, fmt.Errorf("error reading stdout: %v", err)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model details: %v", err)
 	}
 
-	// Wait for the command to complete
-	if err := cmd.Wait(); err != nil {
-		return nil, fmt.Errorf("Ghostscript error: %v, stderr: %s", err, stderr.String())
+	var details struct {
+		Capabilities []string `json:"capabilities"`
+		Error        string   `json:"error,omitempty"`
 	}
-
-	// Get the PNG data
-	pngData := out.Bytes()
-	if len(pngData) == 0 {
-		return nil, fmt.Errorf("no PNG data produced, stderr: %s", stderr.String())
+	if err := json.Unmarshal(body, &details); err != nil {
+		return nil, fmt.Errorf("error parsing model details: %v", err)
 	}
-
-	// Validate the PNG data
-	if err := validatePNG(pngData); err != nil {
-		return nil, fmt.Errorf("invalid PNG data: %v, stderr: %s", err, stderr.String())
+	if details.Error != "" {
+		return nil, fmt.Errorf("%w: %s", errOllamaAPI, details.Error)
 	}
 
-	return pngData, nil
+	return details.Capabilities, nil
 }
 
-// extractPDFPages extracts up to 3 pages from a PDF as PNG images
-func extractPDFPages(pdfFile string) ([][]byte, error) {
-	var images [][]byte
-	maxPages := 3
-
-	for page := 1; page <= maxPages; page++ {
-		imgData, err := extractPageAsPNG(pdfFile, page)
-		if err != nil {
-			// If we can't extract a page, assume we've reached the end
-			break
+// hasCapability reports whether capability is in the list reported by Ollama
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
 		}
-		images = append(images, imgData)
 	}
+	return false
+}
 
-	if len(images) == 0 {
-		return nil, fmt.Errorf("error: could not extract any pages from PDF")
+// settingsPath is the file -setup saves its choices to, e.g.
+// ~/.config/ai-pdf-renamer/config on Linux
+func settingsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(dir, "ai-pdf-renamer", "config"), nil
+}
 
-	return images, nil
+// setting is one "flag = value" line of the settings file
+type setting struct {
+	name, value string
 }
 
-// generateFilename generates a filename using Ollama API
-func generateFilename(text string, prompt string) (string, error) {
-	// Create the JSON payload
-	payload := map[string]interface{}{
-		"model":  config.Model,
-		"prompt": prompt,
-		"stream": false,
+// readSettings parses the settings file: one "flag = value" per line, where flag is an
+// option name without the dash. Blank lines and lines starting with "#" are ignored. A
+// missing file has no settings.
+func readSettings(path string) ([]setting, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
 	}
-
-	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("error creating JSON payload: %v", err)
+		return nil, fmt.Errorf("error reading settings file: %v", err)
 	}
-
-	// Call Ollama API
-	resp, err := http.Post("http://localhost:11434/api/generate", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("error calling Ollama API: %v", err)
+	var settings []setting
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("error in settings file %s line %d: want \"option = value\"", path, i+1)
+		}
+		settings = append(settings, setting{strings.TrimPrefix(strings.TrimSpace(name), "-"), strings.TrimSpace(value)})
 	}
-	defer resp.Body.Close()
+	return settings, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+// applySettings uses the settings as defaults: every option that wasn't given on the
+// command line is set to its value. source names where the settings come from in errors,
+// e.g. "settings file".
+func applySettings(flags *flag.FlagSet, settings []setting, source string) error {
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, s := range settings {
+		if flags.Lookup(s.name) == nil {
+			return fmt.Errorf("error: unknown option %q in %s", s.name, source)
+		}
+		if explicit[s.name] {
+			continue
+		}
+		if err := flags.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("error: invalid value %q for %s in %s: %v", s.value, s.name, source, err)
+		}
 	}
+	return nil
+}
 
-	var ollamaResp OllamaResponse
-	if err := json.Unmarshal(body, &ollamaResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+// saveSettings writes updates to the settings file. Lines for the same options are
+// replaced, everything else (other options, comments) is kept.
+func saveSettings(path string, updates []setting) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading settings file: %v", err)
 	}
-
-	if ollamaResp.Error != "" {
-		return "", fmt.Errorf("error from Ollama API: %s\nPlease ensure that the %s model is installed by running:\n  ollama pull %s", ollamaResp.Error, config.Model, config.Model)
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	} else {
+		lines = []string{"# Defaults for ai-pdf-renamer, written by -setup. Options on the command line win."}
 	}
-
-	if ollamaResp.Response == "" {
-		return "", fmt.Errorf("error: Empty response from Ollama API\nPlease ensure that the %s model is installed and working correctly:\n  1. Check if the model is installed: ollama list\n  2. If not installed, run: ollama pull %s\n  3. If installed but not working, try: ollama rm %s && ollama pull %s", config.Model, config.Model, config.Model, config.Model)
+	for _, update := range updates {
+		line := update.name + " = " + update.value
+		replaced := false
+		for i, existing := range lines {
+			name, _, ok := strings.Cut(existing, "=")
+			if ok && !strings.HasPrefix(strings.TrimSpace(existing), "#") && strings.TrimPrefix(strings.TrimSpace(name), "-") == update.name {
+				lines[i] = line
+				replaced = true
+			}
+		}
+		if !replaced {
+			lines = append(lines, line)
+		}
 	}
-
-	// Clean up the response
-	cleanName := regexp.MustCompile(`[^a-zA-Z0-9-]`).ReplaceAllString(ollamaResp.Response, "-")
-	cleanName = regexp.MustCompile(`-+`).ReplaceAllString(cleanName, "-")
-	cleanName = strings.Trim(cleanName, "-")
-
-	// Ensure the name is not too long
-	if len(cleanName) > 64 {
-		cleanName = cleanName[:64]
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating settings directory: %v", err)
 	}
-
-	return cleanName, nil
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing settings file: %v", err)
+	}
+	return nil
 }
 
-// generateFilenameFast generates a filename using Ollama API with multiple image inputs
-func generateFilenameFast(images [][]byte, prompt string) (string, error) {
-	fmt.Printf("Using model: %s for image-based processing\n", config.Model)
-	fmt.Printf("Extracted %d page(s) from PDF, sending all for analysis\n", len(images))
+// sanitizeProfiles are the -sanitize-profile presets, as the options they set
+var sanitizeProfiles = map[string][]setting{
+	"strict": {
+		{"charset", "ascii"}, {"allow-spaces", "false"}, {"separator", "dash"}, {"case", "lower"}, {"max-words", "4"},
+	},
+	"relaxed": {
+		{"charset", "unicode"}, {"allow-spaces", "true"}, {"separator", "dash"}, {"case", "keep"},
+	},
+	"dms": {
+		{"charset", "ascii"}, {"allow-spaces", "false"}, {"separator", "underscore"}, {"case", "lower"},
+		{"strip-stopwords", "true"}, {"scheme", "{date}_{name}"},
+	},
+}
 
-	if len(images) == 0 {
-		return "", fmt.Errorf("no images extracted from PDF")
+// applySanitizeProfile sets the options of the named -sanitize-profile, except those
+// already given individually
+func applySanitizeProfile(flags *flag.FlagSet, name string) error {
+	profile, ok := sanitizeProfiles[name]
+	if !ok {
+		return fmt.Errorf("error: -sanitize-profile must be one of %s (got %q)", strings.Join(sortedKeys(sanitizeProfiles), ", "), name)
 	}
+	return applySettings(flags, profile, "-sanitize-profile "+name)
+}
 
-	var base64Images []string
-	for i, imgData := range images {
-		fmt.Printf("Page %d: Image size: %d bytes\n", i+1, len(imgData))
-		if len(imgData) > 8 && string(imgData[:8]) == "\x89PNG\r\n\x1a\n" {
-			fmt.Printf("Page %d: Valid PNG signature detected\n", i+1)
-		} else {
-			fmt.Printf("Page %d: Warning - Image data does not appear to be a valid PNG\n", i+1)
-		}
-		base64Images = append(base64Images, base64.StdEncoding.EncodeToString(imgData))
+// askLine prints question and reads one answer line from promptInput. ok is false at
+// end of input.
+func askLine(question string) (answer string, ok bool) {
+	fmt.Print(question)
+	if !promptInput.Scan() {
+		fmt.Println()
+		return "", false
 	}
+	return strings.TrimSpace(promptInput.Text()), true
+}
 
-	// Create the JSON payload with all images
-	payload := map[string]interface{}{
-		"model":  config.Model,
-		"prompt": prompt,
-		"stream": false,
-		"images": base64Images,
+// chooseModel maps an answer to the model list: a number from the list, a listed name,
+// or empty for fallback. ok is false for anything else.
+func chooseModel(models []string, answer, fallback string) (string, bool) {
+	if answer == "" {
+		return fallback, true
 	}
-
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return "", fmt.Errorf("error creating JSON payload: %v", err)
+	if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(models) {
+		return models[n-1], true
 	}
+	if slices.Contains(models, answer) {
+		return answer, true
+	}
+	return "", false
+}
 
-	// Call Ollama API
-	resp, err := http.Post("http://localhost:11434/api/generate", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("error calling Ollama API: %v", err)
+// runSetupWizard guides a new user through the first configuration (-setup): it checks
+// the tools like a normal run, lets the user pick one of the installed models (offering
+// to pull the recommended vision model if none is installed) and saves the choice to
+// the settings file at path.
+func runSetupWizard(path string) error {
+	recommended := getDefaultConfig().Model
+
+	fmt.Println("Step 1/3: Checking the required tools")
+	if err := checkTools(); err != nil {
+		// Missing OCR tools don't stop the model choice, but Ollama has to be running
+		fmt.Printf("  Problem: %v\n", err)
+	} else {
+		fmt.Println("  All tools found and Ollama is running.")
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	fmt.Println("\nStep 2/3: Choosing a model")
+	models, err := installedModels()
 	if err != nil {
-		return "", fmt.Errorf("error reading response: %v", err)
+		return err
 	}
-
-	var ollamaResp OllamaResponse
-	if err := json.Unmarshal(body, &ollamaResp); err != nil {
-		return "", fmt.Errorf("error parsing response: %v", err)
+	var vision []string
+	for _, model := range models {
+		if capabilities, err := modelCapabilities(model); err == nil && hasCapability(capabilities, "vision") {
+			vision = append(vision, model)
+		}
 	}
-
-	if ollamaResp.Error != "" {
-		return "", fmt.Errorf("error from Ollama API: %s", ollamaResp.Error)
+	if len(vision) == 0 {
+		fmt.Printf("  No installed model reports vision support, which the default vision mode needs. %s is recommended.\n", recommended)
+		if answer, _ := askLine(fmt.Sprintf("  Pull %s now (several GB)? [Y/n] ", recommended)); parseConfirmation(answer) == confirmYes {
+			cmd := exec.Command("ollama", "pull", recommended)
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("error: ollama pull %s failed: %v", recommended, err)
+			}
+			vision = append(vision, recommended)
+			if !slices.Contains(models, recommended) {
+				models = append(models, recommended)
+			}
+		}
+	}
+	if len(models) == 0 {
+		return fmt.Errorf("error: no models are installed in Ollama. Install one with: ollama pull %s", recommended)
+	}
+	fallback := models[0]
+	if len(vision) > 0 {
+		fallback = vision[0]
+	}
+	for i, model := range models {
+		label := ""
+		if slices.Contains(vision, model) {
+			label = " (vision)"
+		}
+		fmt.Printf("  %d) %s%s\n", i+1, model, label)
+	}
+	var model string
+	for {
+		answer, ok := askLine(fmt.Sprintf("  Model to use [1-%d, Enter = %s]: ", len(models), fallback))
+		if chosen, valid := chooseModel(models, answer, fallback); valid || !ok {
+			model = chosen
+			if !ok {
+				model = fallback
+			}
+			break
+		}
+		fmt.Printf("  %q is not in the list.\n", answer)
 	}
 
-	// Clean up the response
-	cleanName := regexp.MustCompile(`[^a-zA-Z0-9-]`).ReplaceAllString(ollamaResp.Response, "-")
-	cleanName = regexp.MustCompile(`-+`).ReplaceAllString(cleanName, "-")
-	cleanName = strings.Trim(cleanName, "-")
-
-	// Ensure the name is not too long
-	if len(cleanName) > 64 {
-		cleanName = cleanName[:64]
+	// -vision-model keeps vision mode from switching -model to the default vision model
+	updates := []setting{{"model", model}, {"vision-model", model}, {"novision", "false"}}
+	if !slices.Contains(vision, model) {
+		fmt.Printf("  %s does not report vision support, so OCR mode (-novision) will be used.\n", model)
+		updates[1].value = ""
+		updates[2].value = "true"
 	}
 
-	return cleanName, nil
+	fmt.Println("\nStep 3/3: Saving")
+	if err := saveSettings(path, updates); err != nil {
+		return err
+	}
+	fmt.Printf("  Saved to %s:\n", path)
+	for _, update := range updates {
+		fmt.Printf("    %s = %s\n", update.name, update.value)
+	}
+	fmt.Println("  These are now the defaults; options on the command line still win.")
+	fmt.Println("\nSetup complete. Try a first dry run: ai-pdf-renamer -dry-run '*.pdf'")
+	return nil
 }
 
-// getDefaultConfig returns the default configuration
-func getDefaultConfig() Config {
+// parseTesseractLangs parses the output of "tesseract --list-langs"
+func parseTesseractLangs(output string) map[string]bool {
+	langs := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "List of available languages") {
+			continue
+		}
+		langs[line] = true
+	}
+	return langs
+}
+
+// missingLanguages returns the components of a "eng+deu" language spec that are not available
+func missingLanguages(spec string, available map[string]bool) []string {
+	var missing []string
+	for _, lang := range strings.Split(spec, "+") {
+		if lang = strings.TrimSpace(lang); lang != "" && !available[lang] {
+			missing = append(missing, lang)
+		}
+	}
+	return missing
+}
+
+// checkOCRLanguages verifies that tesseract has data for every language in -lang
+func checkOCRLanguages(spec string) error {
+	output, err := exec.Command("tesseract", "--list-langs").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error: could not list tesseract languages (is tesseract installed?): %v", err)
+	}
+	available := parseTesseractLangs(string(output))
+	if missing := missingLanguages(spec, available); len(missing) > 0 {
+		return fmt.Errorf("error: tesseract language data missing for %s (installed: %s).\nInstall it, e.g. 'sudo apt install tesseract-ocr-%s' or 'brew install tesseract-lang'", strings.Join(missing, ", "), strings.Join(sortedKeys(available), ", "), missing[0])
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fileCtx bounds the work on the current file with -max-runtime-per-file. Tool
+// commands and Ollama requests are derived from it, so all of them stop once the
+// budget is used up.
+var fileCtx = context.Background()
+
+// budgetError returns the error a file is abandoned with once fileCtx has expired,
+// nil while there is time left
+func budgetError() error {
+	if errors.Is(fileCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("error: %w of %v", errTimeBudget, config.MaxRuntimePerFile)
+	}
+	return nil
+}
+
+// toolCommand is an external tool invocation bounded by a timeout. On timeout the whole
+// process group is killed so no orphaned children (e.g. tesseract under ocrmypdf) remain.
+type toolCommand struct {
+	*exec.Cmd
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+// newToolCommand prepares name with args; a zero timeout means no limit. Callers must
+// call cancel when done.
+func newToolCommand(timeout time.Duration, name string, args ...string) *toolCommand {
+	ctx, cancel := context.WithCancel(fileCtx)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	// Don't hang on pipes a stray grandchild might still hold open
+	cmd.WaitDelay = 5 * time.Second
+	return &toolCommand{Cmd: cmd, ctx: ctx, cancel: cancel, timeout: timeout}
+}
+
+// timeoutError returns a "<tool> timed out on <file>" error if the command was killed
+// because of its timeout, nil otherwise
+func (c *toolCommand) timeoutError(tool, file string) error {
+	if err := budgetError(); err != nil {
+		return err
+	}
+	if errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("error: %s %w on %s after %v", tool, errToolTimeout, file, c.timeout)
+	}
+	return nil
+}
+
+// ocrArgs builds the ocrmypdf arguments that OCR pdfFile and write its text to textFile.
+// With -ocr-output-type none ocrmypdf produces no PDF at all ("-" as the output); pdf and
+// pdfa rewrite pdfFile in place with the text layer.
+func ocrArgs(pdfFile, textFile string) []string {
+	var args []string
+	if config.OCROutputType == "none" {
+		args = []string{pdfFile, "-",
+			"--force-ocr",
+			"--sidecar", textFile,
+			"--output-type", "none"}
+	} else {
+		args = []string{pdfFile, pdfFile,
+			"--force-ocr",
+			"--sidecar", textFile,
+			"--optimize", "0",
+			"--output-type", config.OCROutputType,
+			"--fast-web-view", "0"}
+	}
+	if config.Lang != "" {
+		args = append(args, "-l", config.Lang)
+	}
+	if config.OCRJobs > 0 {
+		args = append(args, "--jobs", strconv.Itoa(config.OCRJobs))
+	}
+	return args
+}
+
+// extractText extracts text from a PDF using ocrmypdf. With -page-text-extract, the
+// embedded text layer of born-digital PDFs is used instead if it has enough text.
+func extractText(pdfFile string) (string, error) {
+	if config.PageTextExtract || config.AutoMode {
+		text, tool, err := extractTextLayer(pdfFile, 0)
+		switch chars := utf8.RuneCountInString(strings.TrimSpace(text)); {
+		case err != nil:
+			fmt.Printf("Could not read the text layer (%v), running OCR\n", err)
+		case chars < config.MinTextChars:
+			fmt.Printf("Text layer has %d characters (below -min-text-chars %d), running OCR\n", chars, config.MinTextChars)
+		default:
+			fmt.Printf("Using the text layer (%s, %d characters), skipping OCR\n", tool, chars)
+			return text, nil
+		}
+	}
+	return ocrText(pdfFile)
+}
+
+// extractTextLayer reads the text embedded in a PDF, without OCR, with pdftotext if it
+// is installed and Ghostscript's txtwrite device otherwise. Only pages up to lastPage
+// are read, all of them for 0. It returns the tool used.
+func extractTextLayer(pdfFile string, lastPage int) (text, tool string, err error) {
+	var cmd *toolCommand
+	if _, lookErr := exec.LookPath("pdftotext"); lookErr == nil {
+		tool = "pdftotext"
+		args := []string{"-enc", "UTF-8"}
+		if lastPage > 0 {
+			args = append(args, "-l", strconv.Itoa(lastPage))
+		}
+		cmd = newToolCommand(config.GSTimeout, "pdftotext", append(args, pdfFile, "-")...)
+	} else {
+		tool = "gs txtwrite"
+		args := []string{"-q", "-dNOPAUSE", "-dBATCH", "-sDEVICE=txtwrite", "-sOutputFile=-"}
+		if lastPage > 0 {
+			args = append(args, fmt.Sprintf("-dLastPage=%d", lastPage))
+		}
+		cmd = newToolCommand(config.GSTimeout, "gs", append(args, pdfFile)...)
+	}
+	defer cmd.cancel()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if timeoutErr := cmd.timeoutError(tool, pdfFile); timeoutErr != nil {
+			return "", tool, timeoutErr
+		}
+		return "", tool, fmt.Errorf("%s failed: %v, stderr: %s", tool, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), tool, nil
+}
+
+// ocrText extracts text from a PDF by running ocrmypdf
+func ocrText(pdfFile string) (string, error) {
+	textFile := strings.TrimSuffix(pdfFile, ".pdf") + ".txt"
+
+	// Run OCR with sidecar text file
+	cmd := newToolCommand(config.OCRTimeout, "ocrmypdf", ocrArgs(pdfFile, textFile)...)
+	defer cmd.cancel()
+
+	if err := cmd.Run(); err != nil {
+		if timeoutErr := cmd.timeoutError("OCR", pdfFile); timeoutErr != nil {
+			os.Remove(textFile)
+			return "", timeoutErr
+		}
+		return "", fmt.Errorf("error: OCR failed for %s: %v", pdfFile, err)
+	}
+
+	// Read the text file
+	content, err := os.ReadFile(textFile)
+	if err != nil {
+		return "", fmt.Errorf("error: Text file not created: %v", err)
+	}
+	ocrChars := utf8.RuneCount(content)
+	usage.ocrChars += ocrChars
+	fileUsage.ocrChars += ocrChars
+
+	// Clean up the text file
+	os.Remove(textFile)
+
+	return string(content), nil
+}
+
+// pngSignature is the 8-byte header every PNG file starts with
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// hasPNGSignature reports whether data starts with the PNG signature
+func hasPNGSignature(data []byte) bool {
+	return len(data) > len(pngSignature) && string(data[:len(pngSignature)]) == pngSignature
+}
+
+// validatePNG checks if the provided byte slice is a valid PNG image
+func validatePNG(data []byte) error {
+	_, err := png.DecodeConfig(bytes.NewReader(data))
+	return err
+}
+
+// stringList is a flag.Value that collects every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// gsExtraArgs holds the -gs-extra arguments passed through to Ghostscript
+var gsExtraArgs stringList
+
+// validAlphaBits reports whether v is a value Ghostscript accepts for the AlphaBits options
+func validAlphaBits(v int) bool {
+	return v == 1 || v == 2 || v == 4
+}
+
+// gsDevice is the Ghostscript device pages are rendered with (24-bit color PNG)
+const gsDevice = "png16m"
+
+// gsPNGDevices are the Ghostscript PNG devices -gs-device-fallback accepts
+var gsPNGDevices = []string{"png16m", "pngalpha", "png256", "png16", "pnggray", "pngmono"}
+
+// gsFallbackDevices holds the parsed -gs-device-fallback
+var gsFallbackDevices []string
+
+// parseGSDevices parses a comma-separated -gs-device-fallback list
+func parseGSDevices(value string) ([]string, error) {
+	var devices []string
+	for _, device := range strings.Split(value, ",") {
+		device = strings.TrimSpace(device)
+		if device == "" {
+			continue
+		}
+		if !slices.Contains(gsPNGDevices, device) {
+			return nil, fmt.Errorf("-gs-device-fallback: unknown device %q (valid: %s)", device, strings.Join(gsPNGDevices, ", "))
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// gsRenderArgs builds the Ghostscript arguments that render one page of pdfPath as PNG
+// with device to stdout. The -gs-extra arguments come last before the output so they
+// can override the defaults.
+func gsRenderArgs(pdfPath string, page int, dpi int, device string) []string {
+	args := []string{
+		"-q",                          // Quiet mode (no output)
+		"-dNOPAUSE",                   // No pause after page
+		"-sDEVICE=" + device,          // PNG format
+		"-r" + fmt.Sprintf("%d", dpi), // Render resolution
+		"-dFirstPage=" + fmt.Sprintf("%d", page),
+		"-dLastPage=" + fmt.Sprintf("%d", page),
+		"-dTextAlphaBits=" + fmt.Sprintf("%d", config.TextAlphaBits),
+		"-dGraphicsAlphaBits=" + fmt.Sprintf("%d", config.GraphicsAlphaBits),
+	}
+	if config.UseCropBox {
+		args = append(args, "-dUseCropBox")
+	}
+	args = append(args, gsExtraArgs...)
+	return append(args,
+		"-sOutputFile=-", // Output to stdout
+		pdfPath,
+	)
+}
+
+// gsDeviceError is a rendering failure that another Ghostscript device may not have,
+// unlike a timeout
+type gsDeviceError struct {
+	err error
+}
+
+func (e *gsDeviceError) Error() string {
+	return e.err.Error()
+}
+
+// pageRenderKey identifies a page rendering in the -gs-page-render-cache
+type pageRenderKey struct {
+	path   string
+	page   int
+	dpi    int
+	device string
+}
+
+// pageRenders holds the pages rendered for the current file with -gs-page-render-cache.
+// It is cleared before each file, so it never holds more than one document's pages.
+var pageRenders map[pageRenderKey][]byte
+
+// extractPageAsPNG extracts a single page from a PDF as a PNG image using Ghostscript,
+// in-memory. If the page fails to render, the -gs-device-fallback devices are tried in
+// order before giving up with the first error. With -gs-page-render-cache, a page that
+// was already rendered for the current file is returned without calling Ghostscript.
+func extractPageAsPNG(pdfPath string, page int, dpi int) ([]byte, error) {
+	if config.GSPageRenderCache {
+		// A render with a fallback device means the devices before it failed
+		for _, device := range append([]string{gsDevice}, gsFallbackDevices...) {
+			if data, ok := pageRenders[pageRenderKey{pdfPath, page, dpi, device}]; ok {
+				verbosef("Page %d: reusing the %d DPI %s render\n", page, dpi, device)
+				return data, nil
+			}
+		}
+	}
+	pngData, device, err := renderPage(pdfPath, page, dpi)
+	if err == nil && config.GSPageRenderCache {
+		if pageRenders == nil {
+			pageRenders = make(map[pageRenderKey][]byte)
+		}
+		pageRenders[pageRenderKey{pdfPath, page, dpi, device}] = pngData
+	}
+	return pngData, err
+}
+
+// renderPage renders a page with gsDevice and then the -gs-device-fallback devices, and
+// returns the device that succeeded
+func renderPage(pdfPath string, page int, dpi int) ([]byte, string, error) {
+	pngData, err := renderPageWith(pdfPath, page, dpi, gsDevice)
+	var deviceErr *gsDeviceError
+	if err == nil || !errors.As(err, &deviceErr) {
+		return pngData, gsDevice, err
+	}
+	failed := gsDevice
+	for _, device := range gsFallbackDevices {
+		fmt.Printf("Page %d: rendering with %s failed, retrying with %s\n", page, failed, device)
+		verbosef("  %v\n", err)
+		data, fallbackErr := renderPageWith(pdfPath, page, dpi, device)
+		if fallbackErr == nil {
+			fmt.Printf("Page %d: rendered with fallback device %s\n", page, device)
+			return data, device, nil
+		}
+		if !errors.As(fallbackErr, &deviceErr) {
+			return nil, "", fallbackErr
+		}
+		verbosef("  %v\n", fallbackErr)
+		failed = device
+	}
+	return nil, "", err
+}
+
+// renderPageWith renders a single page with the given Ghostscript device
+func renderPageWith(pdfPath string, page int, dpi int, device string) ([]byte, error) {
+	cmd := newToolCommand(config.GSTimeout, "gs", gsRenderArgs(pdfPath, page, dpi, device)...)
+	defer cmd.cancel()
+
+	// Create a pipe for stdout
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error creating stdout pipe: %v", err)
+	}
+
+	// Capture stderr for debugging
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	// Start the command
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting Ghostscript: %v", err)
+	}
+
+	// Pre-allocate a large buffer for PNG data (e.g., 10MB)
+	var out bytes.Buffer
+	out.Grow(10 * 1024 * 1024)
+
+	// Copy stdout to buffer
+	if _, err := io.Copy(&out, stdout); err != nil {
+		cmd.Wait()
+		if timeoutErr := cmd.timeoutError("gs", pdfPath); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return nil, fmt.Errorf("error reading stdout: %v", err)
+	}
+
+	// Wait for the command to complete
+	if err := cmd.Wait(); err != nil {
+		if timeoutErr := cmd.timeoutError("gs", pdfPath); timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return nil, &gsDeviceError{fmt.Errorf("Ghostscript error: %v, stderr: %s", err, stderr.String())}
+	}
+
+	// Get the PNG data
+	pngData := out.Bytes()
+	if len(pngData) == 0 {
+		return nil, &gsDeviceError{fmt.Errorf("no PNG data produced, stderr: %s", stderr.String())}
+	}
+
+	// Validate the PNG data
+	if err := validatePNG(pngData); err != nil {
+		if !config.AllowInvalidImage || !hasPNGSignature(pngData) {
+			return nil, &gsDeviceError{fmt.Errorf("invalid PNG data: %v, stderr: %s", err, stderr.String())}
+		}
+		fmt.Printf("Page %d: Warning - PNG validation failed (%v), sending it anyway (-allow-invalid-image)\n", page, err)
+	}
+
+	return pngData, nil
+}
+
+// pageDPI returns the render resolution for the given (1-based) position in the list of sent pages.
+// In context-pages mode only the first FullResPages pages are rendered at DPI;
+// the remaining pages are sent as cheap low-res context at ContextDPI.
+func pageDPI(position int) int {
+	if config.ContextPages && position > config.FullResPages {
+		return config.ContextDPI
+	}
+	return config.DPI
+}
+
+// pagesMap holds the per-input page specs loaded from -pages-map
+var pagesMap map[string]string
+
+// parsePageSpec parses a page spec like "1-3,5,9" into 1-based page numbers (in the given order)
+func parsePageSpec(spec string) ([]int, error) {
+	var pages []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil || start < 1 {
+			return nil, fmt.Errorf("invalid page %q in page spec %q", first, spec)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(strings.TrimSpace(last))
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid page range %q in page spec %q", part, spec)
+			}
+		}
+		for page := start; page <= end; page++ {
+			pages = append(pages, page)
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("page spec %q selects no pages", spec)
+	}
+	return pages, nil
+}
+
+// loadPagesMap reads a -pages-map file with one "<file> <spec>" entry per line.
+// Empty lines and lines starting with # are ignored.
+func loadPagesMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pages map: %v", err)
+	}
+
+	result := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("error in pages map line %d: expected \"<file> <spec>\", got %q", i+1, line)
+		}
+		if _, err := parsePageSpec(fields[1]); err != nil {
+			return nil, fmt.Errorf("error in pages map line %d: %v", i+1, err)
+		}
+		result[fields[0]] = fields[1]
+	}
+	return result, nil
+}
+
+// pageSpecForFile returns the page spec for pdfFile. A "<file>.pages" sidecar wins over
+// a -pages-map entry (matched by path, then by base name), which wins over the global -pages.
+func pageSpecForFile(pdfFile string) string {
+	if data, err := os.ReadFile(pdfFile + ".pages"); err == nil {
+		if spec := strings.TrimSpace(string(data)); spec != "" {
+			return spec
+		}
+	}
+	if spec, ok := pagesMap[pdfFile]; ok {
+		return spec
+	}
+	if spec, ok := pagesMap[filepath.Base(pdfFile)]; ok {
+		return spec
+	}
+	return config.Pages
+}
+
+// psString escapes s for use inside a PostScript string literal
+func psString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
+
+// getPageCount returns the number of pages of a PDF using Ghostscript
+func getPageCount(pdfPath string) (int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := newToolCommand(config.GSTimeout, "gs",
+		"-q",          // Quiet mode (no output)
+		"-dNODISPLAY", // No rendering needed
+		"-dBATCH",     // Exit when done
+		"--permit-file-read="+pdfPath,
+		"-c", "("+psString(pdfPath)+") (r) file runpdfbegin pdfpagecount = quit",
+	)
+	defer cmd.cancel()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if timeoutErr := cmd.timeoutError("gs", pdfPath); timeoutErr != nil {
+			return 0, timeoutErr
+		}
+		return 0, fmt.Errorf("Ghostscript page count error: %v, stderr: %s", err, stderr.String())
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("could not determine page count from %q", strings.TrimSpace(stdout.String()))
+	}
+	return count, nil
+}
+
+// samplePages picks n of the pageCount pages according to strategy ("spread" or "random").
+// The result is sorted so the model sees the pages in document order.
+func samplePages(strategy string, pageCount, n int, rng *rand.Rand) []int {
+	if n >= pageCount {
+		pages := make([]int, pageCount)
+		for i := range pages {
+			pages[i] = i + 1
+		}
+		return pages
+	}
+
+	var pages []int
+	switch strategy {
+	case "spread":
+		// Evenly spaced, always including the first and the last page
+		seen := make(map[int]bool)
+		for i := 0; i < n; i++ {
+			page := 1
+			if n > 1 {
+				page = 1 + int(math.Round(float64(i)*float64(pageCount-1)/float64(n-1)))
+			}
+			if !seen[page] {
+				seen[page] = true
+				pages = append(pages, page)
+			}
+		}
+	case "random":
+		for _, index := range rng.Perm(pageCount)[:n] {
+			pages = append(pages, index+1)
+		}
+		sort.Ints(pages)
+	}
+	return pages
+}
+
+// firstPagesCount is the number of leading pages the "first" strategy tries. With
+// -gs-first-page-only-fast-path it is capped at the page count, so a single-page PDF is
+// rendered once and no render is wasted on probing for a page that doesn't exist. If the
+// count fails, the rendering loop probes as usual.
+func firstPagesCount(pdfFile string) int {
+	if !config.FirstPageFastPath {
+		return config.SampleCount
+	}
+	pageCount, err := getPageCount(pdfFile)
+	if err != nil {
+		verbosef("Could not count pages, probing instead: %v\n", err)
+		return config.SampleCount
+	}
+	if pageCount == 1 {
+		fmt.Println("Single-page document, rendering page 1 only")
+	}
+	return min(pageCount, config.SampleCount)
+}
+
+// selectPages returns the pages to render for pdfFile and whether they were chosen
+// explicitly. Without a spec the "first" strategy tries the leading pages until the
+// document ends; "spread" and "random" need the page count up front.
+func selectPages(pdfFile string) ([]int, bool, error) {
+	spec := pageSpecForFile(pdfFile)
+	if spec != "" {
+		pages, err := parsePageSpec(spec)
+		if err != nil {
+			return nil, false, err
+		}
+		fmt.Printf("Using page spec %q\n", spec)
+		return pages, true, nil
+	}
+
+	if config.SamplePages == "first" {
+		pages := make([]int, firstPagesCount(pdfFile))
+		for i := range pages {
+			pages[i] = i + 1
+		}
+		return pages, false, nil
+	}
+
+	pageCount, err := getPageCount(pdfFile)
+	if err != nil {
+		return nil, false, err
+	}
+	seed := config.SampleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	pages := samplePages(config.SamplePages, pageCount, config.SampleCount, rand.New(rand.NewSource(seed)))
+	fmt.Printf("Sampled pages %v of %d (%s)\n", pages, pageCount, config.SamplePages)
+	return pages, true, nil
+}
+
+// adaptPageSize re-renders a single page at -step-down-dpi when its PNG exceeds
+// -max-page-bytes (e.g. huge vector art), keeping payloads bounded without lowering
+// the resolution of every page. The original render is kept if re-rendering fails.
+func adaptPageSize(pdfFile string, page, dpi int, imgData []byte) []byte {
+	if config.MaxPageBytes <= 0 || len(imgData) <= config.MaxPageBytes || dpi <= config.StepDownDPI {
+		return imgData
+	}
+
+	smaller, err := extractPageAsPNG(pdfFile, page, config.StepDownDPI)
+	if err != nil {
+		fmt.Printf("Page %d: could not re-render at %d DPI, keeping %d DPI render: %v\n", page, config.StepDownDPI, dpi, err)
+		return imgData
+	}
+	fmt.Printf("Page %d: %d bytes at %d DPI exceeds %d bytes, re-rendered at %d DPI (%d bytes)\n",
+		page, len(imgData), dpi, config.MaxPageBytes, config.StepDownDPI, len(smaller))
+	return smaller
+}
+
+// limitMegapixels downscales a rendered page whose pixel count exceeds maxMegapixels
+// (-max-megapixels) so it fits, keeping the aspect ratio. Huge page sizes can produce
+// images that overwhelm small vision models regardless of the DPI or the encoded size.
+// The page is kept as is if it can't be decoded or re-encoded.
+func limitMegapixels(page int, imgData []byte, maxMegapixels float64) []byte {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(imgData))
+	if err != nil {
+		return imgData
+	}
+	maxPixels := maxMegapixels * 1e6
+	pixels := float64(cfg.Width) * float64(cfg.Height)
+	if pixels <= maxPixels {
+		return imgData
+	}
+
+	width := max(1, int(math.Sqrt(maxPixels*float64(cfg.Width)/float64(cfg.Height))))
+	scaledHeight := func(w int) int {
+		return int(math.Max(1, math.Round(float64(cfg.Height)*float64(w)/float64(cfg.Width))))
+	}
+	for width > 1 && float64(width)*float64(scaledHeight(width)) > maxPixels {
+		width--
+	}
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return imgData
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, downscaleImage(img, width)); err != nil {
+		fmt.Printf("Page %d: could not downscale (%v), keeping %dx%d\n", page, err, cfg.Width, cfg.Height)
+		return imgData
+	}
+	height := scaledHeight(width)
+	fmt.Printf("Page %d: %dx%d (%.1f MP) exceeds -max-megapixels %g, downscaled to %dx%d (%.1f MP)\n",
+		page, cfg.Width, cfg.Height, pixels/1e6, maxMegapixels, width, height, float64(width*height)/1e6)
+	return buf.Bytes()
+}
+
+// extractPDFPages extracts the selected pages (by default up to the first 3) from a PDF as PNG images
+func extractPDFPages(pdfFile string) ([][]byte, error) {
+	var images [][]byte
+
+	pages, explicit, err := selectPages(pdfFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered []int
+	for i, page := range pages {
+		dpi := pageDPI(i + 1)
+		fmt.Printf("Page %d: rendering at %d DPI\n", page, dpi)
+		imgData, err := extractPageAsPNG(pdfFile, page, dpi)
+		if err != nil {
+			if explicit {
+				fmt.Printf("Page %d: skipped (%v)\n", page, err)
+				continue
+			}
+			// If we can't extract a page, assume we've reached the end
+			break
+		}
+		imgData = adaptPageSize(pdfFile, page, dpi, imgData)
+		if page == 1 && config.EmitThumbnail {
+			firstPageImage = imgData // Before cropping and labels
+		}
+		if config.CropTop > 0 && dpi == config.DPI {
+			imgData = cropPageTop(page, imgData, config.CropTop)
+		}
+		if config.MaxMegapixels > 0 {
+			imgData = limitMegapixels(page, imgData, config.MaxMegapixels)
+		}
+		if config.AnnotatePageNumbers {
+			imgData = annotatePageNumber(page, imgData)
+		}
+		images = append(images, imgData)
+		rendered = append(rendered, page)
+	}
+
+	if images, err = applyEmptyPagePolicy(rendered, images); err != nil {
+		return nil, err
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("error: could not extract any pages from PDF")
+	}
+
+	return images, nil
+}
+
+// allowedFilenameRune reports whether r may appear in a filename as is: ASCII letters,
+// digits and dashes, or with -charset unicode all letters, digits and combining marks.
+// With -allow-spaces the space is allowed as well.
+func allowedFilenameRune(r rune) bool {
+	switch {
+	case r == '-':
+		return true
+	case r == ' ':
+		return config.AllowSpaces
+	case config.Charset == "unicode":
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+	default:
+		return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r))
+	}
+}
+
+// sanitizeFilename turns a raw model response into a filename-safe slug. Characters
+// outside the allowed set become dashes; with -allow-spaces, whitespace becomes a space
+// and any run of separators containing a space collapses to a single space.
+func sanitizeFilename(raw string) string {
+	if config.Charset == "unicode" {
+		raw = canonicalizeUnicode(raw, config.CanonicalizeUnicode)
+	}
+	cleanName := strings.Map(func(r rune) rune {
+		if config.AllowSpaces && unicode.IsSpace(r) {
+			return ' '
+		}
+		if allowedFilenameRune(r) {
+			return r
+		}
+		return '-'
+	}, raw)
+	cleanName = applyNumberPolicy(cleanName)
+	if config.AllowSpaces {
+		cleanName = regexp.MustCompile(`-* [ -]*`).ReplaceAllString(cleanName, " ")
+	}
+	cleanName = regexp.MustCompile(`-+`).ReplaceAllString(cleanName, "-")
+	cleanName = strings.Trim(cleanName, "- ")
+	if config.StripStopwords {
+		cleanName = stripStopwords(cleanName)
+	}
+	if config.MaxWords > 0 {
+		cleanName = firstWords(cleanName, config.MaxWords)
+	}
+	if config.Case == "lower" {
+		cleanName = strings.ToLower(cleanName)
+	}
+	cleanName = strings.ReplaceAll(cleanName, "-", wordSeparator())
+
+	// Ensure the name is not too long (counting characters, so no rune is cut in half)
+	if runes := []rune(cleanName); config.CharsBudget > 0 && len(runes) > config.CharsBudget {
+		cleanName = strings.TrimRight(string(runes[:config.CharsBudget]), " _-")
+	}
+
+	if config.SafeNames {
+		cleanName = safeName(cleanName)
+	}
+	return cleanName
+}
+
+// wordSeparator returns the character that joins the words of a name: "-", or "_" with
+// -separator underscore. Everything appended to a name (page counts, language codes,
+// dates, collision suffixes) uses it too.
+func wordSeparator() string {
+	if config.Separator == "underscore" {
+		return "_"
+	}
+	return "-"
+}
+
+// fitBudget shortens slug so that adding extra more characters keeps it within
+// -chars-budget, dropping a separator left dangling at the cut. At least one character
+// of the slug is kept.
+func fitBudget(slug string, extra int) string {
+	runes := []rune(slug)
+	if config.CharsBudget <= 0 || len(runes)+extra <= config.CharsBudget {
+		return slug
+	}
+	if keep := max(config.CharsBudget-extra, 1); keep < len(runes) {
+		return strings.TrimRight(string(runes[:keep]), " _-")
+	}
+	return slug
+}
+
+// stopwords is the set of filler words -strip-stopwords drops, taken from the language
+// detection lists of all languages
+var stopwords = func() map[string]bool {
+	words := make(map[string]bool)
+	for _, list := range languageStopwords {
+		for _, word := range list {
+			words[word] = true
+		}
+	}
+	return words
+}()
+
+// stripStopwords removes the filler words from a sanitized name (-strip-stopwords),
+// ignoring case. A name made only of stopwords is kept as is.
+func stripStopwords(name string) string {
+	var kept strings.Builder
+	start := 0
+	for i, r := range name + "-" {
+		if r != '-' && r != ' ' {
+			continue
+		}
+		word := name[start:i]
+		if !stopwords[strings.ToLower(word)] {
+			if kept.Len() > 0 {
+				kept.WriteByte(name[start-1])
+			}
+			kept.WriteString(word)
+		}
+		start = i + 1
+	}
+	if kept.Len() == 0 {
+		return name
+	}
+	return kept.String()
+}
+
+// firstWords keeps the first n words of a sanitized name (-max-words). Words are
+// separated by single dashes or, with -allow-spaces, spaces.
+func firstWords(name string, n int) string {
+	words := 0
+	for i, r := range name {
+		if r == '-' || r == ' ' {
+			words++
+			if words == n {
+				return name[:i]
+			}
+		}
+	}
+	return name
+}
+
+// applyNumberPolicy handles digits per -numbers: strip removes words that consist only of
+// digits (e.g. account numbers or "2023" in "report-2023-q1"), collapse shortens every
+// digit run longer than -numbers-max-digits to its last digits, keep changes nothing.
+// Words are separated by dashes or, with -allow-spaces, spaces.
+func applyNumberPolicy(name string) string {
+	switch config.Numbers {
+	case "strip":
+		return regexp.MustCompile(`[^- ]+`).ReplaceAllStringFunc(name, func(word string) string {
+			if strings.Trim(word, "0123456789") == "" {
+				return ""
+			}
+			return word
+		})
+	case "collapse":
+		return regexp.MustCompile(`[0-9]+`).ReplaceAllStringFunc(name, func(run string) string {
+			if len(run) > config.NumbersMaxDigits {
+				return run[len(run)-config.NumbersMaxDigits:]
+			}
+			return run
+		})
+	}
+	return name
+}
+
+// safeName enforces -safe-names: only the URL-unreserved characters A-Z, a-z, 0-9, "-",
+// "_" and "." remain, so neither shells nor URLs need quoting, and the name starts with a
+// letter or digit so it can't be mistaken for a command-line flag or a hidden file.
+func safeName(name string) string {
+	name = regexp.MustCompile(`[^A-Za-z0-9._-]+`).ReplaceAllString(name, "-")
+	name = regexp.MustCompile(`-{2,}`).ReplaceAllString(name, "-")
+	name = regexp.MustCompile(`\.{2,}`).ReplaceAllString(name, ".")
+	name = strings.TrimLeft(name, "-_.")
+	return strings.TrimRight(name, "-.")
+}
+
+// punctuationLookalikes maps Unicode punctuation that models like to emit to its ASCII
+// equivalent (-normalize-dashes)
+var punctuationLookalikes = strings.NewReplacer(
+	"\u2010", "-", // Hyphen
+	"\u2011", "-", // Non-breaking hyphen
+	"\u2012", "-", // Figure dash
+	"\u2013", "-", // En dash
+	"\u2014", "-", // Em dash
+	"\u2015", "-", // Horizontal bar
+	"\u2212", "-", // Minus sign
+	"\u2018", "'", // Left single quotation mark
+	"\u2019", "'", // Right single quotation mark
+	"\u201A", "'", // Single low-9 quotation mark
+	"\u2039", "'", // Single left-pointing angle quotation mark
+	"\u203A", "'", // Single right-pointing angle quotation mark
+	"\u201C", "\"", // Left double quotation mark
+	"\u201D", "\"", // Right double quotation mark
+	"\u201E", "\"", // Double low-9 quotation mark
+	"\u00AB", "\"", // Left-pointing double angle quotation mark
+	"\u00BB", "\"", // Right-pointing double angle quotation mark
+	"\u00A0", " ", // No-break space
+	"\u2007", " ", // Figure space
+	"\u2009", " ", // Thin space
+	"\u202F", " ", // Narrow no-break space
+	"\u2022", " ", // Bullet
+	"\u00B7", " ", // Middle dot
+	"\u2026", "...", // Horizontal ellipsis
+)
+
+// normalizePunctuation replaces Unicode dashes, quotes, spaces and bullets with ASCII
+func normalizePunctuation(s string) string {
+	return punctuationLookalikes.Replace(s)
+}
+
+// monthNumbers maps English and German month names and abbreviations, lowercase, to
+// their number for -normalize-invoice-dates
+var monthNumbers = map[string]int{
+	"jan": 1, "january": 1, "januar": 1, "jän": 1, "jänner": 1,
+	"feb": 2, "february": 2, "februar": 2,
+	"mar": 3, "march": 3, "mär": 3, "märz": 3, "maerz": 3,
+	"apr": 4, "april": 4,
+	"may": 5, "mai": 5,
+	"jun": 6, "june": 6, "juni": 6,
+	"jul": 7, "july": 7, "juli": 7,
+	"aug": 8, "august": 8,
+	"sep": 9, "sept": 9, "september": 9,
+	"oct": 10, "october": 10, "okt": 10, "oktober": 10,
+	"nov": 11, "november": 11,
+	"dec": 12, "december": 12, "dez": 12, "dezember": 12,
+}
+
+// monthNamePattern matches any key of monthNumbers, longest first
+var monthNamePattern = func() string {
+	names := sortedKeys(monthNumbers)
+	sort.SliceStable(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	return strings.Join(names, "|")
+}()
+
+// Date patterns recognized by normalizeDates: numeric dates with one separator (2023-01-05,
+// 05/01/23, 5.1.2023), day before month name (5 Jan 2023, 5. März 2023) and month name
+// before day (Jan 5 2023, January 5th, 2023)
+var (
+	numericDatePattern   = regexp.MustCompile(`\b(\d{1,4})([./-])(\d{1,2})([./-])(\d{1,4})\b`)
+	dayMonthDatePattern  = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\.?\s+(` + monthNamePattern + `)\.?,?\s+(\d{4})\b`)
+	monthDayDatePattern  = regexp.MustCompile(`(?i)\b(` + monthNamePattern + `)\.?\s+(\d{1,2})(?:st|nd|rd|th)?,?\s+(\d{4})\b`)
+	dateContinuesPattern = regexp.MustCompile(`^[./-]\d`)
+)
+
+// normalizeDates rewrites full dates in s as YYYY-MM-DD (-normalize-invoice-dates).
+// Ambiguous numeric dates are read in -date-order, unless only the other order gives a
+// valid date (25/01/2023). Anything that is not a valid date, e.g. a version number
+// like 1.2.10, is left alone.
+func normalizeDates(s string) string {
+	s = replaceDates(s, numericDatePattern, func(m []string) (string, bool) {
+		a, sep, b, c := m[1], m[2], m[3], m[5]
+		if m[4] != sep {
+			return "", false
+		}
+		if len(a) == 4 {
+			if len(c) > 2 {
+				return "", false
+			}
+			return isoDate(a, b, c)
+		}
+		// Two-digit years only with two-digit days and months, which rules out 1.2.10
+		if len(a) > 2 || len(c) == 1 || len(c) == 3 || (len(c) == 2 && (len(a) != 2 || len(b) != 2)) {
+			return "", false
+		}
+		month, day := a, b
+		if config.DateOrder == "dmy" {
+			month, day = b, a
+		}
+		if date, ok := isoDate(c, month, day); ok {
+			return date, true
+		}
+		return isoDate(c, day, month)
+	})
+	s = replaceDates(s, dayMonthDatePattern, func(m []string) (string, bool) {
+		return isoDate(m[3], strconv.Itoa(monthNumbers[strings.ToLower(m[2])]), m[1])
+	})
+	return replaceDates(s, monthDayDatePattern, func(m []string) (string, bool) {
+		return isoDate(m[3], strconv.Itoa(monthNumbers[strings.ToLower(m[1])]), m[2])
+	})
+}
+
+// replaceDates replaces each match of re in s with what convert makes of its submatches.
+// Matches convert rejects, and those that are part of a longer dotted or dashed number
+// such as 1.2.3.4, are kept as they are.
+func replaceDates(s string, re *regexp.Regexp, convert func(m []string) (string, bool)) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := loc[0], loc[1]
+		if dateContinuesPattern.MatchString(s[end:]) || (start >= 2 && dateContinuesPattern.MatchString(s[start-2:start])) {
+			continue
+		}
+		m := make([]string, len(loc)/2)
+		for i := range m {
+			if loc[2*i] >= 0 {
+				m[i] = s[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		date, ok := convert(m)
+		if !ok {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(date)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// isoDate formats year, month and day as YYYY-MM-DD if they form a valid date between
+// 1900 and 2099; two-digit years below 70 are taken as 20xx, the others as 19xx
+func isoDate(year, month, day string) (string, bool) {
+	y, errY := strconv.Atoi(year)
+	m, errM := strconv.Atoi(month)
+	d, errD := strconv.Atoi(day)
+	if errY != nil || errM != nil || errD != nil {
+		return "", false
+	}
+	if len(year) == 2 {
+		y += 1900
+		if y < 1970 {
+			y += 100
+		}
+	}
+	t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	if y < 1900 || y > 2099 || t.Month() != time.Month(m) || t.Day() != d {
+		return "", false
+	}
+	return t.Format("2006-01-02"), true
+}
+
+// canonicalizeUnicode normalizes s to Unicode form "nfc" (base letter + combining mark
+// become the precomposed character, e.g. the NFD "e\u0301" that macOS stores becomes "é")
+// or "nfkc" (additionally folds ligatures, full-width and superscript forms). "none"
+// returns s.
+func canonicalizeUnicode(s, form string) string {
+	switch form {
+	case "nfc":
+		return norm.NFC.String(s)
+	case "nfkc":
+		return norm.NFKC.String(s)
+	}
+	return s
+}
+
+// validateGeneratedName rejects sanitized names that are too short to be meaningful,
+// e.g. when the model answered with punctuation only. Callers treat this as a
+// generation failure so the fallback path runs instead of writing "a.pdf".
+func validateGeneratedName(name string) error {
+	if utf8.RuneCountInString(name) < config.MinNameLength {
+		return fmt.Errorf("error: generated name %q is shorter than %d characters after sanitizing", name, config.MinNameLength)
+	}
+	return nil
+}
+
+// reportThumbnailWidth is the width of the page thumbnails in the -report-html page
+const reportThumbnailWidth = 160
+
+// rememberThumbnail keeps a small PNG of the page image for pdfFile's report row
+func rememberThumbnail(pdfFile string, imgData []byte) {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		verbosef("Could not decode page image for the report thumbnail: %v\n", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, downscaleImage(img, reportThumbnailWidth)); err != nil {
+		verbosef("Could not encode the report thumbnail: %v\n", err)
+		return
+	}
+	if batch.thumbnails == nil {
+		batch.thumbnails = make(map[string][]byte)
+	}
+	batch.thumbnails[pdfFile] = buf.Bytes()
+}
+
+// writeDebugImages dumps the page images that are about to be sent to the vision model
+// as <source>-pN.png into the debug directory, so bad names can be traced back to bad inputs.
+func writeDebugImages(pdfFile string, images [][]byte) {
+	if config.DebugImagesDir == "" {
+		return
+	}
+	if err := os.MkdirAll(config.DebugImagesDir, 0755); err != nil {
+		fmt.Printf("Warning: could not create debug image directory: %v\n", err)
+		return
+	}
+
+	base := strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile))
+	for i, imgData := range images {
+		debugPath := filepath.Join(config.DebugImagesDir, fmt.Sprintf("%s-p%d.png", base, i+1))
+		if err := os.WriteFile(debugPath, imgData, 0644); err != nil {
+			fmt.Printf("Warning: could not write debug image %s: %v\n", debugPath, err)
+			continue
+		}
+		fmt.Printf("Page %d: debug image written to %s\n", i+1, debugPath)
+		if i == 0 && config.ReportHTML != "" {
+			rememberThumbnail(pdfFile, imgData)
+		}
+	}
+}
+
+// verbosef prints diagnostic output when -verbose is set
+func verbosef(format string, args ...interface{}) {
+	if config.Verbose {
+		fmt.Printf(format, args...)
+	}
+}
+
+// textCleaners are the -clean-text steps, applied in this order
+var textCleaners = []struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+}{
+	{"emails", regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`), " "},
+	// The leading group keeps the domain of an email address intact when only urls is set
+	{"urls", regexp.MustCompile(`(?i)(^|[^@a-z0-9._%+-])(?:(?:https?://|www\.)\S+|[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|de|at|ch|eu|io|co|uk|info|biz)\b(?:/\S*)?)`), "${1} "},
+	{"digits", regexp.MustCompile(`\d{6,}`), " "},
+}
+
+// parseCleanText validates a -clean-text value and returns the enabled steps
+func parseCleanText(value string) (map[string]bool, error) {
+	enabled := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		switch part {
+		case "":
+		case "all":
+			for _, c := range textCleaners {
+				enabled[c.name] = true
+			}
+		case "urls", "emails", "digits":
+			enabled[part] = true
+		default:
+			return nil, fmt.Errorf("unknown -clean-text option %q (use urls, emails, digits or all)", part)
+		}
+	}
+	return enabled, nil
+}
+
+// cleanText removes URLs, email addresses and long digit runs from OCR text as selected
+// by -clean-text, so the model names the document after meaningful words instead
+func cleanText(text string) string {
+	enabled, err := parseCleanText(config.CleanText)
+	if err != nil {
+		return text
+	}
+	for _, c := range textCleaners {
+		if enabled[c.name] {
+			text = c.re.ReplaceAllString(text, c.replacement)
+		}
+	}
+	return text
+}
+
+// lowercaseShortWords are short words that are lowercased in ALL-CAPS lines although
+// they would otherwise pass as acronyms
+var lowercaseShortWords = map[string]bool{
+	"A": true, "AN": true, "THE": true, "AND": true, "OR": true, "OF": true, "TO": true, "IN": true,
+	"ON": true, "AT": true, "BY": true, "FOR": true, "NO": true, "NR": true, "PER": true, "IS": true,
+	"ARE": true, "OUR": true, "YOU": true, "YOUR": true, "DER": true, "DIE": true, "DAS": true,
+	"UND": true, "VON": true, "FÜR": true, "MIT": true, "LE": true, "LA": true, "DE": true, "ET": true,
+}
+
+// looksLikeAcronym reports whether an upper-case word of an ALL-CAPS line should keep its
+// case: words with digits (A4, Q1), short words that are not common function words
+// (VAT, USA) and words without vowels (GMBH, PDF)
+func looksLikeAcronym(word string) bool {
+	letters := 0
+	hasVowel := false
+	for _, r := range word {
+		switch {
+		case unicode.IsDigit(r):
+			return true
+		case unicode.IsLetter(r):
+			letters++
+			if strings.ContainsRune("AEIOUYÄÖÜÀÁÂÈÉÊÌÍÎÒÓÔÙÚÛ", r) {
+				hasVowel = true
+			}
+		}
+	}
+	if letters == 0 || lowercaseShortWords[strings.Trim(word, ".,:;!?()")] {
+		return false
+	}
+	return letters <= 3 || !hasVowel
+}
+
+// normalizeCaseInText lowercases the lines of text that are written entirely in upper
+// case (at least two words and four letters), such as scanned letterheads, keeping
+// acronyms. Mixed-case lines are left alone.
+func normalizeCaseInText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		letters := 0
+		shouty := true
+		for _, r := range line {
+			if unicode.IsLetter(r) {
+				letters++
+				if !unicode.IsUpper(r) {
+					shouty = false
+					break
+				}
+			}
+		}
+		words := strings.Fields(line)
+		if !shouty || letters < 4 || len(words) < 2 {
+			continue
+		}
+		for j, word := range words {
+			if !looksLikeAcronym(word) {
+				words[j] = strings.ToLower(word)
+			}
+		}
+		lines[i] = strings.Join(words, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// prepareText applies the configured pre-processing to extracted text before it is sent
+func prepareText(text string) string {
+	if config.CleanText != "" {
+		before := len(text)
+		text = cleanText(text)
+		verbosef("Cleaned text from %d to %d bytes (-clean-text %s)\n", before, len(text), config.CleanText)
+	}
+	if config.NormalizeCaseInText {
+		text = normalizeCaseInText(text)
+	}
+	if config.MaxTextChars > 0 {
+		if runes := []rune(text); len(runes) > config.MaxTextChars {
+			verbosef("Truncating text from %d to %d characters (-max-text-chars, -text-sampling %s)\n", len(runes), config.MaxTextChars, config.TextSampling)
+			text = sampleText(runes, config.MaxTextChars, config.TextSampling)
+		}
+	}
+	return text
+}
+
+// elisionMarker separates the beginning and the end of the text with -text-sampling head-tail
+const elisionMarker = "\n[...]\n"
+
+// sampleText keeps max of the runes: the beginning (head), the end (tail), or the first
+// and the last half joined by elisionMarker (head-tail), for documents such as letters
+// whose sender or signatory is at the bottom
+func sampleText(runes []rune, max int, strategy string) string {
+	switch strategy {
+	case "tail":
+		return string(runes[len(runes)-max:])
+	case "head-tail":
+		head := (max + 1) / 2
+		return string(runes[:head]) + elisionMarker + string(runes[len(runes)-(max-head):])
+	}
+	return string(runes[:max])
+}
+
+// numCtxForPrompt returns the Ollama context window for a text prompt: -num-ctx if set,
+// otherwise roughly 4 characters per token plus room for the answer, rounded up to a
+// multiple of 1024 and clamped between 2048 and -max-num-ctx.
+func numCtxForPrompt(prompt string) int {
+	if config.NumCtx > 0 {
+		return config.NumCtx
+	}
+	const charsPerToken = 4
+	const responseTokens = 512
+	numCtx := len([]rune(prompt))/charsPerToken + responseTokens
+	numCtx = (numCtx + 1023) / 1024 * 1024
+	if numCtx < 2048 {
+		numCtx = 2048
+	}
+	if config.MaxNumCtx > 0 && numCtx > config.MaxNumCtx {
+		numCtx = config.MaxNumCtx
+	}
+	return numCtx
+}
+
+// dirPromptFile is the name of the optional per-directory prompt file
+const dirPromptFile = ".aipdfprompt"
+
+// findDirPrompt returns the contents of the nearest .aipdfprompt file, looking in the
+// directory of pdfFile and then walking up its parents. It returns "" if there is none.
+func findDirPrompt(pdfFile string) string {
+	dir, err := filepath.Abs(filepath.Dir(pdfFile))
+	if err != nil {
+		return ""
+	}
+	for {
+		if data, err := os.ReadFile(filepath.Join(dir, dirPromptFile)); err == nil {
+			if prompt := strings.TrimSpace(string(data)); prompt != "" {
+				verbosef("Using prompt from %s\n", filepath.Join(dir, dirPromptFile))
+				return prompt
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// basePrompt returns the prompt for pdfFile: an explicit -prompt, otherwise the nearest
+// directory prompt file, otherwise the configured (default) prompt.
+func basePrompt(pdfFile string) string {
+	if !config.PromptExplicit {
+		if prompt := findDirPrompt(pdfFile); prompt != "" {
+			return prompt
+		}
+	}
+	return config.CustomPrompt
+}
+
+// applyPromptRules fills the rule placeholders in a prompt so the instructions the model
+// sees match the post-processing: {max_length} becomes the -chars-budget value, and
+// "separate words with dashes" follows -allow-spaces, -separator and -case.
+func applyPromptRules(prompt string) string {
+	words := "separate words with dashes"
+	switch {
+	case config.AllowSpaces:
+		words = "separate words with spaces"
+	case config.Separator == "underscore":
+		words = "separate words with underscores"
+	}
+	if config.Case == "lower" {
+		words += ", all in lowercase"
+	}
+	prompt = strings.ReplaceAll(prompt, "separate words with dashes", words)
+	return strings.ReplaceAll(prompt, "{max_length}", strconv.Itoa(config.CharsBudget))
+}
+
+// readPDFTitle returns the /Title of the PDF's document information dictionary, or ""
+// when there is none
+func readPDFTitle(pdfPath string) (string, error) {
+	return readPDFInfo(pdfPath, "Title")
+}
+
+// readPDFInfo returns the entry key of the PDF's document information dictionary, or ""
+// when there is none
+func readPDFInfo(pdfPath, key string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := newToolCommand(config.GSTimeout, "gs",
+		"-q",          // Quiet mode (no output)
+		"-dNODISPLAY", // No rendering needed
+		"-dBATCH",     // Exit when done
+		"--permit-file-read="+pdfPath,
+		"-c", "("+psString(pdfPath)+") (r) file runpdfbegin Trailer /Info knownoget { /"+key+" knownoget { print } if } if quit",
+	)
+	defer cmd.cancel()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if timeoutErr := cmd.timeoutError("gs", pdfPath); timeoutErr != nil {
+			return "", timeoutErr
+		}
+		return "", fmt.Errorf("Ghostscript %s error: %v, stderr: %s", strings.ToLower(key), err, stderr.String())
+	}
+	return decodePDFString(stdout.Bytes()), nil
+}
+
+// decodePDFString decodes a PDF text string: UTF-16BE with a byte order mark, otherwise
+// PDFDocEncoding, which matches Latin-1 for the printable range
+func decodePDFString(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		var units []uint16
+		for i := 2; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	}
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// titleContext seeds the prompt with the PDF's existing title for -name-from both
+func titleContext(pdfFile string) string {
+	if config.NameFrom != "both" {
+		return ""
+	}
+	title, err := readPDFTitle(pdfFile)
+	if err != nil || title == "" {
+		return ""
+	}
+	return fmt.Sprintf(" The document's metadata title is %q; use it if it fits the content.", title)
+}
+
+// scannerPrefixes are the prefixes from -scanner-prefixes or -scanner-prefixes-file
+var scannerPrefixes []string
+
+// parseScannerPrefixes splits a comma- or newline-separated prefix list. Blank entries
+// and lines starting with # are ignored.
+func parseScannerPrefixes(value string) []string {
+	var prefixes []string
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if part = strings.TrimSpace(part); part != "" && !strings.HasPrefix(part, "#") {
+			prefixes = append(prefixes, part)
+		}
+	}
+	return prefixes
+}
+
+// loadScannerPrefixes reads a -scanner-prefixes-file with one prefix per line
+func loadScannerPrefixes(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scanner prefixes file: %v", err)
+	}
+	return parseScannerPrefixes(string(data)), nil
+}
+
+// splitScannerPrefix removes a scanner prefix (case-insensitive) and the separators after
+// it from base. matched reports whether one of the prefixes was found. A prefix ending in
+// a letter must not be followed by another letter, so "DOC" matches "DOC001234" but not
+// "Documentation".
+func splitScannerPrefix(base string) (rest string, matched bool) {
+	for _, prefix := range scannerPrefixes {
+		if len(base) < len(prefix) || !strings.EqualFold(base[:len(prefix)], prefix) {
+			continue
+		}
+		rest = base[len(prefix):]
+		last, _ := utf8.DecodeLastRuneInString(prefix)
+		next, _ := utf8.DecodeRuneInString(rest)
+		if unicode.IsLetter(last) && unicode.IsLetter(next) {
+			continue
+		}
+		return strings.TrimLeft(rest, "_- "), true
+	}
+	return base, false
+}
+
+// isScannerCounter reports whether s is a device counter like "C224e0123" or
+// "20240311_1234": it has no run of three or more letters, i.e. no real word
+func isScannerCounter(s string) bool {
+	return !regexp.MustCompile(`[A-Za-z]{3,}`).MatchString(s)
+}
+
+// isScannerDefaultName reports whether pdfFile carries a name the scanner made up
+// (prefix plus counter), as opposed to one a person chose
+func isScannerDefaultName(pdfFile string) bool {
+	base := strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile))
+	rest, matched := splitScannerPrefix(base)
+	return matched && isScannerCounter(rest)
+}
+
+// originalNameHint returns the meaningful part of pdfFile's name for -trim-scanner-prefix:
+// the basename without extension and scanner prefix, or "" for pure scanner defaults
+func originalNameHint(pdfFile string) string {
+	base := strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile))
+	rest, matched := splitScannerPrefix(base)
+	if matched && isScannerCounter(rest) {
+		return ""
+	}
+	return rest
+}
+
+// originalNameContext is the prompt sentence that passes the original name as a weak
+// hint with -trim-scanner-prefix, or "" when there is nothing meaningful to pass
+func originalNameContext(pdfFile string) string {
+	if !config.TrimScannerPrefix {
+		return ""
+	}
+	hint := originalNameHint(pdfFile)
+	if hint == "" {
+		return ""
+	}
+	return fmt.Sprintf(" The file was originally called %q; treat this only as a weak hint.", hint)
+}
+
+// dirHint returns the name of the directory pdfFile is in as lowercase words, e.g.
+// "acme" for /clients/acme/doc.pdf or "tax 2024" for Tax_2024/ (at most six words). It is "" for the
+// filesystem root and for the temporary directories archive entries and stdin are
+// spooled to, whose names say nothing about the document.
+func dirHint(pdfFile string) string {
+	dir, err := filepath.Abs(filepath.Dir(pdfFile))
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(dir)
+	if strings.HasPrefix(name, "ai-pdf-renamer-") {
+		return ""
+	}
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 6 {
+		words = words[:6]
+	}
+	return strings.Join(words, " ")
+}
+
+// dirContext is the prompt sentence that passes the directory name as a hint with
+// -use-dir-context, or "" when there is nothing meaningful to pass
+func dirContext(pdfFile string) string {
+	if !config.UseDirContext {
+		return ""
+	}
+	hint := dirHint(pdfFile)
+	if hint == "" {
+		return ""
+	}
+	return fmt.Sprintf(" These files are filed under: %s.", hint)
+}
+
+// languageNames maps the ISO 639-1 codes accepted by -name-lang to the language name
+// used in the prompt; other values are passed on as written
+var languageNames = map[string]string{
+	"en": "English",
+	"de": "German",
+	"fr": "French",
+	"es": "Spanish",
+	"it": "Italian",
+	"nl": "Dutch",
+	"pt": "Portuguese",
+}
+
+// nameLanguageContext is the prompt sentence for -name-lang, or "" when the model may
+// name files in the document's language
+func nameLanguageContext() string {
+	if config.NameLang == "" {
+		return ""
+	}
+	language := config.NameLang
+	if name, ok := languageNames[strings.ToLower(language)]; ok {
+		language = name
+	}
+	return fmt.Sprintf(" Respond with the filename in %s, translating if the document is in another language.", language)
+}
+
+// nameFromMetadata returns a name built from the PDF Title for -name-from metadata; ok is
+// false when the title is missing or too short, so the model is asked instead
+func nameFromMetadata(pdfFile string) (GeneratedName, bool) {
+	title, err := readPDFTitle(pdfFile)
+	if err != nil {
+		verbosef("Could not read PDF title: %v\n", err)
+		return GeneratedName{}, false
+	}
+	if title == "" {
+		fmt.Println("No PDF title found, asking the model")
+		return GeneratedName{}, false
+	}
+	name, err := newGeneratedName(title)
+	if err != nil {
+		fmt.Printf("PDF title %q is not usable (%v), asking the model\n", title, err)
+		return GeneratedName{}, false
+	}
+	return name, true
+}
+
+// PromptExample is one few-shot demonstration from -examples-file: a short description of a
+// document's content (for vision mode a caption of the page) and the ideal filename
+type PromptExample struct {
+	Content  string `json:"content"`
+	Filename string `json:"filename"`
+}
+
+// promptExamples holds the examples loaded from -examples-file
+var promptExamples []PromptExample
+
+// loadPromptExamples reads a JSON array of examples; entries missing either field are rejected
+func loadPromptExamples(path string) ([]PromptExample, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading examples file: %v", err)
+	}
+	var examples []PromptExample
+	if err := json.Unmarshal(data, &examples); err != nil {
+		return nil, fmt.Errorf("error parsing examples file %s (expected a JSON array of {\"content\", \"filename\"}): %v", path, err)
+	}
+	for i, example := range examples {
+		if strings.TrimSpace(example.Content) == "" || strings.TrimSpace(example.Filename) == "" {
+			return nil, fmt.Errorf("error: example %d in %s needs both content and filename", i+1, path)
+		}
+	}
+	return examples, nil
+}
+
+// examplesBlock formats up to -max-examples demonstrations for the prompt
+func examplesBlock() string {
+	examples := promptExamples
+	if len(examples) > config.MaxExamples {
+		examples = examples[:config.MaxExamples]
+	}
+	if len(examples) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(" Examples:")
+	for _, example := range examples {
+		fmt.Fprintf(&b, "\nContent: %s\nFilename: %s", strings.TrimSpace(example.Content), strings.TrimSpace(example.Filename))
+	}
+	b.WriteString("\nNow create the filename for this document.")
+	return b.String()
+}
+
+// visionPrompt builds the prompt sent along with the page images of pdfFile
+func visionPrompt(pdfFile string) string {
+	return applyPromptRules(basePrompt(pdfFile)) + titleContext(pdfFile) + originalNameContext(pdfFile) + dirContext(pdfFile) + nameLanguageContext() + examplesBlock() + config.VisionSuffix
+}
+
+// textPrompt builds the prompt for the OCR path from the extracted text of pdfFile
+func textPrompt(pdfFile, text string) string {
+	return applyPromptRules(basePrompt(pdfFile)) + titleContext(pdfFile) + originalNameContext(pdfFile) + dirContext(pdfFile) + nameLanguageContext() + examplesBlock() + config.TextIntro + text
+}
+
+// GeneratedName holds the model's readable answer and the sanitized slug used as filename
+type GeneratedName struct {
+	Readable string // Model output before slugification, e.g. "Quarterly Report 2023"
+	Slug     string // Sanitized filename without extension, e.g. "Quarterly-Report-2023"
+	Category string // Document type detected with -classify, empty otherwise
+	Language string // ISO 639-1 code detected with -detect-language, empty if unknown
+	Model    string // Model that produced the name, empty for names not made by a model
+
+	Confidence int      // Self-rated confidence (1-10) with -min-confidence, 0 if not rated
+	Keywords   []string // Keywords collected with -keywords
+}
+
+// readableName extracts a human-readable title from a raw model response
+func readableName(raw string) string {
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.Trim(strings.TrimSpace(line), "\"'`")
+		line = strings.TrimSuffix(line, ".pdf")
+		if line != "" {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
+
+// isWordSeparator reports whether r separates the words of a sanitized name: a dash, a
+// space (-allow-spaces) or an underscore (-separator underscore)
+func isWordSeparator(r rune) bool {
+	return r == '-' || r == ' ' || r == '_'
+}
+
+// titleCaseWords upper-cases the first letter of every word
+// (-title-case). The rest of each word is left alone, so acronyms like "ACME" survive.
+func titleCaseWords(name string) string {
+	runes := []rune(name)
+	for i, r := range runes {
+		if i == 0 || isWordSeparator(runes[i-1]) {
+			runes[i] = unicode.ToUpper(r)
+		}
+	}
+	return string(runes)
+}
+
+// newGeneratedName builds a GeneratedName from a raw model response and validates the slug
+func newGeneratedName(raw string) (GeneratedName, error) {
+	if config.NormalizeInvoiceDates {
+		raw = normalizeDates(raw)
+	}
+	slugSource := raw
+	if config.NormalizeDashes {
+		raw = normalizePunctuation(raw)
+		// Apostrophes join the word ("Driver's" -> "Drivers") instead of splitting it
+		slugSource = strings.ReplaceAll(raw, "'", "")
+	}
+	name := GeneratedName{
+		Readable: readableName(raw),
+		Slug:     sanitizeFilename(slugSource),
+	}
+	if config.TitleCase {
+		name.Slug = titleCaseWords(name.Slug)
+	}
+	if err := validateGeneratedName(name.Slug); err != nil {
+		return GeneratedName{}, err
+	}
+	return name, nil
+}
+
+// ollamaOptionsFromFile holds the options loaded from -ollama-options-file
+var ollamaOptionsFromFile map[string]interface{}
+
+// loadOllamaOptions reads a JSON object of Ollama generation options
+func loadOllamaOptions(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Ollama options file: %v", err)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("error parsing Ollama options file: %v", err)
+	}
+	options, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("error: Ollama options file %s must contain a JSON object", path)
+	}
+	return options, nil
+}
+
+// ollamaOptions builds the "options" map of a generate request. Options derived for
+// the current request (extra) come first; the -ollama-options-file entries are merged
+// on top, so the file wins on conflicts.
+func ollamaOptions(extra map[string]interface{}) map[string]interface{} {
+	options := make(map[string]interface{})
+	for key, value := range extra {
+		options[key] = value
+	}
+	for key, value := range ollamaOptionsFromFile {
+		options[key] = value
+	}
+	return options
+}
+
+// newRateLimiter returns a limiter for perSecond generate requests per second (nil =
+// unlimited). A burst of 1 spaces the requests evenly instead of sending them in bursts.
+func newRateLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+// waitForRateLimit blocks until the next generate request may be sent (-rate-limit). If
+// the wait would outlast the file's -max-runtime-per-file budget, it gives up at once.
+func waitForRateLimit() error {
+	if generateLimiter == nil {
+		return nil
+	}
+	if err := generateLimiter.Wait(fileCtx); err != nil {
+		if _, ok := fileCtx.Deadline(); ok {
+			return fmt.Errorf("error: %w of %v", errTimeBudget, config.MaxRuntimePerFile)
+		}
+		return fmt.Errorf("error waiting for -rate-limit: %v", err)
+	}
+	return nil
+}
+
+// generateLimiter throttles the generate requests (-rate-limit)
+var generateLimiter *rate.Limiter
+
+// callOllamaGenerate posts the payload to Ollama's generate endpoint and decodes the response
+func callOllamaGenerate(payload map[string]interface{}) (OllamaResponse, error) {
+	if _, ok := payload["options"]; !ok {
+		if options := ollamaOptions(nil); len(options) > 0 {
+			payload["options"] = options
+		}
+	}
+
+	if config.Stream {
+		payload["stream"] = true
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return OllamaResponse{}, fmt.Errorf("error creating JSON payload: %v", err)
+	}
+	if config.DumpRequest {
+		fmt.Printf("Ollama request:\n%s", requestDump(payload))
+	}
+
+	// Call Ollama API
+	if err := waitForRateLimit(); err != nil {
+		return OllamaResponse{}, err
+	}
+	started := time.Now()
+	if config.Stream {
+		ollamaResp, err := postGenerateStream(jsonData)
+		recordRequest(payload, time.Since(started))
+		return ollamaResp, err
+	}
+	body, err := postGenerate(jsonData)
+	recordRequest(payload, time.Since(started))
+	if err != nil {
+		return OllamaResponse{}, err
+	}
+
+	var ollamaResp OllamaResponse
+	if err := json.Unmarshal(body, &ollamaResp); err != nil {
+		return OllamaResponse{}, fmt.Errorf("error parsing response: %v", err)
+	}
+
+	return ollamaResp, nil
+}
+
+// sendGenerate posts a generate request, bounded by -max-runtime-per-file
+func sendGenerate(jsonData []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(fileCtx, http.MethodPost, "http://localhost:11434/api/generate", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if budgetErr := budgetError(); budgetErr != nil {
+		return nil, budgetErr
+	}
+	return resp, err
+}
+
+// postGenerate sends a generate request and reads the whole response body
+func postGenerate(jsonData []byte) ([]byte, error) {
+	resp, err := sendGenerate(jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("error calling Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return body, nil
+}
+
+// postGenerateStream sends a generate request with "stream": true and assembles the
+// answer from the NDJSON chunks as they arrive (-stream)
+func postGenerateStream(jsonData []byte) (OllamaResponse, error) {
+	resp, err := sendGenerate(jsonData)
+	if err != nil {
+		return OllamaResponse{}, fmt.Errorf("error calling Ollama API: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var echo io.Writer
+	if config.Verbose {
+		echo = os.Stdout
+	}
+	return readGenerateStream(resp.Body, echo)
+}
+
+// generateChunk is one NDJSON record of a streamed generate response
+type generateChunk struct {
+	Response string `json:"response"`
+	Error    string `json:"error,omitempty"`
+	Done     bool   `json:"done"`
+}
+
+// readGenerateStream concatenates the response fragments of a streamed generate answer
+// until the final "done": true record, echoing each fragment to echo if it isn't nil.
+// An error record ends the stream and is returned in the response's Error field, just
+// like a non-streamed error.
+func readGenerateStream(r io.Reader, echo io.Writer) (OllamaResponse, error) {
+	var answer strings.Builder
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk generateChunk
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return OllamaResponse{}, fmt.Errorf("error parsing response: %v", err)
+		}
+		if chunk.Error != "" {
+			return OllamaResponse{Error: chunk.Error}, nil
+		}
+		answer.WriteString(chunk.Response)
+		if echo != nil {
+			fmt.Fprint(echo, chunk.Response)
+		}
+		if chunk.Done {
+			if echo != nil {
+				fmt.Fprintln(echo)
+			}
+			return OllamaResponse{Response: answer.String()}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return OllamaResponse{}, fmt.Errorf("error reading response: %v", err)
+	}
+	return OllamaResponse{}, fmt.Errorf("error reading response: stream ended without the final record")
+}
+
+// usageStats accumulates the Ollama requests and OCR text of a run or a file (-stats)
+type usageStats struct {
+	requests   int
+	imageBytes int64
+	ocrChars   int
+	elapsed    time.Duration
+	models     map[string]*usageStats // Per-model breakdown, only kept for the run totals
+}
+
+// usage holds the totals of the run, fileUsage those of the file being processed
+var usage, fileUsage usageStats
+
+// add counts one request that sent imageBytes of page images and took elapsed
+func (u *usageStats) add(imageBytes int64, elapsed time.Duration) {
+	u.requests++
+	u.imageBytes += imageBytes
+	u.elapsed += elapsed
+}
+
+// decodedSize returns the number of bytes a base64-encoded image decodes to
+func decodedSize(image string) int64 {
+	return int64(len(image)/4*3 - (len(image) - len(strings.TrimRight(image, "="))))
+}
+
+// requestDump returns a generate payload as indented JSON for -dump-request. Everything
+// is shown as sent, except that each image is replaced by a "<N bytes>" placeholder.
+func requestDump(payload map[string]interface{}) string {
+	dump := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		dump[key] = value
+	}
+	if images, ok := payload["images"].([]string); ok {
+		placeholders := make([]string, len(images))
+		for i, image := range images {
+			placeholders[i] = fmt.Sprintf("<%d bytes>", decodedSize(image))
+		}
+		dump["images"] = placeholders
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dump); err != nil {
+		return fmt.Sprintf("(could not encode request: %v)\n", err)
+	}
+	return buf.String()
+}
+
+// recordRequest counts a generate request in the run and file statistics
+func recordRequest(payload map[string]interface{}, elapsed time.Duration) {
+	var imageBytes int64
+	if images, ok := payload["images"].([]string); ok {
+		for _, image := range images {
+			imageBytes += decodedSize(image)
+		}
+	}
+	usage.add(imageBytes, elapsed)
+	fileUsage.add(imageBytes, elapsed)
+
+	model, _ := payload["model"].(string)
+	if usage.models == nil {
+		usage.models = make(map[string]*usageStats)
+	}
+	if usage.models[model] == nil {
+		usage.models[model] = &usageStats{}
+	}
+	usage.models[model].add(imageBytes, elapsed)
+}
+
+// averageResponse returns the mean time per request
+func (u *usageStats) averageResponse() time.Duration {
+	if u.requests == 0 {
+		return 0
+	}
+	return (u.elapsed / time.Duration(u.requests)).Round(time.Millisecond)
+}
+
+// printUsageStats prints the -stats block at the end of the run
+func printUsageStats() {
+	fmt.Println("\nStatistics:")
+	fmt.Printf("  Ollama requests:   %d (average response %v, total %v)\n", usage.requests, usage.averageResponse(), usage.elapsed.Round(time.Millisecond))
+	fmt.Printf("  Image data sent:   %s\n", formatBytes(usage.imageBytes))
+	fmt.Printf("  OCR characters:    %d\n", usage.ocrChars)
+	for _, model := range sortedKeys(usage.models) {
+		m := usage.models[model]
+		fmt.Printf("  %s: %d request(s), %s of images, average response %v\n", model, m.requests, formatBytes(m.imageBytes), m.averageResponse())
+	}
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "3.2 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// junkTokens are name parts that carry no information about the document
+var junkTokens = map[string]bool{
+	"pdf": true, "document": true, "doc": true, "file": true, "filename": true, "scan": true,
+	"scanned": true, "img": true, "image": true, "page": true, "untitled": true, "unknown": true,
+	"copy": true, "new": true, "final": true, "the": true, "and": true, "for": true,
+}
+
+// readabilityScore rates a slug by its distinct keywords minus junk tokens: generic
+// words, single characters, long digit runs and ID-like letter/digit mixes count
+// against it, repeated words count once.
+func readabilityScore(slug string) int {
+	longDigits := regexp.MustCompile(`^\d{6,}$`)
+	idLike := regexp.MustCompile(`^[a-z]*\d[a-z\d]*$`)
+	score := 0
+	seen := make(map[string]bool)
+	for _, token := range strings.FieldsFunc(strings.ToLower(slug), isWordSeparator) {
+		if token == "" || seen[token] {
+			continue
+		}
+		seen[token] = true
+		switch {
+		case len(token) < 2 || junkTokens[token] || longDigits.MatchString(token):
+			score--
+		case idLike.MatchString(token) && len(token) > 8:
+			score--
+		default:
+			score++
+		}
+	}
+	return score
+}
+
+// pickSuggestion calls generate -num-suggestions times and returns the candidate with the
+// best readability score (the first one wins ties). It fails if no call succeeded or if
+// the best candidate is below the -readability-score gate.
+func pickSuggestion(generate func() (GeneratedName, error)) (GeneratedName, error) {
+	var candidates []GeneratedName
+	var lastErr error
+	seen := make(map[string]bool)
+	for i := 0; i < config.NumSuggestions || i == 0; i++ {
+		name, err := generate()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !seen[name.Slug] {
+			seen[name.Slug] = true
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return GeneratedName{}, lastErr
+	}
+
+	best, bestScore := candidates[0], readabilityScore(candidates[0].Slug)
+	for _, candidate := range candidates {
+		score := readabilityScore(candidate.Slug)
+		verbosef("Candidate %s: readability score %d\n", candidate.Slug, score)
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	if config.ReadabilityScore > 0 && bestScore < config.ReadabilityScore {
+		return GeneratedName{}, fmt.Errorf("error: generated name %q scores %d, below -readability-score %d", best.Slug, bestScore, config.ReadabilityScore)
+	}
+	return best, nil
+}
+
+// unsortedCategory receives documents the classifier could not place
+const unsortedCategory = "unsorted"
+
+// parseCategories splits a -categories value into lowercase type names
+func parseCategories(value string) []string {
+	var categories []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.ToLower(strings.TrimSpace(part)); part != "" {
+			categories = append(categories, part)
+		}
+	}
+	return categories
+}
+
+// matchCategory maps a classifier answer to one of the categories. Singular and plural
+// forms match ("invoice" -> "invoices"); anything else, including "unknown", is unsorted.
+func matchCategory(answer string, categories []string) string {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	answer = strings.Trim(answer, " .,:;!\"'`*")
+	for _, category := range categories {
+		if answer == category || strings.TrimSuffix(answer, "s") == strings.TrimSuffix(category, "s") {
+			return category
+		}
+	}
+	return unsortedCategory
+}
+
+// askAboutDocument sends a follow-up question about a document to the model, together
+// with the page images in vision mode or the extracted text otherwise
+func askAboutDocument(prompt, text string, images [][]byte) (string, error) {
+	payload := map[string]interface{}{
+		"model":   textModel(),
+		"stream":  false,
+		"options": ollamaOptions(nil),
+	}
+	if len(images) > 0 {
+		payload["model"] = visionModel()
+		var base64Images []string
+		for _, imgData := range images {
+			base64Images = append(base64Images, base64.StdEncoding.EncodeToString(imgData))
+		}
+		payload["images"] = base64Images
+	} else {
+		prompt += config.TextIntro + text
+	}
+	payload["prompt"] = prompt
+
+	ollamaResp, err := callOllamaGenerate(payload)
+	if err != nil {
+		return "", err
+	}
+	if ollamaResp.Error != "" {
+		return "", fmt.Errorf("%w: %s", errOllamaAPI, ollamaResp.Error)
+	}
+	return ollamaResp.Response, nil
+}
+
+// parseConfidence extracts a 1-10 rating from a model answer; 0 means no rating found
+func parseConfidence(answer string) int {
+	match := regexp.MustCompile(`\b(10|[1-9])\b`).FindString(answer)
+	if match == "" {
+		return 0
+	}
+	rating, _ := strconv.Atoi(match)
+	return rating
+}
+
+// rateConfidence asks the model how well name describes the document, on a 1-10 scale.
+// Failed calls and unparseable answers rate 0, so the name is not auto-accepted.
+func rateConfidence(name GeneratedName, text string, images [][]byte) int {
+	prompt := fmt.Sprintf("This document was given the filename %q. On a scale from 1 to 10, how confident are you "+
+		"that this filename accurately describes the document? Answer with a single number only.", name.Slug+".pdf")
+	answer, err := askAboutDocument(prompt, text, images)
+	if err != nil {
+		fmt.Printf("Warning: could not rate confidence: %v\n", err)
+		return 0
+	}
+	return parseConfidence(answer)
+}
+
+// lowConfidence rates name with -min-confidence, stores the rating in it and reports
+// whether it falls below the threshold; such files keep their original name and are
+// flagged for review
+func lowConfidence(pdfFile string, name *GeneratedName, text string, images [][]byte) bool {
+	if config.MinConfidence <= 0 {
+		return false
+	}
+	rating := rateConfidence(*name, text, images)
+	name.Confidence = rating
+	if rating >= config.MinConfidence {
+		verbosef("Confidence %d/10 for %s\n", rating, name.Slug)
+		return false
+	}
+	fmt.Printf("Low confidence (%d/10, need %d) for %s.pdf, keeping original name for review.\n", rating, config.MinConfidence, name.Slug)
+	logEvent(slog.LevelWarn, pdfFile, "model", "low confidence", "name", name.Slug, "confidence", rating)
+	return true
+}
+
+// classifyDocument asks the model which of the -categories the document belongs to,
+// based on the page images in vision mode or the extracted text otherwise. Failures and
+// unclear answers yield the unsorted category.
+func classifyDocument(text string, images [][]byte) string {
+	categories := parseCategories(config.Categories)
+	prompt := "Classify this document as exactly one of: " + strings.Join(categories, ", ") +
+		". Answer with the category only. If you are not sure, answer unknown."
+	answer, err := askAboutDocument(prompt, text, images)
+	if err != nil {
+		fmt.Printf("Warning: could not classify document: %v\n", err)
+		return unsortedCategory
+	}
+	category := matchCategory(answer, categories)
+	fmt.Printf("Detected document type: %s\n", category)
+	return category
+}
+
+// keywordsPrompt asks for -keywords keywords; %d is replaced with the count
+const keywordsPrompt = "List the %d most important keywords of this document for a tag-based search: " +
+	"names, organizations, topics and document type. Answer with one keyword per line, without numbering or explanations."
+
+// parseKeywords turns a model answer into at most limit distinct keywords, accepting
+// lines or comma-separated lists and dropping bullets, numbering and quotes
+func parseKeywords(answer string, limit int) []string {
+	var keywords []string
+	seen := make(map[string]bool)
+	for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == '\n' || r == ',' || r == ';' }) {
+		keyword := regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s*`).ReplaceAllString(field, "")
+		keyword = strings.TrimSpace(strings.Trim(strings.TrimSpace(keyword), "\"'`*."))
+		if keyword == "" || seen[strings.ToLower(keyword)] {
+			continue
+		}
+		seen[strings.ToLower(keyword)] = true
+		keywords = append(keywords, keyword)
+		if len(keywords) == limit {
+			break
+		}
+	}
+	return keywords
+}
+
+// collectKeywords asks the model for -keywords keywords about the document, from the
+// page images in vision mode or the extracted text otherwise. Failures only cost the
+// tags; the name is used either way.
+func collectKeywords(name *GeneratedName, text string, images [][]byte) {
+	if config.Keywords <= 0 {
+		return
+	}
+	answer, err := askAboutDocument(fmt.Sprintf(keywordsPrompt, config.Keywords), text, images)
+	if err != nil {
+		fmt.Printf("Warning: could not collect keywords: %v\n", err)
+		return
+	}
+	name.Keywords = parseKeywords(answer, config.Keywords)
+	fmt.Printf("Keywords: %s\n", strings.Join(name.Keywords, ", "))
+}
+
+// writeKeywords writes the -keywords tags file <output without .pdf>.tags, one per line
+func writeKeywords(outputPath string, keywords []string) error {
+	path := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".tags"
+	if err := os.WriteFile(path, []byte(strings.Join(keywords, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("could not write keywords: %v", err)
+	}
+	fmt.Printf("Keywords saved to: %s\n", path)
+	return nil
+}
+
+// languageStopwords lists frequent function words per ISO 639-1 code. Counting them is
+// enough to tell these languages apart on a page of text.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "for", "that", "with", "on", "this", "are", "be", "your", "from", "by", "you", "not", "have", "we"},
+	"de": {"der", "die", "und", "das", "ist", "den", "von", "mit", "sich", "des", "auf", "für", "nicht", "ein", "eine", "dem", "wir", "sie", "bei", "zu"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "du", "pour", "dans", "que", "qui", "sur", "pas", "par", "au", "avec", "vous", "nous", "ce"},
+	"es": {"el", "los", "las", "y", "del", "que", "en", "por", "con", "una", "para", "es", "se", "su", "al", "como", "más", "pero", "sus", "le"},
+	"it": {"il", "di", "che", "e", "della", "per", "non", "sono", "gli", "una", "del", "con", "alla", "nel", "si", "le", "dei", "è", "come", "anche"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "voor", "met", "zijn", "aan", "ook", "bij", "wij", "u", "naar", "uw", "te"},
+	"pt": {"de", "que", "não", "os", "as", "uma", "do", "da", "em", "para", "com", "por", "mais", "dos", "das", "se", "ao", "na", "no", "você"},
+}
+
+const (
+	minLanguageWords = 20 // Shorter texts are too little to tell the language
+	minLanguageHits  = 5  // Stopwords the winning language must contain at least
+)
+
+// detectLanguage returns the ISO 639-1 code of the language whose stopwords occur most
+// often in text. Short texts and texts without a clear winner yield "" (unknown).
+func detectLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) < minLanguageWords {
+		return ""
+	}
+	hits := make(map[string]int)
+	for _, code := range sortedKeys(languageStopwords) {
+		stopwords := make(map[string]bool)
+		for _, word := range languageStopwords[code] {
+			stopwords[word] = true
+		}
+		for _, word := range words {
+			if stopwords[word] {
+				hits[code]++
+			}
+		}
+	}
+	best, second := "", 0
+	for _, code := range sortedKeys(languageStopwords) {
+		switch {
+		case best == "" || hits[code] > hits[best]:
+			if best != "" {
+				second = hits[best]
+			}
+			best = code
+		case hits[code] > second:
+			second = hits[code]
+		}
+	}
+	// Require a clear margin, closely related languages share many stopwords
+	if hits[best] < minLanguageHits || hits[best]*2 < second*3 {
+		return ""
+	}
+	return best
+}
+
+// parseLanguageCode extracts an ISO 639-1 code from a model answer ("" for unknown)
+func parseLanguageCode(answer string) string {
+	answer = strings.ToLower(strings.Trim(strings.TrimSpace(answer), " .,:;!\"'`*"))
+	if regexp.MustCompile(`^[a-z]{2}$`).MatchString(answer) {
+		return answer
+	}
+	return ""
+}
+
+// tagLanguage detects the document language for -detect-language, from the extracted
+// text or, in vision mode, by asking the model about the page images. With
+// -language-prefix the code is prepended to the slug, shortening it to stay within
+// -chars-budget; unknown languages leave the name untouched.
+func tagLanguage(name *GeneratedName, text string, images [][]byte) {
+	if !config.DetectLanguage {
+		return
+	}
+	var language string
+	if len(images) > 0 {
+		answer, err := askAboutDocument("What is the primary language of this document? Answer with the two-letter "+
+			"ISO 639-1 code only, for example en or de. If there is too little text to tell, answer unknown.", "", images)
+		if err != nil {
+			fmt.Printf("Warning: could not detect language: %v\n", err)
+			return
+		}
+		language = parseLanguageCode(answer)
+	} else {
+		language = detectLanguage(text)
+	}
+	if language == "" {
+		verbosef("Language unknown for %s\n", name.Slug)
+		return
+	}
+	fmt.Printf("Detected language: %s\n", language)
+	name.Language = language
+	if config.LanguagePrefix {
+		prefix := language + wordSeparator()
+		name.Slug = prefix + fitBudget(name.Slug, len(prefix))
+	}
+}
+
+// generateFilename generates a filename using Ollama API
+func generateFilename(text string, prompt string) (GeneratedName, error) {
+	// Size the context window so the model actually sees all of the text
+	numCtx := numCtxForPrompt(prompt)
+	verbosef("Using num_ctx %d for a %d character prompt\n", numCtx, len([]rune(prompt)))
+
+	// Create the JSON payload
+	model := textModel()
+	payload := map[string]interface{}{
+		"model":   model,
+		"prompt":  prompt,
+		"stream":  false,
+		"options": ollamaOptions(map[string]interface{}{"num_ctx": numCtx}),
+	}
+
+	return generateWithRetries(payload, func(ollamaResp OllamaResponse) (GeneratedName, error) {
+		if ollamaResp.Error != "" {
+			return GeneratedName{}, fmt.Errorf("%w: %s\nPlease ensure that the %s model is installed by running:\n  ollama pull %s", errOllamaAPI, ollamaResp.Error, model, model)
+		}
+
+		if ollamaResp.Response == "" {
+			return GeneratedName{}, unusableAnswer(fmt.Errorf("error: Empty response from Ollama API\nPlease ensure that the %s model is installed and working correctly:\n  1. Check if the model is installed: ollama list\n  2. If not installed, run: ollama pull %s\n  3. If installed but not working, try: ollama rm %s && ollama pull %s", model, model, model, model))
+		}
+
+		// Clean up the response
+		name, err := newGeneratedName(ollamaResp.Response)
+		name.Model = model
+		return name, unusableAnswer(err)
+	})
+}
+
+// generateFilenameFast generates a filename using Ollama API with multiple image inputs
+func generateFilenameFast(images [][]byte, prompt string) (GeneratedName, error) {
+	fmt.Printf("Using model: %s for image-based processing\n", visionModel())
+	fmt.Printf("Extracted %d page(s) from PDF, sending all for analysis\n", len(images))
+
+	if len(images) == 0 {
+		return GeneratedName{}, fmt.Errorf("no images extracted from PDF")
+	}
+	if config.DetectDuplicatePages {
+		images = dropDuplicatePages(images)
+	}
+
+	var base64Images []string
+	for i, imgData := range images {
+		fmt.Printf("Page %d: Image size: %d bytes\n", i+1, len(imgData))
+		if hasPNGSignature(imgData) {
+			fmt.Printf("Page %d: Valid PNG signature detected\n", i+1)
+		} else {
+			fmt.Printf("Page %d: Warning - Image data does not appear to be a valid PNG\n", i+1)
+		}
+		base64Images = append(base64Images, base64.StdEncoding.EncodeToString(imgData))
+	}
+
+	// Create the JSON payload with all images
+	payload := map[string]interface{}{
+		"model":  visionModel(),
+		"prompt": prompt,
+		"stream": false,
+		"images": base64Images,
+	}
+
+	return generateWithRetries(payload, func(ollamaResp OllamaResponse) (GeneratedName, error) {
+		if ollamaResp.Error != "" {
+			return GeneratedName{}, fmt.Errorf("%w: %s", errOllamaAPI, ollamaResp.Error)
+		}
+
+		// Clean up the response
+		name, err := newGeneratedName(ollamaResp.Response)
+		name.Model = visionModel()
+		return name, unusableAnswer(err)
+	})
+}
+
+// unusableAnswerError marks a model answer that was empty or too short to use, as
+// opposed to a failed request; only these are retried with -retries
+type unusableAnswerError struct {
+	err error
+}
+
+func (e *unusableAnswerError) Error() string { return e.err.Error() }
+func (e *unusableAnswerError) Unwrap() error { return e.err }
+
+// unusableAnswer wraps err as an unusableAnswerError (nil stays nil)
+func unusableAnswer(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &unusableAnswerError{err: err}
+}
+
+// temperatureSchedule holds the parsed -temperature-schedule
+var temperatureSchedule []float64
+
+// parseTemperatureSchedule parses a comma-separated -temperature-schedule
+func parseTemperatureSchedule(value string) ([]float64, error) {
+	var schedule []float64
+	for _, field := range strings.Split(value, ",") {
+		temperature, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || temperature < 0 || temperature > 2 {
+			return nil, fmt.Errorf("-temperature-schedule entries must be numbers between 0 and 2 (got %q)", field)
+		}
+		schedule = append(schedule, temperature)
+	}
+	return schedule, nil
+}
+
+// retryTemperature returns the temperature of retry attempt (1-based); retries past the
+// end of the schedule reuse its last entry
+func retryTemperature(attempt int) float64 {
+	if len(temperatureSchedule) == 0 {
+		return 1
+	}
+	return temperatureSchedule[min(attempt, len(temperatureSchedule))-1]
+}
+
+// generateWithRetries sends payload and turns the answer into a name with parse. With
+// -retries, unusable answers are requested again at the next -temperature-schedule
+// temperature and a new seed, since the same settings tend to repeat the same answer.
+// Failed requests and other errors are returned at once.
+func generateWithRetries(payload map[string]interface{}, parse func(OllamaResponse) (GeneratedName, error)) (GeneratedName, error) {
+	var unusable *unusableAnswerError
+	for attempt := 0; ; attempt++ {
+		ollamaResp, err := callOllamaGenerate(payload)
+		if err != nil {
+			return GeneratedName{}, err
+		}
+		name, err := parse(ollamaResp)
+		if !errors.As(err, &unusable) {
+			return name, err
+		}
+		if attempt >= config.Retries {
+			return GeneratedName{}, unusable
+		}
+
+		options, _ := payload["options"].(map[string]interface{})
+		retryOptions := ollamaOptions(options)
+		retryOptions["temperature"] = retryTemperature(attempt + 1)
+		retryOptions["seed"] = rand.Intn(1 << 30)
+		payload["options"] = retryOptions
+		fmt.Printf("Unusable answer (%v), retry %d/%d at temperature %.2f\n", unusable.err, attempt+1, config.Retries, retryOptions["temperature"])
+	}
+}
+
+// getDefaultConfig returns the default configuration
+func getDefaultConfig() Config {
 	return Config{
-		AutoRename:   false,
-		CustomPrompt: defaultPrompt,
-		Model:        "qwen2.5vl:7b",   // Default to vision model
-		FastMode:     true,             // Default to vision mode
-		OutputDir:    "",               // Empty string means use the same directory as input
-		Exitor:       &DefaultExitor{}, // Default exitor implementation
+		AutoRename:            false,
+		CustomPrompt:          defaultPrompt,
+		Model:                 "qwen2.5vl:7b",                                   // Default to vision model
+		FastMode:              true,                                             // Default to vision mode
+		OutputDir:             "",                                               // Empty string means use the same directory as input
+		DPI:                   300,                                              // Full resolution render
+		ContextPages:          false,                                            // Render every page at DPI
+		FullResPages:          1,                                                // Only the first page at full resolution in context-pages mode
+		ContextDPI:            100,                                              // Low-res render for context pages
+		MinNameLength:         3,                                                // Reject single-character and empty names
+		CombineGlob:           "",                                               // Combine mode disabled
+		CombineByPrefix:       false,                                            // Merge all matches into one document
+		CombineRemoveParts:    false,                                            // Keep the parts
+		DebugImagesDir:        "",                                               // Debug image dump disabled
+		VisionSuffix:          defaultVisionSuffix,                              // Current vision instruction
+		TextIntro:             defaultTextIntro,                                 // Current text separator
+		FailFast:              false,                                            // Keep going on errors
+		Pages:                 "",                                               // First 3 pages
+		PagesMap:              "",                                               // No per-file page specs
+		EmitMetadata:          false,                                            // No metadata sidecar
+		SetTitle:              false,                                            // Leave the PDF metadata untouched
+		SamplePages:           "first",                                          // Leading pages, as before
+		SampleCount:           3,                                                // Up to 3 pages
+		SampleSeed:            0,                                                // Non-reproducible random sampling
+		Manifest:              "",                                               // No manifest
+		Resume:                false,                                            // Process everything
+		OllamaOptionsFile:     "",                                               // Ollama defaults
+		Verbose:               false,                                            // Normal output
+		MaxTextChars:          0,                                                // Send the full text
+		NumCtx:                0,                                                // Size from the text length
+		MaxNumCtx:             16384,                                            // Keep VRAM usage bounded
+		PostHook:              "",                                               // No hook
+		PostHookStrict:        false,                                            // Hook failures are only logged
+		OnCollision:           "overwrite",                                      // Replace existing files, as before
+		DedupeByName:          false,                                            // No collision report
+		MaxPageBytes:          0,                                                // Every page keeps -dpi
+		StepDownDPI:           150,                                              // Half the default resolution
+		AllowInvalidImage:     false,                                            // Strict PNG validation
+		ListMatches:           false,                                            // Process files
+		PromptExplicit:        false,                                            // Directory prompt files apply
+		CharsBudget:           64,                                               // Matches the historical 64 character limit
+		JSONLogs:              false,                                            // Human-readable output only
+		TextAlphaBits:         4,                                                // Full text antialiasing
+		GraphicsAlphaBits:     4,                                                // Full graphics antialiasing
+		FallbackPattern:       "",                                               // No pattern fallback
+		Archive:               "",                                               // Write loose files
+		InteractiveBatchEdit:  false,                                            // Per-file confirmation prompts
+		OnEmptyPage:           "skip",                                           // Drop blank pages before calling the model
+		NumSuggestions:        1,                                                // A single model call per path
+		ReadabilityScore:      0,                                                // No score gate
+		CleanText:             "",                                               // Send the OCR text unchanged
+		Classify:              false,                                            // No classification
+		Categories:            "invoices,contracts,letters,receipts,statements", // Common paperwork types
+		RouteByType:           false,                                            // All files go directly into -output
+		Lang:                  "",                                               // ocrmypdf default (English)
+		NameFrom:              "content",                                        // Always ask the model
+		QuietErrors:           false,                                            // Print errors inline as well
+		ExamplesFile:          "",                                               // No few-shot examples
+		MaxExamples:           5,                                                // Keeps the prompt bounded
+		Charset:               "ascii",                                          // Portable ASCII filenames
+		CanonicalizeUnicode:   "nfc",                                            // Precomposed characters, as most filesystems expect
+		GSTimeout:             2 * time.Minute,                                  // Generous for huge pages, stops runaway renders
+		OCRTimeout:            10 * time.Minute,                                 // OCR of long documents takes a while
+		PreviewImage:          false,                                            // No inline preview
+		SetXattr:              false,                                            // Rename files
+		XattrKey:              "user.ai-suggested-name",                         // user. namespace works without privileges on Linux
+		MinConfidence:         0,                                                // No confidence check
+		NormalizeDashes:       false,                                            // Keep the model output as is
+		RateLimit:             0,                                                // No throttling
+		DetectLanguage:        false,                                            // No language detection
+		LanguagePrefix:        false,                                            // Only record the language in the metadata
+		NoClobberSource:       true,                                             // Protect the batch inputs
+		Describe:              false,                                            // Rename documents
+		DescribePrompt:        defaultDescribePrompt,                            // Short catalog caption
+		DescribeTxt:           false,                                            // Only print the caption
+		SafeNames:             false,                                            // Regular sanitizing
+		OCRJobs:               0,                                                // Leave ocrmypdf's own default
+		TrimScannerPrefix:     false,                                            // Ignore the original name
+		ScannerPrefixes:       defaultScannerPrefixes,                           // Common device prefixes
+		ScannerPrefixesFile:   "",                                               // Use -scanner-prefixes
+		OnlyScannerNames:      false,                                            // Process every file
+		DateSubdir:            false,                                            // No date folders
+		VerifyPDF:             false,                                            // No integrity check
+		NormalizeCaseInText:   false,                                            // Send the text as extracted
+		ProgressJSON:          false,                                            // Human-readable output
+		CropTop:               0,                                                // Send whole pages
+		VisionModel:           "",                                               // Use -model
+		TextModel:             "",                                               // Use -model
+		OnFailure:             "keep",                                           // Leave failed inputs in place
+		QuarantineDir:         "",                                               // No quarantine
+		DryRun:                false,                                            // Write the renamed files
+		DryRunDiff:            false,                                            // Plain dry-run list
+		NoColor:               false,                                            // Color on terminals unless NO_COLOR is set
+		AppendPageCount:       false,                                            // No page count in the name
+		PageCountSingle:       false,                                            // Omit -p1
+		AllowSpaces:           false,                                            // Dash-separated names
+		TitleCase:             false,                                            // Keep the model's casing
+		NameLang:              "",                                               // Let the model choose
+		EscalateModel:         "",                                               // No escalation
+		ReportHTML:            "",                                               // No HTML report
+		Numbers:               "keep",                                           // Keep all digits
+		NumbersMaxDigits:      6,                                                // Long enough for most invoice numbers
+		InputJSON:             "",                                               // Files come from the arguments
+		DetectDuplicatePages:  false,                                            // Send every extracted page
+		DuplicateThreshold:    5,                                                // Tolerates scanner noise, not different content
+		ApplyMap:              "",                                               // Names come from the model
+		ReviewDir:             "",                                               // Low-confidence files just keep their name
+		FirstPageFastPath:     false,                                            // Probe for the end of the document while rendering
+		Retries:               0,                                                // Give up on the first unusable answer
+		TemperatureSchedule:   "0.6,0.9,1.2",                                    // Progressively more random
+		Keywords:              0,                                                // No keywords
+		StdinPDF:              false,                                            // Files come from the arguments
+		StdoutName:            false,                                            // Regular output
+		MaxMegapixels:         0,                                                // No pixel cap
+		Scheme:                "",                                               // Use the generated name as is
+		ValidateOnly:          false,                                            // Process files
+		Stream:                false,                                            // Wait for the complete answer
+		DedupeAgainstOutput:   false,                                            // Process inputs regardless of the output directory
+		MaxWords:              0,                                                // No word limit
+		OCROutputType:         "none",                                           // Only the sidecar text is needed for naming
+		Setup:                 false,                                            // Process files
+		AnnotatePageNumbers:   false,                                            // Send the pages unmarked
+		FailOnModelSwitch:     false,                                            // Switch to the default vision model
+		Separator:             "dash",                                           // Words-separated-by-dashes
+		Case:                  "keep",                                           // Keep the case the model chose
+		StripStopwords:        false,                                            // Keep every word
+		SanitizeProfile:       "",                                               // No preset
+		GSDeviceFallback:      "",                                               // Fail the page on the first Ghostscript error
+		Stats:                 false,                                            // No statistics
+		Yes:                   false,                                            // Ask before destructive -auto runs
+		PageTextExtract:       false,                                            // Always OCR
+		MinTextChars:          100,                                              // About a title and a sentence or two
+		UseDirContext:         false,                                            // Only the document itself is used
+		MaxRuntimePerFile:     0,                                                // No limit beyond the per-tool timeouts
+		PromptHashInCacheKey:  false,                                            // -resume goes by the source path alone
+		JSONErrors:            false,                                            // Failures are only reported as text
+		AutoMode:              false,                                            // One mode for all files
+		NormalizeInvoiceDates: false,                                            // Keep dates as the model wrote them
+		DateOrder:             "mdy",                                            // 05/01/23 is January 5
+		MaxFiles:              1000,                                             // Generous, but stops a stray /* glob
+		UseCropBox:            false,                                            // Render the full MediaBox
+		TextSampling:          "head",                                           // Keep the beginning
+		EmitThumbnail:         false,                                            // No thumbnail
+		ThumbnailWidth:        256,                                              // Enough for a file browser grid
+		ThumbnailFormat:       "jpg",                                            // Small files for photos and scans
+		GSPageRenderCache:     false,                                            // Every render calls Ghostscript
+		CollisionSuffix:       "number",                                         // name-1.pdf, name-2.pdf, ...
+		DumpRequest:           false,                                            // Requests are not printed
+		OnCollisionExplicit:   false,                                            // Overwriting is the unconfirmed default
+		Exitor:                &DefaultExitor{},                                 // Default exitor implementation
+	}
+}
+
+func isImageEmpty(imgData []byte) bool {
+	// A blank page is (nearly) uniform, whether it is white paper or an all-black
+	// render: we count "ink" pixels that differ clearly from the average brightness
+	// and call the page empty if there are almost none. Scanner noise stays below
+	// the thresholds.
+	const (
+		inkDelta    = 48.0  // Brightness difference (0-255) that counts as ink
+		maxInkRatio = 0.002 // Share of ink pixels below which the page is blank
+		maxSamples  = 250000
+	)
+
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		// If we can't decode the image, assume it's not empty
+		return false
+	}
+
+	bounds := img.Bounds()
+	totalPixels := bounds.Dx() * bounds.Dy()
+	if totalPixels == 0 {
+		return true
+	}
+
+	// Sample a grid of pixels so high-DPI renders stay fast
+	step := int(math.Sqrt(float64(totalPixels)/maxSamples)) + 1
+	var samples []float64
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			// Convert to grayscale using standard coefficients, scaled to 0-255
+			brightness := (float64(r)*0.299 + float64(g)*0.587 + float64(b)*0.114) / 257
+			samples = append(samples, brightness)
+			sum += brightness
+		}
+	}
+
+	mean := sum / float64(len(samples))
+	ink := 0
+	for _, brightness := range samples {
+		if math.Abs(brightness-mean) > inkDelta {
+			ink++
+		}
+	}
+	return float64(ink)/float64(len(samples)) < maxInkRatio
+}
+
+// cropPageTop keeps the top fraction of a rendered page for -crop-top, where titles and
+// letterheads usually are. If that part is blank, or the image can't be processed, the
+// full page is returned so the model still sees the content.
+func cropPageTop(page int, imgData []byte, fraction float64) []byte {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return imgData
+	}
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return imgData
+	}
+	bounds := img.Bounds()
+	height := int(math.Ceil(float64(bounds.Dy()) * fraction))
+	if height < 1 {
+		return imgData
+	}
+	var buf bytes.Buffer
+	cropped := sub.SubImage(image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+height))
+	if err := png.Encode(&buf, cropped); err != nil {
+		return imgData
+	}
+	if isImageEmpty(buf.Bytes()) {
+		fmt.Printf("Page %d: top %.0f%% is blank, sending the full page\n", page, fraction*100)
+		return imgData
+	}
+	verbosef("Page %d: cropped to the top %.0f%% (%d of %d rows)\n", page, fraction*100, height, bounds.Dy())
+	return buf.Bytes()
+}
+
+// annotatePageNumber draws a black-on-white "Page N" label into the top-left corner of a
+// rendered page (-image-annotate-page-numbers). The label is drawn with the 7x13 basicfont
+// face and enlarged to about 3% of the shorter side. The page is kept as is if it can't
+// be decoded or re-encoded.
+func annotatePageNumber(page int, imgData []byte) []byte {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return imgData
+	}
+	bounds := img.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), img, bounds.Min, draw.Src)
+
+	label := fmt.Sprintf("Page %d", page)
+	face := basicfont.Face7x13
+	const padding = 2
+	text := image.NewRGBA(image.Rect(0, 0, font.MeasureString(face, label).Ceil()+2*padding, face.Height+2*padding))
+	draw.Draw(text, text.Bounds(), image.White, image.Point{}, draw.Src)
+	drawer := &font.Drawer{Dst: text, Src: image.Black, Face: face, Dot: fixed.P(padding, padding+face.Ascent)}
+	drawer.DrawString(label)
+
+	// Enlarge the label pixel by pixel, so it stays crisp
+	scale := max(1, min(bounds.Dx(), bounds.Dy())*3/100/text.Bounds().Dy())
+	for y := range text.Bounds().Dy() {
+		for x := range text.Bounds().Dx() {
+			cell := image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale)
+			draw.Draw(canvas, cell, image.NewUniform(text.At(x, y)), image.Point{}, draw.Src)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return imgData
+	}
+	verbosef("Page %d: labeled with its page number\n", page)
+	return buf.Bytes()
+}
+
+// pageHash computes a 64-bit difference hash of a page image: the image is reduced to 9x8
+// grayscale cells and each bit tells whether a cell is brighter than its right neighbour.
+// It ignores resolution and small scanner noise, so re-scans of the same page hash alike.
+func pageHash(imgData []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return 0, err
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w < 9 || h < 8 {
+		return 0, fmt.Errorf("image too small to hash (%dx%d)", w, h)
+	}
+	var cells [8][9]float64
+	for cy := range 8 {
+		y0, y1 := cy*h/8, (cy+1)*h/8
+		for cx := range 9 {
+			x0, x1 := cx*w/9, (cx+1)*w/9
+			var sum, n float64
+			for y := y0; y < y1; y += max(1, (y1-y0)/16) {
+				for x := x0; x < x1; x += max(1, (x1-x0)/16) {
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+			cells[cy][cx] = sum / n
+		}
+	}
+	var hash uint64
+	for cy := range 8 {
+		for cx := range 8 {
+			hash <<= 1
+			if cells[cy][cx] > cells[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// dropDuplicatePages removes page images whose pageHash is within -duplicate-threshold
+// bits of an earlier page, e.g. a fax cover repeated on every sheet. The first page is
+// always kept; images that can't be hashed are kept too.
+func dropDuplicatePages(images [][]byte) [][]byte {
+	var hashes []uint64
+	var dropped []string
+	kept := images[:0:0]
+	for i, imgData := range images {
+		hash, err := pageHash(imgData)
+		if err != nil {
+			verbosef("Page %d: could not hash for duplicate detection: %v\n", i+1, err)
+			kept = append(kept, imgData)
+			continue
+		}
+		duplicate := false
+		for _, earlier := range hashes {
+			if bits.OnesCount64(hash^earlier) <= config.DuplicateThreshold {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			dropped = append(dropped, strconv.Itoa(i+1))
+			continue
+		}
+		hashes = append(hashes, hash)
+		kept = append(kept, imgData)
+	}
+	if len(dropped) > 0 {
+		fmt.Printf("Page(s) %s dropped as near-duplicates of earlier pages (-detect-duplicate-pages)\n", strings.Join(dropped, ", "))
+	}
+	return kept
+}
+
+// errAllPagesEmpty is returned with -on-empty-page error when every extracted page is
+// blank; it is a hard error that skips the OCR fallback
+var errAllPagesEmpty = fmt.Errorf("error: all extracted pages are blank (-on-empty-page error)")
+
+// applyEmptyPagePolicy applies -on-empty-page to the extracted images; pages lists the
+// page number of each image for reporting
+func applyEmptyPagePolicy(pages []int, images [][]byte) ([][]byte, error) {
+	var blank []string
+	var kept [][]byte
+	for i, imgData := range images {
+		if isImageEmpty(imgData) {
+			blank = append(blank, strconv.Itoa(pages[i]))
+			if config.OnEmptyPage == "skip" {
+				continue
+			}
+		}
+		kept = append(kept, imgData)
+	}
+	if len(blank) == 0 {
+		return images, nil
+	}
+
+	switch config.OnEmptyPage {
+	case "skip":
+		fmt.Printf("Blank page(s) %s skipped (-on-empty-page skip)\n", strings.Join(blank, ", "))
+	case "error":
+		if len(blank) == len(images) {
+			return nil, errAllPagesEmpty
+		}
+		fmt.Printf("Blank page(s) %s included; not all pages are blank (-on-empty-page error)\n", strings.Join(blank, ", "))
+	default:
+		fmt.Printf("Blank page(s) %s included (-on-empty-page include)\n", strings.Join(blank, ", "))
+	}
+	return kept, nil
+}
+
+// Collision resolutions reported by writeOutputFile
+const (
+	resolutionNone        = ""            // Target did not exist
+	resolutionOverwritten = "overwritten" // Existing target replaced
+	resolutionSuffixed    = "suffixed"    // Written under a suffixed name
+	resolutionSkipped     = "skipped"     // Nothing written, original name kept
+)
+
+// suffixedPath returns the first "name-N.ext" variant of path that doesn't exist yet,
+// joined with the -separator character
+func suffixedPath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s%s%d%s", base, wordSeparator(), i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// contentToken returns the first 8 hex digits of the SHA-256 of srcPath for
+// -collision-suffix hash, and "" in number mode or if the file can't be read
+func contentToken(srcPath string) string {
+	if config.CollisionSuffix != "hash" {
+		return ""
+	}
+	hash, err := fileHash(srcPath)
+	if err != nil {
+		verbosef("Could not hash %s, falling back to a numbered name: %v\n", srcPath, err)
+		return ""
+	}
+	return hash[:8]
+}
+
+// collisionPath returns the name a colliding output is written under. With
+// -collision-suffix hash that is "name-<hash>.ext", which stays the same across runs for
+// the same content; only if it exists too (the same document written twice) is it
+// numbered. Otherwise it's the first free "name-N.ext".
+func collisionPath(path, srcPath string) string {
+	token := contentToken(srcPath)
+	if token == "" {
+		return suffixedPath(path)
+	}
+	ext := filepath.Ext(path)
+	candidate := strings.TrimSuffix(path, ext) + wordSeparator() + token + ext
+	if _, err := os.Stat(candidate); os.IsNotExist(err) {
+		return candidate
+	}
+	return suffixedPath(candidate)
+}
+
+// archiveWriter collects renamed files as entries of a single zip or tar archive (-archive)
+type archiveWriter struct {
+	path    string
+	file    *os.File
+	zw      *zip.Writer
+	tw      *tar.Writer
+	gz      *gzip.Writer
+	entries map[string]bool
+}
+
+// outputArchive is the archive of the current run (nil when writing loose files)
+var outputArchive *archiveWriter
+
+// openArchive creates the archive at path; the format follows the extension
+// (.zip, .tar, .tar.gz or .tgz).
+func openArchive(path string) (*archiveWriter, error) {
+	lower := strings.ToLower(path)
+	isZip := strings.HasSuffix(lower, ".zip")
+	isTarGz := strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz")
+	if !isZip && !isTarGz && !strings.HasSuffix(lower, ".tar") {
+		return nil, fmt.Errorf("unsupported archive type %q (use .zip, .tar, .tar.gz or .tgz)", path)
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating archive directory: %v", err)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive: %v", err)
+	}
+	a := &archiveWriter{path: path, file: f, entries: make(map[string]bool)}
+	switch {
+	case isZip:
+		a.zw = zip.NewWriter(f)
+	case isTarGz:
+		a.gz = gzip.NewWriter(f)
+		a.tw = tar.NewWriter(a.gz)
+	default:
+		a.tw = tar.NewWriter(f)
+	}
+	return a, nil
+}
+
+// add stores srcPath as <newName>.pdf. Entries cannot be replaced once written, so a
+// duplicate name is suffixed unless -on-collision skip is set. It returns the output as
+// "<archive>:<entry>" (empty if skipped) and how a collision was resolved.
+func (a *archiveWriter) add(srcPath, newName string) (string, string, error) {
+	entry := newName + ".pdf"
+	resolution := resolutionNone
+	if a.entries[entry] {
+		if config.OnCollision == "skip" {
+			fmt.Printf("Skipping: %s already exists in %s (-on-collision skip)\n", entry, a.path)
+			return "", resolutionSkipped, nil
+		}
+		base := newName
+		if token := contentToken(srcPath); token != "" {
+			base = newName + wordSeparator() + token
+			entry = base + ".pdf"
+		}
+		for i := 1; a.entries[entry]; i++ {
+			entry = fmt.Sprintf("%s%s%d.pdf", base, wordSeparator(), i)
+		}
+		resolution = resolutionSuffixed
+	}
+
+	srcData, err := os.ReadFile(srcPath)
+	if err != nil {
+		return "", resolution, fmt.Errorf("error reading source file: %v", err)
+	}
+	now := time.Now()
+	if a.zw != nil {
+		w, err := a.zw.CreateHeader(&zip.FileHeader{Name: entry, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			_, err = w.Write(srcData)
+		}
+		if err != nil {
+			return "", resolution, fmt.Errorf("error writing archive entry: %v", err)
+		}
+	} else {
+		header := &tar.Header{Name: entry, Mode: 0644, Size: int64(len(srcData)), ModTime: now}
+		if err := a.tw.WriteHeader(header); err != nil {
+			return "", resolution, fmt.Errorf("error writing archive entry: %v", err)
+		}
+		if _, err := a.tw.Write(srcData); err != nil {
+			return "", resolution, fmt.Errorf("error writing archive entry: %v", err)
+		}
+	}
+	a.entries[entry] = true
+
+	outputPath := a.path + ":" + entry
+	fmt.Printf("Added renamed file to archive: %s\n", outputPath)
+	return outputPath, resolution, nil
+}
+
+// close finalizes the archive; it must be called once at the end of the run
+func (a *archiveWriter) close() error {
+	var err error
+	if a.zw != nil {
+		err = a.zw.Close()
+	} else {
+		err = a.tw.Close()
+		if a.gz != nil {
+			if gzErr := a.gz.Close(); err == nil {
+				err = gzErr
+			}
+		}
+	}
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error finalizing archive %s: %v", a.path, err)
+	}
+	return nil
+}
+
+// plannedOutputPath is where writeOutputFile puts newName before resolving collisions:
+// inside -output (and subdir) if given, the current directory otherwise
+func plannedOutputPath(newName, subdir string) string {
+	outputName := newName + ".pdf"
+	if config.OutputDir == "" {
+		return outputName
+	}
+	return filepath.Join(config.OutputDir, subdir, outputName)
+}
+
+// writeOutputFile copies srcPath to the output directory with the given newName, inside
+// subdir of it when subdir is not empty (-route-by-type). It returns the output path
+// (empty if skipped) and how a collision with an existing file was resolved.
+func writeOutputFile(srcPath, newName, subdir string) (string, string, error) {
+	if outputArchive != nil {
+		if subdir != "" {
+			newName = subdir + "/" + newName
+		}
+		return outputArchive.add(srcPath, newName)
+	}
+
+	outputPath := plannedOutputPath(newName, subdir)
+	if config.OutputDir != "" {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return "", resolutionNone, fmt.Errorf("error creating output directory: %v", err)
+		}
+	}
+
+	// Resolve collisions with existing files
+	resolution := resolutionNone
+	if _, err := os.Stat(outputPath); err == nil {
+		switch config.OnCollision {
+		case "skip":
+			fmt.Printf("Skipping: %s already exists (-on-collision skip)\n", outputPath)
+			return "", resolutionSkipped, nil
+		case "suffix":
+			outputPath = collisionPath(outputPath, srcPath)
+			resolution = resolutionSuffixed
+		default:
+			resolution = resolutionOverwritten
+		}
+	}
+
+	if err := checkClobberSource(srcPath, outputPath); err != nil {
+		return "", resolution, err
+	}
+
+	// Read the source file
+	srcData, err := os.ReadFile(srcPath)
+	if err != nil {
+		return "", resolution, fmt.Errorf("error reading source file: %v", err)
+	}
+	// Write to the new location
+	if err := os.WriteFile(outputPath, srcData, 0644); err != nil {
+		return "", resolution, fmt.Errorf("error writing file: %v", err)
+	}
+	fmt.Printf("Renamed (saved) file to: %s\n", outputPath)
+	return outputPath, resolution, nil
+}
+
+// absPathSet returns the absolute paths of files as a set
+func absPathSet(files []string) map[string]bool {
+	set := make(map[string]bool, len(files))
+	for _, file := range files {
+		if abs, err := filepath.Abs(file); err == nil {
+			set[abs] = true
+		}
+	}
+	return set
+}
+
+// checkClobberSource refuses an output path that is another input of the batch. With
+// -on-collision overwrite, one file's new name could otherwise destroy an input that is
+// still waiting to be processed. Writing a file onto itself is allowed.
+func checkClobberSource(srcPath, outputPath string) error {
+	if !config.NoClobberSource {
+		return nil
+	}
+	target, err := filepath.Abs(outputPath)
+	if err != nil {
+		return nil
+	}
+	if source, err := filepath.Abs(srcPath); err == nil && source == target {
+		return nil
+	}
+	if batch.sources[target] {
+		return fmt.Errorf("refusing to write %s: it is an input file of this batch (use -on-collision suffix, a different -output or -no-clobber-source=false)", outputPath)
+	}
+	return nil
+}
+
+// unknownDateDir receives documents without a determinable date (-date-subdir)
+const unknownDateDir = "unknown-date"
+
+// nameDatePattern finds a year and month (optionally a day) in a name, e.g. 2024-03-11,
+// 20240311 or 2024_03, not embedded in a longer number
+var nameDatePattern = regexp.MustCompile(`(?:^|\D)((?:19|20)\d{2})[-_.]?(0[1-9]|1[0-2])(?:[-_.]?(?:0[1-9]|[12]\d|3[01]))?(?:\D|$)`)
+
+// dateInName returns the year and month of the first date in s
+func dateInName(s string) (year, month string, ok bool) {
+	m := nameDatePattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// parsePDFDate returns the year and month of a PDF date string such as
+// "D:20240311093000+01'00'"
+func parsePDFDate(value string) (year, month string, ok bool) {
+	m := regexp.MustCompile(`^(?:D:)?((?:19|20)\d{2})(0[1-9]|1[0-2])`).FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// dateSubdir returns the YYYY/MM folder for -date-subdir. The document date is taken
+// from the generated name, then the original filename, then the PDF's /CreationDate, and
+// finally the file's modification time; unknownDateDir if none of them is available.
+func dateSubdir(pdfFile string, name GeneratedName) string {
+	if year, month, ok := documentDate(pdfFile, name); ok {
+		return year + "/" + month
+	}
+	return unknownDateDir
+}
+
+// documentDate returns the year and month of a document, looked up as described for
+// dateSubdir
+func documentDate(pdfFile string, name GeneratedName) (year, month string, ok bool) {
+	if year, month, ok := dateInName(name.Slug); ok {
+		return year, month, true
+	}
+	if year, month, ok := dateInName(filepath.Base(pdfFile)); ok {
+		return year, month, true
+	}
+	if created, err := readPDFInfo(pdfFile, "CreationDate"); err == nil {
+		if year, month, ok := parsePDFDate(created); ok {
+			return year, month, true
+		}
+	}
+	if info, err := os.Stat(pdfFile); err == nil {
+		return info.ModTime().Format("2006"), info.ModTime().Format("01"), true
+	}
+	return "", "", false
+}
+
+// DocumentMetadata describes a renamed document; it is written next to the output with -emit-metadata
+type DocumentMetadata struct {
+	Source   string   `json:"source"`
+	Output   string   `json:"output"`
+	Title    string   `json:"title"`
+	Filename string   `json:"filename"`
+	Mode     string   `json:"mode"`
+	Category string   `json:"category,omitempty"`
+	Language string   `json:"language,omitempty"`
+	Keywords []string `json:"keywords,omitempty"`
+}
+
+// emitMetadata writes the metadata sidecar <output>.json next to the written PDF
+func emitMetadata(pdfFile, outputPath string, name GeneratedName, mode string) error {
+	metadata := DocumentMetadata{
+		Source:   pdfFile,
+		Output:   outputPath,
+		Title:    name.Readable,
+		Filename: filepath.Base(outputPath),
+		Mode:     mode,
+		Category: name.Category,
+		Language: name.Language,
+		Keywords: name.Keywords,
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding metadata: %v", err)
+	}
+	metadataPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".json"
+	if err := os.WriteFile(metadataPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing metadata: %v", err)
+	}
+	fmt.Printf("Metadata written to: %s\n", metadataPath)
+	return nil
+}
+
+// firstPageImage is the rendering of page 1 of the current file in vision mode, kept
+// for -emit-thumbnail
+var firstPageImage []byte
+
+// thumbnailDPI renders page 1 for -emit-thumbnail when vision mode didn't
+const thumbnailDPI = 72
+
+// emitThumbnail writes a -thumbnail-width wide image of page 1 next to the written PDF as
+// <output>.thumb.jpg (or .png). It reuses the page rendered for the vision model and
+// only renders page 1 itself in OCR mode or when page 1 was not among the pages sent.
+func emitThumbnail(outputPath string) error {
+	imgData := firstPageImage
+	if imgData == nil {
+		var err error
+		if imgData, err = extractPageAsPNG(outputPath, 1, thumbnailDPI); err != nil {
+			return fmt.Errorf("error rendering thumbnail: %v", err)
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		return fmt.Errorf("error decoding page for the thumbnail: %v", err)
+	}
+	thumbnail := downscaleImage(img, config.ThumbnailWidth)
+	var buf bytes.Buffer
+	if config.ThumbnailFormat == "png" {
+		err = png.Encode(&buf, thumbnail)
+	} else {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding thumbnail: %v", err)
+	}
+	thumbnailPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".thumb." + config.ThumbnailFormat
+	if err := os.WriteFile(thumbnailPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing thumbnail: %v", err)
+	}
+	fmt.Printf("Thumbnail written to: %s\n", thumbnailPath)
+	return nil
+}
+
+// pdfTextString encodes s as a PostScript hex string in UTF-16BE with BOM, the
+// PDF text string form that survives any characters the model may return.
+func pdfTextString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// setPDFTitle rewrites the PDF at path with its document Title set to title using Ghostscript
+func setPDFTitle(path, title string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".ai-pdf-renamer-title-*.pdf")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	var stderr bytes.Buffer
+	cmd := newToolCommand(config.GSTimeout, "gs",
+		"-q",                // Quiet mode (no output)
+		"-dNOPAUSE",         // No pause after page
+		"-dBATCH",           // Exit when done
+		"-sDEVICE=pdfwrite", // Write a PDF
+		"-sOutputFile="+tmpFile.Name(),
+		path,
+		"-c", "[ /Title "+pdfTextString(title)+" /DOCINFO pdfmark",
+	)
+	defer cmd.cancel()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if timeoutErr := cmd.timeoutError("gs", path); timeoutErr != nil {
+			return timeoutErr
+		}
+		return fmt.Errorf("Ghostscript error setting title: %v, stderr: %s", err, stderr.String())
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// downscaleImage shrinks img to at most maxWidth pixels wide, keeping the aspect ratio,
+// by averaging the source pixels that fall into each target pixel. Smaller images are
+// returned unchanged.
+func downscaleImage(img image.Image, maxWidth int) image.Image {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= maxWidth || maxWidth < 1 {
+		return img
+	}
+	dstW := maxWidth
+	dstH := int(math.Max(1, math.Round(float64(srcH)*float64(dstW)/float64(srcW))))
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n>>8), uint8(g/n>>8), uint8(b/n>>8), uint8(a/n>>8)
+		}
+	}
+	return dst
+}
+
+// inlineImageProtocol returns the terminal image protocol supported by the current
+// terminal ("iterm" or "kitty"), or "" if there is none or stdout is not a terminal
+func inlineImageProtocol() string {
+	if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return ""
+	}
+	return detectImageProtocol(os.Getenv)
+}
+
+// detectImageProtocol picks the image protocol from the terminal's environment variables
+func detectImageProtocol(getenv func(string) string) string {
+	switch {
+	case getenv("TERM_PROGRAM") == "iTerm.app" || getenv("TERM_PROGRAM") == "WezTerm":
+		return "iterm"
+	case getenv("KITTY_WINDOW_ID") != "" || getenv("TERM") == "xterm-kitty" || getenv("TERM_PROGRAM") == "ghostty":
+		return "kitty"
+	}
+	return ""
+}
+
+// inlineImageSequence wraps PNG data in the escape sequence of the given protocol
+func inlineImageSequence(protocol string, pngData []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(pngData)
+	if protocol == "iterm" {
+		return fmt.Sprintf("\x1b]1337;File=inline=1;size=%d;preserveAspectRatio=1:%s\a\n", len(pngData), encoded)
+	}
+	// kitty transmits the data in chunks of at most 4096 bytes
+	var b strings.Builder
+	for first := true; len(encoded) > 0; first = false {
+		chunk := encoded
+		if len(chunk) > 4096 {
+			chunk = chunk[:4096]
+		}
+		encoded = encoded[len(chunk):]
+		more := 0
+		if len(encoded) > 0 {
+			more = 1
+		}
+		if first {
+			fmt.Fprintf(&b, "\x1b_Ga=T,f=100,m=%d;%s\x1b\\", more, chunk)
+		} else {
+			fmt.Fprintf(&b, "\x1b_Gm=%d;%s\x1b\\", more, chunk)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// showPreview prints a thumbnail of page 1 of pdfFile for -preview-image. It does
+// nothing on terminals without an inline image protocol.
+func showPreview(pdfFile string) {
+	protocol := inlineImageProtocol()
+	if protocol == "" {
+		verbosef("Terminal does not support inline images, skipping preview\n")
+		return
+	}
+	imgData, err := extractPageAsPNG(pdfFile, 1, 50)
+	if err != nil {
+		verbosef("Could not render preview: %v\n", err)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(imgData))
+	if err != nil {
+		verbosef("Could not decode preview: %v\n", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, downscaleImage(img, 400)); err != nil {
+		verbosef("Could not encode preview: %v\n", err)
+		return
+	}
+	fmt.Print(inlineImageSequence(protocol, buf.Bytes()))
+}
+
+// FileResult describes how a single document was handled
+type FileResult struct {
+	Output string        // Written output path, empty if the original name was kept
+	Mode   string        // Processing path that produced the name, e.g. "vision mode"
+	Name   GeneratedName // Generated name
+	Queued bool          // Queued for -interactive-batch-edit; nothing was written yet
+
+	LowConfidence bool   // Name rated below -min-confidence; the original name was kept
+	Review        string // Copy of a low-confidence file in -review-dir
+	Description   string // Caption produced in -describe mode; nothing was renamed
+	Verified      string // -verify-pdf outcome: ok, source-invalid or output-invalid
+}
+
+// promptInput is where the confirmation prompt reads its answers from, one line each
+var promptInput = bufio.NewScanner(os.Stdin)
+
+// readConfirmation reads one answer line from promptInput. ok is false at end of input
+// (e.g. piped or closed stdin) or on a read error.
+func readConfirmation() (answer string, ok bool) {
+	if !promptInput.Scan() {
+		return confirmNo, false
+	}
+	return parseConfirmation(promptInput.Text()), true
+}
+
+// Answers to the confirmation prompt
+const (
+	confirmYes  = "yes"  // Rename this file
+	confirmNo   = "no"   // Keep the original name
+	confirmAll  = "all"  // Rename this and all remaining files without asking
+	confirmQuit = "quit" // Keep the original name and stop the batch
+)
+
+// parseConfirmation maps a line typed at the confirmation prompt to an answer. Case and
+// surrounding whitespace are ignored, an empty line (just Enter) means yes, and anything
+// unrecognized keeps the original name.
+func parseConfirmation(line string) string {
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "", "y", "yes":
+		return confirmYes
+	case "a", "all":
+		return confirmAll
+	case "q", "quit":
+		return confirmQuit
+	default:
+		return confirmNo
+	}
+}
+
+// pageCountSuffix appends "-pN" ("_pN" with -separator underscore) to slug for
+// -append-page-count, shortening the slug so the result stays within -chars-budget.
+// Single pages get no suffix unless -page-count-single is set.
+func pageCountSuffix(slug string, pages int) string {
+	if pages < 1 || (pages == 1 && !config.PageCountSingle) {
+		return slug
+	}
+	suffix := fmt.Sprintf("%sp%d", wordSeparator(), pages)
+	return fitBudget(slug, len(suffix)) + suffix
+}
+
+// withPageCount adds the page count of pdfFile to name (-append-page-count). If the
+// count can't be determined, the name is used as is.
+func withPageCount(pdfFile string, name GeneratedName) GeneratedName {
+	pages, err := getPageCount(pdfFile)
+	if err != nil {
+		fmt.Printf("Warning: could not determine page count, no -pN suffix: %v\n", err)
+		return name
+	}
+	name.Slug = pageCountSuffix(name.Slug, pages)
+	return name
+}
+
+// schemeFields lists the placeholders -scheme understands
+var schemeFields = []string{"name", "date", "type", "keywords", "original", "hash", "pages"}
+
+// namingScheme holds the parsed -scheme, nil without one
+var namingScheme *scheme
+
+// scheme is a parsed -scheme: literals[i] precedes fields[i], and the last literal
+// follows the last field
+type scheme struct {
+	literals []string
+	fields   []string
+}
+
+// uses reports whether the scheme contains the placeholder field
+func (s *scheme) uses(field string) bool {
+	return slices.Contains(s.fields, field)
+}
+
+// schemeLiteralRune reports whether r may appear between placeholders. Besides the
+// filename characters, "_" and "." are allowed as separators.
+func schemeLiteralRune(r rune) bool {
+	return r == '_' || r == '.' || allowedFilenameRune(r)
+}
+
+// parseScheme parses a -scheme like "{date}_{type}_{name}". Unknown placeholders, stray
+// braces and characters that aren't allowed in filenames are errors.
+func parseScheme(value string) (*scheme, error) {
+	s := &scheme{}
+	rest := value
+	for {
+		open := strings.IndexByte(rest, '{')
+		literal := rest
+		if open >= 0 {
+			literal = rest[:open]
+		}
+		if strings.ContainsRune(literal, '}') {
+			return nil, fmt.Errorf("-scheme %q has a \"}\" without a matching \"{\"", value)
+		}
+		for _, r := range literal {
+			if !schemeLiteralRune(r) {
+				return nil, fmt.Errorf("-scheme %q contains %q, which is not allowed in filenames", value, r)
+			}
+		}
+		s.literals = append(s.literals, literal)
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("-scheme %q has a \"{\" without a matching \"}\"", value)
+		}
+		field := rest[open+1 : open+end]
+		if !slices.Contains(schemeFields, field) {
+			return nil, fmt.Errorf("unknown placeholder {%s} in -scheme (valid: {%s})", field, strings.Join(schemeFields, "}, {"))
+		}
+		s.fields = append(s.fields, field)
+		rest = rest[open+end+1:]
+	}
+	if len(s.fields) == 0 {
+		return nil, fmt.Errorf("-scheme %q contains no placeholder", value)
+	}
+	return s, nil
+}
+
+// schemeValue returns the sanitized value of a -scheme placeholder, empty if the
+// pipeline has nothing for it (e.g. no category detected)
+func schemeValue(field, pdfFile string, name GeneratedName) string {
+	switch field {
+	case "name":
+		return name.Slug
+	case "date":
+		if year, month, ok := documentDate(pdfFile, name); ok {
+			return year + wordSeparator() + month
+		}
+	case "type":
+		return sanitizeFilename(name.Category)
+	case "keywords":
+		var words []string
+		for _, keyword := range name.Keywords {
+			if word := sanitizeFilename(keyword); word != "" {
+				words = append(words, word)
+			}
+		}
+		separator := "-"
+		if config.AllowSpaces {
+			separator = " "
+		}
+		return strings.Join(words, separator)
+	case "original":
+		return sanitizeFilename(strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile)))
+	case "hash":
+		hash, err := fileHash(pdfFile)
+		if err != nil {
+			fmt.Printf("Warning: could not hash %s for -scheme: %v\n", pdfFile, err)
+			return ""
+		}
+		return hash[:8]
+	case "pages":
+		pages, err := getPageCount(pdfFile)
+		if err != nil {
+			fmt.Printf("Warning: could not determine page count for -scheme: %v\n", err)
+			return ""
+		}
+		return strconv.Itoa(pages)
+	}
+	return ""
+}
+
+// compose builds the filename from the scheme. Empty placeholders are left out together
+// with one of their separators, so "{date}_{type}_{name}" without a type gives
+// "2024-03_Invoice" rather than "2024-03__Invoice". The result is cut to -chars-budget.
+func (s *scheme) compose(pdfFile string, name GeneratedName) string {
+	var b strings.Builder
+	b.WriteString(s.literals[0])
+	separator, written := "", false
+	for i, field := range s.fields {
+		value := schemeValue(field, pdfFile, name)
+		if value == "" {
+			continue
+		}
+		if written {
+			b.WriteString(separator)
+		}
+		b.WriteString(value)
+		written = true
+		if i+1 < len(s.fields) {
+			separator = s.literals[i+1]
+		}
+	}
+	b.WriteString(s.literals[len(s.literals)-1])
+	composed := b.String()
+	if runes := []rune(composed); config.CharsBudget > 0 && len(runes) > config.CharsBudget {
+		composed = strings.TrimRight(string(runes[:config.CharsBudget]), "-_. ")
+	}
+	return composed
+}
+
+// withScheme replaces the slug with the name composed by -scheme. If nothing usable is
+// left (every placeholder empty), the generated name is kept.
+func withScheme(pdfFile string, name GeneratedName) GeneratedName {
+	composed := namingScheme.compose(pdfFile, name)
+	if strings.Trim(composed, "-_. ") == "" {
+		fmt.Printf("Warning: -scheme produced an empty name, keeping %s\n", name.Slug)
+		return name
+	}
+	name.Slug = composed
+	return name
+}
+
+// confirmAndWrite shows the suggestion (unless auto-renaming), writes the output file on
+// confirmation and applies the optional title/metadata outputs. mode labels the path
+// that produced the name (e.g. "vision mode"). The returned result has an empty Output
+// when the original name was kept.
+func confirmAndWrite(pdfFile string, name GeneratedName, mode string) (FileResult, error) {
+	if err := budgetError(); err != nil {
+		return FileResult{}, err
+	}
+	if namingScheme != nil {
+		name = withScheme(pdfFile, name)
+	}
+	if config.AppendPageCount {
+		name = withPageCount(pdfFile, name)
+	}
+	result := FileResult{Name: name, Mode: mode}
+	if config.InteractiveBatchEdit {
+		fmt.Printf("Suggested new filename (%s): %s.pdf (queued for batch edit)\n", mode, name.Slug)
+		batch.pending = append(batch.pending, pendingRename{source: pdfFile, name: name, mode: mode})
+		result.Queued = true
+		return result, nil
+	}
+	if !config.AutoRename && !config.DryRun {
+		if config.PreviewImage {
+			showPreview(pdfFile)
+		}
+		fmt.Printf("Suggested new filename (%s): %s.pdf\n", mode, name.Slug)
+		fmt.Println("Options:")
+		fmt.Println("  y / Enter – Rename file")
+		fmt.Println("  n – Keep original name")
+		fmt.Println("  a – Rename all remaining files automatically")
+		fmt.Println("  q – Keep original name and quit")
+		answer, ok := readConfirmation()
+		if !ok {
+			// Nobody is left to answer: keep this file and don't prompt again
+			batch.quit = true
+			fmt.Printf("\nNo more input, file kept with original name (%s), stopping.\n", mode)
+			logEvent(slog.LevelInfo, pdfFile, "rename", "kept original name", "mode", mode)
+			return result, nil
+		}
+		switch answer {
+		case confirmYes:
+		case confirmAll:
+			config.AutoRename = true
+		case confirmQuit:
+			batch.quit = true
+			fmt.Printf("File kept with original name (%s), stopping.\n", mode)
+			logEvent(slog.LevelInfo, pdfFile, "rename", "kept original name", "mode", mode)
+			return result, nil
+		default:
+			fmt.Printf("File kept with original name (%s).\n", mode)
+			logEvent(slog.LevelInfo, pdfFile, "rename", "kept original name", "mode", mode)
+			return result, nil
+		}
+	}
+
+	return applyRename(pdfFile, name, mode)
+}
+
+// errXattrUnsupported is returned by setXattr when the OS or filesystem has no xattrs
+var errXattrUnsupported = errors.New("extended attributes are not supported")
+
+// tagWithXattr records the suggested name in the -xattr-key attribute of pdfFile and
+// leaves the file itself alone. Missing xattr support is only a warning.
+func tagWithXattr(pdfFile string, name GeneratedName, mode string) (FileResult, error) {
+	result := FileResult{Name: name, Mode: mode}
+	value := name.Slug + ".pdf"
+	if err := setXattr(pdfFile, config.XattrKey, value); err != nil {
+		if errors.Is(err, errXattrUnsupported) {
+			fmt.Printf("Warning: cannot tag %s: %v\n", pdfFile, err)
+			return result, nil
+		}
+		return result, fmt.Errorf("error setting %s on %s: %v", config.XattrKey, pdfFile, err)
+	}
+	fmt.Printf("Tagged %s with %s=%s\n", pdfFile, config.XattrKey, value)
+	logEvent(slog.LevelInfo, pdfFile, "rename", "tagged file", "mode", mode, "xattr", config.XattrKey, "name", value)
+	return result, nil
+}
+
+// applyRename writes the output file for a confirmed name and applies the optional
+// title/metadata outputs and the post-hook. With -set-xattr the name is only recorded
+// in an extended attribute.
+func applyRename(pdfFile string, name GeneratedName, mode string) (FileResult, error) {
+	progress.update(progressWriting, "", nil)
+	if config.DryRun {
+		return planRename(pdfFile, name, mode), nil
+	}
+	if config.SetXattr {
+		return tagWithXattr(pdfFile, name, mode)
+	}
+	result := FileResult{Name: name, Mode: mode}
+	subdir := outputSubdir(pdfFile, name)
+	outputPath, resolution, err := writeOutputFile(pdfFile, name.Slug, subdir)
+	batch.recordName(name.Slug, pdfFile, outputPath, resolution)
+	if err != nil || outputPath == "" {
+		return result, err
+	}
+	result.Output = outputPath
+	logEvent(slog.LevelInfo, pdfFile, "rename", "wrote renamed file", "mode", mode, "output", outputPath, "resolution", resolution)
+
+	if config.SetTitle && name.Readable != "" {
+		if err := setPDFTitle(outputPath, name.Readable); err != nil {
+			fmt.Printf("Warning: could not set PDF title: %v\n", err)
+		} else {
+			fmt.Printf("PDF title set to: %s\n", name.Readable)
+		}
+	}
+
+	if config.VerifyPDF {
+		if outputArchive != nil {
+			result.Verified = verifyOK // The entry is a byte copy of the verified source
+		} else if err := verifyPDF(outputPath); err != nil {
+			result.Verified = verifyOutputInvalid
+			return result, fmt.Errorf("written PDF %s failed verification: %v", outputPath, err)
+		} else {
+			result.Verified = verifyOK
+			verbosef("Verified %s\n", outputPath)
+		}
+	}
+
+	if config.EmitMetadata {
+		if err := emitMetadata(pdfFile, outputPath, name, mode); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	if config.EmitThumbnail {
+		if err := emitThumbnail(outputPath); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	if len(name.Keywords) > 0 {
+		if err := writeKeywords(outputPath, name.Keywords); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+
+	if err := runPostHook(pdfFile, result); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// outputSubdir returns the folder below -output that name is filed into by -route-by-type
+// and -date-subdir ("" for none)
+func outputSubdir(pdfFile string, name GeneratedName) string {
+	subdir := ""
+	if config.RouteByType {
+		subdir = name.Category
+		if subdir == "" {
+			subdir = unsortedCategory
+		}
+	}
+	if config.DateSubdir {
+		subdir = path.Join(subdir, dateSubdir(pdfFile, name))
+	}
+	return subdir
+}
+
+// nameOutput receives the bare names with -stdout-name (nil otherwise)
+var nameOutput io.Writer
+
+// planRename records the rename a -dry-run would make and prints it; nothing is written
+func planRename(pdfFile string, name GeneratedName, mode string) FileResult {
+	target := plannedOutputPath(name.Slug, outputSubdir(pdfFile, name))
+	if config.SetXattr {
+		target = name.Slug + ".pdf"
+	}
+	fmt.Printf("Dry run (%s): %s -> %s\n", mode, pdfFile, target)
+	if nameOutput != nil {
+		fmt.Fprintln(nameOutput, filepath.Base(target))
+	}
+	logEvent(slog.LevelInfo, pdfFile, "rename", "dry run", "mode", mode, "output", target)
+	batch.planned = append(batch.planned, plannedRename{source: pdfFile, target: target})
+	return FileResult{Name: name, Mode: mode}
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// destructiveActions lists what an -auto run configured by cfg would do to the
+// original files beyond copying them under a new name
+func destructiveActions(cfg Config) []string {
+	if !cfg.AutoRename || cfg.DryRun {
+		return nil
+	}
+	var actions []string
+	if cfg.CombineGlob != "" && cfg.CombineRemoveParts {
+		actions = append(actions, "DELETE the combined part files (-combine-remove-parts)")
+	}
+	if cfg.OnFailure == "quarantine" {
+		actions = append(actions, fmt.Sprintf("MOVE failed originals to %s (-on-failure quarantine)", cfg.QuarantineDir))
+	}
+	if cfg.OCROutputType != "none" {
+		actions = append(actions, fmt.Sprintf("REWRITE originals that need OCR in place (-ocr-output-type %s)", cfg.OCROutputType))
+	}
+	if cfg.OnCollision == "overwrite" && cfg.Archive == "" && !cfg.SetXattr && (cfg.OnCollisionExplicit || hasPDFs(cfg.OutputDir)) {
+		actions = append(actions, "REPLACE existing files that get the same name (-on-collision overwrite)")
+	}
+	return actions
+}
+
+// hasPDFs reports whether dir directly contains a PDF, i.e. an -output directory with
+// files that a new name could replace. An empty dir (no -output) has none.
+func hasPDFs(dir string) bool {
+	if dir == "" {
+		return false
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".pdf") {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmDestructive asks once at startup before an -auto run that changes originals
+// (see destructiveActions) and reports whether to go ahead. -yes skips the question;
+// without a terminal to ask on, -yes is required.
+func confirmDestructive(cfg Config, files int, interactive bool) bool {
+	actions := destructiveActions(cfg)
+	if len(actions) == 0 || cfg.Yes {
+		return true
+	}
+	if !interactive {
+		fmt.Fprintf(os.Stderr, "Error: this -auto run would %s without asking; pass -yes to confirm when not running in a terminal\n", strings.Join(actions, " and "))
+		return false
+	}
+	fmt.Printf("About to auto-rename %d file(s) and:\n", files)
+	for _, action := range actions {
+		fmt.Printf("  - %s\n", action)
+	}
+	fmt.Print("Continue? [y/N] ")
+	if promptInput.Scan() {
+		switch strings.ToLower(strings.TrimSpace(promptInput.Text())) {
+		case "y", "yes":
+			return true
+		}
+	}
+	fmt.Println("Aborted, nothing was changed.")
+	return false
+}
+
+// checkMaxFiles refuses a batch of more than -max-files inputs, which usually means a
+// pattern like /* or the wrong working directory, unless -yes confirms it
+func checkMaxFiles(cfg Config, files int) error {
+	if cfg.MaxFiles == 0 || files <= cfg.MaxFiles || cfg.Yes {
+		return nil
+	}
+	return fmt.Errorf("%d files matched, more than -max-files %d; check the patterns, or pass -yes or a higher -max-files to process them all", files, cfg.MaxFiles)
+}
+
+// useColor reports whether output may contain ANSI colors: stdout is a terminal and
+// neither -no-color nor NO_COLOR (https://no-color.org) disables them
+func useColor() bool {
+	if config.NoColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// ANSI sequences for -dry-run-diff
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiReset = "\x1b[0m"
+)
+
+// diffNames splits old and new into a common prefix, the differing middles and a common
+// suffix, rune-wise
+func diffNames(oldName, newName string) (prefix, oldMiddle, newMiddle, suffix string) {
+	o, n := []rune(oldName), []rune(newName)
+	p := 0
+	for p < len(o) && p < len(n) && o[p] == n[p] {
+		p++
+	}
+	s := 0
+	for s < len(o)-p && s < len(n)-p && o[len(o)-1-s] == n[len(n)-1-s] {
+		s++
+	}
+	return string(o[:p]), string(o[p : len(o)-s]), string(n[p : len(n)-s]), string(o[len(o)-s:])
+}
+
+// formatDryRunDiff renders the planned renames as an aligned old -> new list with the
+// changed parts highlighted (red old, green new; brackets without color). Names that
+// stay the same are listed in a separate group.
+func formatDryRunDiff(planned []plannedRename, color bool) string {
+	highlight := func(s, code string) string {
+		if s == "" {
+			return ""
+		}
+		if color {
+			return code + s + ansiReset
+		}
+		return "[" + s + "]"
+	}
+
+	var changed, unchanged []plannedRename
+	width := 0
+	for _, p := range planned {
+		if filepath.Base(p.source) == filepath.Base(p.target) {
+			unchanged = append(unchanged, p)
+			continue
+		}
+		changed = append(changed, p)
+		if w := utf8.RuneCountInString(filepath.Base(p.source)); w > width {
+			width = w
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Changed (%d):\n", len(changed))
+	for _, p := range changed {
+		oldName, newName := filepath.Base(p.source), filepath.Base(p.target)
+		prefix, oldMiddle, newMiddle, suffix := diffNames(oldName, newName)
+		padding := strings.Repeat(" ", width-utf8.RuneCountInString(oldName))
+		fmt.Fprintf(&b, "  %s%s%s%s  ->  %s%s%s\n",
+			prefix, highlight(oldMiddle, ansiRed), suffix, padding,
+			prefix, highlight(newMiddle, ansiGreen), suffix)
+	}
+	if len(unchanged) > 0 {
+		fmt.Fprintf(&b, "Unchanged (%d):\n", len(unchanged))
+		for _, p := range unchanged {
+			fmt.Fprintf(&b, "  %s\n", filepath.Base(p.source))
+		}
+	}
+	return b.String()
+}
+
+// batchEditHeader explains the format of the file opened by -interactive-batch-edit
+const batchEditHeader = `# Review the suggested names below, one "source<TAB>new-name" per line.
+# Edit a name to change it, delete a line to keep the original name.
+# Names are sanitized again after saving; lines starting with # are ignored.
+`
+
+// formatBatchEdit renders the queued suggestions for editing
+func formatBatchEdit(pending []pendingRename) string {
+	var b strings.Builder
+	b.WriteString(batchEditHeader)
+	for _, p := range pending {
+		fmt.Fprintf(&b, "%s\t%s\n", p.source, p.name.Slug)
+	}
+	return b.String()
+}
+
+// parseBatchEdit reads an edited batch file back into source -> target name. Lines
+// without a tab or with an empty target are returned as rejected; the valid lines still
+// apply.
+func parseBatchEdit(content string) (map[string]string, []string) {
+	mappings, rejected := scanNameMappings(content)
+	targets := make(map[string]string, len(mappings))
+	for _, m := range mappings {
+		targets[m.source] = m.target
+	}
+	return targets, rejected
+}
+
+// nameMapping is one "source<TAB>new-name" line of a batch edit file or -apply-map
+type nameMapping struct {
+	source string
+	target string // New name without the .pdf extension, not yet sanitized
+}
+
+// parseNameMappings reads "source<TAB>new-name" lines in file order and fails on the
+// first line that doesn't parse
+func parseNameMappings(content string) ([]nameMapping, error) {
+	mappings, rejected := scanNameMappings(content)
+	if len(rejected) > 0 {
+		return nil, errors.New(rejected[0])
+	}
+	return mappings, nil
+}
+
+// scanNameMappings reads "source<TAB>new-name" lines in file order. Blank lines and
+// lines starting with "#" are skipped; a ".pdf" extension on the name is dropped. Lines
+// without a tab or with an empty name are returned as rejected, with their line number.
+func scanNameMappings(content string) (mappings []nameMapping, rejected []string) {
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source, target, ok := strings.Cut(line, "\t")
+		target = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(target), ".pdf"))
+		if !ok || target == "" {
+			rejected = append(rejected, fmt.Sprintf("line %d: expected \"source<TAB>new-name\", got %q", i+1, line))
+			continue
+		}
+		mappings = append(mappings, nameMapping{source: source, target: target})
+	}
+	return mappings, rejected
+}
+
+// nameMap holds the source -> new name pairs of -apply-map (nil when names come from
+// the model)
+var nameMap map[string]string
+
+// loadNameMap reads an -apply-map file. Every source must exist and appear only once.
+func loadNameMap(path string) ([]nameMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading -apply-map: %v", err)
+	}
+	mappings, err := parseNameMappings(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("-apply-map %s: %v", path, err)
+	}
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("-apply-map %s lists no files", path)
+	}
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		if seen[m.source] {
+			return nil, fmt.Errorf("-apply-map %s: %s is listed more than once", path, m.source)
+		}
+		seen[m.source] = true
+		if info, err := os.Stat(m.source); err != nil {
+			return nil, fmt.Errorf("-apply-map %s: %v", path, err)
+		} else if info.IsDir() {
+			return nil, fmt.Errorf("-apply-map %s: %s is a directory", path, m.source)
+		}
+	}
+	return mappings, nil
+}
+
+// applyMappedName names pdfFile from the -apply-map entry instead of asking the model.
+// The name is sanitized like a model answer and written through the usual confirmation,
+// collision and output handling.
+func applyMappedName(pdfFile string) (FileResult, error) {
+	fmt.Printf("Processing: %s\n", pdfFile)
+	name, err := newGeneratedName(nameMap[pdfFile])
+	if err != nil {
+		return FileResult{}, err
+	}
+	return confirmAndWrite(pdfFile, name, "name map")
+}
+
+// runBatchEdit opens the queued suggestions in $EDITOR (vi if unset) and applies the
+// saved result: unchanged lines rename as suggested, edited names are sanitized again
+// and deleted lines keep the original name. Malformed lines are ignored, so their files
+// keep the original name too. If the edit itself fails, every queued file is recorded as
+// failed with the original name kept.
+func runBatchEdit() {
+	pending := batch.pending
+	batch.pending = nil
+	if len(pending) == 0 {
+		return
+	}
+	failAll := func(err error) {
+		for _, p := range pending {
+			recordResult(p.source, p.source, FileResult{Name: p.name, Mode: p.mode}, err)
+			batch.recordFailure(p.source, err)
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "ai-pdf-renamer-*.tsv")
+	if err != nil {
+		failAll(fmt.Errorf("error creating batch edit file: %v", err))
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(formatBatchEdit(pending))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		failAll(fmt.Errorf("error writing batch edit file: %v", err))
+		return
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	args, err := splitCommandLine(editor)
+	if err == nil && len(args) == 0 {
+		err = fmt.Errorf("empty command")
+	}
+	if err == nil {
+		cmd := exec.Command(args[0], append(args[1:], tmp.Name())...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err = cmd.Run()
+	}
+	if err != nil {
+		failAll(fmt.Errorf("error running editor %q: %v; original name kept", editor, err))
+		return
+	}
+
+	content, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		failAll(fmt.Errorf("error reading batch edit file: %v; original name kept", err))
+		return
+	}
+	targets, rejected := parseBatchEdit(string(content))
+	for _, problem := range rejected {
+		fmt.Printf("Ignoring batch edit %s\n", problem)
+	}
+
+	for i, p := range pending {
+		target, ok := targets[p.source]
+		var result FileResult
+		var err error
+		switch {
+		case !ok:
+			fmt.Printf("Keeping original name: %s\n", p.source)
+			result = FileResult{Name: p.name, Mode: p.mode}
+		case target == p.name.Slug:
+			result, err = applyRename(p.source, p.name, p.mode)
+		default:
+			var name GeneratedName
+			if name, err = newGeneratedName(target); err == nil {
+				result, err = applyRename(p.source, name, p.mode+", edited")
+			}
+		}
+		recordResult(p.source, p.source, result, err)
+		if err != nil && batch.recordFailure(p.source, err) {
+			// -fail-fast: the files not renamed yet keep their original names
+			for _, rest := range pending[i+1:] {
+				fmt.Printf("Keeping original name: %s\n", rest.source)
+				recordResult(rest.source, rest.source, FileResult{Name: rest.name, Mode: rest.mode}, nil)
+			}
+			break
+		}
+	}
+}
+
+// splitCommandLine splits a command line into arguments, honoring single and double
+// quotes and backslash escapes (outside single quotes) like a POSIX shell would.
+func splitCommandLine(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range command {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in command %q", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// postHookArgs builds the hook command for one rename. Placeholders are substituted per
+// argument after splitting, so file names never need shell quoting.
+func postHookArgs(hook, src, dst, mode string) ([]string, error) {
+	args, err := splitCommandLine(hook)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty post-hook command")
+	}
+	replacer := strings.NewReplacer("{src}", src, "{dst}", dst, "{mode}", mode)
+	for i, arg := range args {
+		args[i] = replacer.Replace(arg)
+	}
+	return args, nil
+}
+
+// -verify-pdf outcomes recorded in the manifest
+const (
+	verifyOK            = "ok"
+	verifySourceInvalid = "source-invalid"
+	verifyOutputInvalid = "output-invalid"
+)
+
+// verifyPDF checks that path is a structurally valid PDF. qpdf --check is used when
+// installed; otherwise Ghostscript parses the whole document and stops at the first error.
+func verifyPDF(path string) error {
+	var cmd *toolCommand
+	tool := "qpdf"
+	if _, err := exec.LookPath("qpdf"); err == nil {
+		cmd = newToolCommand(config.GSTimeout, "qpdf", "--check", path)
+	} else {
+		tool = "gs"
+		cmd = newToolCommand(config.GSTimeout, "gs",
+			"-q",                 // Quiet mode
+			"-dNODISPLAY",        // Parse only, no rendering
+			"-dBATCH",            // Exit when done
+			"-dNOPAUSE",          // No prompts between pages
+			"-dPDFSTOPONERROR",   // Fail instead of repairing silently
+			"-dPDFSTOPONWARNING", // Treat repaired damage as an error too
+			path)
+	}
+	defer cmd.cancel()
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if timeoutErr := cmd.timeoutError(tool, path); timeoutErr != nil {
+			return timeoutErr
+		}
+		return fmt.Errorf("%s reports %s is invalid: %v %s", tool, path, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// runPostHook runs the -post-hook command for a successful rename. Hooks run serially so
+// their order matches the processing order. Failures are logged and only returned with -post-hook-strict.
+func runPostHook(src string, result FileResult) error {
+	if config.PostHook == "" {
+		return nil
+	}
+	args, err := postHookArgs(config.PostHook, src, result.Output, result.Mode)
+	if err != nil {
+		return fmt.Errorf("error: invalid -post-hook: %v", err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err == nil {
+		fmt.Printf("Post-hook succeeded for %s\n", result.Output)
+		return nil
+	}
+
+	fmt.Printf("Post-hook failed for %s: %v\n", result.Output, err)
+	if config.PostHookStrict {
+		return fmt.Errorf("error: post-hook failed: %v", err)
+	}
+	return nil
+}
+
+// fallbackRule is the compiled -fallback-pattern (nil when disabled)
+var fallbackRule *patternRule
+
+// patternRule rewrites a basename with a regular expression
+type patternRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// parsePatternRule parses a 'regex=>replacement' rule. The replacement may refer to
+// capture groups as $1 or ${name}.
+func parsePatternRule(rule string) (*patternRule, error) {
+	expr, replacement, ok := strings.Cut(rule, "=>")
+	if !ok || expr == "" {
+		return nil, fmt.Errorf("expected 'regex=>replacement', got %q", rule)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %v", expr, err)
+	}
+	return &patternRule{re: re, replacement: replacement}, nil
+}
+
+// apply rewrites the basename of pdfFile (without extension). It reports false when the
+// regex does not match, so unrelated files are left alone.
+func (r *patternRule) apply(pdfFile string) (string, bool) {
+	base := strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile))
+	if !r.re.MatchString(base) {
+		return "", false
+	}
+	return r.re.ReplaceAllString(base, r.replacement), true
+}
+
+// fallbackToPattern is the last resort when the model could not name pdfFile: it derives
+// a name from the original basename via -fallback-pattern. Without a pattern, or when the
+// pattern does not match, the original error is returned unchanged. With -escalate-model
+// it first hands the failure back to processPDF for the escalation attempt.
+func fallbackToPattern(pdfFile string, cause error) (FileResult, error) {
+	if config.EscalateModel != "" && !escalating {
+		return FileResult{}, &escalationError{cause: cause}
+	}
+	if fallbackRule == nil {
+		return fallbackToOriginalName(pdfFile, cause)
+	}
+	raw, ok := fallbackRule.apply(pdfFile)
+	if !ok {
+		return fallbackToOriginalName(pdfFile, cause)
+	}
+	name, err := newGeneratedName(raw)
+	if err != nil {
+		fmt.Printf("Error in pattern fallback: %v\n", err)
+		return FileResult{}, cause
+	}
+	fmt.Printf("Model failed (%v), using -fallback-pattern name\n", cause)
+	return confirmAndWrite(pdfFile, name, "pattern fallback")
+}
+
+// fallbackToOriginalName is the last resort with -trim-scanner-prefix: the original name
+// without its scanner prefix, e.g. "Scan_Invoice_ACME.pdf" -> "Invoice_ACME". Pure
+// scanner defaults and names without a prefix keep failing with cause.
+func fallbackToOriginalName(pdfFile string, cause error) (FileResult, error) {
+	if !config.TrimScannerPrefix {
+		return FileResult{}, cause
+	}
+	base := strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile))
+	hint := originalNameHint(pdfFile)
+	if hint == "" || hint == base {
+		return FileResult{}, cause
+	}
+	name, err := newGeneratedName(hint)
+	if err != nil {
+		return FileResult{}, cause
+	}
+	fmt.Printf("Model failed (%v), using the original name without scanner prefix\n", cause)
+	return confirmAndWrite(pdfFile, name, "scanner prefix fallback")
+}
+
+// fallbackToOCR is a helper that (if fast mode fails) falls back to OCR mode (using ocrmypdf) to extract text, generate a filename, and (if confirmed) write the output file. It returns the file result (with an empty Output if the original name was kept) and an error if any.
+func fallbackToOCR(pdfFile string) (FileResult, error) {
+	fmt.Println("Falling back to OCR mode (using ocrmypdf)…")
+	text, err := extractText(pdfFile)
+	if err != nil {
+		fmt.Printf("Error in OCR fallback (extractText): %v\n", err)
+		return fallbackToPattern(pdfFile, err)
+	}
+	fmt.Printf("Extracted text length (OCR fallback): %d characters\n", len(text))
+	logEvent(slog.LevelInfo, pdfFile, "extract", "extracted text", "chars", len(text))
+	progress.update(progressGenerating, "", nil)
+	text = prepareText(text)
+	prompt := textPrompt(pdfFile, text)
+	newName, err := pickSuggestion(func() (GeneratedName, error) { return generateFilename(text, prompt) })
+	if err != nil {
+		fmt.Printf("Error in OCR fallback (generateFilename): %v\n", err)
+		return fallbackToPattern(pdfFile, err)
+	}
+	logEvent(slog.LevelInfo, pdfFile, "model", "generated filename", "mode", "OCR fallback", "name", newName.Slug)
+	if lowConfidence(pdfFile, &newName, text, nil) {
+		return FileResult{Name: newName, Mode: "OCR fallback", LowConfidence: true}, nil
+	}
+	if config.Classify {
+		newName.Category = classifyDocument(text, nil)
+	}
+	tagLanguage(&newName, text, nil)
+	collectKeywords(&newName, text, nil)
+	return confirmAndWrite(pdfFile, newName, "OCR fallback")
+}
+
+// eventLog receives structured events when -json-logs is set (nil otherwise)
+var eventLog *slog.Logger
+
+// newEventLogger returns a JSON logger whose lines carry ts, level, msg, file and phase
+func newEventLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				a.Key = "ts"
+			}
+			return a
+		},
+	}))
+}
+
+// logEvent emits a structured event for file in the given phase. It is a no-op unless
+// -json-logs is enabled, so callers don't need to check.
+func logEvent(level slog.Level, file, phase, msg string, attrs ...any) {
+	if eventLog == nil {
+		return
+	}
+	eventLog.Log(context.Background(), level, msg, append([]any{"file", file, "phase", phase}, attrs...)...)
+}
+
+// Progress states reported with -progress-json
+const (
+	progressQueued     = "queued"
+	progressExtracting = "extracting"
+	progressGenerating = "generating"
+	progressWriting    = "writing"
+	progressDone       = "done"
+	progressFailed     = "failed"
+	progressSkipped    = "skipped" // Completed in a previous run (-resume)
+)
+
+// ProgressEvent is one line of the -progress-json stream. The schema is stable: fields
+// are only ever added, and Schema is raised on incompatible changes.
+type ProgressEvent struct {
+	Schema  int     `json:"schema"`
+	File    string  `json:"file"`
+	State   string  `json:"state"`
+	Index   int     `json:"index"`   // 1-based position of the file in the batch
+	Total   int     `json:"total"`   // Number of files in the batch
+	Percent float64 `json:"percent"` // Share of the batch that is finished, 0-100
+	Output  string  `json:"output,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// progressTracker writes the -progress-json stream. A nil tracker ignores all calls, so
+// callers don't need to check whether the stream is enabled.
+type progressTracker struct {
+	w        io.Writer
+	total    int
+	finished int
+	index    int
+	file     string
+}
+
+// progress is the tracker of the current run (nil unless -progress-json)
+var progress *progressTracker
+
+// queue announces every file of the batch; archive inputs count with their PDF entries
+func (p *progressTracker) queue(files []string) {
+	if p == nil {
+		return
+	}
+	var sources []string
+	for _, file := range files {
+		if !isArchiveInput(file) {
+			sources = append(sources, file)
+			continue
+		}
+		var entries []string
+		forEachArchivePDF(file, func(name string, r io.Reader) error {
+			entries = append(entries, file+":"+name)
+			return nil
+		})
+		if len(entries) == 0 {
+			entries = []string{file} // Unreadable or empty, reported as one failure
+		}
+		sources = append(sources, entries...)
+	}
+	p.total = len(sources)
+	for i, source := range sources {
+		p.index, p.file = i+1, source
+		p.update(progressQueued, "", nil)
+	}
+	p.index, p.file = 0, ""
+}
+
+// begin makes source the file that the following updates refer to
+func (p *progressTracker) begin(source string) {
+	if p == nil {
+		return
+	}
+	p.index++
+	p.file = source
+}
+
+// update emits an event for the current file; final states count as finished
+func (p *progressTracker) update(state, output string, err error) {
+	switch state {
+	case progressExtracting, progressGenerating, progressWriting:
+		filePhase = state
+	}
+	if p == nil {
+		return
+	}
+	switch state {
+	case progressDone, progressFailed, progressSkipped:
+		p.finished++
+	}
+	total := p.total
+	if p.index > total {
+		total = p.index // More files than announced (e.g. an archive that grew)
+	}
+	event := ProgressEvent{Schema: 1, File: p.file, State: state, Index: p.index, Total: total, Output: output}
+	if total > 0 {
+		event.Percent = math.Round(float64(min(p.finished, total))*1000/float64(total)) / 10
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	data, _ := json.Marshal(event)
+	p.w.Write(append(data, '\n'))
+}
+
+// finish emits the final state of the current file
+func (p *progressTracker) finish(result FileResult, err error) {
+	if err != nil {
+		p.update(progressFailed, "", err)
+		return
+	}
+	p.update(progressDone, result.Output, nil)
+}
+
+// escalationError signals that the primary paths failed and -escalate-model should get
+// a turn before the fallbacks
+type escalationError struct {
+	cause error
+}
+
+func (e *escalationError) Error() string { return e.cause.Error() }
+func (e *escalationError) Unwrap() error { return e.cause }
+
+// escalating is set while the -escalate-model attempt runs, so its failures go on to the
+// pattern fallback instead of escalating again
+var escalating bool
+
+// processPDF names and writes a single PDF. The returned result has an empty Output
+// when the user chose to keep the original name. If vision and OCR both fail, the whole
+// pipeline runs once more with -escalate-model for the vision and text path.
+//
+// With -max-runtime-per-file, everything including the escalation shares one budget.
+// Once it is used up, running tools and requests are aborted and the file fails with a
+// "processing exceeded time budget" error.
+func processPDF(pdfFile string) (FileResult, error) {
+	if config.MaxRuntimePerFile > 0 {
+		var cancel context.CancelFunc
+		fileCtx, cancel = context.WithTimeout(context.Background(), config.MaxRuntimePerFile)
+		defer func() {
+			cancel()
+			fileCtx = context.Background()
+		}()
+	}
+	result, err := namePDF(pdfFile)
+	if budgetErr := budgetError(); err != nil && budgetErr != nil {
+		// Report the budget rather than whichever aborted step failed last
+		return result, budgetErr
+	}
+	var escalation *escalationError
+	if !errors.As(err, &escalation) {
+		return result, err
+	}
+	fmt.Printf("Vision and OCR failed (%v), retrying with escalation model %s\n", escalation.cause, config.EscalateModel)
+	logEvent(slog.LevelInfo, pdfFile, "model", "escalating", "model", config.EscalateModel, "error", escalation.cause.Error())
+	visionSaved, textSaved := config.VisionModel, config.TextModel
+	config.VisionModel, config.TextModel = config.EscalateModel, config.EscalateModel
+	escalating = true
+	defer func() {
+		config.VisionModel, config.TextModel = visionSaved, textSaved
+		escalating = false
+	}()
+	result, err = namePDF(pdfFile)
+	if budgetErr := budgetError(); err != nil && budgetErr != nil {
+		return result, budgetErr
+	}
+	return result, err
+}
+
+// useVision reports whether pdfFile goes down the vision path. With -auto-mode, files
+// whose first page has at least -min-text-chars of text layer take the text path, since
+// reading that text is cheaper than rendering pages and often gives better names.
+func useVision(pdfFile string) bool {
+	if !config.AutoMode {
+		return config.FastMode
+	}
+	text, _, err := extractTextLayer(pdfFile, 1)
+	if err != nil {
+		fmt.Printf("Auto mode: could not read the text layer (%v), using vision\n", err)
+		logEvent(slog.LevelInfo, pdfFile, "extract", "chose vision", "reason", "no text layer")
+		return true
+	}
+	chars := utf8.RuneCountInString(strings.TrimSpace(text))
+	if chars < config.MinTextChars {
+		fmt.Printf("Auto mode: page 1 has %d characters of text (scan or photo), using vision\n", chars)
+		logEvent(slog.LevelInfo, pdfFile, "extract", "chose vision", "reason", "little text", "chars", chars)
+		return true
+	}
+	fmt.Printf("Auto mode: page 1 has %d characters of text, using the text path\n", chars)
+	logEvent(slog.LevelInfo, pdfFile, "extract", "chose text path", "reason", "text layer", "chars", chars)
+	return false
+}
+
+// namePDF runs the naming pipeline for a single PDF: metadata, vision with OCR fallback
+// or OCR only, and the pattern fallbacks
+func namePDF(pdfFile string) (FileResult, error) {
+	if config.OnlyScannerNames && !isScannerDefaultName(pdfFile) {
+		fmt.Printf("Skipping (not a scanner default name): %s\n", pdfFile)
+		return FileResult{}, nil
+	}
+	fmt.Printf("Processing: %s\n", pdfFile)
+	logEvent(slog.LevelInfo, pdfFile, "start", "processing file")
+	progress.update(progressExtracting, "", nil)
+
+	if config.VerifyPDF {
+		if err := verifyPDF(pdfFile); err != nil {
+			return FileResult{Verified: verifySourceInvalid}, fmt.Errorf("%w: %v", errInvalidSource, err)
+		}
+	}
+
+	if config.NameFrom == "metadata" {
+		if name, ok := nameFromMetadata(pdfFile); ok {
+			logEvent(slog.LevelInfo, pdfFile, "model", "used PDF title", "mode", "PDF metadata", "name", name.Slug)
+			return confirmAndWrite(pdfFile, name, "PDF metadata")
+		}
+	}
+
+	if useVision(pdfFile) {
+		// Try vision-based processing first
+		images, err := extractPDFPages(pdfFile)
+		if err != nil {
+			fmt.Printf("Error (vision mode) extracting PDF pages: %v\n", err)
+			if errors.Is(err, errAllPagesEmpty) {
+				return FileResult{}, err
+			}
+			return fallbackToOCR(pdfFile)
+		}
+		logEvent(slog.LevelInfo, pdfFile, "extract", "extracted page images", "pages", len(images))
+		progress.update(progressGenerating, "", nil)
+		writeDebugImages(pdfFile, images)
+		// Use image-based processing (generateFilenameFast) with all extracted pages
+		prompt := visionPrompt(pdfFile)
+		newName, err := pickSuggestion(func() (GeneratedName, error) { return generateFilenameFast(images, prompt) })
+		if err != nil {
+			fmt.Printf("Error (vision mode) generating filename (generateFilenameFast): %v\n", err)
+			return fallbackToOCR(pdfFile)
+		}
+		logEvent(slog.LevelInfo, pdfFile, "model", "generated filename", "mode", "vision mode", "name", newName.Slug)
+		if lowConfidence(pdfFile, &newName, "", images) {
+			return FileResult{Name: newName, Mode: "vision mode", LowConfidence: true}, nil
+		}
+		if config.Classify {
+			newName.Category = classifyDocument("", images)
+		}
+		tagLanguage(&newName, "", images)
+		collectKeywords(&newName, "", images)
+		return confirmAndWrite(pdfFile, newName, "vision mode")
+	} else {
+		// OCR-only mode
+		text, err := extractText(pdfFile)
+		if err != nil {
+			fmt.Printf("Error (OCR mode) extractText: %v\n", err)
+			return fallbackToPattern(pdfFile, err)
+		}
+		fmt.Printf("Extracted text length (OCR mode): %d characters\n", len(text))
+		logEvent(slog.LevelInfo, pdfFile, "extract", "extracted text", "chars", len(text))
+		progress.update(progressGenerating, "", nil)
+		text = prepareText(text)
+		prompt := textPrompt(pdfFile, text)
+		newName, err := pickSuggestion(func() (GeneratedName, error) { return generateFilename(text, prompt) })
+		if err != nil {
+			fmt.Printf("Error (OCR mode) generateFilename: %v\n", err)
+			return fallbackToPattern(pdfFile, err)
+		}
+		logEvent(slog.LevelInfo, pdfFile, "model", "generated filename", "mode", "OCR mode", "name", newName.Slug)
+		if lowConfidence(pdfFile, &newName, text, nil) {
+			return FileResult{Name: newName, Mode: "OCR mode", LowConfidence: true}, nil
+		}
+		if config.Classify {
+			newName.Category = classifyDocument(text, nil)
+		}
+		tagLanguage(&newName, text, nil)
+		collectKeywords(&newName, text, nil)
+		return confirmAndWrite(pdfFile, newName, "OCR mode")
+	}
+}
+
+// cleanDescription turns a model answer into a single-line caption
+func cleanDescription(answer string) string {
+	answer = strings.Join(strings.Fields(answer), " ")
+	return strings.TrimSpace(strings.Trim(answer, "\"'`"))
+}
+
+// describeTextPath is the <file>.txt a -describe caption is written to, placed inside
+// -output when given and next to the source otherwise
+func describeTextPath(source string) string {
+	if config.OutputDir != "" {
+		return filepath.Join(config.OutputDir, filepath.Base(source)+".txt")
+	}
+	return source + ".txt"
+}
+
+// describePDF captions a document in -describe mode. It reuses the page image or text
+// extraction of the renaming path, but asks for a short description and renames nothing.
+// source is the name reported to the user, pdfFile the file to read.
+func describePDF(source, pdfFile string) (FileResult, error) {
+	fmt.Printf("Describing: %s\n", source)
+	logEvent(slog.LevelInfo, source, "start", "describing file")
+	progress.update(progressExtracting, "", nil)
+
+	var images [][]byte
+	var text string
+	mode := "OCR mode"
+	if useVision(pdfFile) {
+		var err error
+		images, err = extractPDFPages(pdfFile)
+		if errors.Is(err, errAllPagesEmpty) {
+			return FileResult{}, err
+		}
+		if err != nil {
+			fmt.Printf("Error (vision mode) extracting PDF pages: %v\n", err)
+			fmt.Println("Falling back to OCR mode (using ocrmypdf)…")
+			mode = "OCR fallback"
+		} else {
+			mode = "vision mode"
+		}
+	}
+	if len(images) == 0 {
+		extracted, err := extractText(pdfFile)
+		if err != nil {
+			return FileResult{}, err
+		}
+		text = prepareText(extracted)
+	}
+
+	progress.update(progressGenerating, "", nil)
+	answer, err := askAboutDocument(config.DescribePrompt, text, images)
+	if err != nil {
+		return FileResult{}, err
+	}
+	description := cleanDescription(answer)
+	if description == "" {
+		return FileResult{}, fmt.Errorf("model returned an empty description")
+	}
+	fmt.Printf("Description: %s\n", description)
+	logEvent(slog.LevelInfo, source, "model", "generated description", "mode", mode, "description", description)
+
+	if config.DescribeTxt {
+		path := describeTextPath(source)
+		if config.OutputDir != "" {
+			if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+				return FileResult{}, fmt.Errorf("error creating output directory: %v", err)
+			}
+		}
+		if err := os.WriteFile(path, []byte(description+"\n"), 0644); err != nil {
+			return FileResult{}, fmt.Errorf("error writing description: %v", err)
+		}
+		fmt.Printf("Description saved to: %s\n", path)
+	}
+	return FileResult{Mode: mode, Description: description}, nil
+}
+
+// ManifestEntry is one line of the JSON Lines manifest written with -manifest/-resume
+type ManifestEntry struct {
+	Time        string `json:"time"`
+	Source      string `json:"source"`
+	Output      string `json:"output,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	Model       string `json:"model,omitempty"`       // Model that produced the name
+	Status      string `json:"status"`                // renamed, kept, low-confidence, described or failed
+	Suggested   string `json:"suggested,omitempty"`   // Name rejected by -min-confidence, for review
+	Review      string `json:"review,omitempty"`      // Copy of the file in -review-dir
+	Description string `json:"description,omitempty"` // Caption written in -describe mode
+	Verified    string `json:"verified,omitempty"`    // -verify-pdf outcome: ok, source-invalid or output-invalid
+	Error       string `json:"error,omitempty"`
+	Usage       *Usage `json:"usage,omitempty"` // Requests and data volume for this file, with -stats
+	Key         string `json:"key,omitempty"`   // What the name was made from, with -prompt-hash-in-cache-key
+}
+
+// Usage is what processing one file cost, recorded in the manifest with -stats
+type Usage struct {
+	Requests   int   `json:"requests"`
+	ImageBytes int64 `json:"image_bytes"` // Page images sent, before base64 encoding
+	OCRChars   int   `json:"ocr_chars"`
+	OllamaMS   int64 `json:"ollama_ms"` // Time spent waiting for Ollama
+}
+
+// reportRow is one file in the -report-html page
+type reportRow struct {
+	ManifestEntry
+	NewName   string       // Name the file was given (or would get in a dry run), empty if kept
+	Thumbnail template.URL // data: URL of the page thumbnail, empty without -debug-images
+}
+
+// reportTemplate renders the -report-html page. html/template escapes every file name,
+// error and description; only the thumbnail data URLs built here are trusted.
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>ai-pdf-renamer report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.5em; text-align: left; vertical-align: top; }
+th { background: #f4f4f4; }
+td.status-failed { color: #b00020; }
+td.status-renamed { color: #1b5e20; }
+img { max-width: 160px; border: 1px solid #ccc; }
+.detail { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>ai-pdf-renamer report</h1>
+<p>{{.Generated}} &middot; {{len .Rows}} file(s)</p>
+<table>
+<tr>{{if .Thumbnails}}<th>Page</th>{{end}}<th>Source</th><th>New name</th><th>Mode</th><th>Status</th></tr>
+{{- range .Rows}}
+<tr>
+{{- if $.Thumbnails}}<td>{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="First page of {{.Source}}">{{end}}</td>{{end}}
+<td>{{.Source}}</td>
+<td>{{.NewName}}{{if .Suggested}}<div class="detail">Suggested: {{.Suggested}}</div>{{end}}{{if .Description}}<div class="detail">{{.Description}}</div>{{end}}</td>
+<td>{{.Mode}}{{if .Model}}<div class="detail">{{.Model}}</div>{{end}}</td>
+<td class="status-{{.Status}}">{{.Status}}{{if .Error}}<div class="detail">{{.Error}}</div>{{end}}</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// writeHTMLReport writes the -report-html page for rows to path
+func writeHTMLReport(path string, rows []reportRow) error {
+	data := struct {
+		Generated  string
+		Rows       []reportRow
+		Thumbnails bool
+	}{Generated: time.Now().Format("2006-01-02 15:04"), Rows: rows}
+	for _, row := range rows {
+		if row.Thumbnail != "" {
+			data.Thumbnails = true
+		}
+	}
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// manifestPath is the manifest the current run appends to (empty disables it)
+var manifestPath string
+
+// resumeDone holds the sources a previous run completed, keyed by manifestKey, with
+// the cache key recorded for each (empty for entries written without one)
+var resumeDone map[string]string
+
+// fileCacheKey is the cacheKey of the file being processed with -prompt-hash-in-cache-key
+var fileCacheKey string
+
+// cacheKey identifies what a name for pdfFile is made from: the file content, the
+// prompts, the models and the options that shape the name. With
+// -prompt-hash-in-cache-key, -resume only reuses a recorded name while it is unchanged.
+func cacheKey(pdfFile string) (string, error) {
+	content, err := fileHash(pdfFile)
+	if err != nil {
+		return "", err
+	}
+	naming := fmt.Sprintf("charset=%s canonicalize=%s spaces=%t title-case=%t numbers=%s/%d case=%s separator=%s budget=%d words=%d stopwords=%t safe=%t scheme=%s",
+		config.Charset, config.CanonicalizeUnicode, config.AllowSpaces, config.TitleCase, config.Numbers, config.NumbersMaxDigits, config.Case,
+		config.Separator, config.CharsBudget, config.MaxWords, config.StripStopwords, config.SafeNames, config.Scheme)
+	h := sha256.New()
+	for _, part := range []string{
+		content,
+		visionPrompt(pdfFile),
+		textPrompt(pdfFile, ""),
+		visionModel(),
+		textModel(),
+		strconv.FormatBool(config.FastMode),
+		strconv.FormatBool(config.AutoMode),
+		naming,
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// defaultManifestName is used inside -output when -resume is given without -manifest
+const defaultManifestName = ".ai-pdf-renamer-manifest.jsonl"
+
+// manifestKey identifies a source across runs independent of the working directory
+func manifestKey(source string) string {
+	if abs, err := filepath.Abs(source); err == nil {
+		return abs
+	}
+	return source
+}
+
+// newManifestEntry describes the outcome for source as a manifest entry
+func newManifestEntry(source string, result FileResult, procErr error) ManifestEntry {
+	entry := ManifestEntry{
+		Time:     time.Now().Format(time.RFC3339),
+		Source:   source,
+		Output:   result.Output,
+		Mode:     result.Mode,
+		Model:    result.Name.Model,
+		Status:   "kept",
+		Verified: result.Verified,
+		Key:      fileCacheKey,
+	}
+	if config.Stats {
+		entry.Usage = &Usage{
+			Requests:   fileUsage.requests,
+			ImageBytes: fileUsage.imageBytes,
+			OCRChars:   fileUsage.ocrChars,
+			OllamaMS:   fileUsage.elapsed.Milliseconds(),
+		}
+	}
+	switch {
+	case procErr != nil:
+		entry.Status = "failed"
+		entry.Error = procErr.Error()
+	case result.Output != "":
+		entry.Status = "renamed"
+	case result.LowConfidence:
+		entry.Status = "low-confidence"
+		entry.Suggested = result.Name.Slug + ".pdf"
+		entry.Review = result.Review
+	case result.Description != "":
+		entry.Status = "described"
+		entry.Description = result.Description
+	}
+	return entry
+}
+
+// recordResult records the outcome for source in the manifest and, with -report-html,
+// for the report. pdfFile is the file that was read, which differs from source for
+// archive entries and combined scans.
+func recordResult(source, pdfFile string, result FileResult, procErr error) {
+	recordManifest(source, result, procErr)
+	if config.ReportHTML == "" {
+		return
+	}
+	row := reportRow{ManifestEntry: newManifestEntry(source, result, procErr)}
+	switch {
+	case result.Output != "":
+		row.NewName = filepath.Base(result.Output)
+	case config.DryRun && procErr == nil && result.Name.Slug != "":
+		row.Status = "planned"
+		row.NewName = result.Name.Slug + ".pdf"
+	}
+	if thumbnail, ok := batch.thumbnails[pdfFile]; ok {
+		row.Thumbnail = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(thumbnail))
+		delete(batch.thumbnails, pdfFile)
+	}
+	batch.report = append(batch.report, row)
+}
+
+// recordManifest appends the outcome for source to the manifest. The file is opened
+// per entry so that an interrupted run still leaves a usable manifest behind.
+func recordManifest(source string, result FileResult, procErr error) {
+	if manifestPath == "" || config.DryRun {
+		return
+	}
+
+	data, err := json.Marshal(newManifestEntry(manifestKey(source), result, procErr))
+	if err != nil {
+		fmt.Printf("Warning: could not encode manifest entry: %v\n", err)
+		return
+	}
+	f, err := os.OpenFile(manifestPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("Warning: could not open manifest: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		fmt.Printf("Warning: could not write manifest: %v\n", err)
+	}
+}
+
+// loadResumeSet reads a previous manifest and returns the sources that were renamed
+// and whose output still exists. A missing manifest simply means nothing to resume.
+func loadResumeSet(path string) (map[string]string, error) {
+	done := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("error parsing manifest line %d: %v", i+1, err)
+		}
+		if entry.Status != "renamed" {
+			continue
+		}
+		if _, err := os.Stat(entry.Output); err == nil {
+			done[entry.Source] = entry.Key
+		}
+	}
+	return done, nil
+}
+
+// partSuffixPattern matches the running part number scanners append to split documents
+var partSuffixPattern = regexp.MustCompile(`[-_ ]*\d+$`)
+
+// combineGroupKey returns the shared prefix of a multi-part scan, so that
+// "scan_001.pdf" and "scan_010.pdf" in the same directory map to the same group.
+func combineGroupKey(pdfFile string) string {
+	base := strings.TrimSuffix(filepath.Base(pdfFile), filepath.Ext(pdfFile))
+	return filepath.Join(filepath.Dir(pdfFile), partSuffixPattern.ReplaceAllString(base, ""))
+}
+
+// groupCombineParts splits the (sorted) parts into the groups that get merged.
+// Without byPrefix every part belongs to a single group.
+func groupCombineParts(parts []string, byPrefix bool) [][]string {
+	if len(parts) == 0 {
+		return nil
+	}
+	if !byPrefix {
+		return [][]string{parts}
+	}
+
+	var keys []string
+	groups := make(map[string][]string)
+	for _, part := range parts {
+		key := combineGroupKey(part)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], part)
+	}
+
+	result := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, groups[key])
+	}
+	return result
+}
+
+// mergePDFs merges the given parts (in order) into a temporary PDF using Ghostscript and returns its path
+func mergePDFs(parts []string) (string, error) {
+	tmpFile, err := os.CreateTemp("", "ai-pdf-renamer-combined-*.pdf")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tmpFile.Close()
+
+	args := []string{
+		"-q",                // Quiet mode (no output)
+		"-dNOPAUSE",         // No pause after page
+		"-dBATCH",           // Exit when done
+		"-sDEVICE=pdfwrite", // Write a PDF
+		"-sOutputFile=" + tmpFile.Name(),
+	}
+	args = append(args, parts...)
+
+	var stderr bytes.Buffer
+	cmd := newToolCommand(config.GSTimeout, "gs", args...)
+	defer cmd.cancel()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpFile.Name())
+		if timeoutErr := cmd.timeoutError("gs", strings.Join(parts, ", ")); timeoutErr != nil {
+			return "", timeoutErr
+		}
+		return "", fmt.Errorf("Ghostscript merge error: %v, stderr: %s", err, stderr.String())
+	}
+
+	return tmpFile.Name(), nil
+}
+
+// processCombined merges the PDFs matching pattern into combined documents and names each of them
+func processCombined(pattern string) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		fmt.Printf("Error processing combine pattern %s: %v\n", pattern, err)
+		return
+	}
+
+	var parts []string
+	for _, match := range matches {
+		if !strings.HasSuffix(strings.ToLower(match), ".pdf") {
+			fmt.Printf("Skipping non-PDF file: %s\n", match)
+			continue
+		}
+		parts = append(parts, match)
+	}
+	if len(parts) == 0 {
+		fmt.Printf("No PDF files match combine pattern %s\n", pattern)
+		return
+	}
+
+	for _, group := range groupCombineParts(parts, config.CombineByPrefix) {
+		if batch.aborted || batch.quit {
+			return
+		}
+		batch.processed++
+		fmt.Printf("Combining %d part(s): %s\n", len(group), strings.Join(group, ", "))
+		merged, err := mergePDFs(group)
+		if err != nil {
+			batch.recordFailure(strings.Join(group, ","), fmt.Errorf("combining parts: %v", err))
+			continue
+		}
+
+		result, err := processPDF(merged)
+		os.Remove(merged)
+		recordResult(strings.Join(group, ","), merged, result, err)
+		if err != nil {
+			batch.recordFailure(strings.Join(group, ","), err)
+			continue
+		}
+
+		if result.Output != "" && config.CombineRemoveParts {
+			for _, part := range group {
+				if err := os.Remove(part); err != nil {
+					fmt.Printf("Error removing part %s: %v\n", part, err)
+					continue
+				}
+				fmt.Printf("Removed part: %s\n", part)
+			}
+		}
+	}
+}
+
+// processInput processes one input file, unpacking archives into their PDF entries
+func processInput(pdfFile string) {
+	if isArchiveInput(pdfFile) {
+		if err := processArchiveInput(pdfFile); err != nil {
+			batch.processed++
+			batch.recordFailure(pdfFile, err)
+			progress.begin(pdfFile)
+			progress.finish(FileResult{}, err)
+		}
+		return
+	}
+	processSource(pdfFile, pdfFile)
+}
+
+// stdinSource is how a PDF read with -stdin-pdf is reported and recorded
+const stdinSource = "stdin"
+
+// processStdinPDF processes a PDF read from r (-stdin-pdf). Ghostscript and ocrmypdf
+// need a real file, so the data is spooled to a temporary stdin.pdf that is removed
+// afterwards; the output, if any, is written to -output or the current directory.
+func processStdinPDF(r io.Reader) error {
+	dir, err := os.MkdirTemp("", "ai-pdf-renamer-stdin-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pdfFile := filepath.Join(dir, "stdin.pdf")
+	out, err := os.Create(pdfFile)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	n, err := io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error reading PDF from stdin: %v", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no PDF data on stdin")
+	}
+	processSource(stdinSource, pdfFile)
+	return nil
+}
+
+// JobEntry is one file of an -input-json batch spec. Empty fields fall back to the
+// global options; model overrides both the vision and the text model.
+type JobEntry struct {
+	Path   string `json:"path"`
+	Prompt string `json:"prompt,omitempty"`
+	Model  string `json:"model,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+// jobEntries holds the files loaded from -input-json
+var jobEntries []JobEntry
+
+// loadJobSpec reads and validates an -input-json batch spec: a JSON array of entries
+// with known fields only, each naming an existing file
+func loadJobSpec(path string) ([]JobEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading -input-json: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var entries []JobEntry
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid -input-json %s: %v", path, err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("invalid -input-json %s: unexpected data after the list of entries", path)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("-input-json %s lists no files", path)
+	}
+	for i, entry := range entries {
+		if strings.TrimSpace(entry.Path) == "" {
+			return nil, fmt.Errorf("-input-json entry %d: missing path", i+1)
+		}
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("-input-json entry %d: %v", i+1, err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("-input-json entry %d: %s is a directory", i+1, entry.Path)
+		}
+		if entry.Output != "" {
+			entries[i].Output = filepath.Clean(entry.Output)
+		}
+	}
+	return entries, nil
+}
+
+// jobPaths lists the paths of the -input-json entries
+func jobPaths(entries []JobEntry) []string {
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = entry.Path
+	}
+	return paths
+}
+
+// jobModels lists the models the -input-json entries override -model with
+func jobModels(entries []JobEntry) []string {
+	var models []string
+	for _, entry := range entries {
+		if entry.Model != "" && !slices.Contains(models, entry.Model) {
+			models = append(models, entry.Model)
+		}
+	}
+	return models
+}
+
+// processJobEntry processes one -input-json entry with its overrides layered over the
+// global options, which are restored afterwards
+func processJobEntry(entry JobEntry) {
+	prompt, explicit := config.CustomPrompt, config.PromptExplicit
+	vision, text, output := config.VisionModel, config.TextModel, config.OutputDir
+	defer func() {
+		config.CustomPrompt, config.PromptExplicit = prompt, explicit
+		config.VisionModel, config.TextModel, config.OutputDir = vision, text, output
+	}()
+	if entry.Prompt != "" {
+		config.CustomPrompt, config.PromptExplicit = entry.Prompt, true
+	}
+	if entry.Model != "" {
+		config.VisionModel, config.TextModel = entry.Model, entry.Model
+	}
+	if entry.Output != "" {
+		config.OutputDir = entry.Output
+	}
+	processInput(entry.Path)
+}
+
+// outputHashes maps the SHA-256 of every PDF in the output directory to its path
+// (-dedupe-against-output), nil without the flag
+var outputHashes map[string]string
+
+// fileHash returns the hex SHA-256 of a file's content
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashPDFs hashes every PDF below dir, including the -date-subdir and -route-by-type
+// folders. A directory that doesn't exist yet has no PDFs.
+func hashPDFs(dir string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".pdf") {
+			return nil
+		}
+		hash, err := fileHash(path)
+		if err != nil {
+			return err
+		}
+		if _, ok := hashes[hash]; !ok {
+			hashes[hash] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error indexing output directory for -dedupe-against-output: %v", err)
+	}
+	return hashes, nil
+}
+
+// processSource names and writes pdfFile, recording the outcome under source (which
+// differs from pdfFile for archive entries). It returns whether the batch should stop.
+func processSource(source, pdfFile string) bool {
+	progress.begin(source)
+	filePhase = "start"
+	fileCacheKey = ""
+	if config.PromptHashInCacheKey {
+		var err error
+		if fileCacheKey, err = cacheKey(pdfFile); err != nil {
+			fmt.Printf("Warning: could not hash %s for -prompt-hash-in-cache-key: %v\n", source, err)
+		}
+	}
+	if key, ok := resumeDone[manifestKey(source)]; ok {
+		if !config.PromptHashInCacheKey || (key != "" && key == fileCacheKey) {
+			fmt.Printf("Skipping (completed in a previous run): %s\n", source)
+			batch.resumed++
+			progress.update(progressSkipped, "", nil)
+			return false
+		}
+		fmt.Printf("Reprocessing (content, prompt, model or naming options changed since the previous run): %s\n", source)
+	}
+	var hash string
+	if outputHashes != nil {
+		var err error
+		if hash, err = fileHash(pdfFile); err != nil {
+			fmt.Printf("Warning: could not hash %s for -dedupe-against-output: %v\n", source, err)
+		} else if existing, ok := outputHashes[hash]; ok {
+			fmt.Printf("Skipping (same content as %s in the output directory): %s\n", existing, source)
+			batch.duplicate++
+			progress.update(progressSkipped, "", nil)
+			return false
+		}
+	}
+
+	batch.processed++
+	fileUsage = usageStats{}
+	firstPageImage = nil
+	pageRenders = nil
+	var result FileResult
+	var err error
+	if config.Describe {
+		result, err = describePDF(source, pdfFile)
+	} else if nameMap != nil {
+		result, err = applyMappedName(pdfFile)
+	} else {
+		result, err = processPDF(pdfFile)
+	}
+	if err == nil && result.LowConfidence {
+		result.Review = sendToReview(source, pdfFile, result)
+	}
+	if !result.Queued {
+		recordResult(source, pdfFile, result, err)
+	}
+	if err == nil && hash != "" && result.Output != "" {
+		// Later inputs with the same content are duplicates of this one
+		outputHashes[hash] = result.Output
+	}
+	progress.finish(result, err)
+	if err != nil {
+		quarantine(source, pdfFile, err)
+		return batch.recordFailure(source, err)
+	}
+	return batch.quit
+}
+
+// ReviewRecord is the .review.json sidecar written next to a file in -review-dir
+type ReviewRecord struct {
+	Source     string `json:"source"`
+	Time       string `json:"time"`
+	Suggested  string `json:"suggested"`
+	Confidence int    `json:"confidence"`
+	Mode       string `json:"mode,omitempty"`
+}
+
+// sendToReview copies a low-confidence file into -review-dir under its original name
+// (suffixed on collisions) with a sidecar holding the suggested name, so a hands-off
+// run leaves a triage queue. It returns the copy's path, or "" when there is no review
+// directory or the copy failed, which is only a warning.
+func sendToReview(source, pdfFile string, result FileResult) string {
+	if config.ReviewDir == "" || config.DryRun {
+		return ""
+	}
+	if err := os.MkdirAll(config.ReviewDir, 0755); err != nil {
+		fmt.Printf("Warning: could not create review directory: %v\n", err)
+		return ""
+	}
+	target := filepath.Join(config.ReviewDir, filepath.Base(source))
+	if _, err := os.Stat(target); err == nil {
+		target = collisionPath(target, pdfFile)
+	}
+	if err := copyFile(pdfFile, target); err != nil {
+		fmt.Printf("Warning: could not copy %s for review: %v\n", source, err)
+		return ""
+	}
+
+	record, _ := json.MarshalIndent(ReviewRecord{
+		Source:     source,
+		Time:       time.Now().Format(time.RFC3339),
+		Suggested:  result.Name.Slug + ".pdf",
+		Confidence: result.Name.Confidence,
+		Mode:       result.Mode,
+	}, "", "  ")
+	if err := os.WriteFile(target+".review.json", append(record, '\n'), 0644); err != nil {
+		fmt.Printf("Warning: could not write review sidecar: %v\n", err)
+	}
+	fmt.Printf("Copied %s to %s for review\n", source, target)
+	logEvent(slog.LevelInfo, source, "rename", "queued for review", "output", target)
+	return target
+}
+
+// FailureRecord is the .failure.json sidecar written next to a quarantined input
+type FailureRecord struct {
+	Source string `json:"source"`
+	Time   string `json:"time"`
+	Error  string `json:"error"`
+}
+
+// quarantine moves a failed input into -quarantine-dir for -on-failure quarantine,
+// keeping its name (suffixed on collisions) and writing the reason to a sidecar. Archive
+// entries are copied, since the archive itself stays where it is. Problems are warnings:
+// the file's failure is reported either way.
+func quarantine(source, pdfFile string, cause error) {
+	if config.OnFailure != "quarantine" || config.DryRun {
+		return
+	}
+	if err := os.MkdirAll(config.QuarantineDir, 0755); err != nil {
+		fmt.Printf("Warning: could not create quarantine directory: %v\n", err)
+		return
+	}
+	target := filepath.Join(config.QuarantineDir, filepath.Base(pdfFile))
+	if _, err := os.Stat(target); err == nil {
+		target = collisionPath(target, pdfFile)
+	}
+
+	var err error
+	if source == pdfFile {
+		err = moveFile(pdfFile, target)
+	} else {
+		err = copyFile(pdfFile, target)
+	}
+	if err != nil {
+		fmt.Printf("Warning: could not quarantine %s: %v\n", source, err)
+		return
+	}
+
+	record, _ := json.MarshalIndent(FailureRecord{
+		Source: source,
+		Time:   time.Now().Format(time.RFC3339),
+		Error:  cause.Error(),
+	}, "", "  ")
+	if err := os.WriteFile(target+".failure.json", append(record, '\n'), 0644); err != nil {
+		fmt.Printf("Warning: could not write failure sidecar: %v\n", err)
+	}
+	fmt.Printf("Quarantined %s to %s\n", source, target)
+	logEvent(slog.LevelInfo, source, "error", "quarantined failed input", "output", target)
+}
+
+// copyFile copies src to dst
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+// moveFile renames src to dst, copying and removing src when they are on different
+// filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// isArchiveInput reports whether path is a zip or tar archive to read PDFs from
+func isArchiveInput(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveTempDirs are the directories of extracted archive entries still in use by
+// -interactive-batch-edit; they are removed at the end of the run
+var archiveTempDirs []string
+
+// removeArchiveTempDirs deletes the extracted archive entries that were kept for later
+func removeArchiveTempDirs() {
+	for _, dir := range archiveTempDirs {
+		os.RemoveAll(dir)
+	}
+	archiveTempDirs = nil
+}
+
+// forEachArchivePDF calls fn for every .pdf entry of a zip or tar(.gz) archive, in
+// archive order, stopping at the first error fn returns
+func forEachArchivePDF(path string, fn func(name string, r io.Reader) error) error {
+	isPDF := func(name string) bool {
+		return strings.HasSuffix(strings.ToLower(name), ".pdf")
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return fmt.Errorf("error opening archive: %v", err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !isPDF(f.Name) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("error reading %s from archive: %v", f.Name, err)
+			}
+			err = fn(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening archive: %v", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if lower := strings.ToLower(path); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("error opening archive: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg || !isPDF(header.Name) {
+			continue
+		}
+		if err := fn(header.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// errStopBatch ends the iteration over an archive when -fail-fast aborts the batch
+var errStopBatch = errors.New("batch aborted")
+
+// processArchiveInput extracts each PDF entry of an archive to a temporary file and
+// processes it like a file given on the command line. Entries are reported as
+// "<archive>:<entry>" and deleted once they are done.
+func processArchiveInput(path string) error {
+	fmt.Printf("Reading PDFs from archive: %s\n", path)
+	err := forEachArchivePDF(path, func(name string, r io.Reader) error {
+		source := path + ":" + name
+		dir, err := os.MkdirTemp("", "ai-pdf-renamer-entry-*")
+		if err != nil {
+			return fmt.Errorf("error creating temporary directory: %v", err)
+		}
+		pdfFile := filepath.Join(dir, filepath.Base(name))
+		out, err := os.Create(pdfFile)
+		if err == nil {
+			_, err = io.Copy(out, r)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			batch.processed++
+			err = fmt.Errorf("error extracting entry: %v", err)
+			progress.begin(source)
+			progress.finish(FileResult{}, err)
+			if batch.recordFailure(source, err) {
+				return errStopBatch
+			}
+			return nil
+		}
+
+		pendingBefore := len(batch.pending)
+		stop := processSource(source, pdfFile)
+		if len(batch.pending) > pendingBefore {
+			// Queued for the batch editor, which still needs the file
+			archiveTempDirs = append(archiveTempDirs, dir)
+		} else {
+			os.RemoveAll(dir)
+		}
+		if stop {
+			return errStopBatch
+		}
+		return nil
+	})
+	if errors.Is(err, errStopBatch) {
+		return nil
+	}
+	return err
+}
+
+// expandPatterns expands the file patterns given on the command line into the list of
+// PDF files to process, skipping non-PDF matches (the .pdf check is case-insensitive).
+// Zip and tar archives are kept; their PDF entries are processed by processArchiveInput.
+func expandPatterns(patterns []string) []string {
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			fmt.Printf("Error processing pattern %s: %v\n", pattern, err)
+			continue
+		}
+
+		for _, pdfFile := range matches {
+			// Archives are opened later and their PDF entries processed one by one
+			if isArchiveInput(pdfFile) {
+				files = append(files, pdfFile)
+				continue
+			}
+			// Skip if not a PDF file
+			if !strings.HasSuffix(strings.ToLower(pdfFile), ".pdf") {
+				fmt.Printf("Skipping non-PDF file: %s\n", pdfFile)
+				continue
+			}
+			files = append(files, pdfFile)
+		}
+	}
+	return files
+}
+
+// listMatches prints the files the patterns expand to, without processing them
+func listMatches(patterns []string) {
+	files := expandPatterns(patterns)
+	for _, pdfFile := range files {
+		fmt.Println(pdfFile)
+	}
+	fmt.Printf("%d PDF file(s) or archive(s) matched\n", len(files))
+}
+
+// reservedNames are device names Windows refuses as filenames, with any extension
+var reservedNames = []string{"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9"}
+
+// nameViolations lists why the filename base (with its .pdf extension) doesn't conform
+// to the naming rules in config, i.e. wouldn't come out of sanitizeFilename unchanged.
+// An empty result means the name conforms.
+func nameViolations(base string) []string {
+	stem := strings.TrimSuffix(base, filepath.Ext(base))
+	original := stem
+	var reasons []string
+	if config.Separator == "underscore" {
+		// Check the words as if separated by dashes, then require underscores only
+		if strings.Contains(stem, "-") {
+			reasons = append(reasons, "contains \"-\", but -separator is underscore")
+		}
+		stem = strings.ReplaceAll(stem, "_", "-")
+	}
+	if ext := filepath.Ext(base); ext != ".pdf" {
+		reasons = append(reasons, fmt.Sprintf("extension %q is not \".pdf\"", ext))
+	}
+	var bad []string
+	for _, r := range stem {
+		if !allowedFilenameRune(r) && !slices.Contains(bad, string(r)) {
+			bad = append(bad, string(r))
+		}
+	}
+	if len(bad) > 0 {
+		reasons = append(reasons, fmt.Sprintf("characters not allowed by -charset %s: %q", config.Charset, strings.Join(bad, "")))
+	}
+	if strings.Trim(stem, "- ") != stem {
+		reasons = append(reasons, "starts or ends with a separator")
+	}
+	if strings.Contains(stem, "--") || strings.Contains(stem, "  ") || strings.Contains(stem, "- ") || strings.Contains(stem, " -") {
+		reasons = append(reasons, "repeated separators")
+	}
+	if length := len([]rune(stem)); config.CharsBudget > 0 && length > config.CharsBudget {
+		reasons = append(reasons, fmt.Sprintf("%d characters, longer than -chars-budget %d", length, config.CharsBudget))
+	}
+	if utf8.RuneCountInString(stem) < config.MinNameLength {
+		reasons = append(reasons, fmt.Sprintf("shorter than -min-name-length %d", config.MinNameLength))
+	}
+	if device, _, _ := strings.Cut(stem, "."); slices.Contains(reservedNames, strings.ToUpper(device)) {
+		reasons = append(reasons, fmt.Sprintf("%q is a reserved device name on Windows", device))
+	}
+	if len(reasons) == 0 {
+		// Catch the remaining rules (-numbers, -safe-names, Unicode normalization)
+		if sanitized := sanitizeFilename(stem); sanitized != original {
+			reasons = append(reasons, fmt.Sprintf("sanitizing changes it to %q", sanitized))
+		}
+	}
+	return reasons
+}
+
+// validateNames reports for every file whether its name conforms to the naming rules
+// (-validate-only) and returns the number of files that don't. Archives are skipped.
+func validateNames(files []string) int {
+	var conforming, failed int
+	for _, file := range files {
+		if isArchiveInput(file) {
+			fmt.Printf("SKIP %s: archives are not validated\n", file)
+			continue
+		}
+		if reasons := nameViolations(filepath.Base(file)); len(reasons) > 0 {
+			fmt.Printf("FAIL %s: %s\n", file, strings.Join(reasons, "; "))
+			failed++
+			continue
+		}
+		fmt.Printf("OK   %s\n", file)
+		conforming++
+	}
+	fmt.Printf("%d file(s) conform, %d file(s) don't\n", conforming, failed)
+	return failed
+}
+
+func setup(cfg Config) {
+	// Check for common flag usage errors
+	args := flag.Args()
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-novision=") {
+			fmt.Fprintf(os.Stderr, "Error: -novision is a switch flag and doesn't take a value. Use just -novision instead of -novision=%s\n", strings.TrimPrefix(arg, "-novision="))
+			cfg.Exitor.Exit(1)
+		}
+	}
+
+	// Clean up output directory path and ensure it's set
+	outputDirPath := cfg.OutputDir
+	if outputDirPath != "" {
+		// Clean and normalize the path
+		outputDirPath = filepath.Clean(outputDirPath)
+		// Remove trailing slash if present
+		outputDirPath = strings.TrimSuffix(outputDirPath, string(os.PathSeparator))
+		cfg.OutputDir = outputDirPath
+	}
+
+	// Validate render resolutions
+	if cfg.DPI <= 0 || cfg.ContextDPI <= 0 || cfg.StepDownDPI <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -dpi, -context-dpi and -step-down-dpi must be positive (got %d, %d and %d)\n", cfg.DPI, cfg.ContextDPI, cfg.StepDownDPI)
+		cfg.Exitor.Exit(1)
+	}
+
+	// Validate page selection
+	if cfg.SamplePages != "first" && cfg.SamplePages != "spread" && cfg.SamplePages != "random" {
+		fmt.Fprintf(os.Stderr, "Error: -sample-pages must be first, spread or random (got %q)\n", cfg.SamplePages)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.SampleCount < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -sample-count must be at least 1 (got %d)\n", cfg.SampleCount)
+		cfg.Exitor.Exit(1)
+	}
+	if !validAlphaBits(cfg.TextAlphaBits) || !validAlphaBits(cfg.GraphicsAlphaBits) {
+		fmt.Fprintf(os.Stderr, "Error: -text-alpha-bits and -graphics-alpha-bits must be 1, 2 or 4 (got %d and %d)\n", cfg.TextAlphaBits, cfg.GraphicsAlphaBits)
+		cfg.Exitor.Exit(1)
+	}
+	for _, arg := range gsExtraArgs {
+		if !strings.HasPrefix(arg, "-") {
+			fmt.Fprintf(os.Stderr, "Error: -gs-extra expects a Ghostscript option starting with '-' (got %q)\n", arg)
+			cfg.Exitor.Exit(1)
+		}
+	}
+	if cfg.NumSuggestions < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -num-suggestions must be at least 1 (got %d)\n", cfg.NumSuggestions)
+		cfg.Exitor.Exit(1)
+	}
+	if _, err := parseCleanText(cfg.CleanText); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.Charset != "ascii" && cfg.Charset != "unicode" {
+		fmt.Fprintf(os.Stderr, "Error: -charset must be ascii or unicode (got %q)\n", cfg.Charset)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.SafeNames && cfg.AllowSpaces {
+		fmt.Fprintf(os.Stderr, "Error: -safe-names and -allow-spaces cannot be combined\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.SafeNames && cfg.Charset == "unicode" {
+		fmt.Fprintf(os.Stderr, "Error: -safe-names cannot be combined with -charset unicode (non-ASCII letters need percent-encoding in URLs)\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.CanonicalizeUnicode != "nfc" && cfg.CanonicalizeUnicode != "nfkc" && cfg.CanonicalizeUnicode != "none" {
+		fmt.Fprintf(os.Stderr, "Error: -canonicalize-unicode must be nfc, nfkc or none (got %q)\n", cfg.CanonicalizeUnicode)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.GSTimeout < 0 || cfg.OCRTimeout < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -gs-timeout and -ocr-timeout must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.ReviewDir != "" && cfg.MinConfidence <= 0 {
+		fmt.Fprintf(os.Stderr, "Error: -review-dir requires -min-confidence\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.MinConfidence < 0 || cfg.MinConfidence > 10 {
+		fmt.Fprintf(os.Stderr, "Error: -min-confidence must be between 0 and 10 (got %d)\n", cfg.MinConfidence)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.CropTop < 0 || cfg.CropTop >= 1 {
+		fmt.Fprintf(os.Stderr, "Error: -crop-top must be at least 0 and below 1 (got %v)\n", cfg.CropTop)
+		cfg.Exitor.Exit(1)
+	}
+
+	if cfg.DuplicateThreshold < 0 || cfg.DuplicateThreshold > 64 {
+		fmt.Fprintf(os.Stderr, "Error: -duplicate-threshold must be between 0 and 64 (got %d)\n", cfg.DuplicateThreshold)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.Retries < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -retries must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	schedule, err := parseTemperatureSchedule(cfg.TemperatureSchedule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		cfg.Exitor.Exit(1)
+	}
+	temperatureSchedule = schedule
+	if cfg.Keywords < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -keywords must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	switch cfg.OCROutputType {
+	case "none", "pdf", "pdfa":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: -ocr-output-type must be none, pdf or pdfa (got %q)\n", cfg.OCROutputType)
+		cfg.Exitor.Exit(1)
+	}
+	// ocrmypdf would rewrite the inputs in place, which a dry run must not do
+	if cfg.DryRun && cfg.OCROutputType != "none" {
+		fmt.Fprintf(os.Stderr, "Error: -dry-run cannot be combined with -ocr-output-type %s, which rewrites the input files\n", cfg.OCROutputType)
+		cfg.Exitor.Exit(1)
+	}
+	switch cfg.Separator {
+	case "dash", "underscore":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: -separator must be dash or underscore (got %q)\n", cfg.Separator)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.Separator == "underscore" && cfg.AllowSpaces {
+		fmt.Fprintf(os.Stderr, "Error: -separator underscore and -allow-spaces cannot be combined\n")
+		cfg.Exitor.Exit(1)
+	}
+	switch cfg.Case {
+	case "keep", "lower":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: -case must be keep or lower (got %q)\n", cfg.Case)
+		cfg.Exitor.Exit(1)
+	}
+	devices, err := parseGSDevices(cfg.GSDeviceFallback)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		cfg.Exitor.Exit(1)
+	}
+	gsFallbackDevices = devices
+	if cfg.MaxFiles < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-files must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.MaxRuntimePerFile < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-runtime-per-file must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.ThumbnailWidth < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -thumbnail-width must be at least 1\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.ThumbnailFormat != "jpg" && cfg.ThumbnailFormat != "png" {
+		fmt.Fprintf(os.Stderr, "Error: -thumbnail-format must be jpg or png (got %q)\n", cfg.ThumbnailFormat)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.TextSampling != "head" && cfg.TextSampling != "head-tail" && cfg.TextSampling != "tail" {
+		fmt.Fprintf(os.Stderr, "Error: -text-sampling must be head, head-tail or tail (got %q)\n", cfg.TextSampling)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.DateOrder != "mdy" && cfg.DateOrder != "dmy" {
+		fmt.Fprintf(os.Stderr, "Error: -date-order must be mdy or dmy (got %q)\n", cfg.DateOrder)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.AutoMode && !cfg.FastMode {
+		fmt.Fprintf(os.Stderr, "Error: -auto-mode chooses between vision and the text path itself and cannot be combined with -novision\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.MinTextChars < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -min-text-chars must be at least 1\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.MaxWords < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-words must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.MaxMegapixels < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-megapixels must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.RateLimit < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -rate-limit must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	if cfg.OCRJobs < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -ocr-jobs must not be negative\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	if cfg.CharsBudget < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -chars-budget must be at least 1 (got %d)\n", cfg.CharsBudget)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.Pages != "" {
+		if _, err := parsePageSpec(cfg.Pages); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: -pages: %v\n", err)
+			cfg.Exitor.Exit(1)
+		}
+	}
+	pagesMap = nil
+	if cfg.PagesMap != "" {
+		var err error
+		if pagesMap, err = loadPagesMap(cfg.PagesMap); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+		}
+	}
+
+	// Load extra Ollama generation options
+	ollamaOptionsFromFile = nil
+	if cfg.OllamaOptionsFile != "" {
+		var err error
+		if ollamaOptionsFromFile, err = loadOllamaOptions(cfg.OllamaOptionsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			cfg.Exitor.Exit(1)
+		}
+	}
+
+	// Load the scanner prefixes
+	scannerPrefixes = parseScannerPrefixes(cfg.ScannerPrefixes)
+	if cfg.ScannerPrefixesFile != "" {
+		var err error
+		if scannerPrefixes, err = loadScannerPrefixes(cfg.ScannerPrefixesFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			cfg.Exitor.Exit(1)
+		}
+	}
+
+	// Load the few-shot examples
+	promptExamples = nil
+	if cfg.MaxExamples < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -max-examples must not be negative (got %d)\n", cfg.MaxExamples)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.ExamplesFile != "" {
+		var err error
+		if promptExamples, err = loadPromptExamples(cfg.ExamplesFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			cfg.Exitor.Exit(1)
+		}
 	}
-}
 
-func isImageEmpty(imgData []byte) bool {
-	// Check if the image is mostly black/empty
-	// We'll do this by checking if the average pixel value is very low
-	// This is a simple heuristic - we could make it more sophisticated if needed
-	img, err := jpeg.Decode(bytes.NewReader(imgData))
-	if err != nil {
-		// If we can't decode the image, assume it's not empty
-		return false
+	// An archive replaces the output directory, and the per-file extras need a real file
+	if cfg.Archive != "" {
+		var conflicts []string
+		for name, set := range map[string]bool{"-output": cfg.OutputDir != "", "-set-title": cfg.SetTitle, "-emit-metadata": cfg.EmitMetadata, "-emit-thumbnail": cfg.EmitThumbnail, "-keywords": cfg.Keywords > 0, "-post-hook": cfg.PostHook != "", "-resume": cfg.Resume} {
+			if set {
+				conflicts = append(conflicts, name)
+			}
+		}
+		if len(conflicts) > 0 {
+			sort.Strings(conflicts)
+			fmt.Fprintf(os.Stderr, "Error: -archive cannot be combined with %s\n", strings.Join(conflicts, ", "))
+			cfg.Exitor.Exit(1)
+		}
 	}
 
-	bounds := img.Bounds()
-	totalPixels := bounds.Dx() * bounds.Dy()
-	if totalPixels == 0 {
-		return true
+	// Batch editing replaces the per-file prompts and needs the source files to stay around
+	if cfg.InteractiveBatchEdit && (cfg.AutoRename || cfg.CombineGlob != "") {
+		fmt.Fprintf(os.Stderr, "Error: -interactive-batch-edit cannot be combined with -auto or -combine-glob\n")
+		cfg.Exitor.Exit(1)
 	}
 
-	var sumBrightness float64
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := img.At(x, y).RGBA()
-			// Convert to grayscale using standard coefficients
-			brightness := float64(r)*0.299 + float64(g)*0.587 + float64(b)*0.114
-			sumBrightness += brightness
-		}
+	// Describe mode writes no PDFs, so there is nothing to archive or review
+	if cfg.Describe && (cfg.Archive != "" || cfg.InteractiveBatchEdit || cfg.CombineGlob != "") {
+		fmt.Fprintf(os.Stderr, "Error: -describe cannot be combined with -archive, -interactive-batch-edit or -combine-glob\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.DescribeTxt && !cfg.Describe {
+		fmt.Fprintf(os.Stderr, "Error: -describe-txt requires -describe\n")
+		cfg.Exitor.Exit(1)
 	}
 
-	avgBrightness := sumBrightness / float64(totalPixels)
-	// If average brightness is very low (close to black), consider it empty
-	return avgBrightness < 1000 // This threshold might need adjustment
-}
+	// The progress stream replaces stdout, so nobody could see or answer a prompt
+	if cfg.ProgressJSON && !cfg.AutoRename && !cfg.Describe {
+		fmt.Fprintf(os.Stderr, "Error: -progress-json requires -auto or -describe\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.ProgressJSON && cfg.CombineGlob != "" {
+		fmt.Fprintf(os.Stderr, "Error: -progress-json cannot be combined with -combine-glob\n")
+		cfg.Exitor.Exit(1)
+	}
 
-// writeOutputFile copies srcPath to the output directory with the given newName, returns the output path
-func writeOutputFile(srcPath, newName string) (string, error) {
-	outputName := newName + ".pdf"
-	outputPath := outputName
-	if config.OutputDir != "" {
-		if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-			return "", fmt.Errorf("error creating output directory: %v", err)
-		}
-		outputPath = filepath.Join(config.OutputDir, filepath.Base(outputName))
+	// A name map replaces the model and the file arguments
+	if cfg.ApplyMap != "" && (cfg.Describe || cfg.CombineGlob != "" || cfg.InputJSON != "" || len(args) > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -apply-map cannot be combined with -describe, -combine-glob, -input-json or file arguments\n")
+		cfg.Exitor.Exit(1)
 	}
-	// Read the source file
-	srcData, err := os.ReadFile(srcPath)
-	if err != nil {
-		return "", fmt.Errorf("error reading source file: %v", err)
+
+	// Stdin carries the PDF, so nobody can answer a prompt there
+	if cfg.StdinPDF && (len(args) > 0 || cfg.CombineGlob != "" || cfg.InputJSON != "" || cfg.ApplyMap != "") {
+		fmt.Fprintf(os.Stderr, "Error: -stdin-pdf cannot be combined with file arguments, -combine-glob, -input-json or -apply-map\n")
+		cfg.Exitor.Exit(1)
 	}
-	// Write to the new location
-	if err := os.WriteFile(outputPath, srcData, 0644); err != nil {
-		return "", fmt.Errorf("error writing file: %v", err)
+	if cfg.StdinPDF && !cfg.AutoRename && !cfg.StdoutName {
+		fmt.Fprintf(os.Stderr, "Error: -stdin-pdf requires -auto or -stdout-name\n")
+		cfg.Exitor.Exit(1)
 	}
-	fmt.Printf("Renamed (saved) file to: %s\n", outputPath)
-	return outputPath, nil
-}
 
-// fallbackToOCR is a helper that (if fast mode fails) falls back to OCR mode (using ocrmypdf) to extract text, generate a filename, and (if confirmed) write the output file. It returns an error if any.
-func fallbackToOCR(pdfFile string) (err error) {
-	fmt.Println("Falling back to OCR mode (using ocrmypdf)…")
-	text, err := extractText(pdfFile)
-	if err != nil {
-		fmt.Printf("Error in OCR fallback (extractText): %v\n", err)
-		return err
+	// -stdout-name is a dry run that prints just the names
+	if cfg.StdoutName && (cfg.Archive != "" || cfg.InteractiveBatchEdit || cfg.ProgressJSON || cfg.Describe) {
+		fmt.Fprintf(os.Stderr, "Error: -stdout-name cannot be combined with -archive, -interactive-batch-edit, -progress-json or -describe\n")
+		cfg.Exitor.Exit(1)
 	}
-	fmt.Printf("Extracted text length (OCR fallback): %d characters\n", len(text))
-	prompt := config.CustomPrompt + " Text: " + text
-	newName, err := generateFilename(text, prompt)
-	if err != nil {
-		fmt.Printf("Error in OCR fallback (generateFilename): %v\n", err)
-		return err
+	if cfg.StdoutName {
+		cfg.DryRun = true
 	}
-	if !config.AutoRename {
-		fmt.Printf("Suggested new filename (OCR fallback): %s.pdf\n", newName)
-		fmt.Println("Options:")
-		fmt.Println("  y – Rename file")
-		fmt.Println("  n – Keep original name")
-		fmt.Println("  a – Rename all remaining files automatically")
-		var confirm string
-		fmt.Scanf("%s", &confirm)
-		if confirm == "a" {
-			config.AutoRename = true
-		} else if confirm != "y" {
-			fmt.Println("File kept with original name (OCR fallback).")
-			return nil
+
+	if cfg.JSONErrors && cfg.JSONLogs {
+		fmt.Fprintf(os.Stderr, "Error: -json-errors cannot be combined with -json-logs, which writes its events to stderr as well\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	// A dry run writes nothing, so there is nothing to archive or edit afterwards
+	if cfg.DryRun && (cfg.Archive != "" || cfg.InteractiveBatchEdit) {
+		fmt.Fprintf(os.Stderr, "Error: -dry-run cannot be combined with -archive or -interactive-batch-edit\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.PageCountSingle && !cfg.AppendPageCount {
+		fmt.Fprintf(os.Stderr, "Error: -page-count-single requires -append-page-count\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.NameLang != "" && !regexp.MustCompile(`^\pL+( \pL+)*$`).MatchString(cfg.NameLang) {
+		fmt.Fprintf(os.Stderr, "Error: -name-lang must be a language name or code such as English or en (got %q)\n", cfg.NameLang)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.DryRunDiff && !cfg.DryRun {
+		fmt.Fprintf(os.Stderr, "Error: -dry-run-diff requires -dry-run\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	// Validate the blank page policy
+	if cfg.OnEmptyPage != "skip" && cfg.OnEmptyPage != "error" && cfg.OnEmptyPage != "include" {
+		fmt.Fprintf(os.Stderr, "Error: -on-empty-page must be skip, error or include (got %q)\n", cfg.OnEmptyPage)
+		cfg.Exitor.Exit(1)
+	}
+
+	// Routing by type needs the classifier and a directory to route into
+	if cfg.RouteByType && (!cfg.Classify || (cfg.OutputDir == "" && cfg.Archive == "")) {
+		fmt.Fprintf(os.Stderr, "Error: -route-by-type requires -classify and -output (or -archive)\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.DateSubdir && cfg.OutputDir == "" && cfg.Archive == "" {
+		fmt.Fprintf(os.Stderr, "Error: -date-subdir requires -output (or -archive)\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.DedupeAgainstOutput && cfg.OutputDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: -dedupe-against-output requires -output\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.Classify {
+		categories := parseCategories(cfg.Categories)
+		if len(categories) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: -categories must name at least one document type\n")
+			cfg.Exitor.Exit(1)
+		}
+		for _, category := range categories {
+			if sanitizeFilename(category) != category {
+				fmt.Fprintf(os.Stderr, "Error: -categories entry %q may only contain letters, digits and dashes\n", category)
+				cfg.Exitor.Exit(1)
+			}
 		}
 	}
-	_, err = writeOutputFile(pdfFile, newName)
-	return err
-}
 
-func processPDF(pdfFile string) error {
-	fmt.Printf("Processing: %s\n", pdfFile)
+	// Validate the name source
+	if cfg.NameFrom != "metadata" && cfg.NameFrom != "content" && cfg.NameFrom != "both" {
+		fmt.Fprintf(os.Stderr, "Error: -name-from must be metadata, content or both (got %q)\n", cfg.NameFrom)
+		cfg.Exitor.Exit(1)
+	}
 
-	if config.FastMode {
-		// Try vision-based processing first
-		images, err := extractPDFPages(pdfFile)
+	// Tagging leaves the files where they are, so there is no output to configure
+	if cfg.SetXattr && (cfg.OutputDir != "" || cfg.Archive != "") {
+		fmt.Fprintf(os.Stderr, "Error: -set-xattr cannot be combined with -output or -archive\n")
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.SetXattr && cfg.XattrKey == "" {
+		fmt.Fprintf(os.Stderr, "Error: -xattr-key must not be empty\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	if cfg.LanguagePrefix && !cfg.DetectLanguage {
+		fmt.Fprintf(os.Stderr, "Error: -language-prefix requires -detect-language\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	// Validate the failure policy
+	if cfg.OnFailure != "keep" && cfg.OnFailure != "quarantine" {
+		fmt.Fprintf(os.Stderr, "Error: -on-failure must be keep or quarantine (got %q)\n", cfg.OnFailure)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.OnFailure == "quarantine" && cfg.QuarantineDir == "" {
+		fmt.Fprintf(os.Stderr, "Error: -on-failure quarantine requires -quarantine-dir\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	// Validate the digit policy
+	if cfg.Numbers != "keep" && cfg.Numbers != "strip" && cfg.Numbers != "collapse" {
+		fmt.Fprintf(os.Stderr, "Error: -numbers must be keep, strip or collapse (got %q)\n", cfg.Numbers)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.Numbers == "collapse" && cfg.NumbersMaxDigits < 1 {
+		fmt.Fprintf(os.Stderr, "Error: -numbers-max-digits must be at least 1\n")
+		cfg.Exitor.Exit(1)
+	}
+
+	// Validate the collision policy
+	if cfg.OnCollision != "overwrite" && cfg.OnCollision != "suffix" && cfg.OnCollision != "skip" {
+		fmt.Fprintf(os.Stderr, "Error: -on-collision must be overwrite, suffix or skip (got %q)\n", cfg.OnCollision)
+		cfg.Exitor.Exit(1)
+	}
+	if cfg.CollisionSuffix != "number" && cfg.CollisionSuffix != "hash" {
+		fmt.Fprintf(os.Stderr, "Error: -collision-suffix must be number or hash (got %q)\n", cfg.CollisionSuffix)
+		cfg.Exitor.Exit(1)
+	}
+
+	// Compile the last-resort rename pattern
+	fallbackRule = nil
+	if cfg.FallbackPattern != "" {
+		rule, err := parsePatternRule(cfg.FallbackPattern)
 		if err != nil {
-			fmt.Printf("Error (vision mode) extracting PDF pages: %v\n", err)
-			return fallbackToOCR(pdfFile)
+			fmt.Fprintf(os.Stderr, "Error: -fallback-pattern: %v\n", err)
+			cfg.Exitor.Exit(1)
 		}
-		// Use image-based processing (generateFilenameFast) with all extracted pages
-		prompt := config.CustomPrompt + " Analyze these images and create a filename based on their content."
-		newName, err := generateFilenameFast(images, prompt)
-		if err != nil {
-			fmt.Printf("Error (vision mode) generating filename (generateFilenameFast): %v\n", err)
-			return fallbackToOCR(pdfFile)
+		fallbackRule = rule
+	}
+
+	// Validate the post-hook command up front instead of failing after the first rename
+	if cfg.PostHook != "" {
+		if _, err := postHookArgs(cfg.PostHook, "", "", ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid -post-hook: %v\n", err)
+			cfg.Exitor.Exit(1)
 		}
-		if !config.AutoRename {
-			fmt.Printf("Suggested new filename (vision mode): %s.pdf\n", newName)
-			fmt.Println("Options:")
-			fmt.Println("  y – Rename file")
-			fmt.Println("  n – Keep original name")
-			fmt.Println("  a – Rename all remaining files automatically")
-			var confirm string
-			fmt.Scanf("%s", &confirm)
-			if confirm == "a" {
-				config.AutoRename = true
-			} else if confirm != "y" {
-				fmt.Println("File kept with original name (vision mode).")
-				return nil
-			}
-		}
-		_, err = writeOutputFile(pdfFile, newName)
-		return err
-	} else {
-		// OCR-only mode
-		text, err := extractText(pdfFile)
+	}
+
+	// If vision mode is enabled (default), ensure we're using the vision model
+	if cfg.FastMode && cfg.VisionModel == "" && cfg.Model != "qwen2.5vl:7b" {
+		if cfg.FailOnModelSwitch {
+			capabilities, err := modelCapabilities(cfg.Model)
+			if err := modelSwitchError(cfg.Model, capabilities, err); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				cfg.Exitor.Exit(1)
+				return
+			}
+		} else {
+			fmt.Printf("Note: Switching to qwen2.5vl:7b model for vision-based processing\n")
+			cfg.Model = "qwen2.5vl:7b"
+		}
+	}
+
+	// Set global config for downstream functions
+	config = cfg
+	progress = nil
+	if cfg.ProgressJSON {
+		// Progress events go to the real stdout, everything else printed there is dropped
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 		if err != nil {
-			fmt.Printf("Error (OCR mode) extractText: %v\n", err)
-			return err
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
 		}
-		fmt.Printf("Extracted text length (OCR mode): %d characters\n", len(text))
-		prompt := config.CustomPrompt + " Text: " + text
-		newName, err := generateFilename(text, prompt)
+		progress = &progressTracker{w: os.Stdout}
+		os.Stdout = devNull
+	}
+	nameOutput = nil
+	if cfg.StdoutName {
+		// Only the names go to the real stdout; everything else printed there moves to stderr
+		nameOutput = os.Stdout
+		os.Stdout = os.Stderr
+	}
+	errorOutput = nil
+	if cfg.JSONErrors {
+		errorOutput = os.Stderr
+		if cfg.StdoutName {
+			// Keep stderr to the JSON lines; the names stay on stdout
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				cfg.Exitor.Exit(1)
+				return
+			}
+			os.Stdout = devNull
+		}
+	}
+	eventLog = nil
+	if cfg.JSONLogs {
+		eventLog = newEventLogger(os.Stderr)
+	}
+	generateLimiter = newRateLimiter(cfg.RateLimit)
+	// The scheme's separators are checked against the final -charset/-allow-spaces
+	namingScheme = nil
+	if cfg.Scheme != "" {
+		scheme, err := parseScheme(cfg.Scheme)
 		if err != nil {
-			fmt.Printf("Error (OCR mode) generateFilename: %v\n", err)
-			return err
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
 		}
-		if !config.AutoRename {
-			fmt.Printf("Suggested new filename (OCR mode): %s.pdf\n", newName)
-			fmt.Println("Options:")
-			fmt.Println("  y – Rename file")
-			fmt.Println("  n – Keep original name")
-			fmt.Println("  a – Rename all remaining files automatically")
-			var confirm string
-			fmt.Scanf("%s", &confirm)
-			if confirm == "a" {
-				config.AutoRename = true
-			} else if confirm != "y" {
-				fmt.Println("File kept with original name (OCR mode).")
-				return nil
-			}
-		}
-		_, err = writeOutputFile(pdfFile, newName)
-		return err
+		if scheme.uses("type") && !cfg.Classify {
+			fmt.Fprintf(os.Stderr, "Error: {type} in -scheme requires -classify\n")
+			cfg.Exitor.Exit(1)
+		}
+		if scheme.uses("keywords") && cfg.Keywords == 0 {
+			fmt.Fprintf(os.Stderr, "Error: {keywords} in -scheme requires -keywords\n")
+			cfg.Exitor.Exit(1)
+		}
+		namingScheme = scheme
 	}
-}
 
-func setup(cfg Config) {
-	// Check for common flag usage errors
-	args := flag.Args()
-	for _, arg := range args {
-		if strings.HasPrefix(arg, "-novision=") {
-			fmt.Fprintf(os.Stderr, "Error: -novision is a switch flag and doesn't take a value. Use just -novision instead of -novision=%s\n", strings.TrimPrefix(arg, "-novision="))
+	// The setup wizard replaces a run
+	if cfg.Setup {
+		path, err := settingsPath()
+		if err == nil {
+			err = runSetupWizard(path)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			cfg.Exitor.Exit(1)
 		}
+		return
 	}
 
-	// Clean up output directory path and ensure it's set
-	outputDirPath := cfg.OutputDir
-	if outputDirPath != "" {
-		// Clean and normalize the path
-		outputDirPath = filepath.Clean(outputDirPath)
-		// Remove trailing slash if present
-		outputDirPath = strings.TrimSuffix(outputDirPath, string(os.PathSeparator))
-		cfg.OutputDir = outputDirPath
+	// Preview the scope without touching Ollama or any file
+	if cfg.ListMatches {
+		listMatches(flag.Args())
+		return
 	}
 
-	// If vision mode is enabled (default), ensure we're using the vision model
-	if cfg.FastMode && cfg.Model != "qwen2.5vl:7b" {
-		fmt.Printf("Note: Switching to qwen2.5vl:7b model for vision-based processing\n")
-		cfg.Model = "qwen2.5vl:7b"
+	// Lint existing names, again without Ollama and without renaming anything
+	if cfg.ValidateOnly {
+		if failed := validateNames(expandPatterns(flag.Args())); failed > 0 {
+			cfg.Exitor.Exit(1)
+		}
+		return
 	}
 
-	// Set global config for downstream functions
-	config = cfg
+	// Load the batch spec before the dependency check, so its models are checked too
+	jobEntries = nil
+	if cfg.InputJSON != "" {
+		entries, err := loadJobSpec(cfg.InputJSON)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
+		}
+		jobEntries = entries
+	}
+
+	// Load the name map; applying it needs neither Ollama nor the OCR tools
+	nameMap = nil
+	var mapSources []string
+	if cfg.ApplyMap != "" {
+		mappings, err := loadNameMap(cfg.ApplyMap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
+		}
+		nameMap = make(map[string]string, len(mappings))
+		for _, m := range mappings {
+			nameMap[m.source] = m.target
+			mapSources = append(mapSources, m.source)
+		}
+	}
 
 	// Check dependencies
-	if err := checkDependencies(); err != nil {
-		fmt.Println(err)
-		cfg.Exitor.Exit(1)
+	if cfg.ApplyMap == "" {
+		if err := checkDependencies(); err != nil {
+			fmt.Println(err)
+			cfg.Exitor.Exit(1)
+		}
 	}
 
 	// Get file patterns from arguments
 	args = flag.Args()
-	if len(args) == 0 {
+	if len(args) == 0 && cfg.CombineGlob == "" && len(jobEntries) == 0 && len(mapSources) == 0 && !cfg.StdinPDF {
 		fmt.Println("Usage: ai-pdf-renamer [OPTIONS] [FILE_PATTERNS...]")
 		fmt.Println("\nOptions:")
 		flag.PrintDefaults()
@@ -560,32 +7194,154 @@ func setup(cfg Config) {
 		fmt.Println("  ai-pdf-renamer -output renamed/ *.pdf     # Save renamed files to 'renamed' directory")
 		fmt.Println("  cat filelist.txt | xargs ai-pdf-renamer   # Process files listed in filelist.txt")
 		fmt.Println("  ai-pdf-renamer -p 'custom prompt' *.pdf   # Use custom prompt for filename generation")
+		fmt.Println("  ai-pdf-renamer -combine-glob 'scan_*.pdf' # Merge multi-part scans and name the result")
 		cfg.Exitor.Exit(1)
 	}
 
-	// Process each file pattern
-	for _, pattern := range args {
-		matches, err := filepath.Glob(pattern)
+	batch = batchState{}
+	usage = usageStats{}
+
+	// Set up the manifest and, with -resume, the sources to skip
+	if cfg.PromptHashInCacheKey && cfg.Manifest == "" && !cfg.Resume {
+		fmt.Fprintf(os.Stderr, "Error: -prompt-hash-in-cache-key needs -manifest or -resume to record the keys in\n")
+		cfg.Exitor.Exit(1)
+	}
+	manifestPath = cfg.Manifest
+	resumeDone = nil
+	if cfg.Resume {
+		if manifestPath == "" {
+			if cfg.OutputDir == "" {
+				fmt.Fprintf(os.Stderr, "Error: -resume needs -manifest or -output to locate the previous run's manifest\n")
+				cfg.Exitor.Exit(1)
+				return
+			}
+			if err := os.MkdirAll(cfg.OutputDir, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "Error creating output directory: %v\n", err)
+				cfg.Exitor.Exit(1)
+				return
+			}
+			manifestPath = filepath.Join(cfg.OutputDir, defaultManifestName)
+		}
+		var err error
+		if resumeDone, err = loadResumeSet(manifestPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
+		}
+		fmt.Printf("Resuming from manifest %s (%d file(s) already done)\n", manifestPath, len(resumeDone))
+	}
+
+	// Index the content already in the output directory
+	outputHashes = nil
+	if cfg.DedupeAgainstOutput {
+		hashes, err := hashPDFs(cfg.OutputDir)
 		if err != nil {
-			fmt.Printf("Error processing pattern %s: %v\n", pattern, err)
-			continue
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
 		}
+		outputHashes = hashes
+		fmt.Printf("Indexed %d PDF(s) in %s for -dedupe-against-output\n", len(outputHashes), cfg.OutputDir)
+	}
 
-		for _, pdfFile := range matches {
-			// Skip if not a PDF file
-			if !strings.HasSuffix(strings.ToLower(pdfFile), ".pdf") {
-				fmt.Printf("Skipping non-PDF file: %s\n", pdfFile)
-				continue
-			}
+	// Collect the results in a single archive, finalized after the batch
+	outputArchive = nil
+	if cfg.Archive != "" {
+		a, err := openArchive(cfg.Archive)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
+		}
+		outputArchive = a
+	}
 
-			if err := processPDF(pdfFile); err != nil {
-				fmt.Printf("Error processing %s: %v\n", pdfFile, err)
-				continue
-			}
+	// Process each matched file
+	files := expandPatterns(args)
+	if cfg.ApplyMap != "" {
+		files = mapSources
+	}
+
+	// A mistyped pattern shouldn't start a run over thousands of files
+	if err := checkMaxFiles(cfg, len(files)+len(jobEntries)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		removeArchiveTempDirs()
+		cfg.Exitor.Exit(1)
+		return
+	}
+
+	// One confirmation up front for runs that delete, move or rewrite originals unasked
+	if !confirmDestructive(cfg, len(files)+len(jobEntries), stdinIsTerminal()) {
+		removeArchiveTempDirs()
+		cfg.Exitor.Exit(1)
+		return
+	}
+
+	// Combine mode merges multi-part scans before naming them
+	if cfg.CombineGlob != "" {
+		processCombined(cfg.CombineGlob)
+	}
+	inputs := append(slices.Clone(files), jobPaths(jobEntries)...)
+	if cfg.StdinPDF {
+		inputs = append(inputs, stdinSource)
+	}
+	batch.sources = absPathSet(inputs)
+	progress.queue(inputs)
+	for _, pdfFile := range files {
+		if batch.aborted || batch.quit {
+			break
+		}
+		processInput(pdfFile)
+	}
+	for _, entry := range jobEntries {
+		if batch.aborted || batch.quit {
+			break
+		}
+		processJobEntry(entry)
+	}
+	if cfg.StdinPDF {
+		if err := processStdinPDF(os.Stdin); err != nil {
+			batch.processed++
+			batch.recordFailure(stdinSource, err)
+			progress.begin(stdinSource)
+			progress.finish(FileResult{}, err)
 		}
 	}
 
-	fmt.Println("Processing complete!")
+	if cfg.InteractiveBatchEdit {
+		runBatchEdit()
+	}
+	removeArchiveTempDirs()
+	if cfg.DryRunDiff {
+		fmt.Print("\n" + formatDryRunDiff(batch.planned, useColor()))
+	}
+	if cfg.DedupeByName {
+		printNameCollisions()
+	}
+	if outputArchive != nil {
+		err := outputArchive.close()
+		outputArchive = nil
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			cfg.Exitor.Exit(1)
+			return
+		}
+		fmt.Printf("Archive written: %s\n", cfg.Archive)
+	}
+	if cfg.ReportHTML != "" {
+		if err := writeHTMLReport(cfg.ReportHTML, batch.report); err != nil {
+			fmt.Printf("Warning: could not write HTML report: %v\n", err)
+		} else {
+			fmt.Printf("HTML report written: %s\n", cfg.ReportHTML)
+		}
+	}
+	if config.Stats {
+		printUsageStats()
+	}
+	printBatchSummary()
+	if batch.aborted {
+		cfg.Exitor.Exit(1)
+	}
 }
 
 func main() {
@@ -596,6 +7352,149 @@ func main() {
 	model := flag.String("model", defaultConfig.Model, "Ollama model to use for filename generation")
 	noVision := flag.Bool("novision", false, "Disable vision-based processing and use OCR only")
 	outputDir := flag.String("output", "", "Output directory for renamed files (default: same as input)")
+	dpi := flag.Int("dpi", defaultConfig.DPI, "Render resolution (DPI) for full-resolution pages in vision mode")
+	contextPages := flag.Bool("context-pages", defaultConfig.ContextPages, "Send pages after the first -full-res-pages as low-res context rendered at -context-dpi")
+	fullResPages := flag.Int("full-res-pages", defaultConfig.FullResPages, "Number of leading pages rendered at -dpi when -context-pages is set")
+	contextDPI := flag.Int("context-dpi", defaultConfig.ContextDPI, "Render resolution (DPI) for low-res context pages")
+	minNameLength := flag.Int("min-name-length", defaultConfig.MinNameLength, "Treat sanitized names shorter than this as a failed generation (0 disables the check)")
+	combineGlob := flag.String("combine-glob", defaultConfig.CombineGlob, "Merge the PDFs matching this glob into one document and name it from the combined content")
+	combineByPrefix := flag.Bool("combine-by-prefix", defaultConfig.CombineByPrefix, "With -combine-glob, merge matches per shared name prefix (scan_001.pdf, scan_002.pdf -> scan)")
+	combineRemoveParts := flag.Bool("combine-remove-parts", defaultConfig.CombineRemoveParts, "With -combine-glob, delete the parts after the combined document was written")
+	debugImagesDir := flag.String("debug-images", defaultConfig.DebugImagesDir, "Write each page image sent to the vision model to this directory as <source>-pN.png")
+	visionSuffix := flag.String("vision-suffix", defaultConfig.VisionSuffix, "Text appended to the prompt in vision mode (empty sends the bare prompt)")
+	textIntro := flag.String("text-intro", defaultConfig.TextIntro, "Text placed between the prompt and the extracted text in OCR mode (empty sends the prompt directly followed by the text)")
+	failFast := flag.Bool("fail-fast", defaultConfig.FailFast, "Abort the whole run on the first file error (default: keep going)")
+	pages := flag.String("pages", defaultConfig.Pages, "Pages to send in vision mode, e.g. \"1-3,5\" (default: the first 3 pages)")
+	pagesMap := flag.String("pages-map", defaultConfig.PagesMap, "File with per-input page specs, one \"<file> <spec>\" per line, overriding -pages")
+	emitMetadata := flag.Bool("emit-metadata", defaultConfig.EmitMetadata, "Write a <newname>.json sidecar with the readable title and source next to the renamed PDF")
+	setTitle := flag.Bool("set-title", defaultConfig.SetTitle, "Set the PDF document Title of the renamed file to the model's readable name (via Ghostscript)")
+	samplePages := flag.String("sample-pages", defaultConfig.SamplePages, "Page selection strategy when no page spec applies: first, spread (evenly spaced) or random")
+	sampleCount := flag.Int("sample-count", defaultConfig.SampleCount, "Number of pages selected by -sample-pages")
+	sampleSeed := flag.Int64("sample-seed", defaultConfig.SampleSeed, "Seed for -sample-pages random, for reproducible runs (0 picks a new seed every run)")
+	manifest := flag.String("manifest", defaultConfig.Manifest, "Append a JSON Lines record (source, output, status, error) for every processed file to this file")
+	resume := flag.Bool("resume", defaultConfig.Resume, "Skip files that the manifest records as already renamed (manifest defaults to <output>/.ai-pdf-renamer-manifest.jsonl)")
+	ollamaOptionsFile := flag.String("ollama-options-file", defaultConfig.OllamaOptionsFile, "JSON object of Ollama generation options (top_k, top_p, num_ctx, ...) merged into every request; file values win over flags")
+	verbose := flag.Bool("verbose", defaultConfig.Verbose, "Print additional diagnostic output")
+	maxTextChars := flag.Int("max-text-chars", defaultConfig.MaxTextChars, "Cap the OCR text sent to the model to this many characters (0 = no cap)")
+	numCtx := flag.Int("num-ctx", defaultConfig.NumCtx, "Ollama context window (num_ctx) for the OCR path (0 = size automatically from the text length)")
+	maxNumCtx := flag.Int("max-num-ctx", defaultConfig.MaxNumCtx, "Upper bound for the automatically sized num_ctx")
+	postHook := flag.String("post-hook", defaultConfig.PostHook, "Command to run after each successful rename, e.g. 'upload {dst}'; {src}, {dst} and {mode} are substituted")
+	postHookStrict := flag.Bool("post-hook-strict", defaultConfig.PostHookStrict, "Treat a failing -post-hook as a failure of the file instead of only logging it")
+	onCollision := flag.String("on-collision", defaultConfig.OnCollision, "What to do when the output file already exists: overwrite, suffix (name-1.pdf, ...) or skip")
+	dedupeByName := flag.Bool("dedupe-by-name", defaultConfig.DedupeByName, "Report generated names shared by more than one source, and how each collision was resolved, at the end of the run")
+	maxPageBytes := flag.Int("max-page-bytes", defaultConfig.MaxPageBytes, "Re-render a page at -step-down-dpi when its PNG exceeds this many bytes (0 disables)")
+	stepDownDPI := flag.Int("step-down-dpi", defaultConfig.StepDownDPI, "Render resolution for pages whose PNG exceeds -max-page-bytes")
+	allowInvalidImage := flag.Bool("allow-invalid-image", defaultConfig.AllowInvalidImage, "Send page images that fail PNG validation but carry a PNG signature, with a warning (default: strict)")
+	listOnly := flag.Bool("list-matches", defaultConfig.ListMatches, "Print the PDF files the patterns expand to, with a count, and exit without processing")
+	charsBudget := flag.Int("chars-budget", defaultConfig.CharsBudget, "Maximum filename length; replaces {max_length} in the prompt")
+	jsonLogs := flag.Bool("json-logs", defaultConfig.JSONLogs, "Emit one JSON object per event (start, extract, model, rename, error) on stderr")
+	textAlphaBits := flag.Int("text-alpha-bits", defaultConfig.TextAlphaBits, "Ghostscript text antialiasing for page images (1, 2 or 4)")
+	graphicsAlphaBits := flag.Int("graphics-alpha-bits", defaultConfig.GraphicsAlphaBits, "Ghostscript graphics antialiasing for page images (1, 2 or 4)")
+	flag.Var(&gsExtraArgs, "gs-extra", "Extra Ghostscript argument for page rendering, e.g. -dInterpolateControl=-1 (repeatable)")
+	fallbackPattern := flag.String("fallback-pattern", defaultConfig.FallbackPattern, "Last-resort rename 'regex=>replacement' applied to the original basename when the model fails")
+	archive := flag.String("archive", defaultConfig.Archive, "Collect renamed files in a single .zip, .tar or .tar.gz archive instead of writing loose files")
+	interactiveBatchEdit := flag.Bool("interactive-batch-edit", defaultConfig.InteractiveBatchEdit, "Generate all names first, then review and edit them in $EDITOR before renaming")
+	onEmptyPage := flag.String("on-empty-page", defaultConfig.OnEmptyPage, "Blank page policy: skip, error (fail if all pages are blank) or include")
+	numSuggestions := flag.Int("num-suggestions", defaultConfig.NumSuggestions, "Request this many names and keep the one with the best readability score")
+	readabilityScore := flag.Int("readability-score", defaultConfig.ReadabilityScore, "Treat names scoring below this (distinct keywords minus junk tokens) as a failed generation (0 disables)")
+	cleanText := flag.String("clean-text", defaultConfig.CleanText, "Remove noise from OCR text before it is sent: comma-separated urls, emails, digits (6+ digit runs) or all")
+	classify := flag.Bool("classify", defaultConfig.Classify, "Detect the document type (one of -categories) with an extra model call")
+	categories := flag.String("categories", defaultConfig.Categories, "Comma-separated document types for -classify")
+	routeByType := flag.Bool("route-by-type", defaultConfig.RouteByType, "With -classify, file renamed documents into -output/<type>/ (unknown types go to unsorted/)")
+	lang := flag.String("lang", defaultConfig.Lang, "OCR language(s) passed to ocrmypdf -l, e.g. deu or eng+deu (checked against the installed tesseract data)")
+	nameFrom := flag.String("name-from", defaultConfig.NameFrom, "Name source: metadata (use the PDF Title, call the model only if absent), content or both (model seeded with the Title)")
+	quietErrors := flag.Bool("quiet-errors", defaultConfig.QuietErrors, "Don't print per-file errors inline; list them only in the final \"Errors\" summary")
+	examplesFile := flag.String("examples-file", defaultConfig.ExamplesFile, "JSON array of {\"content\", \"filename\"} examples shown to the model before the request")
+	maxExamples := flag.Int("max-examples", defaultConfig.MaxExamples, "Maximum number of -examples-file entries injected into the prompt")
+	charset := flag.String("charset", defaultConfig.Charset, "Characters kept in filenames: ascii or unicode (keeps accented and non-Latin letters)")
+	canonicalizeUnicode := flag.String("canonicalize-unicode", defaultConfig.CanonicalizeUnicode, "Normalize names for -charset unicode: nfc, nfkc (also folds ligatures and full-width forms) or none")
+	gsTimeout := flag.Duration("gs-timeout", defaultConfig.GSTimeout, "Kill a Ghostscript call that runs longer than this, e.g. 30s (0 disables)")
+	ocrTimeout := flag.Duration("ocr-timeout", defaultConfig.OCRTimeout, "Kill an ocrmypdf call that runs longer than this, e.g. 5m (0 disables)")
+	previewImage := flag.Bool("preview-image", defaultConfig.PreviewImage, "Show a thumbnail of page 1 before the confirmation prompt (iTerm2, WezTerm, kitty, Ghostty)")
+	setXattrFlag := flag.Bool("set-xattr", defaultConfig.SetXattr, "Write the suggested name to an extended attribute of the source file instead of renaming it")
+	xattrKey := flag.String("xattr-key", defaultConfig.XattrKey, "Extended attribute used by -set-xattr")
+	minConfidence := flag.Int("min-confidence", defaultConfig.MinConfidence, "Ask the model to rate its name 1-10 and keep the original name below this (0 disables)")
+	normalizeDashes := flag.Bool("normalize-dashes", defaultConfig.NormalizeDashes, "Map Unicode dashes, curly quotes, non-breaking spaces and bullets to ASCII before building the filename")
+	rateLimit := flag.Float64("rate-limit", defaultConfig.RateLimit, "Maximum Ollama generate requests per second, e.g. 0.5 for one request every two seconds (0 = unlimited)")
+	detectLanguage := flag.Bool("detect-language", defaultConfig.DetectLanguage, "Detect the primary document language and record it in the -emit-metadata sidecar")
+	languagePrefix := flag.Bool("language-prefix", defaultConfig.LanguagePrefix, "With -detect-language, prefix the filename with the language code, e.g. de-Rechnung-2024")
+	noClobberSource := flag.Bool("no-clobber-source", defaultConfig.NoClobberSource, "Refuse to write a renamed file over another input file of the same batch (-no-clobber-source=false disables)")
+	describe := flag.Bool("describe", defaultConfig.Describe, "Print a one-sentence description of each PDF instead of renaming it")
+	describePrompt := flag.String("describe-prompt", defaultConfig.DescribePrompt, "Prompt used to describe documents in -describe mode")
+	describeTxt := flag.Bool("describe-txt", defaultConfig.DescribeTxt, "With -describe, also write each description to <file>.txt (inside -output if given)")
+	safeNames := flag.Bool("safe-names", defaultConfig.SafeNames, "Guarantee names that are URL-safe, free of shell metacharacters and never start with a dash")
+	ocrJobs := flag.Int("ocr-jobs", defaultConfig.OCRJobs, "CPU threads ocrmypdf may use per document, passed as --jobs (0 = ocrmypdf default)")
+	trimScannerPrefix := flag.Bool("trim-scanner-prefix", defaultConfig.TrimScannerPrefix, "Pass the original name, stripped of scanner prefixes like SKM_ or IMG_, to the model as a hint and use it when naming fails")
+	scannerPrefixes := flag.String("scanner-prefixes", defaultConfig.ScannerPrefixes, "Comma-separated filename prefixes that scanners and cameras use")
+	scannerPrefixesFile := flag.String("scanner-prefixes-file", defaultConfig.ScannerPrefixesFile, "File with one scanner prefix per line, replacing -scanner-prefixes")
+	onlyScannerNames := flag.Bool("only-scanner-names", defaultConfig.OnlyScannerNames, "Only rename files whose name is a scanner default such as SKM_C224e0123.pdf")
+	dateSubdir := flag.Bool("date-subdir", defaultConfig.DateSubdir, "File renamed documents into -output/YYYY/MM/ by document date (name, PDF metadata or file time; otherwise unknown-date/)")
+	verifyPDF := flag.Bool("verify-pdf", defaultConfig.VerifyPDF, "Check that the source PDF and the written output parse cleanly (qpdf --check if installed, Ghostscript otherwise)")
+	normalizeCaseInText := flag.Bool("normalize-case-in-text", defaultConfig.NormalizeCaseInText, "Lowercase ALL-CAPS lines (keeping acronyms) in the OCR text so the model does not echo shouty headers")
+	progressJSON := flag.Bool("progress-json", defaultConfig.ProgressJSON, "Emit one JSON progress event per line on stdout for UIs and suppress the human-readable output (needs -auto or -describe)")
+	cropTop := flag.Float64("crop-top", defaultConfig.CropTop, "In vision mode, send only the top fraction of each full-resolution page, e.g. 0.4 for the header/title region (0 = whole page)")
+	visionModel := flag.String("vision-model", defaultConfig.VisionModel, "Model for page images in vision mode, overriding -model")
+	textModel := flag.String("text-model", defaultConfig.TextModel, "Model for OCR text (-novision and the OCR fallback), overriding -model")
+	onFailure := flag.String("on-failure", defaultConfig.OnFailure, "What happens to inputs that fail: keep (leave in place) or quarantine (move to -quarantine-dir)")
+	quarantineDir := flag.String("quarantine-dir", defaultConfig.QuarantineDir, "Directory that -on-failure quarantine moves failed inputs to, with a .failure.json sidecar")
+	dryRun := flag.Bool("dry-run", defaultConfig.DryRun, "Show the suggested names without prompting or writing any file")
+	dryRunDiff := flag.Bool("dry-run-diff", defaultConfig.DryRunDiff, "With -dry-run, end with an aligned old -> new diff that highlights the changed parts and lists unchanged names separately")
+	noColor := flag.Bool("no-color", defaultConfig.NoColor, "Disable colored output (also disabled by the NO_COLOR environment variable)")
+	appendPageCount := flag.Bool("append-page-count", defaultConfig.AppendPageCount, "Append the page count to the name, e.g. Invoice-ACME-p5.pdf (single-page documents get no suffix unless -page-count-single)")
+	pageCountSingle := flag.Bool("page-count-single", defaultConfig.PageCountSingle, "With -append-page-count, also append -p1 to single-page documents")
+	allowSpaces := flag.Bool("allow-spaces", defaultConfig.AllowSpaces, "Keep single spaces between words (e.g. \"Quarterly Report 2023.pdf\") instead of replacing them with dashes")
+	titleCase := flag.Bool("title-case", defaultConfig.TitleCase, "Capitalize the first letter of every word in the name")
+	nameLang := flag.String("name-lang", defaultConfig.NameLang, "Language to name files in, e.g. English or en (independent of the OCR -lang)")
+	escalateModel := flag.String("escalate-model", defaultConfig.EscalateModel, "Retry the whole pipeline once with this (stronger) model when vision and OCR both fail")
+	reportHTML := flag.String("report-html", defaultConfig.ReportHTML, "Write a self-contained HTML page listing each file's source name, new name and mode (with page thumbnails when -debug-images is set)")
+	numbers := flag.String("numbers", defaultConfig.Numbers, "Digits in names: keep, strip (remove digit-only words) or collapse (shorten digit runs longer than -numbers-max-digits)")
+	numbersMaxDigits := flag.Int("numbers-max-digits", defaultConfig.NumbersMaxDigits, "With -numbers collapse, digit runs longer than this keep only their last N digits")
+	inputJSON := flag.String("input-json", defaultConfig.InputJSON, "Process the files listed in this JSON spec, a list of {path, prompt, model, output} objects with per-file overrides")
+	detectDuplicatePages := flag.Bool("detect-duplicate-pages", defaultConfig.DetectDuplicatePages, "Drop page images that are near-duplicates of an earlier page (e.g. a repeated fax cover) in vision mode")
+	duplicateThreshold := flag.Int("duplicate-threshold", defaultConfig.DuplicateThreshold, "With -detect-duplicate-pages, maximum perceptual hash distance (0-64) for pages to count as duplicates")
+	applyMap := flag.String("apply-map", defaultConfig.ApplyMap, "Apply the names in this TSV file (source<TAB>new-name per line) without any model calls")
+	reviewDir := flag.String("review-dir", defaultConfig.ReviewDir, "With -min-confidence, copy files rated below the threshold into this directory with a .review.json sidecar holding the suggested name")
+	firstPageFastPath := flag.Bool("gs-first-page-only-fast-path", defaultConfig.FirstPageFastPath, "Count the pages before rendering, so a single-page PDF is rendered once without probing for further pages")
+	retries := flag.Int("retries", defaultConfig.Retries, "Retry a generate call this many times when the answer is empty or too short, at rising temperatures and new seeds")
+	temperatureSchedule := flag.String("temperature-schedule", defaultConfig.TemperatureSchedule, "Comma-separated temperatures for the -retries attempts; the last one is reused for further retries")
+	keywords := flag.Int("keywords", defaultConfig.Keywords, "Ask the model for N keywords per document and write them to <newname>.tags, one per line (0 disables)")
+	stdinPDF := flag.Bool("stdin-pdf", defaultConfig.StdinPDF, "Read one PDF from stdin instead of file arguments (needs -auto or -stdout-name)")
+	stdoutName := flag.Bool("stdout-name", defaultConfig.StdoutName, "Print only the suggested name of each file on stdout, one per line, and write nothing; other output goes to stderr")
+	maxMegapixels := flag.Float64("max-megapixels", defaultConfig.MaxMegapixels, "Downscale rendered pages larger than this many megapixels before sending them, e.g. 12 (0 disables)")
+	scheme := flag.String("scheme", defaultConfig.Scheme, "Compose the filename from placeholders, e.g. \"{date}_{type}_{name}\" ({name}, {date}, {type}, {keywords}, {original}, {hash}, {pages})")
+	validateOnly := flag.Bool("validate-only", defaultConfig.ValidateOnly, "Check the names of the matched PDFs against the naming rules (-charset, -allow-spaces, -chars-budget, ...), report violations and exit; non-zero exit if any fail")
+	stream := flag.Bool("stream", defaultConfig.Stream, "Stream the answer from Ollama chunk by chunk; with -verbose the answer is shown as it is generated")
+	dedupeAgainstOutput := flag.Bool("dedupe-against-output", defaultConfig.DedupeAgainstOutput, "Skip inputs whose content (SHA-256) matches a PDF already in -output, e.g. renamed by an earlier run")
+	maxWords := flag.Int("max-words", defaultConfig.MaxWords, "Keep only the first N words of the generated name, e.g. 4 (0 = no limit)")
+	ocrOutputType := flag.String("ocr-output-type", defaultConfig.OCROutputType, "What ocrmypdf does with the PDF: none (only extract the text), pdf or pdfa (add the text layer to the input file in place)")
+	setupWizard := flag.Bool("setup", defaultConfig.Setup, "Guided first-time setup: check the tools, pick an Ollama model (optionally pulling one) and save it as the default, then exit")
+	annotatePageNumbers := flag.Bool("image-annotate-page-numbers", defaultConfig.AnnotatePageNumbers, "Draw a \"Page N\" label in the top-left corner of every page image, so the model can tell multiple pages apart")
+	failOnModelSwitch := flag.Bool("fail-on-model-switch", defaultConfig.FailOnModelSwitch, "In vision mode, never replace -model with qwen2.5vl:7b: keep it if Ollama reports vision support, otherwise stop with an error")
+	separator := flag.String("separator", defaultConfig.Separator, "Word separator in generated names: dash or underscore")
+	nameCase := flag.String("case", defaultConfig.Case, "Letter case of generated names: keep or lower")
+	stripStopwords := flag.Bool("strip-stopwords", defaultConfig.StripStopwords, "Drop filler words (the, and, der, und, le, ...) from generated names")
+	sanitizeProfile := flag.String("sanitize-profile", defaultConfig.SanitizeProfile, "Preset naming rules: strict, relaxed or dms; options given individually override the preset")
+	gsDeviceFallback := flag.String("gs-device-fallback", defaultConfig.GSDeviceFallback, "Ghostscript devices to retry a page with, in order, when rendering with png16m fails, e.g. pnggray,pngmono")
+	stats := flag.Bool("stats", defaultConfig.Stats, "Print Ollama requests, image bytes sent, OCR characters and response times (total and per model) at the end, and record them per file in the manifest")
+	yes := flag.Bool("yes", defaultConfig.Yes, "Confirm destructive -auto runs (deleting parts, moving or rewriting originals) up front, required when not running in a terminal; also lifts -max-files")
+	pageTextExtract := flag.Bool("page-text-extract", defaultConfig.PageTextExtract, "In the text path, read the PDF's embedded text layer (pdftotext, else Ghostscript txtwrite) and only run ocrmypdf if it has too little text")
+	minTextChars := flag.Int("min-text-chars", defaultConfig.MinTextChars, "With -page-text-extract, the text layer characters needed to skip OCR")
+	useDirContext := flag.Bool("use-dir-context", defaultConfig.UseDirContext, "Pass the name of the folder each PDF is in (only the name, not the path) to the model as a hint")
+	maxRuntimePerFile := flag.Duration("max-runtime-per-file", defaultConfig.MaxRuntimePerFile, "Abandon a file when naming it takes longer than this in total, across all tools and retries (e.g. 5m; 0 means no limit)")
+	promptHashInCacheKey := flag.Bool("prompt-hash-in-cache-key", defaultConfig.PromptHashInCacheKey, "Record a hash of the content, prompt, model and naming options in the manifest, and let -resume skip a file only while that hash is unchanged")
+	jsonErrors := flag.Bool("json-errors", defaultConfig.JSONErrors, "Write each failed file to stderr as a JSON object {file, phase, code, message}, one per line")
+	autoMode := flag.Bool("auto-mode", defaultConfig.AutoMode, "Choose per file: the text path (with the PDF's text layer) if page 1 has at least -min-text-chars of extractable text, vision otherwise")
+	normalizeInvoiceDates := flag.Bool("normalize-invoice-dates", defaultConfig.NormalizeInvoiceDates, "Rewrite dates in generated names (Jan 5 2023, 05/01/23, 5. März 2023) as YYYY-MM-DD so they sort correctly")
+	dateOrder := flag.String("date-order", defaultConfig.DateOrder, "How -normalize-invoice-dates reads ambiguous numeric dates like 05/01/23: mdy or dmy")
+	maxFiles := flag.Int("max-files", defaultConfig.MaxFiles, "Refuse to start when the patterns match more files than this, unless -yes is given (0 means no limit)")
+	useCropBox := flag.Bool("use-cropbox", defaultConfig.UseCropBox, "Render only the visible area of each page (its CropBox) instead of the full MediaBox, which can carry large empty margins")
+	textSampling := flag.String("text-sampling", defaultConfig.TextSampling, "Which part of the text -max-text-chars keeps: head, head-tail (first and last half, joined by an elision marker) or tail")
+	emitThumbnail := flag.Bool("emit-thumbnail", defaultConfig.EmitThumbnail, "Write a thumbnail of page 1 as <newname>.thumb.jpg next to the renamed PDF")
+	thumbnailWidth := flag.Int("thumbnail-width", defaultConfig.ThumbnailWidth, "Width of -emit-thumbnail images in pixels")
+	thumbnailFormat := flag.String("thumbnail-format", defaultConfig.ThumbnailFormat, "Image format of -emit-thumbnail: jpg or png")
+	gsPageRenderCache := flag.Bool("gs-page-render-cache", defaultConfig.GSPageRenderCache, "Keep the pages rendered for a file in memory, so passes that render the same page again (e.g. -escalate-model) don't call Ghostscript twice")
+	collisionSuffix := flag.String("collision-suffix", defaultConfig.CollisionSuffix, "How colliding names are made unique: number (name-1.pdf, ...) or hash (a short hash of the file content, name-3f9a2c1e.pdf)")
+	dumpRequest := flag.Bool("dump-request", defaultConfig.DumpRequest, "Print the JSON of every request sent to Ollama (model, prompt, options, ...), with each image replaced by a \"<N bytes>\" placeholder")
 
 	// Custom usage function to provide clearer help
 	flag.Usage = func() {
@@ -607,19 +7506,200 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s -novision *.pdf            # Use OCR-only mode\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -auto *.pdf                # Process all PDFs automatically\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -model llama3.3:latest *.pdf # Use a different model\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -setup                     # Guided first-time setup\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nNote: Vision-based processing is enabled by default. Use -novision to disable it and use OCR only.\n")
 	}
 
 	flag.Parse()
 
+	// A prompt given on the command line wins over directory prompt files
+	promptExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "prompt" {
+			promptExplicit = true
+		}
+	})
+
+	// Defaults saved by -setup; options given on the command line take precedence
+	if path, err := settingsPath(); err == nil {
+		settings, err := readSettings(path)
+		if err == nil {
+			err = applySettings(flag.CommandLine, settings, "settings file")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// The profile fills in only what wasn't set on the command line or in the settings file
+	if *sanitizeProfile != "" {
+		if err := applySanitizeProfile(flag.CommandLine, *sanitizeProfile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// An explicit -on-collision overwrite is confirmed like the other destructive options
+	onCollisionExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "on-collision" {
+			onCollisionExplicit = true
+		}
+	})
+
 	// Build config from flags
 	cfg := Config{
-		AutoRename:   *autoRename,
-		CustomPrompt: *customPrompt,
-		Model:        *model,
-		FastMode:     !*noVision, // Invert the novision flag to get FastMode
-		OutputDir:    *outputDir,
-		Exitor:       &DefaultExitor{},
+		AutoRename:            *autoRename,
+		CustomPrompt:          *customPrompt,
+		Model:                 *model,
+		FastMode:              !*noVision, // Invert the novision flag to get FastMode
+		OutputDir:             *outputDir,
+		DPI:                   *dpi,
+		ContextPages:          *contextPages,
+		FullResPages:          *fullResPages,
+		ContextDPI:            *contextDPI,
+		MinNameLength:         *minNameLength,
+		CombineGlob:           *combineGlob,
+		CombineByPrefix:       *combineByPrefix,
+		CombineRemoveParts:    *combineRemoveParts,
+		DebugImagesDir:        *debugImagesDir,
+		VisionSuffix:          *visionSuffix,
+		TextIntro:             *textIntro,
+		FailFast:              *failFast,
+		Pages:                 *pages,
+		PagesMap:              *pagesMap,
+		EmitMetadata:          *emitMetadata,
+		SetTitle:              *setTitle,
+		SamplePages:           *samplePages,
+		SampleCount:           *sampleCount,
+		SampleSeed:            *sampleSeed,
+		Manifest:              *manifest,
+		Resume:                *resume,
+		OllamaOptionsFile:     *ollamaOptionsFile,
+		Verbose:               *verbose,
+		MaxTextChars:          *maxTextChars,
+		NumCtx:                *numCtx,
+		MaxNumCtx:             *maxNumCtx,
+		PostHook:              *postHook,
+		PostHookStrict:        *postHookStrict,
+		OnCollision:           *onCollision,
+		DedupeByName:          *dedupeByName,
+		MaxPageBytes:          *maxPageBytes,
+		StepDownDPI:           *stepDownDPI,
+		AllowInvalidImage:     *allowInvalidImage,
+		ListMatches:           *listOnly,
+		PromptExplicit:        promptExplicit,
+		CharsBudget:           *charsBudget,
+		JSONLogs:              *jsonLogs,
+		TextAlphaBits:         *textAlphaBits,
+		GraphicsAlphaBits:     *graphicsAlphaBits,
+		FallbackPattern:       *fallbackPattern,
+		Archive:               *archive,
+		InteractiveBatchEdit:  *interactiveBatchEdit,
+		OnEmptyPage:           *onEmptyPage,
+		NumSuggestions:        *numSuggestions,
+		ReadabilityScore:      *readabilityScore,
+		CleanText:             *cleanText,
+		Classify:              *classify,
+		Categories:            *categories,
+		RouteByType:           *routeByType,
+		Lang:                  *lang,
+		NameFrom:              *nameFrom,
+		QuietErrors:           *quietErrors,
+		ExamplesFile:          *examplesFile,
+		MaxExamples:           *maxExamples,
+		Charset:               *charset,
+		CanonicalizeUnicode:   *canonicalizeUnicode,
+		GSTimeout:             *gsTimeout,
+		OCRTimeout:            *ocrTimeout,
+		PreviewImage:          *previewImage,
+		SetXattr:              *setXattrFlag,
+		XattrKey:              *xattrKey,
+		MinConfidence:         *minConfidence,
+		NormalizeDashes:       *normalizeDashes,
+		RateLimit:             *rateLimit,
+		DetectLanguage:        *detectLanguage,
+		LanguagePrefix:        *languagePrefix,
+		NoClobberSource:       *noClobberSource,
+		Describe:              *describe,
+		DescribePrompt:        *describePrompt,
+		DescribeTxt:           *describeTxt,
+		SafeNames:             *safeNames,
+		OCRJobs:               *ocrJobs,
+		TrimScannerPrefix:     *trimScannerPrefix,
+		ScannerPrefixes:       *scannerPrefixes,
+		ScannerPrefixesFile:   *scannerPrefixesFile,
+		OnlyScannerNames:      *onlyScannerNames,
+		DateSubdir:            *dateSubdir,
+		VerifyPDF:             *verifyPDF,
+		NormalizeCaseInText:   *normalizeCaseInText,
+		ProgressJSON:          *progressJSON,
+		CropTop:               *cropTop,
+		VisionModel:           *visionModel,
+		TextModel:             *textModel,
+		OnFailure:             *onFailure,
+		QuarantineDir:         *quarantineDir,
+		DryRun:                *dryRun,
+		DryRunDiff:            *dryRunDiff,
+		NoColor:               *noColor,
+		AppendPageCount:       *appendPageCount,
+		PageCountSingle:       *pageCountSingle,
+		AllowSpaces:           *allowSpaces,
+		TitleCase:             *titleCase,
+		NameLang:              *nameLang,
+		EscalateModel:         *escalateModel,
+		ReportHTML:            *reportHTML,
+		Numbers:               *numbers,
+		NumbersMaxDigits:      *numbersMaxDigits,
+		InputJSON:             *inputJSON,
+		DetectDuplicatePages:  *detectDuplicatePages,
+		DuplicateThreshold:    *duplicateThreshold,
+		ApplyMap:              *applyMap,
+		ReviewDir:             *reviewDir,
+		FirstPageFastPath:     *firstPageFastPath,
+		Retries:               *retries,
+		TemperatureSchedule:   *temperatureSchedule,
+		Keywords:              *keywords,
+		StdinPDF:              *stdinPDF,
+		StdoutName:            *stdoutName,
+		MaxMegapixels:         *maxMegapixels,
+		Scheme:                *scheme,
+		ValidateOnly:          *validateOnly,
+		Stream:                *stream,
+		DedupeAgainstOutput:   *dedupeAgainstOutput,
+		MaxWords:              *maxWords,
+		OCROutputType:         *ocrOutputType,
+		Setup:                 *setupWizard,
+		AnnotatePageNumbers:   *annotatePageNumbers,
+		FailOnModelSwitch:     *failOnModelSwitch,
+		Separator:             *separator,
+		Case:                  *nameCase,
+		StripStopwords:        *stripStopwords,
+		SanitizeProfile:       *sanitizeProfile,
+		GSDeviceFallback:      *gsDeviceFallback,
+		Stats:                 *stats,
+		Yes:                   *yes,
+		PageTextExtract:       *pageTextExtract,
+		MinTextChars:          *minTextChars,
+		UseDirContext:         *useDirContext,
+		MaxRuntimePerFile:     *maxRuntimePerFile,
+		PromptHashInCacheKey:  *promptHashInCacheKey,
+		JSONErrors:            *jsonErrors,
+		AutoMode:              *autoMode,
+		NormalizeInvoiceDates: *normalizeInvoiceDates,
+		DateOrder:             *dateOrder,
+		MaxFiles:              *maxFiles,
+		UseCropBox:            *useCropBox,
+		TextSampling:          *textSampling,
+		EmitThumbnail:         *emitThumbnail,
+		ThumbnailWidth:        *thumbnailWidth,
+		ThumbnailFormat:       *thumbnailFormat,
+		GSPageRenderCache:     *gsPageRenderCache,
+		CollisionSuffix:       *collisionSuffix,
+		DumpRequest:           *dumpRequest,
+		OnCollisionExplicit:   onCollisionExplicit,
+		Exitor:                &DefaultExitor{},
 	}
 
 	setup(cfg)
@@ -1,12 +1,34 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 // MockExitor implements Exitor for testing purposes
@@ -382,3 +404,4345 @@ func TestModelSwitching(t *testing.T) {
 		})
 	}
 }
+
+// TestPageDPI verifies that context pages are rendered at the lower resolution
+func TestPageDPI(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tests := []struct {
+		name         string
+		contextPages bool
+		fullResPages int
+		page         int
+		expectedDPI  int
+	}{
+		{name: "Disabled, first page", contextPages: false, fullResPages: 1, page: 1, expectedDPI: 300},
+		{name: "Disabled, later page", contextPages: false, fullResPages: 1, page: 3, expectedDPI: 300},
+		{name: "Enabled, first page", contextPages: true, fullResPages: 1, page: 1, expectedDPI: 300},
+		{name: "Enabled, context page", contextPages: true, fullResPages: 1, page: 2, expectedDPI: 100},
+		{name: "Enabled, two full-res pages", contextPages: true, fullResPages: 2, page: 2, expectedDPI: 300},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = getDefaultConfig()
+			config.ContextPages = tt.contextPages
+			config.FullResPages = tt.fullResPages
+			if got := pageDPI(tt.page); got != tt.expectedDPI {
+				t.Errorf("pageDPI(%d) = %d, want %d", tt.page, got, tt.expectedDPI)
+			}
+		})
+	}
+}
+
+// TestSanitizeFilenameRejectsFailedResponses verifies that degenerate model output is treated as a failure
+func TestSanitizeFilenameRejectsFailedResponses(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tests := []struct {
+		name      string
+		response  string
+		expected  string
+		expectErr bool
+	}{
+		{name: "Regular response", response: "Invoice ACME 2023", expected: "Invoice-ACME-2023", expectErr: false},
+		{name: "Single character", response: "a", expected: "a", expectErr: true},
+		{name: "All separators", response: "-- ... !!", expected: "", expectErr: true},
+		{name: "Empty response", response: "", expected: "", expectErr: true},
+		{name: "Exactly minimum length", response: "abc", expected: "abc", expectErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeFilename(tt.response)
+			if got != tt.expected {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.response, got, tt.expected)
+			}
+			err := validateGeneratedName(got)
+			if (err != nil) != tt.expectErr {
+				t.Errorf("validateGeneratedName(%q) error = %v, expectErr %v", got, err, tt.expectErr)
+			}
+		})
+	}
+}
+
+// TestGroupCombineParts verifies how multi-part scans are grouped before merging
+func TestGroupCombineParts(t *testing.T) {
+	parts := []string{
+		filepath.Join("in", "scan_001.pdf"),
+		filepath.Join("in", "scan_002.pdf"),
+		filepath.Join("in", "receipt-1.pdf"),
+		filepath.Join("in", "receipt-2.pdf"),
+	}
+
+	all := groupCombineParts(parts, false)
+	if len(all) != 1 || len(all[0]) != 4 {
+		t.Errorf("Without prefix grouping all parts should form one group, got %v", all)
+	}
+
+	grouped := groupCombineParts(parts, true)
+	if len(grouped) != 2 {
+		t.Fatalf("Expected 2 prefix groups, got %d: %v", len(grouped), grouped)
+	}
+	if grouped[0][0] != parts[0] || grouped[0][1] != parts[1] {
+		t.Errorf("First group = %v, want the scan_ parts in order", grouped[0])
+	}
+	if grouped[1][0] != parts[2] || grouped[1][1] != parts[3] {
+		t.Errorf("Second group = %v, want the receipt- parts in order", grouped[1])
+	}
+
+	if groupCombineParts(nil, true) != nil {
+		t.Error("Expected no groups for no parts")
+	}
+}
+
+// TestPromptSuffixes verifies the configurable vision suffix and text intro
+func TestPromptSuffixes(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	config.CustomPrompt = "Name it."
+	config.PromptExplicit = true
+	if got, want := visionPrompt("doc.pdf"), "Name it."+defaultVisionSuffix; got != want {
+		t.Errorf("visionPrompt() = %q, want %q", got, want)
+	}
+	if got, want := textPrompt("doc.pdf", "hello"), "Name it. Text: hello"; got != want {
+		t.Errorf("textPrompt() = %q, want %q", got, want)
+	}
+
+	config.VisionSuffix = ""
+	config.TextIntro = ""
+	if got := visionPrompt("doc.pdf"); got != "Name it." {
+		t.Errorf("visionPrompt() with empty suffix = %q, want the bare prompt", got)
+	}
+	if got := textPrompt("doc.pdf", "hello"); got != "Name it.hello" {
+		t.Errorf("textPrompt() with empty intro = %q, want prompt directly followed by text", got)
+	}
+}
+
+// TestRecordFailure verifies keep-going and fail-fast batch error behavior and the
+// collection of errors for the final summary
+func TestRecordFailure(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	b := batchState{}
+	if b.recordFailure("a.pdf", fmt.Errorf("ocr failed")) || b.recordFailure("b.pdf", fmt.Errorf("model missing")) {
+		t.Error("Default keep-going mode should never abort")
+	}
+	if b.failed != 2 {
+		t.Errorf("failed = %d, want 2", b.failed)
+	}
+	if len(b.errors) != 2 || b.errors[1] != (fileError{source: "b.pdf", reason: "model missing"}) {
+		t.Errorf("errors = %v, want both failures collected in order", b.errors)
+	}
+
+	config.FailFast = true
+	b = batchState{}
+	if !b.recordFailure("a.pdf", fmt.Errorf("ocr failed")) {
+		t.Error("-fail-fast should abort on the first failure")
+	}
+	if !b.aborted {
+		t.Error("aborted should be set after a -fail-fast failure")
+	}
+}
+
+// TestParsePageSpec verifies page spec parsing
+func TestParsePageSpec(t *testing.T) {
+	tests := []struct {
+		spec      string
+		expected  []int
+		expectErr bool
+	}{
+		{spec: "1", expected: []int{1}},
+		{spec: "1-3,5", expected: []int{1, 2, 3, 5}},
+		{spec: "1, 3, 5, 7", expected: []int{1, 3, 5, 7}},
+		{spec: "0", expectErr: true},
+		{spec: "3-1", expectErr: true},
+		{spec: "a-b", expectErr: true},
+		{spec: ",", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parsePageSpec(tt.spec)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("parsePageSpec(%q) error = %v, expectErr %v", tt.spec, err, tt.expectErr)
+			}
+			if tt.expectErr {
+				return
+			}
+			if len(got) != len(tt.expected) {
+				t.Fatalf("parsePageSpec(%q) = %v, want %v", tt.spec, got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("parsePageSpec(%q) = %v, want %v", tt.spec, got, tt.expected)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestPageSpecForFile verifies the precedence of sidecar, pages map and global spec
+func TestPageSpecForFile(t *testing.T) {
+	originalConfig, originalPagesMap := config, pagesMap
+	defer func() { config, pagesMap = originalConfig, originalPagesMap }()
+
+	tmpDir := t.TempDir()
+	withSidecar := filepath.Join(tmpDir, "sidecar.pdf")
+	if err := os.WriteFile(withSidecar+".pages", []byte("1,3\n"), 0644); err != nil {
+		t.Fatalf("Failed to write sidecar: %v", err)
+	}
+
+	mapFile := filepath.Join(tmpDir, "pages.map")
+	if err := os.WriteFile(mapFile, []byte("# comment\nsidecar.pdf 9\nmapped.pdf 2-4\n"), 0644); err != nil {
+		t.Fatalf("Failed to write pages map: %v", err)
+	}
+	var err error
+	if pagesMap, err = loadPagesMap(mapFile); err != nil {
+		t.Fatalf("loadPagesMap() error = %v", err)
+	}
+
+	config = getDefaultConfig()
+	config.Pages = "1"
+
+	if got := pageSpecForFile(withSidecar); got != "1,3" {
+		t.Errorf("Sidecar spec = %q, want %q", got, "1,3")
+	}
+	if got := pageSpecForFile(filepath.Join(tmpDir, "mapped.pdf")); got != "2-4" {
+		t.Errorf("Pages map spec = %q, want %q", got, "2-4")
+	}
+	if got := pageSpecForFile(filepath.Join(tmpDir, "other.pdf")); got != "1" {
+		t.Errorf("Global spec = %q, want %q", got, "1")
+	}
+}
+
+// TestNewGeneratedName verifies that both the readable name and the slug are kept
+func TestNewGeneratedName(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tests := []struct {
+		name             string
+		response         string
+		expectedReadable string
+		expectedSlug     string
+		expectErr        bool
+	}{
+		{name: "Plain title", response: "Quarterly Report 2023", expectedReadable: "Quarterly Report 2023", expectedSlug: "Quarterly-Report-2023"},
+		{name: "Quoted", response: "  \"Invoice ACME\"\n", expectedReadable: "Invoice ACME", expectedSlug: "Invoice-ACME"},
+		{name: "Leading blank line", response: "\nLease Agreement", expectedReadable: "Lease Agreement", expectedSlug: "Lease-Agreement"},
+		{name: "Punctuation only", response: "?!", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newGeneratedName(tt.response)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("newGeneratedName(%q) error = %v, expectErr %v", tt.response, err, tt.expectErr)
+			}
+			if got.Readable != tt.expectedReadable || got.Slug != tt.expectedSlug {
+				t.Errorf("newGeneratedName(%q) = %+v, want {Readable:%s Slug:%s}", tt.response, got, tt.expectedReadable, tt.expectedSlug)
+			}
+		})
+	}
+}
+
+// TestPDFTextString verifies the UTF-16BE hex encoding used for the PDF title
+func TestPDFTextString(t *testing.T) {
+	if got, want := pdfTextString("Aé"), "<FEFF004100E9>"; got != want {
+		t.Errorf("pdfTextString() = %q, want %q", got, want)
+	}
+}
+
+// TestSamplePages verifies the spread and random page selection strategies
+func TestSamplePages(t *testing.T) {
+	equal := func(a, b []int) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	if got := samplePages("spread", 200, 3, nil); !equal(got, []int{1, 101, 200}) {
+		t.Errorf("spread over 200 pages = %v, want [1 101 200]", got)
+	}
+	if got := samplePages("spread", 2, 3, nil); !equal(got, []int{1, 2}) {
+		t.Errorf("spread over a short document = %v, want all pages", got)
+	}
+
+	first := samplePages("random", 200, 4, rand.New(rand.NewSource(42)))
+	second := samplePages("random", 200, 4, rand.New(rand.NewSource(42)))
+	if len(first) != 4 || !equal(first, second) {
+		t.Errorf("random sampling with the same seed should be reproducible, got %v and %v", first, second)
+	}
+	for i, page := range first {
+		if page < 1 || page > 200 || (i > 0 && page <= first[i-1]) {
+			t.Errorf("random sample %v should be sorted, unique and within the document", first)
+			break
+		}
+	}
+}
+
+// TestManifestResume verifies that renamed sources with an existing output are resumed
+func TestManifestResume(t *testing.T) {
+	originalManifestPath := manifestPath
+	defer func() { manifestPath = originalManifestPath }()
+
+	tmpDir := t.TempDir()
+	manifestPath = filepath.Join(tmpDir, defaultManifestName)
+	output := filepath.Join(tmpDir, "Invoice-ACME.pdf")
+	if err := os.WriteFile(output, []byte("%PDF"), 0644); err != nil {
+		t.Fatalf("Failed to write output: %v", err)
+	}
+
+	recordManifest("renamed.pdf", FileResult{Output: output, Mode: "vision mode"}, nil)
+	recordManifest("missing-output.pdf", FileResult{Output: filepath.Join(tmpDir, "gone.pdf")}, nil)
+	recordManifest("kept.pdf", FileResult{Mode: "vision mode"}, nil)
+	recordManifest("failed.pdf", FileResult{}, os.ErrNotExist)
+
+	done, err := loadResumeSet(manifestPath)
+	if err != nil {
+		t.Fatalf("loadResumeSet() error = %v", err)
+	}
+	if _, ok := done[manifestKey("renamed.pdf")]; !ok {
+		t.Error("Renamed source with existing output should be resumed")
+	}
+	for _, source := range []string{"missing-output.pdf", "kept.pdf", "failed.pdf"} {
+		if _, ok := done[manifestKey(source)]; ok {
+			t.Errorf("%s should be processed again", source)
+		}
+	}
+
+	if done, err := loadResumeSet(filepath.Join(tmpDir, "none.jsonl")); err != nil || len(done) != 0 {
+		t.Errorf("Missing manifest should resume nothing, got %v, %v", done, err)
+	}
+}
+
+// TestOllamaOptionsFile verifies validation and merge precedence of the options file
+func TestOllamaOptionsFile(t *testing.T) {
+	originalOptions := ollamaOptionsFromFile
+	defer func() { ollamaOptionsFromFile = originalOptions }()
+
+	tmpDir := t.TempDir()
+	valid := filepath.Join(tmpDir, "options.json")
+	if err := os.WriteFile(valid, []byte(`{"top_k": 20, "num_ctx": 8192}`), 0644); err != nil {
+		t.Fatalf("Failed to write options file: %v", err)
+	}
+	invalid := filepath.Join(tmpDir, "array.json")
+	if err := os.WriteFile(invalid, []byte(`[1, 2]`), 0644); err != nil {
+		t.Fatalf("Failed to write options file: %v", err)
+	}
+
+	if _, err := loadOllamaOptions(invalid); err == nil {
+		t.Error("Expected an error for a JSON array")
+	}
+
+	var err error
+	if ollamaOptionsFromFile, err = loadOllamaOptions(valid); err != nil {
+		t.Fatalf("loadOllamaOptions() error = %v", err)
+	}
+	options := ollamaOptions(map[string]interface{}{"num_ctx": 2048, "temperature": 0.2})
+	if options["num_ctx"] != float64(8192) {
+		t.Errorf("num_ctx = %v, want the file value 8192", options["num_ctx"])
+	}
+	if options["temperature"] != 0.2 || options["top_k"] != float64(20) {
+		t.Errorf("Merged options = %v, want temperature from the request and top_k from the file", options)
+	}
+}
+
+// TestNumCtxForPrompt verifies the automatic context window sizing
+func TestNumCtxForPrompt(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tests := []struct {
+		name      string
+		promptLen int
+		numCtx    int
+		expected  int
+	}{
+		{name: "Short prompt uses the minimum", promptLen: 400, expected: 2048},
+		{name: "Long prompt is rounded up", promptLen: 20000, expected: 6144},
+		{name: "Huge prompt is capped", promptLen: 1000000, expected: 16384},
+		{name: "Override wins", promptLen: 1000000, numCtx: 4096, expected: 4096},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.NumCtx = tt.numCtx
+			if got := numCtxForPrompt(strings.Repeat("a", tt.promptLen)); got != tt.expected {
+				t.Errorf("numCtxForPrompt(%d chars) = %d, want %d", tt.promptLen, got, tt.expected)
+			}
+		})
+	}
+}
+
+// TestPrepareTextTruncates verifies the -max-text-chars cap
+func TestPrepareTextTruncates(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	if got := prepareText("äbcdef"); got != "äbcdef" {
+		t.Errorf("prepareText() without a cap = %q, want the full text", got)
+	}
+	config.MaxTextChars = 3
+	if got := prepareText("äbcdef"); got != "äbc" {
+		t.Errorf("prepareText() = %q, want %q", got, "äbc")
+	}
+}
+
+// TestPostHookArgs verifies command splitting and placeholder substitution for -post-hook
+func TestPostHookArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		hook      string
+		expected  []string
+		expectErr bool
+	}{
+		{
+			name:     "Placeholders",
+			hook:     "notify {src} {dst} {mode}",
+			expected: []string{"notify", "in dir/scan.pdf", "out/Invoice.pdf", "vision mode"},
+		},
+		{
+			name:     "Quoted arguments",
+			hook:     `aws s3 cp {dst} "s3://bucket/my docs/" --meta 'src={src}'`,
+			expected: []string{"aws", "s3", "cp", "out/Invoice.pdf", "s3://bucket/my docs/", "--meta", "src=in dir/scan.pdf"},
+		},
+		{name: "Unterminated quote", hook: `echo "oops`, expectErr: true},
+		{name: "Empty", hook: "   ", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := postHookArgs(tt.hook, "in dir/scan.pdf", "out/Invoice.pdf", "vision mode")
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("postHookArgs(%q) error = %v, expectErr %v", tt.hook, err, tt.expectErr)
+			}
+			if tt.expectErr {
+				return
+			}
+			if strings.Join(got, "|") != strings.Join(tt.expected, "|") {
+				t.Errorf("postHookArgs(%q) = %q, want %q", tt.hook, got, tt.expected)
+			}
+		})
+	}
+}
+
+// TestWriteOutputFileCollisions verifies the -on-collision policies and the collision report data
+func TestWriteOutputFileCollisions(t *testing.T) {
+	originalConfig, originalBatch := config, batch
+	defer func() { config, batch = originalConfig, originalBatch }()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-new"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	outDir := filepath.Join(tmpDir, "out")
+	existing := filepath.Join(outDir, "Invoice.pdf")
+
+	tests := []struct {
+		policy             string
+		expectedPath       string
+		expectedResolution string
+	}{
+		{policy: "overwrite", expectedPath: existing, expectedResolution: resolutionOverwritten},
+		{policy: "suffix", expectedPath: filepath.Join(outDir, "Invoice-1.pdf"), expectedResolution: resolutionSuffixed},
+		{policy: "skip", expectedPath: "", expectedResolution: resolutionSkipped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			os.RemoveAll(outDir)
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				t.Fatalf("Failed to create output dir: %v", err)
+			}
+			if err := os.WriteFile(existing, []byte("%PDF-old"), 0644); err != nil {
+				t.Fatalf("Failed to write existing output: %v", err)
+			}
+
+			config = getDefaultConfig()
+			config.OutputDir = outDir
+			config.OnCollision = tt.policy
+
+			path, resolution, err := writeOutputFile(src, "Invoice", "")
+			if err != nil {
+				t.Fatalf("writeOutputFile() error = %v", err)
+			}
+			if path != tt.expectedPath || resolution != tt.expectedResolution {
+				t.Errorf("writeOutputFile() = %q, %q, want %q, %q", path, resolution, tt.expectedPath, tt.expectedResolution)
+			}
+		})
+	}
+
+	batch = batchState{}
+	batch.recordName("Invoice", "a.pdf", "out/Invoice.pdf", resolutionNone)
+	batch.recordName("Contract", "b.pdf", "out/Contract.pdf", resolutionNone)
+	batch.recordName("Invoice", "c.pdf", "out/Invoice-1.pdf", resolutionSuffixed)
+	collisions := batch.nameCollisions()
+	if len(collisions) != 1 || collisions[0] != "Invoice" || len(batch.names["Invoice"]) != 2 {
+		t.Errorf("nameCollisions() = %v, want only Invoice with two sources", collisions)
+	}
+}
+
+// TestHasPNGSignature verifies the sanity check used with -allow-invalid-image
+func TestHasPNGSignature(t *testing.T) {
+	if !hasPNGSignature([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")) {
+		t.Error("Expected PNG signature to be detected")
+	}
+	if hasPNGSignature([]byte("%PDF-1.7")) || hasPNGSignature(nil) {
+		t.Error("Expected non-PNG data to be rejected")
+	}
+}
+
+// TestExpandPatterns verifies glob expansion and the case-insensitive .pdf filter
+func TestExpandPatterns(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.pdf", "b.PDF", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte("x"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	files := expandPatterns([]string{filepath.Join(tmpDir, "*"), filepath.Join(tmpDir, "missing.pdf")})
+	expected := []string{filepath.Join(tmpDir, "a.pdf"), filepath.Join(tmpDir, "b.PDF")}
+	if strings.Join(files, "|") != strings.Join(expected, "|") {
+		t.Errorf("expandPatterns() = %v, want %v", files, expected)
+	}
+}
+
+// TestDirPrompt verifies that the nearest .aipdfprompt overrides the default prompt
+// unless -prompt was given explicitly
+func TestDirPrompt(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	root := t.TempDir()
+	sub := filepath.Join(root, "invoices", "2024")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "invoices", dirPromptFile), []byte("Name this invoice.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config = getDefaultConfig()
+	config.CustomPrompt = "Default."
+	tests := []struct {
+		name     string
+		file     string
+		explicit bool
+		want     string
+	}{
+		{"nested directory uses parent prompt", filepath.Join(sub, "a.pdf"), false, "Name this invoice."},
+		{"directory without prompt file", filepath.Join(root, "b.pdf"), false, "Default."},
+		{"explicit -prompt wins", filepath.Join(sub, "a.pdf"), true, "Default."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.PromptExplicit = tt.explicit
+			if got := basePrompt(tt.file); got != tt.want {
+				t.Errorf("basePrompt(%q) = %q, want %q", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCharsBudget verifies that the length cap is announced in the prompt and applied
+// when sanitizing
+func TestCharsBudget(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	config.CharsBudget = 20
+	prompt := visionPrompt("doc.pdf")
+	if !strings.Contains(prompt, "(max 20 chars)") || strings.Contains(prompt, "{max_length}") {
+		t.Errorf("visionPrompt() = %q, want the placeholder replaced by 20", prompt)
+	}
+	if got := sanitizeFilename("invoice acme corporation march 2024"); got != "invoice-acme-corpora" {
+		t.Errorf("sanitizeFilename() = %q, want it cut to 20 characters", got)
+	}
+	config.CharsBudget = 10
+	if got := sanitizeFilename("Quarterly Report"); got != "Quarterly" {
+		t.Errorf("sanitizeFilename() cut at a separator = %q, want %q", got, "Quarterly")
+	}
+}
+
+// TestLogEvent verifies the JSON event format and that logging is off by default
+func TestLogEvent(t *testing.T) {
+	originalLog := eventLog
+	defer func() { eventLog = originalLog }()
+
+	eventLog = nil
+	logEvent(slog.LevelInfo, "a.pdf", "start", "processing file") // must not panic
+
+	var buf bytes.Buffer
+	eventLog = newEventLogger(&buf)
+	logEvent(slog.LevelError, "a.pdf", "error", "boom", "mode", "OCR mode")
+
+	var event map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("event is not valid JSON: %v (%q)", err, buf.String())
+	}
+	for key, want := range map[string]string{"level": "ERROR", "file": "a.pdf", "phase": "error", "msg": "boom", "mode": "OCR mode"} {
+		if event[key] != want {
+			t.Errorf("event[%q] = %v, want %q", key, event[key], want)
+		}
+	}
+	if _, ok := event["ts"]; !ok {
+		t.Errorf("event has no ts field: %v", event)
+	}
+}
+
+// TestGSRenderArgs verifies the antialiasing options, -use-cropbox and the -gs-extra passthrough
+func TestGSRenderArgs(t *testing.T) {
+	originalConfig := config
+	originalExtra := gsExtraArgs
+	defer func() { config = originalConfig; gsExtraArgs = originalExtra }()
+
+	config = getDefaultConfig()
+	config.TextAlphaBits = 2
+	gsExtraArgs = nil
+	if err := gsExtraArgs.Set("-dInterpolateControl=-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	args := gsRenderArgs("doc.pdf", 3, 150, gsDevice)
+	joined := strings.Join(args, " ")
+	for _, want := range []string{"-r150", "-dFirstPage=3", "-dTextAlphaBits=2", "-dGraphicsAlphaBits=4", "-dInterpolateControl=-1"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("gsRenderArgs() = %v, missing %s", args, want)
+		}
+	}
+	if n := len(args); args[n-2] != "-sOutputFile=-" || args[n-1] != "doc.pdf" {
+		t.Errorf("gsRenderArgs() should end with the output and input, got %v", args)
+	}
+	if slices.Contains(args, "-dUseCropBox") {
+		t.Errorf("gsRenderArgs() without -use-cropbox = %v, want the MediaBox rendered", args)
+	}
+	config.UseCropBox = true
+	if args := gsRenderArgs("doc.pdf", 3, 150, gsDevice); !slices.Contains(args, "-dUseCropBox") {
+		t.Errorf("gsRenderArgs() with -use-cropbox = %v, missing -dUseCropBox", args)
+	}
+
+	for v, want := range map[int]bool{0: false, 1: true, 2: true, 3: false, 4: true, 8: false} {
+		if got := validAlphaBits(v); got != want {
+			t.Errorf("validAlphaBits(%d) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+// TestFallbackPattern verifies the 'regex=>replacement' rule and the last-resort rename
+func TestFallbackPattern(t *testing.T) {
+	originalConfig := config
+	originalRule := fallbackRule
+	defer func() { config = originalConfig; fallbackRule = originalRule }()
+
+	for _, bad := range []string{"", "no-arrow", "=>x", "([a-z=>x"} {
+		if _, err := parsePatternRule(bad); err == nil {
+			t.Errorf("parsePatternRule(%q) should fail", bad)
+		}
+	}
+
+	rule, err := parsePatternRule(`^IMG_(\d+)$=>scan-$1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := rule.apply("in/IMG_0042.pdf"); !ok || got != "scan-0042" {
+		t.Errorf("apply() = %q, %v, want scan-0042, true", got, ok)
+	}
+	if _, ok := rule.apply("in/invoice.pdf"); ok {
+		t.Error("apply() should not match an unrelated name")
+	}
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "IMG_0042.pdf")
+	if err := os.WriteFile(src, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = getDefaultConfig()
+	config.AutoRename = true
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	cause := fmt.Errorf("ollama unreachable")
+
+	fallbackRule = nil
+	if _, err := fallbackToPattern(src, cause); err != cause {
+		t.Errorf("without a rule the original error should be returned, got %v", err)
+	}
+
+	fallbackRule = rule
+	result, err := fallbackToPattern(src, cause)
+	if err != nil {
+		t.Fatalf("fallbackToPattern() error = %v", err)
+	}
+	if filepath.Base(result.Output) != "scan-0042.pdf" || result.Mode != "pattern fallback" {
+		t.Errorf("fallbackToPattern() = %+v, want scan-0042.pdf in pattern fallback mode", result)
+	}
+}
+
+// TestArchiveWriter verifies zip and tar archives including collision suffixing
+func TestArchiveWriter(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openArchive(filepath.Join(tmpDir, "out.rar")); err == nil {
+		t.Error("openArchive() should reject unknown extensions")
+	}
+
+	for _, name := range []string{"out.zip", "out.tar", "out.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, name)
+			a, err := openArchive(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, res, err := a.add(src, "invoice"); err != nil || res != resolutionNone {
+				t.Fatalf("add() = %q, %v", res, err)
+			}
+			out, res, err := a.add(src, "invoice")
+			if err != nil || res != resolutionSuffixed || out != path+":invoice-1.pdf" {
+				t.Errorf("duplicate add() = %q, %q, %v, want the -1 suffix", out, res, err)
+			}
+			if err := a.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries []string
+			if name == "out.zip" {
+				r, err := zip.OpenReader(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				for _, f := range r.File {
+					entries = append(entries, f.Name)
+				}
+			} else {
+				f, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				var rd io.Reader = f
+				if strings.HasSuffix(name, ".gz") {
+					gz, err := gzip.NewReader(f)
+					if err != nil {
+						t.Fatal(err)
+					}
+					rd = gz
+				}
+				tr := tar.NewReader(rd)
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					entries = append(entries, h.Name)
+				}
+			}
+			if strings.Join(entries, ",") != "invoice.pdf,invoice-1.pdf" {
+				t.Errorf("archive entries = %v, want invoice.pdf and invoice-1.pdf", entries)
+			}
+		})
+	}
+}
+
+// TestBatchEdit verifies the batch edit file round trip: unchanged lines apply as
+// suggested, edited names are sanitized and deleted lines keep the original
+func TestBatchEdit(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	originalEditor, hadEditor := os.LookupEnv("EDITOR")
+	defer func() {
+		config = originalConfig
+		batch = originalBatch
+		if hadEditor {
+			os.Setenv("EDITOR", originalEditor)
+		} else {
+			os.Unsetenv("EDITOR")
+		}
+	}()
+
+	targets, rejected := parseBatchEdit("# comment\n\na.pdf\tnew-name.pdf\r\nb.pdf without-tab\nc.pdf\t\n")
+	if targets["a.pdf"] != "new-name" || len(targets) != 1 {
+		t.Errorf("parseBatchEdit() = %v, want only the valid line", targets)
+	}
+	if len(rejected) != 2 || !strings.HasPrefix(rejected[0], "line 4:") || !strings.HasPrefix(rejected[1], "line 5:") {
+		t.Errorf("parseBatchEdit() rejected %v, want lines 4 and 5", rejected)
+	}
+
+	tmpDir := t.TempDir()
+	var sources []string
+	for _, name := range []string{"one.pdf", "two.pdf", "three.pdf"} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte("%PDF"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, path)
+	}
+
+	config = getDefaultConfig()
+	config.InteractiveBatchEdit = true
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	batch = batchState{}
+	for i, slug := range []string{"first-doc", "second-doc", "third-doc"} {
+		result, err := confirmAndWrite(sources[i], GeneratedName{Slug: slug}, "OCR mode")
+		if err != nil || !result.Queued {
+			t.Fatalf("confirmAndWrite() = %+v, %v, want a queued result", result, err)
+		}
+	}
+
+	// The "editor" renames the second suggestion and deletes the third line
+	os.Setenv("EDITOR", `sed -i -e "s/second-doc/Edited Name!/" -e "/third-doc/d"`)
+	runBatchEdit()
+
+	for _, want := range []string{"first-doc.pdf", "Edited-Name.pdf"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, want)); err != nil {
+			t.Errorf("expected %s to be written: %v", want, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "third-doc.pdf")); err == nil {
+		t.Error("a deleted line should keep the original name")
+	}
+	if len(batch.pending) != 0 {
+		t.Errorf("pending suggestions should be cleared, got %d", len(batch.pending))
+	}
+	// A malformed line is ignored; the other edits still apply
+	os.RemoveAll(config.OutputDir)
+	batch = batchState{}
+	for i, slug := range []string{"first-doc", "second-doc"} {
+		if _, err := confirmAndWrite(sources[i], GeneratedName{Slug: slug}, "OCR mode"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("EDITOR", `sed -i -e "s/second-doc/Edited/" -e 's/\tfirst-doc/ first-doc/'`)
+	runBatchEdit()
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Edited.pdf")); err != nil {
+		t.Errorf("valid edit not applied next to a malformed line: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "first-doc.pdf")); err == nil {
+		t.Error("the file of a malformed line should keep the original name")
+	}
+
+	// A failing editor records every queued file as failed
+	batch = batchState{}
+	for i, slug := range []string{"first-doc", "second-doc"} {
+		if _, err := confirmAndWrite(sources[i], GeneratedName{Slug: slug}, "OCR mode"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("EDITOR", "false")
+	runBatchEdit()
+	if batch.failed != 2 || len(batch.errors) != 2 || !strings.Contains(batch.errors[0].reason, "error running editor") {
+		t.Errorf("after a failed editor: failed = %d, errors = %v, want both files recorded", batch.failed, batch.errors)
+	}
+	// A failed edit doesn't spill over onto a deleted line after it
+	queue := func() {
+		batch = batchState{}
+		for i, slug := range []string{"first-doc", "second-doc"} {
+			if _, err := confirmAndWrite(sources[i], GeneratedName{Slug: slug}, "OCR mode"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	queue()
+	os.Setenv("EDITOR", `sed -i -e "s/first-doc/!!/" -e "/second-doc/d"`)
+	runBatchEdit()
+	if batch.failed != 1 || len(batch.errors) != 1 || batch.errors[0].source != sources[0] {
+		t.Errorf("after a bad edit and a deleted line: failed = %d, errors = %v, want only %s", batch.failed, batch.errors, sources[0])
+	}
+
+	// With -fail-fast, the files after the failure are recorded with their original names
+	config.FailFast = true
+	config.ReportHTML = filepath.Join(tmpDir, "report.html")
+	queue()
+	os.Setenv("EDITOR", `sed -i -e "s/first-doc/!!/"`)
+	runBatchEdit()
+	if len(batch.report) != 2 || batch.report[1].Source != sources[1] || batch.report[1].Error != "" {
+		t.Errorf("report after -fail-fast = %+v, want the second file recorded without an error", batch.report)
+	}
+}
+
+// testPagePNG renders a 200x200 PNG filled with bg; ink draws a dark block
+// covering roughly 4% of the page, noise flips a few scattered pixels slightly
+func testPagePNG(t *testing.T, bg uint8, ink, noise bool) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 200, 200))
+	for i := range img.Pix {
+		img.Pix[i] = bg
+		if noise && i%97 == 0 {
+			img.Pix[i] = bg - 20
+		}
+	}
+	if ink {
+		for y := 60; y < 100; y++ {
+			for x := 40; x < 80; x++ {
+				img.SetGray(x, y, color.Gray{Y: 10})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestIsImageEmpty verifies the blank page heuristic on PNG renders
+func TestIsImageEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"white page", testPagePNG(t, 255, false, false), true},
+		{"dark page", testPagePNG(t, 30, false, false), true},
+		{"noisy blank scan", testPagePNG(t, 240, false, true), true},
+		{"page with content", testPagePNG(t, 255, true, false), false},
+		{"undecodable data", []byte("not an image"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isImageEmpty(tt.data); got != tt.want {
+				t.Errorf("isImageEmpty() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestApplyEmptyPagePolicy verifies the skip, error and include policies
+func TestApplyEmptyPagePolicy(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	blank := testPagePNG(t, 255, false, false)
+	content := testPagePNG(t, 255, true, false)
+
+	tests := []struct {
+		policy  string
+		images  [][]byte
+		want    int
+		wantErr bool
+	}{
+		{"skip", [][]byte{content, blank}, 1, false},
+		{"skip", [][]byte{blank, blank}, 0, false},
+		{"error", [][]byte{blank, blank}, 0, true},
+		{"error", [][]byte{content, blank}, 2, false},
+		{"include", [][]byte{blank, blank}, 2, false},
+	}
+	for _, tt := range tests {
+		config.OnEmptyPage = tt.policy
+		got, err := applyEmptyPagePolicy([]int{1, 2}, tt.images)
+		if (err != nil) != tt.wantErr || len(got) != tt.want {
+			t.Errorf("policy %s: got %d image(s), err %v; want %d, error %v", tt.policy, len(got), err, tt.want, tt.wantErr)
+		}
+		if tt.wantErr && !errors.Is(err, errAllPagesEmpty) {
+			t.Errorf("policy %s: error = %v, want errAllPagesEmpty", tt.policy, err)
+		}
+	}
+}
+
+// TestReadabilityScore verifies the keyword scoring and the candidate selection
+func TestReadabilityScore(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	scores := map[string]int{
+		"invoice-acme-march-2024":  4,
+		"scan-document-pdf":        -3,
+		"invoice-invoice-acme":     2,
+		"INV-20240311-883271-acme": 0,
+		"a-contract":               0,
+	}
+	for slug, want := range scores {
+		if got := readabilityScore(slug); got != want {
+			t.Errorf("readabilityScore(%q) = %d, want %d", slug, got, want)
+		}
+	}
+
+	config = getDefaultConfig()
+	config.NumSuggestions = 3
+	responses := []string{"scan-document", "invoice-acme-march", "invoice"}
+	calls := 0
+	generate := func() (GeneratedName, error) {
+		name := GeneratedName{Slug: responses[calls]}
+		calls++
+		return name, nil
+	}
+	best, err := pickSuggestion(generate)
+	if err != nil || best.Slug != "invoice-acme-march" || calls != 3 {
+		t.Errorf("pickSuggestion() = %q, %v after %d call(s), want invoice-acme-march after 3", best.Slug, err, calls)
+	}
+
+	config.NumSuggestions = 1
+	config.ReadabilityScore = 2
+	calls = 0
+	if _, err := pickSuggestion(generate); err == nil {
+		t.Error("pickSuggestion() should reject a name below -readability-score")
+	}
+
+	failing := func() (GeneratedName, error) { return GeneratedName{}, fmt.Errorf("ollama down") }
+	if _, err := pickSuggestion(failing); err == nil || err.Error() != "ollama down" {
+		t.Errorf("pickSuggestion() error = %v, want the generation error", err)
+	}
+}
+
+// TestCleanText verifies that URLs, email addresses and long digit runs are removed
+// from OCR text as selected by -clean-text
+func TestCleanText(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	text := "ACME GmbH Invoice No. 2024003817 visit https://www.acme-shop.com/orders or acme.de, mail billing@acme.de Total 49.90 EUR"
+	tests := []struct {
+		options string
+		absent  []string
+		present []string
+	}{
+		{"", nil, []string{"2024003817", "https://www.acme-shop.com/orders", "billing@acme.de"}},
+		{"urls", []string{"https://", "acme-shop.com", "acme.de,"}, []string{"2024003817", "billing@acme.de"}},
+		{"digits", []string{"2024003817"}, []string{"49.90", "https://"}},
+		{"emails,urls", []string{"billing@", "acme.de", "https://"}, []string{"2024003817"}},
+		{"all", []string{"2024003817", "https://", "billing@", "acme.de"}, []string{"ACME GmbH Invoice No.", "49.90 EUR"}},
+	}
+	for _, tt := range tests {
+		config.CleanText = tt.options
+		got := cleanText(text)
+		for _, s := range tt.absent {
+			if strings.Contains(got, s) {
+				t.Errorf("-clean-text %q: %q still contains %q", tt.options, got, s)
+			}
+		}
+		for _, s := range tt.present {
+			if !strings.Contains(got, s) {
+				t.Errorf("-clean-text %q: %q lost %q", tt.options, got, s)
+			}
+		}
+	}
+
+	if _, err := parseCleanText("urls,phones"); err == nil {
+		t.Error("parseCleanText() should reject unknown options")
+	}
+}
+
+// TestRouteByType verifies category matching and routing into type subdirectories
+func TestRouteByType(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	defer func() { config = originalConfig; batch = originalBatch }()
+
+	categories := parseCategories(" Invoices, contracts ,,letters")
+	if strings.Join(categories, ",") != "invoices,contracts,letters" {
+		t.Fatalf("parseCategories() = %v", categories)
+	}
+	answers := map[string]string{
+		"invoices":    "invoices",
+		"Invoice.":    "invoices",
+		" contract\n": "contracts",
+		"unknown":     unsortedCategory,
+		"a recipe":    unsortedCategory,
+	}
+	for answer, want := range answers {
+		if got := matchCategory(answer, categories); got != want {
+			t.Errorf("matchCategory(%q) = %q, want %q", answer, got, want)
+		}
+	}
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = getDefaultConfig()
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	config.Classify = true
+	config.RouteByType = true
+	batch = batchState{}
+
+	for category, wantDir := range map[string]string{"invoices": "invoices", "": unsortedCategory} {
+		result, err := applyRename(src, GeneratedName{Slug: "acme-" + wantDir, Category: category}, "OCR mode")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := filepath.Join(config.OutputDir, wantDir, "acme-"+wantDir+".pdf"); result.Output != want {
+			t.Errorf("applyRename() wrote %q, want %q", result.Output, want)
+		}
+	}
+}
+
+// TestOCRLanguages verifies parsing of "tesseract --list-langs" and the -lang check
+func TestOCRLanguages(t *testing.T) {
+	output := "List of available languages in \"/usr/share/tesseract-ocr/5/tessdata/\" (3):\neng\nosd\ndeu\n"
+	available := parseTesseractLangs(output)
+	if len(available) != 3 || !available["deu"] {
+		t.Fatalf("parseTesseractLangs() = %v", available)
+	}
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"deu", nil},
+		{"eng+deu", nil},
+		{"eng+fra", []string{"fra"}},
+		{"spa+ita", []string{"spa", "ita"}},
+	}
+	for _, tt := range tests {
+		if got := missingLanguages(tt.spec, available); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("missingLanguages(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// TestDecodePDFString verifies decoding of PDF titles in both string encodings
+func TestDecodePDFString(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{"PDFDocEncoding", []byte("Quarterly Report 2023\n"), "Quarterly Report 2023"},
+		{"Latin-1 range", []byte{'C', 'a', 'f', 0xE9}, "Café"},
+		{"UTF-16BE with BOM", []byte{0xFE, 0xFF, 0x00, 'S', 0x00, 0xFC, 0x00, 'd'}, "Süd"},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodePDFString(tt.raw); got != tt.want {
+				t.Errorf("decodePDFString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPromptExamples verifies loading of -examples-file and the capped prompt block
+func TestPromptExamples(t *testing.T) {
+	originalConfig := config
+	originalExamples := promptExamples
+	defer func() { config = originalConfig; promptExamples = originalExamples }()
+
+	tmpDir := t.TempDir()
+	valid := filepath.Join(tmpDir, "examples.json")
+	if err := os.WriteFile(valid, []byte(`[
+		{"content": "Electricity bill from Stadtwerke for March 2024", "filename": "stadtwerke-electricity-bill-2024-03"},
+		{"content": "Rental contract for the flat in Main Street", "filename": "rental-contract-main-street"},
+		{"content": "Dentist invoice", "filename": "dentist-invoice"}
+	]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	incomplete := filepath.Join(tmpDir, "incomplete.json")
+	if err := os.WriteFile(incomplete, []byte(`[{"content": "only content"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPromptExamples(incomplete); err == nil {
+		t.Error("loadPromptExamples() should reject examples without a filename")
+	}
+
+	examples, err := loadPromptExamples(valid)
+	if err != nil || len(examples) != 3 {
+		t.Fatalf("loadPromptExamples() = %v, %v", examples, err)
+	}
+
+	config = getDefaultConfig()
+	config.CustomPrompt = "Name it."
+	config.PromptExplicit = true
+	config.MaxExamples = 2
+	promptExamples = examples
+	prompt := textPrompt("doc.pdf", "hello")
+	if !strings.Contains(prompt, "Filename: rental-contract-main-street") || strings.Contains(prompt, "dentist-invoice") {
+		t.Errorf("textPrompt() = %q, want the first two examples only", prompt)
+	}
+	if !strings.HasPrefix(prompt, "Name it. Examples:") || !strings.HasSuffix(prompt, " Text: hello") {
+		t.Errorf("textPrompt() = %q, want the examples between prompt and text", prompt)
+	}
+
+	promptExamples = nil
+	if got := textPrompt("doc.pdf", "hello"); got != "Name it. Text: hello" {
+		t.Errorf("textPrompt() without examples = %q", got)
+	}
+}
+
+// TestCanonicalizeUnicode verifies that precomposed and decomposed spellings of the same
+// name produce identical filenames with -charset unicode
+func TestCanonicalizeUnicode(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	config.Charset = "unicode"
+
+	precomposed := "Rechnung Café Müller Ærøskøbing"
+	decomposed := "Rechnung Café Müller Ærøskøbing"
+	if precomposed == decomposed {
+		t.Fatal("test strings must differ in composition")
+	}
+	want := "Rechnung-Café-Müller-Ærøskøbing"
+	for _, raw := range []string{precomposed, decomposed} {
+		if got := sanitizeFilename(raw); got != want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", raw, got, want)
+		}
+	}
+
+	// Non-Latin scripts: NFD Hangul syllables, Cyrillic й, Greek ά and Vietnamese ệ
+	for _, tt := range []struct{ precomposed, decomposed string }{
+		{"한글", "\u1112\u1161\u11ab\u1100\u1173\u11af"},
+		{"Отчёт-май", "Отче\u0308т-маи\u0306"},
+		{"άλφα", "α\u0301λφα"},
+		{"Hóa-đơn-Việt", "Ho\u0301a-đơn-Vie\u0323\u0302t"},
+	} {
+		if tt.precomposed == tt.decomposed {
+			t.Fatalf("test strings for %q must differ in composition", tt.precomposed)
+		}
+		if got := sanitizeFilename(tt.decomposed); got != tt.precomposed {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.decomposed, got, tt.precomposed)
+		}
+		if got := sanitizeFilename(tt.precomposed); got != tt.precomposed {
+			t.Errorf("sanitizeFilename(%q) = %q, want it unchanged", tt.precomposed, got)
+		}
+	}
+
+	config.CanonicalizeUnicode = "none"
+	if got := sanitizeFilename(decomposed); got == want {
+		t.Error("-canonicalize-unicode none should leave decomposed input alone")
+	}
+
+	if got := canonicalizeUnicode("ﬁnal ｒｅｐｏｒｔ²", "nfkc"); got != "final report2" {
+		t.Errorf("canonicalizeUnicode(nfkc) = %q, want %q", got, "final report2")
+	}
+	if got := canonicalizeUnicode("ﬁnal", "nfc"); got != "ﬁnal" {
+		t.Errorf("canonicalizeUnicode(nfc) should keep compatibility characters, got %q", got)
+	}
+
+	config = getDefaultConfig()
+	if got := sanitizeFilename(precomposed); got != "Rechnung-Caf-M-ller-r-sk-bing" {
+		t.Errorf("sanitizeFilename() with -charset ascii = %q, want the accented letters replaced", got)
+	}
+}
+
+// TestDownscaleImage verifies the thumbnail size and the averaging of pixels
+func TestDownscaleImage(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 800, 1000))
+	for y := 0; y < 1000; y++ {
+		for x := 0; x < 800; x++ {
+			if x%2 == 0 {
+				src.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	dst := downscaleImage(src, 400)
+	if b := dst.Bounds(); b.Dx() != 400 || b.Dy() != 500 {
+		t.Fatalf("downscaleImage() size = %dx%d, want 400x500", b.Dx(), b.Dy())
+	}
+	if r, _, _, _ := dst.At(10, 10).RGBA(); r>>8 < 120 || r>>8 > 135 {
+		t.Errorf("downscaled pixel = %d, want the average grey of black and white columns", r>>8)
+	}
+	if small := image.NewGray(image.Rect(0, 0, 100, 100)); downscaleImage(small, 400) != image.Image(small) {
+		t.Error("downscaleImage() should return smaller images unchanged")
+	}
+}
+
+// TestLimitMegapixels verifies that oversized pages are downscaled to fit the pixel cap
+func TestLimitMegapixels(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3000, 2000))); err != nil {
+		t.Fatal(err)
+	}
+	limited := limitMegapixels(1, buf.Bytes(), 1.5)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(limited))
+	if err != nil {
+		t.Fatalf("downscaled page does not decode: %v", err)
+	}
+	if cfg.Width*cfg.Height > 1500000 || cfg.Width < 1490 {
+		t.Errorf("limitMegapixels() size = %dx%d, want just under 1.5 MP", cfg.Width, cfg.Height)
+	}
+	if got := cfg.Width * 2000 / 3000; got-cfg.Height > 1 || cfg.Height-got > 1 {
+		t.Errorf("limitMegapixels() size = %dx%d, want a 3:2 aspect ratio", cfg.Width, cfg.Height)
+	}
+	if got := limitMegapixels(1, buf.Bytes(), 6); !bytes.Equal(got, buf.Bytes()) {
+		t.Error("limitMegapixels() should keep pages within the cap unchanged")
+	}
+}
+
+// TestInlineImagePreview verifies terminal detection and the escape sequences
+func TestInlineImagePreview(t *testing.T) {
+	envs := []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"TERM_PROGRAM": "iTerm.app"}, "iterm"},
+		{map[string]string{"TERM": "xterm-kitty"}, "kitty"},
+		{map[string]string{"KITTY_WINDOW_ID": "1", "TERM": "xterm-256color"}, "kitty"},
+		{map[string]string{"TERM": "xterm-256color", "TERM_PROGRAM": "Apple_Terminal"}, ""},
+	}
+	for _, tt := range envs {
+		if got := detectImageProtocol(func(k string) string { return tt.env[k] }); got != tt.want {
+			t.Errorf("detectImageProtocol(%v) = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+
+	data := bytes.Repeat([]byte{0x89}, 5000) // base64 is longer than one kitty chunk
+	iterm := inlineImageSequence("iterm", data)
+	if !strings.HasPrefix(iterm, "\x1b]1337;File=inline=1;size=5000;") {
+		t.Errorf("iTerm2 sequence has unexpected prefix: %q", iterm[:40])
+	}
+	kitty := inlineImageSequence("kitty", data)
+	if strings.Count(kitty, "\x1b_G") != 2 || !strings.Contains(kitty, "a=T,f=100,m=1;") || !strings.Contains(kitty, "\x1b_Gm=0;") {
+		t.Errorf("kitty sequence should be sent in two chunks, got %d", strings.Count(kitty, "\x1b_G"))
+	}
+}
+
+// TestTagWithXattr verifies that -set-xattr records the name without renaming the file
+func TestTagWithXattr(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+	config.SetXattr = true
+
+	src := filepath.Join(t.TempDir(), "IMG_0001.pdf")
+	if err := os.WriteFile(src, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(src, config.XattrKey, "probe"); errors.Is(err, errXattrUnsupported) {
+		t.Skipf("no xattr support here: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := applyRename(src, GeneratedName{Slug: "invoice-acme"}, "OCR mode")
+	if err != nil || result.Output != "" {
+		t.Fatalf("applyRename() = %+v, %v, want no output file", result, err)
+	}
+	if got, err := getXattr(src, config.XattrKey); err != nil || got != "invoice-acme.pdf" {
+		t.Errorf("getXattr() = %q, %v, want invoice-acme.pdf", got, err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("source should stay in place: %v", err)
+	}
+}
+
+// TestMinConfidence verifies parsing of the self-rating and the manifest flag for
+// names below -min-confidence
+func TestMinConfidence(t *testing.T) {
+	originalManifest := manifestPath
+	defer func() { manifestPath = originalManifest }()
+
+	ratings := map[string]int{"8": 8, "I would say 10.": 10, "Confidence: 3/10": 3, "very sure": 0, "15": 0}
+	for answer, want := range ratings {
+		if got := parseConfidence(answer); got != want {
+			t.Errorf("parseConfidence(%q) = %d, want %d", answer, got, want)
+		}
+	}
+
+	manifestPath = filepath.Join(t.TempDir(), "manifest.jsonl")
+	recordManifest("scan.pdf", FileResult{Name: GeneratedName{Slug: "maybe-invoice"}, Mode: "OCR mode", LowConfidence: true}, nil)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry ManifestEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != "low-confidence" || entry.Suggested != "maybe-invoice.pdf" || entry.Output != "" {
+		t.Errorf("manifest entry = %+v, want a low-confidence entry with the suggestion", entry)
+	}
+}
+
+// TestArchiveInput verifies that the PDF entries of zip and tar.gz inputs are processed
+// and reported as <archive>:<entry>
+func TestArchiveInput(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	originalRule := fallbackRule
+	defer func() { config = originalConfig; batch = originalBatch; fallbackRule = originalRule }()
+
+	tmpDir := t.TempDir()
+	entries := map[string]string{"docs/a.pdf": "%PDF-a", "b.PDF": "%PDF-b", "notes.txt": "skip me"}
+
+	zipPath := filepath.Join(tmpDir, "in.zip")
+	zf, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(zf)
+	for _, name := range []string{"docs/a.pdf", "b.PDF", "notes.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(entries[name]))
+	}
+	zw.Close()
+	zf.Close()
+
+	tgzPath := filepath.Join(tmpDir, "in.tar.gz")
+	tf, err := os.Create(tgzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"docs/a.pdf", "b.PDF", "notes.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(entries[name])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(entries[name]))
+	}
+	tw.Close()
+	gz.Close()
+	tf.Close()
+
+	for _, path := range []string{zipPath, tgzPath} {
+		var names []string
+		err := forEachArchivePDF(path, func(name string, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			if err != nil || string(data) != entries[name] {
+				t.Errorf("%s: entry %s = %q, %v", path, name, data, err)
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil || strings.Join(names, ",") != "docs/a.pdf,b.PDF" {
+			t.Errorf("forEachArchivePDF(%s) = %v, %v, want the two PDF entries", path, names, err)
+		}
+	}
+
+	// Without OCR tools the pattern fallback names the extracted entries
+	config = getDefaultConfig()
+	config.FastMode = false
+	config.AutoRename = true
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	config.QuietErrors = true
+	batch = batchState{}
+	if fallbackRule, err = parsePatternRule(`^(.*)$=>from-zip-$1`); err != nil {
+		t.Fatal(err)
+	}
+	if err := processArchiveInput(zipPath); err != nil {
+		t.Fatalf("processArchiveInput() error = %v", err)
+	}
+	if batch.processed != 2 || batch.failed != 0 {
+		t.Errorf("processed %d, failed %d; want 2 and 0", batch.processed, batch.failed)
+	}
+	for _, want := range []string{"from-zip-a.pdf", "from-zip-b.pdf"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, want)); err != nil {
+			t.Errorf("expected output %s: %v", want, err)
+		}
+	}
+	if !isArchiveInput("x.TGZ") || isArchiveInput("x.pdf") {
+		t.Error("isArchiveInput() misclassified an extension")
+	}
+}
+
+// TestNormalizePunctuation verifies that each Unicode lookalike maps to its ASCII equivalent
+func TestNormalizePunctuation(t *testing.T) {
+	tests := []struct {
+		char string
+		want string
+	}{
+		{"‐", "-"}, {"‑", "-"}, {"‒", "-"}, {"–", "-"}, {"—", "-"}, {"―", "-"}, {"−", "-"},
+		{"‘", "'"}, {"’", "'"}, {"‚", "'"}, {"‹", "'"}, {"›", "'"},
+		{"“", "\""}, {"”", "\""}, {"„", "\""}, {"«", "\""}, {"»", "\""},
+		{" ", " "}, {" ", " "}, {" ", " "}, {" ", " "},
+		{"•", " "}, {"·", " "}, {"…", "..."},
+	}
+	for _, tt := range tests {
+		if got := normalizePunctuation("a" + tt.char + "b"); got != "a"+tt.want+"b" {
+			t.Errorf("normalizePunctuation(%U) = %q, want %q", []rune(tt.char)[0], got, "a"+tt.want+"b")
+		}
+	}
+}
+
+// TestNormalizeDashes verifies the effect of -normalize-dashes on the generated name
+func TestNormalizeDashes(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	config.NormalizeDashes = true
+
+	tests := []struct {
+		raw          string
+		wantSlug     string
+		wantReadable string
+	}{
+		{"“Q1 — Report”", "Q1-Report", "Q1 - Report"},
+		{"Driver’s License • 2024", "Drivers-License-2024", "Driver's License   2024"},
+		{"Invoice–2024–ACME", "Invoice-2024-ACME", "Invoice-2024-ACME"},
+	}
+	for _, tt := range tests {
+		name, err := newGeneratedName(tt.raw)
+		if err != nil {
+			t.Fatalf("newGeneratedName(%q) returned error: %v", tt.raw, err)
+		}
+		if name.Slug != tt.wantSlug {
+			t.Errorf("newGeneratedName(%q).Slug = %q, want %q", tt.raw, name.Slug, tt.wantSlug)
+		}
+		if name.Readable != tt.wantReadable {
+			t.Errorf("newGeneratedName(%q).Readable = %q, want %q", tt.raw, name.Readable, tt.wantReadable)
+		}
+	}
+
+	config.NormalizeDashes = false
+	name, err := newGeneratedName("Driver’s License")
+	if err != nil {
+		t.Fatalf("newGeneratedName() returned error: %v", err)
+	}
+	if name.Slug != "Driver-s-License" {
+		t.Errorf("without -normalize-dashes Slug = %q, want %q", name.Slug, "Driver-s-License")
+	}
+}
+
+// TestRateLimiter verifies that -rate-limit hands out evenly spaced slots
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("newRateLimiter(0) should be unlimited (nil)")
+	}
+	originalLimiter := generateLimiter
+	defer func() { generateLimiter = originalLimiter }()
+	generateLimiter = nil
+	if err := waitForRateLimit(); err != nil {
+		t.Errorf("waitForRateLimit() without a limit = %v, want nil", err)
+	}
+
+	// The first request goes immediately, the others are spaced 250ms apart
+	limiter := newRateLimiter(4)
+	start := time.Now()
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, limiter.ReserveN(start, 1).DelayFrom(start))
+	}
+	want := []time.Duration{0, 250 * time.Millisecond, 500 * time.Millisecond, 750 * time.Millisecond, time.Second}
+	if fmt.Sprint(delays) != fmt.Sprint(want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+}
+
+// TestDetectLanguage verifies stopword-based detection and the unknown cases
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"english", "Thank you for your order. This is the invoice for the services we provided to you in March, and the amount is due within 30 days. Please pay by bank transfer and quote the invoice number with your payment.", "en"},
+		{"german", "Sehr geehrte Damen und Herren, wir danken Ihnen für die Bestellung. Die Rechnung ist bis zum Ende des Monats zu bezahlen. Bei Fragen stehen wir Ihnen mit der Buchhaltung gerne zur Verfügung, und die Zahlung ist auf das Konto der Firma zu leisten.", "de"},
+		{"french", "Madame, Monsieur, nous vous remercions pour votre commande. La facture est à régler dans les trente jours par virement sur le compte de la société. Pour toute question, le service client est à votre disposition et nous restons à votre écoute.", "fr"},
+		{"spanish", "Estimado cliente, le agradecemos por su pedido. La factura se debe pagar en los próximos treinta días por transferencia a la cuenta de la empresa. Para cualquier pregunta, el servicio al cliente está a su disposición con las condiciones del contrato.", "es"},
+		{"too little text", "Invoice 2024 ACME Corp", ""},
+		{"no words", strings.Repeat("1234 5678 ", 30), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectLanguage(tt.text); got != tt.want {
+				t.Errorf("detectLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTagLanguage verifies the language prefix, the metadata field and parsing model answers
+func TestTagLanguage(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	german := "Sehr geehrte Damen und Herren, die Rechnung ist bis zum Ende des Monats zu bezahlen. Bei Fragen stehen wir Ihnen mit der Buchhaltung gerne zur Verfügung, und die Zahlung ist auf das Konto der Firma zu leisten."
+
+	name := GeneratedName{Slug: "Rechnung-2024"}
+	tagLanguage(&name, german, nil)
+	if name.Language != "" || name.Slug != "Rechnung-2024" {
+		t.Errorf("tagLanguage() without -detect-language changed the name: %+v", name)
+	}
+
+	config.DetectLanguage = true
+	tagLanguage(&name, german, nil)
+	if name.Language != "de" || name.Slug != "Rechnung-2024" {
+		t.Errorf("tagLanguage() = %+v, want language de and an unchanged slug", name)
+	}
+
+	config.LanguagePrefix = true
+	name = GeneratedName{Slug: "Rechnung-2024"}
+	tagLanguage(&name, german, nil)
+	if name.Slug != "de-Rechnung-2024" {
+		t.Errorf("tagLanguage() with -language-prefix Slug = %q, want %q", name.Slug, "de-Rechnung-2024")
+	}
+
+	config.CharsBudget = 12
+	name = GeneratedName{Slug: "Rechnung-ACME-2024"}
+	tagLanguage(&name, german, nil)
+	if name.Slug != "de-Rechnung" {
+		t.Errorf("tagLanguage() with -chars-budget 12 Slug = %q, want %q", name.Slug, "de-Rechnung")
+	}
+	config.Separator = "underscore"
+	name = GeneratedName{Slug: "Rechnung_2024"}
+	tagLanguage(&name, german, nil)
+	if name.Slug != "de_Rechnung" {
+		t.Errorf("tagLanguage() with -separator underscore Slug = %q, want %q", name.Slug, "de_Rechnung")
+	}
+
+	name = GeneratedName{Slug: "Scan"}
+	tagLanguage(&name, "Scan 1", nil)
+	if name.Language != "" || name.Slug != "Scan" {
+		t.Errorf("tagLanguage() with too little text = %+v, want no tag", name)
+	}
+
+	for answer, want := range map[string]string{"de": "de", " EN.\n": "en", "`fr`": "fr", "unknown": "", "German": ""} {
+		if got := parseLanguageCode(answer); got != want {
+			t.Errorf("parseLanguageCode(%q) = %q, want %q", answer, got, want)
+		}
+	}
+}
+
+// TestNoClobberSource verifies that a renamed file never overwrites another batch input
+func TestNoClobberSource(t *testing.T) {
+	originalConfig, originalBatch := config, batch
+	defer func() { config, batch = originalConfig, originalBatch }()
+
+	tmpDir := t.TempDir()
+	first := filepath.Join(tmpDir, "scan1.pdf")
+	second := filepath.Join(tmpDir, "Invoice.pdf")
+	for path, content := range map[string]string{first: "%PDF-first", second: "%PDF-second"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	config = getDefaultConfig()
+	config.OutputDir = tmpDir
+	config.OnCollision = "overwrite"
+	batch = batchState{sources: absPathSet([]string{first, second})}
+
+	if _, _, err := writeOutputFile(first, "Invoice", ""); err == nil {
+		t.Fatal("writeOutputFile() over another batch input should fail")
+	}
+	if data, _ := os.ReadFile(second); string(data) != "%PDF-second" {
+		t.Errorf("batch input was overwritten, content %q", data)
+	}
+
+	// A file may be written onto itself
+	if _, _, err := writeOutputFile(second, "Invoice", ""); err != nil {
+		t.Errorf("writeOutputFile() onto its own source returned error: %v", err)
+	}
+
+	// Suffixing never hits an existing file
+	config.OnCollision = "suffix"
+	if output, _, err := writeOutputFile(first, "Invoice", ""); err != nil || output != filepath.Join(tmpDir, "Invoice-1.pdf") {
+		t.Errorf("writeOutputFile() with suffix = %q, %v", output, err)
+	}
+
+	config.OnCollision = "overwrite"
+	config.NoClobberSource = false
+	if _, _, err := writeOutputFile(first, "Invoice", ""); err != nil {
+		t.Errorf("writeOutputFile() with -no-clobber-source=false returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(second); string(data) != "%PDF-first" {
+		t.Errorf("with the interlock disabled the target should be overwritten, content %q", data)
+	}
+}
+
+// TestDescribe verifies caption cleanup, the <file>.txt location and the manifest entry
+func TestDescribe(t *testing.T) {
+	originalConfig, originalManifest := config, manifestPath
+	defer func() { config, manifestPath = originalConfig, originalManifest }()
+
+	config = getDefaultConfig()
+	if got := cleanDescription("  \"An invoice from ACME\n for March 2024.\"\n"); got != "An invoice from ACME for March 2024." {
+		t.Errorf("cleanDescription() = %q", got)
+	}
+
+	if got := describeTextPath("docs/scan.pdf"); got != "docs/scan.pdf.txt" {
+		t.Errorf("describeTextPath() = %q, want %q", got, "docs/scan.pdf.txt")
+	}
+	config.OutputDir = "catalog"
+	if got := describeTextPath("docs/scan.pdf"); got != filepath.Join("catalog", "scan.pdf.txt") {
+		t.Errorf("describeTextPath() with -output = %q", got)
+	}
+
+	manifestPath = filepath.Join(t.TempDir(), "manifest.jsonl")
+	recordManifest("scan.pdf", FileResult{Mode: "vision mode", Description: "An invoice from ACME."}, nil)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var entry ManifestEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("Failed to parse manifest entry: %v", err)
+	}
+	if entry.Status != "described" || entry.Description != "An invoice from ACME." || entry.Output != "" {
+		t.Errorf("manifest entry = %+v, want status described with the description and no output", entry)
+	}
+}
+
+// TestParseConfirmation verifies the accepted inputs of the confirmation prompt
+func TestParseConfirmation(t *testing.T) {
+	tests := map[string]string{
+		"\n":      confirmYes,
+		"y\n":     confirmYes,
+		" Y \n":   confirmYes,
+		"YES\r\n": confirmYes,
+		"n\n":     confirmNo,
+		"N\n":     confirmNo,
+		"A\n":     confirmAll,
+		"all\n":   confirmAll,
+		"q\n":     confirmQuit,
+		"Quit\n":  confirmQuit,
+		"maybe\n": confirmNo,
+	}
+	for line, want := range tests {
+		if got := parseConfirmation(line); got != want {
+			t.Errorf("parseConfirmation(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+// TestConfirmQuit verifies that q keeps the file and stops the batch
+func TestConfirmQuit(t *testing.T) {
+	originalConfig, originalBatch, originalInput := config, batch, promptInput
+	defer func() { config, batch, promptInput = originalConfig, originalBatch, originalInput }()
+
+	config = getDefaultConfig()
+	config.OutputDir = t.TempDir()
+	batch = batchState{}
+	src := filepath.Join(t.TempDir(), "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+
+	promptInput = bufio.NewScanner(strings.NewReader("\nQ\n"))
+	result, err := confirmAndWrite(src, GeneratedName{Slug: "Invoice"}, "OCR mode")
+	if err != nil || result.Output == "" {
+		t.Fatalf("Enter should accept the name, got %+v, %v", result, err)
+	}
+	result, err = confirmAndWrite(src, GeneratedName{Slug: "Receipt"}, "OCR mode")
+	if err != nil || result.Output != "" {
+		t.Fatalf("q should keep the original name, got %+v, %v", result, err)
+	}
+	if !batch.quit {
+		t.Error("q should stop the batch")
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Receipt.pdf")); err == nil {
+		t.Error("q should not write the file")
+	}
+}
+
+// TestConfirmationScriptedInput feeds scripted stdin to the confirmation prompt,
+// including whitespace, CRLF line endings and end of input
+func TestConfirmationScriptedInput(t *testing.T) {
+	originalConfig, originalBatch, originalInput := config, batch, promptInput
+	defer func() { config, batch, promptInput = originalConfig, originalBatch, originalInput }()
+
+	config = getDefaultConfig()
+	config.OutputDir = t.TempDir()
+	batch = batchState{}
+	src := filepath.Join(t.TempDir(), "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+
+	promptInput = bufio.NewScanner(strings.NewReader("  n  \r\n Y\r\n"))
+	steps := []struct {
+		slug     string
+		written  bool
+		wantQuit bool
+	}{
+		{"First", false, false}, // "  n  " keeps the name
+		{"Second", true, false}, // " Y" renames, the \r is trimmed
+		{"Third", false, true},  // End of input keeps the name and stops
+		{"Fourth", false, true}, // Still stopped, nothing more is read
+	}
+	for _, step := range steps {
+		result, err := confirmAndWrite(src, GeneratedName{Slug: step.slug}, "OCR mode")
+		if err != nil {
+			t.Fatalf("confirmAndWrite(%s) returned error: %v", step.slug, err)
+		}
+		if written := result.Output != ""; written != step.written {
+			t.Errorf("confirmAndWrite(%s) wrote = %v, want %v", step.slug, written, step.written)
+		}
+		if batch.quit != step.wantQuit {
+			t.Errorf("after %s batch.quit = %v, want %v", step.slug, batch.quit, step.wantQuit)
+		}
+	}
+}
+
+// TestSafeNames verifies that -safe-names yields URL- and shell-safe names
+func TestSafeNames(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"-temp", "temp"},
+		{"--rm -rf", "rm-rf"},
+		{"a b&c", "a-b-c"},
+		{"$(whoami);ls|cat>`x`", "whoami-ls-cat-x"},
+		{"report*?[1].pdf", "report-1-pdf"},
+		{"Invoice-2024", "Invoice-2024"},
+	}
+	config = getDefaultConfig()
+	config.SafeNames = true
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.raw); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) with -safe-names = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	// safeName also guards names that did not come through the ASCII sanitizer
+	for raw, want := range map[string]string{"-x.pdf": "x.pdf", "..hidden": "hidden", "a b/c": "a-b-c", "_tmp_": "tmp_", "Müller": "M-ller"} {
+		if got := safeName(raw); got != want {
+			t.Errorf("safeName(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+// TestOCRArgs verifies the ocrmypdf arguments, including -lang, -ocr-jobs and -ocr-output-type
+func TestOCRArgs(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = getDefaultConfig()
+	args := strings.Join(ocrArgs("scan.pdf", "scan.txt"), " ")
+	if args != "scan.pdf - --force-ocr --sidecar scan.txt --output-type none" {
+		t.Errorf("ocrArgs() = %q, want only the sidecar text and no PDF output by default", args)
+	}
+	config.OCROutputType = "pdfa"
+	args = strings.Join(ocrArgs("scan.pdf", "scan.txt"), " ")
+	if !strings.HasPrefix(args, "scan.pdf scan.pdf --force-ocr --sidecar scan.txt") || !strings.Contains(args, "--output-type pdfa") {
+		t.Errorf("ocrArgs() = %q, want input, output and sidecar first and a PDF/A output", args)
+	}
+	if strings.Contains(args, "--jobs") {
+		t.Errorf("ocrArgs() = %q, should leave --jobs to ocrmypdf by default", args)
+	}
+
+	config.Lang = "deu+eng"
+	config.OCRJobs = 4
+	args = strings.Join(ocrArgs("scan.pdf", "scan.txt"), " ")
+	for _, want := range []string{"-l deu+eng", "--jobs 4"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("ocrArgs() = %q, want it to contain %q", args, want)
+		}
+	}
+}
+
+// TestScannerPrefixes verifies scanner default detection, the name hint and the fallback
+func TestScannerPrefixes(t *testing.T) {
+	originalConfig, originalPrefixes := config, scannerPrefixes
+	defer func() { config, scannerPrefixes = originalConfig, originalPrefixes }()
+
+	config = getDefaultConfig()
+	scannerPrefixes = parseScannerPrefixes(defaultScannerPrefixes)
+
+	tests := []struct {
+		file        string
+		wantDefault bool
+		wantHint    string
+	}{
+		{"SKM_C224e0123.pdf", true, ""},
+		{"scans/IMG_20240311_1234.pdf", true, ""},
+		{"scan_001.PDF", true, ""},
+		{"DOC001234.pdf", true, ""},
+		{"Scan_Invoice_ACME.pdf", false, "Invoice_ACME"},
+		{"Documentation.pdf", false, "Documentation"},
+		{"Invoice-2024.pdf", false, "Invoice-2024"},
+	}
+	for _, tt := range tests {
+		if got := isScannerDefaultName(tt.file); got != tt.wantDefault {
+			t.Errorf("isScannerDefaultName(%q) = %v, want %v", tt.file, got, tt.wantDefault)
+		}
+		if got := originalNameHint(tt.file); got != tt.wantHint {
+			t.Errorf("originalNameHint(%q) = %q, want %q", tt.file, got, tt.wantHint)
+		}
+	}
+
+	// The hint only reaches the prompt with -trim-scanner-prefix
+	if got := originalNameContext("Scan_Invoice_ACME.pdf"); got != "" {
+		t.Errorf("originalNameContext() without -trim-scanner-prefix = %q, want empty", got)
+	}
+	config.TrimScannerPrefix = true
+	if got := originalNameContext("Scan_Invoice_ACME.pdf"); !strings.Contains(got, `"Invoice_ACME"`) {
+		t.Errorf("originalNameContext() = %q, want the trimmed name", got)
+	}
+	if got := originalNameContext("SKM_C224e0123.pdf"); got != "" {
+		t.Errorf("originalNameContext() for a scanner default = %q, want empty", got)
+	}
+
+	// A prefixes file replaces the list
+	path := filepath.Join(t.TempDir(), "prefixes.txt")
+	if err := os.WriteFile(path, []byte("# office copier\nRICOH-\n\nBRN\n"), 0644); err != nil {
+		t.Fatalf("Failed to write prefixes file: %v", err)
+	}
+	prefixes, err := loadScannerPrefixes(path)
+	if err != nil {
+		t.Fatalf("loadScannerPrefixes() returned error: %v", err)
+	}
+	if fmt.Sprint(prefixes) != "[RICOH- BRN]" {
+		t.Errorf("loadScannerPrefixes() = %v, want [RICOH- BRN]", prefixes)
+	}
+}
+
+// TestScannerPrefixFallback verifies the trimmed original name as last resort
+func TestScannerPrefixFallback(t *testing.T) {
+	originalConfig, originalPrefixes, originalRule := config, scannerPrefixes, fallbackRule
+	defer func() { config, scannerPrefixes, fallbackRule = originalConfig, originalPrefixes, originalRule }()
+
+	config = getDefaultConfig()
+	config.AutoRename = true
+	config.OutputDir = t.TempDir()
+	scannerPrefixes = parseScannerPrefixes(defaultScannerPrefixes)
+	fallbackRule = nil
+	cause := errors.New("model unavailable")
+
+	src := filepath.Join(t.TempDir(), "Scan_Invoice_ACME.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	if _, err := fallbackToPattern(src, cause); err != cause {
+		t.Errorf("fallbackToPattern() without -trim-scanner-prefix = %v, want the cause", err)
+	}
+
+	config.TrimScannerPrefix = true
+	result, err := fallbackToPattern(src, cause)
+	if err != nil || result.Mode != "scanner prefix fallback" || filepath.Base(result.Output) != "Invoice-ACME.pdf" {
+		t.Errorf("fallbackToPattern() = %+v, %v, want Invoice-ACME.pdf", result, err)
+	}
+
+	if _, err := fallbackToPattern(filepath.Join(t.TempDir(), "SKM_C224e0123.pdf"), cause); err != cause {
+		t.Errorf("fallbackToPattern() for a scanner default = %v, want the cause", err)
+	}
+}
+
+// TestDateSubdir verifies the date sources of -date-subdir in order of preference
+func TestDateSubdir(t *testing.T) {
+	originalConfig, originalBatch := config, batch
+	defer func() { config, batch = originalConfig, originalBatch }()
+	config = getDefaultConfig()
+
+	dates := []struct {
+		s         string
+		wantYear  string
+		wantMonth string
+		wantOK    bool
+	}{
+		{"Invoice-ACME-2024-03-11", "2024", "03", true},
+		{"Statement_20231231", "2023", "12", true},
+		{"Report-2022-07", "2022", "07", true},
+		{"Order-120240311", "", "", false},
+		{"Invoice-2024-13-01", "", "", false},
+		{"Letter", "", "", false},
+	}
+	for _, tt := range dates {
+		year, month, ok := dateInName(tt.s)
+		if year != tt.wantYear || month != tt.wantMonth || ok != tt.wantOK {
+			t.Errorf("dateInName(%q) = %q, %q, %v, want %q, %q, %v", tt.s, year, month, ok, tt.wantYear, tt.wantMonth, tt.wantOK)
+		}
+	}
+	if year, month, ok := parsePDFDate("D:20210405093000+01'00'"); !ok || year != "2021" || month != "04" {
+		t.Errorf("parsePDFDate() = %q, %q, %v, want 2021, 04", year, month, ok)
+	}
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	mtime := time.Date(2020, 2, 14, 12, 0, 0, 0, time.Local)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+
+	tests := []struct {
+		pdfFile string
+		slug    string
+		want    string
+	}{
+		{src, "Invoice-2024-03-11", "2024/03"},
+		{filepath.Join(tmpDir, "IMG_20230518_0001.pdf"), "Invoice", "2023/05"},
+		{src, "Invoice", "2020/02"},
+		{filepath.Join(tmpDir, "missing.pdf"), "Invoice", unknownDateDir},
+	}
+	for _, tt := range tests {
+		if got := dateSubdir(tt.pdfFile, GeneratedName{Slug: tt.slug}); got != tt.want {
+			t.Errorf("dateSubdir(%s, %s) = %q, want %q", filepath.Base(tt.pdfFile), tt.slug, got, tt.want)
+		}
+	}
+
+	// The folders are created below -output
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	config.DateSubdir = true
+	batch = batchState{}
+	result, err := applyRename(src, GeneratedName{Slug: "Invoice-2024-03-11"}, "OCR mode")
+	if err != nil {
+		t.Fatalf("applyRename() returned error: %v", err)
+	}
+	if want := filepath.Join(config.OutputDir, "2024", "03", "Invoice-2024-03-11.pdf"); result.Output != want {
+		t.Errorf("applyRename() output = %q, want %q", result.Output, want)
+	}
+}
+
+// TestVerifyPDF verifies the integrity check with a stand-in qpdf and the manifest status
+func TestVerifyPDF(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as qpdf stand-in")
+	}
+	originalConfig, originalBatch, originalManifest := config, batch, manifestPath
+	defer func() { config, batch, manifestPath = originalConfig, originalBatch, originalManifest }()
+
+	binDir := t.TempDir()
+	script := "#!/bin/sh\ncase \"$2\" in *bad*) echo 'file is damaged'; exit 2;; esac\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(binDir, "qpdf"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write qpdf stand-in: %v", err)
+	}
+	t.Setenv("PATH", binDir)
+
+	config = getDefaultConfig()
+	tmpDir := t.TempDir()
+	good := filepath.Join(tmpDir, "good.pdf")
+	bad := filepath.Join(tmpDir, "bad.pdf")
+	for _, path := range []string{good, bad} {
+		if err := os.WriteFile(path, []byte("%PDF-1.4"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	if err := verifyPDF(good); err != nil {
+		t.Errorf("verifyPDF(good) returned error: %v", err)
+	}
+	if err := verifyPDF(bad); err == nil || !strings.Contains(err.Error(), "file is damaged") {
+		t.Errorf("verifyPDF(bad) = %v, want the qpdf message", err)
+	}
+
+	config.VerifyPDF = true
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	batch = batchState{}
+	result, err := applyRename(good, GeneratedName{Slug: "Invoice"}, "OCR mode")
+	if err != nil || result.Verified != verifyOK {
+		t.Errorf("applyRename() = %+v, %v, want verified ok", result, err)
+	}
+	result, err = applyRename(good, GeneratedName{Slug: "bad-output"}, "OCR mode")
+	if err == nil || result.Verified != verifyOutputInvalid {
+		t.Errorf("applyRename() with an invalid output = %+v, %v, want output-invalid", result, err)
+	}
+
+	result, err = processPDF(bad)
+	if err == nil || result.Verified != verifySourceInvalid {
+		t.Errorf("processPDF(bad) = %+v, %v, want source-invalid", result, err)
+	}
+	manifestPath = filepath.Join(tmpDir, "manifest.jsonl")
+	recordManifest(bad, result, err)
+	data, readErr := os.ReadFile(manifestPath)
+	if readErr != nil || !strings.Contains(string(data), `"verified":"source-invalid"`) {
+		t.Errorf("manifest = %s, %v, want the verification status", data, readErr)
+	}
+}
+
+// TestNormalizeCaseInText verifies that ALL-CAPS lines are lowercased with acronyms kept
+func TestNormalizeCaseInText(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	text := "ACME INDUSTRIES GMBH\nINVOICE FOR Q1 2024 VAT INCLUDED\nDear Mr. Smith, please find the invoice for your PDF order.\nTOTAL\nUSA"
+	want := "acme industries GMBH\ninvoice for Q1 2024 VAT included\nDear Mr. Smith, please find the invoice for your PDF order.\nTOTAL\nUSA"
+	if got := normalizeCaseInText(text); got != want {
+		t.Errorf("normalizeCaseInText() =\n%s\nwant\n%s", got, want)
+	}
+
+	config = getDefaultConfig()
+	if got := prepareText(text); got != text {
+		t.Errorf("prepareText() without -normalize-case-in-text changed the text: %q", got)
+	}
+	config.NormalizeCaseInText = true
+	if got := prepareText(text); got != want {
+		t.Errorf("prepareText() with -normalize-case-in-text = %q, want %q", got, want)
+	}
+}
+
+// TestProgressJSON verifies the -progress-json event stream
+func TestProgressJSON(t *testing.T) {
+	originalConfig, originalBatch, originalProgress := config, batch, progress
+	defer func() { config, batch, progress = originalConfig, originalBatch, originalProgress }()
+
+	var unset *progressTracker
+	unset.queue([]string{"a.pdf"})
+	unset.begin("a.pdf")
+	unset.update(progressExtracting, "", nil)
+	unset.finish(FileResult{}, nil)
+
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "scans.zip")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"one.pdf", "two.pdf"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte("%PDF-1.4"))
+	}
+	zw.Close()
+	f.Close()
+
+	var buf bytes.Buffer
+	progress = &progressTracker{w: &buf}
+	progress.queue([]string{"a.pdf", archivePath})
+	progress.begin("a.pdf")
+	progress.update(progressExtracting, "", nil)
+	progress.update(progressGenerating, "", nil)
+	progress.update(progressWriting, "", nil)
+	progress.finish(FileResult{Output: "Invoice.pdf"}, nil)
+	progress.begin(archivePath + ":one.pdf")
+	progress.finish(FileResult{}, errors.New("OCR failed"))
+
+	var events []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid progress line %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	want := []string{
+		"queued a.pdf 1/3 0",
+		"queued " + archivePath + ":one.pdf 2/3 0",
+		"queued " + archivePath + ":two.pdf 3/3 0",
+		"extracting a.pdf 1/3 0",
+		"generating a.pdf 1/3 0",
+		"writing a.pdf 1/3 0",
+		"done a.pdf 1/3 33.3",
+		"failed " + archivePath + ":one.pdf 2/3 66.7",
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(events), len(want), buf.String())
+	}
+	for i, event := range events {
+		got := fmt.Sprintf("%s %s %d/%d %v", event.State, event.File, event.Index, event.Total, event.Percent)
+		if got != want[i] || event.Schema != 1 {
+			t.Errorf("event %d = %q (schema %d), want %q", i, got, event.Schema, want[i])
+		}
+	}
+	if events[6].Output != "Invoice.pdf" || events[7].Error != "OCR failed" {
+		t.Errorf("final events = %+v, %+v, want the output and the error", events[6], events[7])
+	}
+
+	// A real file that cannot be processed ends in a failed event
+	config = getDefaultConfig()
+	config.AutoRename = true
+	batch = batchState{}
+	buf.Reset()
+	progress = &progressTracker{w: &buf}
+	src := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	progress.queue([]string{src})
+	processSource(src, src)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var last ProgressEvent
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if last.State != progressFailed || last.Percent != 100 || !strings.Contains(buf.String(), `"state":"extracting"`) {
+		t.Errorf("progress stream = %s, want extracting and a final failed event at 100%%", buf.String())
+	}
+}
+
+// TestCropPageTop verifies the -crop-top crop and the full-page fallback for blank crops
+func TestCropPageTop(t *testing.T) {
+	page := testPagePNG(t, 255, true, false) // Ink in rows 60-99 of 200
+
+	cropped := cropPageTop(1, page, 0.4)
+	img, err := png.Decode(bytes.NewReader(cropped))
+	if err != nil {
+		t.Fatalf("cropped image is not a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 80 {
+		t.Errorf("cropped size = %dx%d, want 200x80", b.Dx(), b.Dy())
+	}
+
+	// The top quarter is blank, so the whole page is sent
+	if got := cropPageTop(1, page, 0.25); !bytes.Equal(got, page) {
+		t.Error("cropPageTop() with a blank crop should return the full page")
+	}
+
+	// Undecodable data is passed through
+	if got := cropPageTop(1, []byte("not an image"), 0.4); string(got) != "not an image" {
+		t.Errorf("cropPageTop() on invalid data = %q, want it unchanged", got)
+	}
+}
+
+// TestModelPerMode verifies which models the vision and text paths use and check
+func TestModelPerMode(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tests := []struct {
+		name        string
+		fastMode    bool
+		visionModel string
+		textModel   string
+		wantVision  string
+		wantText    string
+		wantInUse   string
+	}{
+		{"defaults", true, "", "", "qwen2.5vl:7b", "qwen2.5vl:7b", "[qwen2.5vl:7b]"},
+		{"text model", true, "", "llama3.3", "qwen2.5vl:7b", "llama3.3", "[qwen2.5vl:7b llama3.3]"},
+		{"both models", true, "llava:13b", "llama3.3", "llava:13b", "llama3.3", "[llava:13b llama3.3]"},
+		{"novision", false, "llava:13b", "llama3.3", "llava:13b", "llama3.3", "[llama3.3]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = getDefaultConfig()
+			config.FastMode = tt.fastMode
+			config.VisionModel = tt.visionModel
+			config.TextModel = tt.textModel
+			if got := visionModel(); got != tt.wantVision {
+				t.Errorf("visionModel() = %q, want %q", got, tt.wantVision)
+			}
+			if got := textModel(); got != tt.wantText {
+				t.Errorf("textModel() = %q, want %q", got, tt.wantText)
+			}
+			if got := fmt.Sprint(modelsInUse()); got != tt.wantInUse {
+				t.Errorf("modelsInUse() = %s, want %s", got, tt.wantInUse)
+			}
+		})
+	}
+}
+
+// TestQuarantine verifies that -on-failure quarantine moves failed inputs with a sidecar
+func TestQuarantine(t *testing.T) {
+	originalConfig, originalBatch := config, batch
+	defer func() { config, batch = originalConfig, originalBatch }()
+
+	tmpDir := t.TempDir()
+	config = getDefaultConfig()
+	config.QuarantineDir = filepath.Join(tmpDir, "failed")
+	cause := errors.New("OCR failed")
+
+	src := filepath.Join(tmpDir, "scan.pdf")
+	writeSource := func() {
+		if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+			t.Fatalf("Failed to write source: %v", err)
+		}
+	}
+
+	// keep leaves the input alone
+	writeSource()
+	quarantine(src, src, cause)
+	if _, err := os.Stat(src); err != nil {
+		t.Fatalf("-on-failure keep moved the input: %v", err)
+	}
+
+	config.OnFailure = "quarantine"
+	quarantine(src, src, cause)
+	target := filepath.Join(config.QuarantineDir, "scan.pdf")
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("quarantined input should be moved away")
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "%PDF-1.4" {
+		t.Errorf("quarantined file = %q, %v", data, err)
+	}
+	data, err := os.ReadFile(target + ".failure.json")
+	if err != nil {
+		t.Fatalf("Failed to read failure sidecar: %v", err)
+	}
+	var record FailureRecord
+	if err := json.Unmarshal(data, &record); err != nil || record.Source != src || record.Error != "OCR failed" {
+		t.Errorf("failure sidecar = %s, %v", data, err)
+	}
+
+	// A second failure with the same name is suffixed
+	writeSource()
+	quarantine(src, src, cause)
+	if _, err := os.Stat(filepath.Join(config.QuarantineDir, "scan-1.pdf")); err != nil {
+		t.Errorf("second quarantined file should be suffixed: %v", err)
+	}
+
+	// Archive entries are copied from their temporary file
+	entry := filepath.Join(t.TempDir(), "entry.pdf")
+	if err := os.WriteFile(entry, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	quarantine("scans.zip:entry.pdf", entry, cause)
+	if _, err := os.Stat(entry); err != nil {
+		t.Error("archive entries should be copied, not moved")
+	}
+	if _, err := os.Stat(filepath.Join(config.QuarantineDir, "entry.pdf")); err != nil {
+		t.Errorf("archive entry was not quarantined: %v", err)
+	}
+
+	// Failing files are quarantined by the batch loop
+	writeSource()
+	batch = batchState{}
+	config.AutoRename = true
+	processSource(src, src)
+	if batch.failed != 1 {
+		t.Fatalf("processSource() failed = %d, want 1", batch.failed)
+	}
+	if _, err := os.Stat(filepath.Join(config.QuarantineDir, "scan-2.pdf")); err != nil {
+		t.Errorf("failed file was not quarantined by processSource: %v", err)
+	}
+}
+
+// TestDryRunDiff verifies that -dry-run writes nothing and the diff output format
+func TestDryRunDiff(t *testing.T) {
+	originalConfig, originalBatch, originalInput := config, batch, promptInput
+	defer func() { config, batch, promptInput = originalConfig, originalBatch, originalInput }()
+
+	tmpDir := t.TempDir()
+	config = getDefaultConfig()
+	config.DryRun = true
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	batch = batchState{}
+	src := filepath.Join(tmpDir, "Invoice-2023.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+
+	// No prompt is shown and nothing is written
+	promptInput = bufio.NewScanner(strings.NewReader(""))
+	result, err := confirmAndWrite(src, GeneratedName{Slug: "Invoice-2024"}, "OCR mode")
+	if err != nil || result.Output != "" {
+		t.Errorf("confirmAndWrite() in a dry run = %+v, %v, want no output", result, err)
+	}
+	if _, err := os.Stat(config.OutputDir); !os.IsNotExist(err) {
+		t.Error("a dry run should not create the output directory")
+	}
+	if len(batch.planned) != 1 || batch.planned[0].target != filepath.Join(config.OutputDir, "Invoice-2024.pdf") {
+		t.Errorf("planned renames = %+v", batch.planned)
+	}
+
+	for _, tt := range []struct{ old, new, prefix, oldMid, newMid, suffix string }{
+		{"Invoice-2023.pdf", "Invoice-2024.pdf", "Invoice-202", "3", "4", ".pdf"},
+		{"scan.pdf", "Invoice.pdf", "", "scan", "Invoice", ".pdf"},
+		{"a.pdf", "a.pdf", "a.pdf", "", "", ""},
+		{"aa.pdf", "aaa.pdf", "aa", "", "a", ".pdf"},
+	} {
+		prefix, oldMid, newMid, suffix := diffNames(tt.old, tt.new)
+		if prefix != tt.prefix || oldMid != tt.oldMid || newMid != tt.newMid || suffix != tt.suffix {
+			t.Errorf("diffNames(%q, %q) = %q %q %q %q", tt.old, tt.new, prefix, oldMid, newMid, suffix)
+		}
+		if prefix+oldMid+suffix != tt.old || prefix+newMid+suffix != tt.new {
+			t.Errorf("diffNames(%q, %q) parts do not rebuild the names", tt.old, tt.new)
+		}
+	}
+
+	planned := []plannedRename{
+		{source: "in/scan.pdf", target: "out/Invoice.pdf"},
+		{source: "in/Invoice-2023.pdf", target: "out/Invoice-2024.pdf"},
+		{source: "in/Report.pdf", target: "out/Report.pdf"},
+	}
+	want := "Changed (2):\n" +
+		"  [scan].pdf          ->  [Invoice].pdf\n" +
+		"  Invoice-202[3].pdf  ->  Invoice-202[4].pdf\n" +
+		"Unchanged (1):\n" +
+		"  Report.pdf\n"
+	if got := formatDryRunDiff(planned, false); got != want {
+		t.Errorf("formatDryRunDiff() =\n%s\nwant\n%s", got, want)
+	}
+	if got := formatDryRunDiff(planned[:1], true); !strings.Contains(got, "\x1b[31mscan\x1b[0m.pdf") || !strings.Contains(got, "\x1b[32mInvoice\x1b[0m.pdf") {
+		t.Errorf("formatDryRunDiff() with color = %q", got)
+	}
+
+	config.NoColor = false
+	t.Setenv("NO_COLOR", "1")
+	if useColor() {
+		t.Error("useColor() should respect NO_COLOR")
+	}
+}
+
+// multiPagePDF builds a minimal, valid PDF with the given number of blank pages.
+func multiPagePDF(pages int) []byte {
+	var objects []string
+	kids := make([]string, pages)
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", i+3)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages))
+	for range pages {
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// TestAppendPageCount verifies the -pN suffix, the single-page choice and the length cap,
+// and, when Ghostscript is installed, the suffix for a multi-page fixture.
+func TestAppendPageCount(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.CharsBudget = 0
+	config.PageCountSingle = false
+
+	if got := pageCountSuffix("Invoice-ACME", 5); got != "Invoice-ACME-p5" {
+		t.Errorf("pageCountSuffix(5) = %q", got)
+	}
+	if got := pageCountSuffix("Invoice-ACME", 1); got != "Invoice-ACME" {
+		t.Errorf("single page without -page-count-single = %q", got)
+	}
+	config.PageCountSingle = true
+	if got := pageCountSuffix("Invoice-ACME", 1); got != "Invoice-ACME-p1" {
+		t.Errorf("single page with -page-count-single = %q", got)
+	}
+	config.CharsBudget = 12
+	if got := pageCountSuffix("Invoice-ACME-Corp", 12); got != "Invoice-p12" {
+		t.Errorf("capped suffix = %q, want %q", got, "Invoice-p12")
+	}
+	config.Separator = "underscore"
+	if got := pageCountSuffix("Invoice_ACME_Corp", 12); got != "Invoice_p12" {
+		t.Errorf("capped suffix with -separator underscore = %q, want %q", got, "Invoice_p12")
+	}
+
+	if _, err := exec.LookPath("gs"); err != nil {
+		t.Skip("Ghostscript not installed")
+	}
+	config = saved
+	config.CharsBudget = 0
+	config.PageCountSingle = false
+	pdf := filepath.Join(t.TempDir(), "fixture.pdf")
+	if err := os.WriteFile(pdf, multiPagePDF(3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := withPageCount(pdf, GeneratedName{Slug: "Report"})
+	if name.Slug != "Report-p3" {
+		t.Errorf("withPageCount on 3-page fixture = %q, want %q", name.Slug, "Report-p3")
+	}
+}
+
+// TestAllowSpaces verifies that -allow-spaces keeps single spaces, collapses runs,
+// trims the ends and still replaces filesystem-illegal characters, optionally title-cased.
+func TestAllowSpaces(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.AllowSpaces = true
+	config.Charset = "ascii"
+	config.CharsBudget = 0
+	config.MinNameLength = 1
+
+	tests := []struct {
+		raw, want string
+	}{
+		{"Quarterly Report 2023", "Quarterly Report 2023"},
+		{"  Quarterly   Report\t2023  ", "Quarterly Report 2023"},
+		{"Report: Q3/2023", "Report Q3-2023"},
+		{"Smith - Jones <contract>?", "Smith Jones contract"},
+		{"Invoice-ACME 2024", "Invoice-ACME 2024"},
+		{"..\\\\secret*|name.", "secret-name"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.raw); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	config.CharsBudget = 10
+	if got := sanitizeFilename("Quarterly Report"); got != "Quarterly" {
+		t.Errorf("capped name = %q, want no trailing space", got)
+	}
+
+	config.CharsBudget = 0
+	config.TitleCase = true
+	name, err := newGeneratedName("quarterly report for ACME 2023")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name.Slug != "Quarterly Report For ACME 2023" {
+		t.Errorf("title-cased slug = %q", name.Slug)
+	}
+	if got := applyPromptRules(defaultPrompt); !strings.Contains(got, "separate words with spaces") {
+		t.Errorf("prompt not adapted to -allow-spaces: %q", got)
+	}
+	config.AllowSpaces = false
+	config.Separator = "underscore"
+	config.Case = "lower"
+	if got := applyPromptRules(defaultPrompt); !strings.Contains(got, "separate words with underscores, all in lowercase") {
+		t.Errorf("prompt not adapted to -separator underscore and -case lower: %q", got)
+	}
+	config.Separator = "dash"
+	config.Case = "keep"
+	if got := applyPromptRules(defaultPrompt); !strings.Contains(got, "separate words with dashes.") {
+		t.Errorf("default prompt rules changed: %q", got)
+	}
+	config.AllowSpaces = true
+
+	config.AllowSpaces = false
+	if got := sanitizeFilename("Quarterly Report 2023"); got != "Quarterly-Report-2023" {
+		t.Errorf("default sanitizing = %q", got)
+	}
+}
+
+// TestNameLang verifies that -name-lang appends the language instruction to the
+// default and custom prompts, and that ISO codes are spelled out
+func TestNameLang(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	pdf := filepath.Join(t.TempDir(), "factura.pdf")
+
+	config.NameLang = ""
+	if strings.Contains(textPrompt(pdf, "texto"), "Respond with the filename in") {
+		t.Error("language instruction added without -name-lang")
+	}
+
+	config.NameLang = "en"
+	want := "Respond with the filename in English"
+	if got := textPrompt(pdf, "texto"); !strings.Contains(got, want) {
+		t.Errorf("text prompt misses %q: %q", want, got)
+	}
+	config.CustomPrompt = "Name this document."
+	config.NameLang = "Spanish"
+	if got := visionPrompt(pdf); !strings.HasPrefix(got, "Name this document.") || !strings.Contains(got, "filename in Spanish") {
+		t.Errorf("custom vision prompt = %q", got)
+	}
+}
+
+// TestEscalateModel verifies that a failure of the primary paths is handed back for one
+// escalation attempt, that the escalation attempt reaches the pattern fallback, and that
+// the model behind a name is recorded in the manifest
+func TestEscalateModel(t *testing.T) {
+	originalConfig := config
+	originalRule := fallbackRule
+	originalManifest := manifestPath
+	defer func() { config = originalConfig; fallbackRule = originalRule; manifestPath = originalManifest }()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "IMG_0042.pdf")
+	if err := os.WriteFile(src, []byte("not a pdf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rule, err := parsePatternRule(`^IMG_(\d+)$=>scan-$1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallbackRule = rule
+	config = getDefaultConfig()
+	config.AutoRename = true
+	config.FastMode = false
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	config.EscalateModel = "big-model:70b"
+	config.TextModel = "small-model"
+
+	cause := fmt.Errorf("ocr failed")
+	_, err = fallbackToPattern(src, cause)
+	var escalation *escalationError
+	if !errors.As(err, &escalation) || !errors.Is(err, cause) {
+		t.Fatalf("fallbackToPattern() before escalation = %v, want an escalationError wrapping the cause", err)
+	}
+	if models := modelsInUse(); !slices.Contains(models, "big-model:70b") {
+		t.Errorf("modelsInUse() = %v, want the escalation model", models)
+	}
+
+	result, err := processPDF(src)
+	if err != nil {
+		t.Fatalf("processPDF() error = %v", err)
+	}
+	if result.Mode != "pattern fallback" || filepath.Base(result.Output) != "scan-0042.pdf" {
+		t.Errorf("processPDF() = %+v, want the pattern fallback after escalation", result)
+	}
+	if config.TextModel != "small-model" || config.VisionModel != "" || escalating {
+		t.Errorf("models not restored after escalation: text %q, vision %q, escalating %v", config.TextModel, config.VisionModel, escalating)
+	}
+
+	manifestPath = filepath.Join(tmpDir, "manifest.jsonl")
+	recordManifest(src, FileResult{Output: "out/x.pdf", Mode: "OCR mode", Name: GeneratedName{Slug: "x", Model: "big-model:70b"}}, nil)
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"model":"big-model:70b"`) {
+		t.Errorf("manifest entry misses the model: %s", data)
+	}
+}
+
+// TestWriteDebugImages verifies that -debug-images writes each page as <source>-pN.png
+// and that nothing is written without it
+func TestWriteDebugImages(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tmpDir := t.TempDir()
+	t.Chdir(tmpDir)
+	writeDebugImages(filepath.Join("in", "scan.pdf"), [][]byte{[]byte("page one"), []byte("page two")})
+	if entries, _ := os.ReadDir(tmpDir); len(entries) > 0 {
+		t.Errorf("writeDebugImages() without -debug-images wrote %d entries", len(entries))
+	}
+
+	config.DebugImagesDir = filepath.Join(tmpDir, "debug")
+	writeDebugImages(filepath.Join("in", "scan.pdf"), [][]byte{[]byte("page one"), []byte("page two")})
+	for name, want := range map[string]string{"scan-p1.png": "page one", "scan-p2.png": "page two"} {
+		data, err := os.ReadFile(filepath.Join(config.DebugImagesDir, name))
+		if err != nil {
+			t.Errorf("debug image %s not written: %v", name, err)
+			continue
+		}
+		if string(data) != want {
+			t.Errorf("debug image %s = %q, want %q", name, data, want)
+		}
+	}
+	if entries, _ := os.ReadDir(config.DebugImagesDir); len(entries) != 2 {
+		t.Errorf("debug directory has %d entries, want 2", len(entries))
+	}
+}
+
+// TestReportHTML verifies that the HTML report lists each outcome, escapes user-derived
+// strings and embeds page thumbnails as data URLs
+func TestReportHTML(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	defer func() { config = originalConfig; batch = originalBatch }()
+	config = getDefaultConfig()
+	config.ReportHTML = filepath.Join(t.TempDir(), "report.html")
+	batch = batchState{}
+
+	page := image.NewRGBA(image.Rect(0, 0, 800, 1000))
+	var pageData bytes.Buffer
+	if err := png.Encode(&pageData, page); err != nil {
+		t.Fatal(err)
+	}
+	rememberThumbnail("in/scan.pdf", pageData.Bytes())
+
+	recordResult("in/scan.pdf", "in/scan.pdf", FileResult{Output: "out/Invoice-ACME.pdf", Mode: "vision mode"}, nil)
+	recordResult("in/<script>alert(1)</script>.pdf", "in/x.pdf", FileResult{}, fmt.Errorf("bad & broken <pdf>"))
+
+	if len(batch.report) != 2 || batch.report[0].NewName != "Invoice-ACME.pdf" || batch.report[1].Status != "failed" {
+		t.Fatalf("report rows = %+v", batch.report)
+	}
+	if len(batch.thumbnails) != 0 {
+		t.Error("thumbnail should be consumed by its report row")
+	}
+
+	if err := writeHTMLReport(config.ReportHTML, batch.report); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(config.ReportHTML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(data)
+	for _, want := range []string{"Invoice-ACME.pdf", "vision mode", `src="data:image/png;base64,`, "&lt;script&gt;", "bad &amp; broken &lt;pdf&gt;"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report misses %q", want)
+		}
+	}
+	if strings.Contains(html, "<script>") {
+		t.Error("report contains an unescaped file name")
+	}
+}
+
+// TestNumberPolicy verifies -numbers keep, strip and collapse
+func TestNumberPolicy(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = getDefaultConfig()
+	config.CharsBudget = 0
+
+	tests := []struct {
+		policy string
+		raw    string
+		want   string
+	}{
+		{"keep", "invoice-0000012345-acme", "invoice-0000012345-acme"},
+		{"strip", "invoice-0000012345-acme", "invoice-acme"},
+		{"collapse", "invoice-0000012345-acme", "invoice-012345-acme"},
+		{"strip", "2023-05-01 report Q1", "report-Q1"},
+		{"strip", "INV12345-acme", "INV12345-acme"},
+		{"collapse", "INV0000012345-2023", "INV012345-2023"},
+	}
+	for _, tt := range tests {
+		config.Numbers = tt.policy
+		if got := sanitizeFilename(tt.raw); got != tt.want {
+			t.Errorf("-numbers %s: sanitizeFilename(%q) = %q, want %q", tt.policy, tt.raw, got, tt.want)
+		}
+	}
+
+	config.Numbers = "strip"
+	config.AllowSpaces = true
+	if got := sanitizeFilename("Quarterly Report 2023"); got != "Quarterly Report" {
+		t.Errorf("strip with -allow-spaces = %q", got)
+	}
+}
+
+// TestJobSpec verifies loading and validating an -input-json spec and that per-entry
+// overrides apply to their file only
+func TestJobSpec(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	originalRule := fallbackRule
+	originalEntries := jobEntries
+	defer func() {
+		config, batch, fallbackRule, jobEntries = originalConfig, originalBatch, originalRule, originalEntries
+	}()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "IMG_0042.pdf")
+	if err := os.WriteFile(src, []byte("not a pdf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeSpec := func(content string) string {
+		path := filepath.Join(tmpDir, "spec.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, bad := range []string{
+		`{"path": "x.pdf"}`,
+		`[]`,
+		`[{"path": ""}]`,
+		`[{"path": "` + filepath.ToSlash(src) + `", "modle": "x"}]`,
+		`[{"path": "` + filepath.ToSlash(filepath.Join(tmpDir, "missing.pdf")) + `"}]`,
+		`[{"path": "` + filepath.ToSlash(tmpDir) + `"}]`,
+	} {
+		if _, err := loadJobSpec(writeSpec(bad)); err == nil {
+			t.Errorf("loadJobSpec(%s) should fail", bad)
+		}
+	}
+
+	out := filepath.Join(tmpDir, "per-file")
+	entries, err := loadJobSpec(writeSpec(`[{"path": "` + filepath.ToSlash(src) + `", "model": "big:70b", "prompt": "Name it.", "output": "` + filepath.ToSlash(out) + `/"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Model != "big:70b" || entries[0].Output != out {
+		t.Fatalf("loadJobSpec() = %+v", entries)
+	}
+
+	config = getDefaultConfig()
+	config.AutoRename = true
+	config.FastMode = false
+	config.OutputDir = filepath.Join(tmpDir, "global")
+	jobEntries = entries
+	if models := modelsInUse(); !slices.Contains(models, "big:70b") {
+		t.Errorf("modelsInUse() = %v, want the spec model", models)
+	}
+	batch = batchState{}
+	fallbackRule, err = parsePatternRule(`^IMG_(\d+)$=>scan-$1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processJobEntry(entries[0])
+	if _, err := os.Stat(filepath.Join(out, "scan-0042.pdf")); err != nil {
+		t.Errorf("entry output override not used: %v", err)
+	}
+	if config.OutputDir != filepath.Join(tmpDir, "global") || config.TextModel != "" || config.CustomPrompt != defaultPrompt {
+		t.Errorf("global options not restored: output %q, text model %q", config.OutputDir, config.TextModel)
+	}
+}
+
+// TestDropDuplicatePages verifies that a re-rendered copy of an earlier page is dropped
+// while different pages are kept
+func TestDropDuplicatePages(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.DuplicateThreshold = 5
+
+	page := func(w, h int, shade func(x, y int) uint8) []byte {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := range h {
+			for x := range w {
+				img.SetGray(x, y, color.Gray{Y: shade(x*100/w, y*100/h)})
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	cover := func(x, y int) uint8 {
+		if y < 20 && x > 10 && x < 60 {
+			return 0 // Letterhead block
+		}
+		return 255
+	}
+	letter := func(x, y int) uint8 {
+		if (y/8)%2 == 0 && x > 5 && x < 90-y/2 {
+			return 30 // Text lines
+		}
+		return 250
+	}
+
+	images := [][]byte{page(200, 260, cover), page(200, 260, letter), page(100, 130, cover)}
+	kept := dropDuplicatePages(images)
+	if len(kept) != 2 || !bytes.Equal(kept[0], images[0]) || !bytes.Equal(kept[1], images[1]) {
+		t.Errorf("dropDuplicatePages kept %d pages, want the cover and the letter", len(kept))
+	}
+
+	config.DuplicateThreshold = 0
+	a, err := pageHash(images[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := pageHash(images[1]); a == b {
+		t.Error("different pages should hash differently")
+	}
+	if kept := dropDuplicatePages([][]byte{[]byte("not an image"), images[1]}); len(kept) != 2 {
+		t.Errorf("unhashable images should be kept, got %d pages", len(kept))
+	}
+}
+
+// TestApplyMap verifies reading an -apply-map file and writing the mapped, sanitized
+// names through the regular output path without a model
+func TestApplyMap(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	originalMap := nameMap
+	defer func() { config, batch, nameMap = originalConfig, originalBatch, originalMap }()
+
+	tmpDir := t.TempDir()
+	first := filepath.Join(tmpDir, "scan_0001.pdf")
+	second := filepath.Join(tmpDir, "scan_0002.pdf")
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, []byte("%PDF"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMap := func(content string) string {
+		path := filepath.Join(tmpDir, "names.tsv")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, bad := range []string{
+		"",
+		first + " Invoice ACME\n",
+		first + "\tInvoice\n" + first + "\tOther\n",
+		filepath.Join(tmpDir, "missing.pdf") + "\tInvoice\n",
+	} {
+		if _, err := loadNameMap(writeMap(bad)); err == nil {
+			t.Errorf("loadNameMap(%q) should fail", bad)
+		}
+	}
+
+	mappings, err := loadNameMap(writeMap("# source\tname\n" + second + "\tInvoice ACME 2024.pdf\r\n" + first + "\tInvoice: ACME/2024\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mappings) != 2 || mappings[0].source != second || mappings[0].target != "Invoice ACME 2024" {
+		t.Fatalf("loadNameMap() = %+v", mappings)
+	}
+
+	config = getDefaultConfig()
+	config.AutoRename = true
+	config.OnCollision = "suffix"
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	batch = batchState{}
+	nameMap = map[string]string{}
+	for _, m := range mappings {
+		nameMap[m.source] = m.target
+	}
+	for _, m := range mappings {
+		processSource(m.source, m.source)
+	}
+	for _, want := range []string{"Invoice-ACME-2024.pdf", "Invoice-ACME-2024-1.pdf"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, want)); err != nil {
+			t.Errorf("expected output %s: %v", want, err)
+		}
+	}
+	if batch.failed != 0 {
+		t.Errorf("batch.failed = %d, want 0", batch.failed)
+	}
+}
+
+// TestReviewDir verifies that low-confidence files are copied into -review-dir with a
+// sidecar holding the suggestion, and that the manifest points at the copy
+func TestReviewDir(t *testing.T) {
+	originalConfig := config
+	originalManifest := manifestPath
+	defer func() { config, manifestPath = originalConfig, originalManifest }()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scan_0001.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-low"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = getDefaultConfig()
+	result := FileResult{Name: GeneratedName{Slug: "Maybe-Invoice", Confidence: 3}, Mode: "vision mode", LowConfidence: true}
+
+	if got := sendToReview(src, src, result); got != "" {
+		t.Errorf("sendToReview without -review-dir = %q", got)
+	}
+
+	config.ReviewDir = filepath.Join(tmpDir, "review")
+	first := sendToReview(src, src, result)
+	second := sendToReview(src, src, result)
+	if first != filepath.Join(config.ReviewDir, "scan_0001.pdf") || second != filepath.Join(config.ReviewDir, "scan_0001-1.pdf") {
+		t.Fatalf("review copies = %q, %q", first, second)
+	}
+	if data, err := os.ReadFile(src); err != nil || string(data) != "%PDF-low" {
+		t.Error("the original must stay in place")
+	}
+	data, err := os.ReadFile(first + ".review.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record ReviewRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Source != src || record.Suggested != "Maybe-Invoice.pdf" || record.Confidence != 3 || record.Mode != "vision mode" {
+		t.Errorf("review sidecar = %+v", record)
+	}
+
+	result.Review = first
+	if entry := newManifestEntry(src, result, nil); entry.Status != "low-confidence" || entry.Review != first {
+		t.Errorf("manifest entry = %+v", entry)
+	}
+}
+
+// TestFirstPageFastPath verifies that the page count caps the pages tried by the "first"
+// strategy, and that a failing count falls back to probing
+func TestFirstPageFastPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as gs stand-in")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	binDir := t.TempDir()
+	script := "#!/bin/sh\ncase \"$*\" in *broken*) exit 1;; *multi*) echo 7;; *) echo 1;; esac\n"
+	if err := os.WriteFile(filepath.Join(binDir, "gs"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write gs stand-in: %v", err)
+	}
+	t.Setenv("PATH", binDir)
+
+	config = getDefaultConfig()
+	config.SampleCount = 3
+	config.FirstPageFastPath = true
+	tests := []struct {
+		file string
+		want []int
+	}{
+		{"receipt.pdf", []int{1}},
+		{"multi.pdf", []int{1, 2, 3}},
+		{"broken.pdf", []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		pages, explicit, err := selectPages(filepath.Join(t.TempDir(), tt.file))
+		if err != nil || explicit || !slices.Equal(pages, tt.want) {
+			t.Errorf("selectPages(%s) = %v, %v, %v, want %v", tt.file, pages, explicit, err, tt.want)
+		}
+	}
+
+	config.FirstPageFastPath = false
+	if pages, _, _ := selectPages("receipt.pdf"); len(pages) != 3 {
+		t.Errorf("without the fast path all %d leading pages should be tried, got %v", config.SampleCount, pages)
+	}
+}
+
+// TestTemperatureSchedule verifies parsing -temperature-schedule, the temperature per
+// retry and that only unusable answers are marked for a retry
+func TestTemperatureSchedule(t *testing.T) {
+	originalSchedule := temperatureSchedule
+	defer func() { temperatureSchedule = originalSchedule }()
+
+	for _, bad := range []string{"", "0.5,,1", "hot", "-0.1", "2.5"} {
+		if _, err := parseTemperatureSchedule(bad); err == nil {
+			t.Errorf("parseTemperatureSchedule(%q) should fail", bad)
+		}
+	}
+	schedule, err := parseTemperatureSchedule("0.6, 0.9,1.2")
+	if err != nil || !slices.Equal(schedule, []float64{0.6, 0.9, 1.2}) {
+		t.Fatalf("parseTemperatureSchedule() = %v, %v", schedule, err)
+	}
+	temperatureSchedule = schedule
+	for attempt, want := range map[int]float64{1: 0.6, 2: 0.9, 3: 1.2, 5: 1.2} {
+		if got := retryTemperature(attempt); got != want {
+			t.Errorf("retryTemperature(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	if unusableAnswer(nil) != nil {
+		t.Error("unusableAnswer(nil) should stay nil")
+	}
+	cause := fmt.Errorf("generated name \"a\" is too short")
+	var unusable *unusableAnswerError
+	if err := unusableAnswer(cause); !errors.As(err, &unusable) || !errors.Is(err, cause) || err.Error() != cause.Error() {
+		t.Errorf("unusableAnswer(%v) = %v", cause, err)
+	}
+}
+
+// TestKeywords verifies parsing keyword answers and writing the tags file and metadata
+func TestKeywords(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	answer := "1. ACME Corp\n2. invoice\n- Hosting\n* acme corp\n\"VAT\", payment terms\n\n"
+	want := []string{"ACME Corp", "invoice", "Hosting", "VAT"}
+	if got := parseKeywords(answer, 4); !slices.Equal(got, want) {
+		t.Errorf("parseKeywords() = %q, want %q", got, want)
+	}
+	if got := parseKeywords("", 5); len(got) != 0 {
+		t.Errorf("parseKeywords(empty) = %q", got)
+	}
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = getDefaultConfig()
+	config.AutoRename = true
+	config.EmitMetadata = true
+	config.OutputDir = filepath.Join(tmpDir, "out")
+	name := GeneratedName{Readable: "Invoice ACME", Slug: "Invoice-ACME", Keywords: want}
+	if _, err := applyRename(src, name, "OCR mode"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(config.OutputDir, "Invoice-ACME.tags"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "ACME Corp\ninvoice\nHosting\nVAT\n" {
+		t.Errorf("tags file = %q", data)
+	}
+	data, err = os.ReadFile(filepath.Join(config.OutputDir, "Invoice-ACME.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata DocumentMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil || !slices.Equal(metadata.Keywords, want) {
+		t.Errorf("metadata keywords = %q, %v", metadata.Keywords, err)
+	}
+}
+
+// TestStdinPDF verifies that a piped PDF is spooled to a temporary file, named, reported
+// on the -stdout-name writer and cleaned up afterwards
+func TestStdinPDF(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	originalRule := fallbackRule
+	originalOutput := nameOutput
+	defer func() {
+		config, batch, fallbackRule, nameOutput = originalConfig, originalBatch, originalRule, originalOutput
+	}()
+
+	rule, err := parsePatternRule(`^stdin$=>piped-report`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallbackRule = rule
+	config = getDefaultConfig()
+	config.FastMode = false
+	config.AutoRename = true
+	config.DryRun = true
+	batch = batchState{}
+	var names bytes.Buffer
+	nameOutput = &names
+
+	if err := processStdinPDF(strings.NewReader("")); err == nil {
+		t.Error("empty stdin should fail")
+	}
+	if err := processStdinPDF(strings.NewReader("%PDF-1.4 piped")); err != nil {
+		t.Fatal(err)
+	}
+	if names.String() != "piped-report.pdf\n" {
+		t.Errorf("stdout names = %q, want %q", names.String(), "piped-report.pdf\n")
+	}
+	if len(batch.planned) != 1 {
+		t.Fatalf("planned = %+v", batch.planned)
+	}
+	if _, err := os.Stat(batch.planned[0].source); !os.IsNotExist(err) {
+		t.Errorf("temporary file %s was not removed", batch.planned[0].source)
+	}
+
+	// Without -stdout-name and with -output, the name is used for the written copy
+	config.DryRun = false
+	config.OutputDir = t.TempDir()
+	nameOutput = nil
+	if err := processStdinPDF(strings.NewReader("%PDF-1.4 piped")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(config.OutputDir, "piped-report.pdf"))
+	if err != nil || string(data) != "%PDF-1.4 piped" {
+		t.Errorf("written output = %q, %v", data, err)
+	}
+}
+
+// TestScheme verifies -scheme parsing and how the name is composed from its placeholders
+func TestScheme(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	for _, value := range []string{"{date}_{title}", "{name", "name}_{date}", "{date} {name}", "prefix-only"} {
+		if _, err := parseScheme(value); err == nil {
+			t.Errorf("parseScheme(%q) should fail", value)
+		}
+	}
+
+	pdfFile := filepath.Join(t.TempDir(), "scan_0042.pdf")
+	if err := os.WriteFile(pdfFile, []byte("%PDF-1.4 scheme"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte("%PDF-1.4 scheme")))[:8]
+	name := GeneratedName{Slug: "Invoice-ACME-2024-03", Category: "invoice", Keywords: []string{"tax", "Q1 report"}}
+
+	tests := []struct {
+		scheme string
+		name   GeneratedName
+		want   string
+	}{
+		{"{date}_{type}_{name}", name, "2024-03_invoice_Invoice-ACME-2024-03"},
+		{"{date}_{type}_{name}", GeneratedName{Slug: "Invoice-ACME-2024-03"}, "2024-03_Invoice-ACME-2024-03"},
+		{"{type}_{name}", GeneratedName{Slug: "Letter"}, "Letter"},
+		{"{name}_{keywords}", name, "Invoice-ACME-2024-03_tax-Q1-report"},
+		{"{original}.{hash}", name, "scan-0042." + hash},
+		{"doc-{name}", name, "doc-Invoice-ACME-2024-03"},
+	}
+	for _, tt := range tests {
+		scheme, err := parseScheme(tt.scheme)
+		if err != nil {
+			t.Fatalf("parseScheme(%q) error: %v", tt.scheme, err)
+		}
+		if got := scheme.compose(pdfFile, tt.name); got != tt.want {
+			t.Errorf("%q.compose() = %q, want %q", tt.scheme, got, tt.want)
+		}
+	}
+
+	config.CharsBudget = 12
+	scheme, _ := parseScheme("{name}_{type}")
+	if got := scheme.compose(pdfFile, name); got != "Invoice-ACME" {
+		t.Errorf("compose() with -chars-budget 12 = %q, want %q", got, "Invoice-ACME")
+	}
+
+	config.CharsBudget = 0
+	config.Separator = "underscore"
+	scheme, _ = parseScheme("{date}_{name}")
+	if got := scheme.compose(pdfFile, GeneratedName{Slug: "invoice_acme_2024_03"}); got != "2024_03_invoice_acme_2024_03" {
+		t.Errorf("compose() with -separator underscore = %q, want %q", got, "2024_03_invoice_acme_2024_03")
+	}
+}
+
+// TestValidateOnly verifies the reasons -validate-only reports for non-conforming names
+func TestValidateOnly(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+	config.CharsBudget = 20
+
+	tests := []struct {
+		base string
+		want string // substring of the reasons, empty if the name conforms
+	}{
+		{"Invoice-ACME-2024.pdf", ""},
+		{"Invoice ACME.pdf", "characters not allowed"},
+		{"Invoice--ACME.pdf", "repeated separators"},
+		{"-Invoice.pdf", "separator"},
+		{"Quarterly-Report-ACME-2024.pdf", "longer than -chars-budget 20"},
+		{"nul.pdf", "reserved device name"},
+		{"Invoice.PDF", "extension"},
+	}
+	for _, tt := range tests {
+		reasons := strings.Join(nameViolations(tt.base), "; ")
+		if tt.want == "" && reasons != "" {
+			t.Errorf("nameViolations(%q) = %q, want none", tt.base, reasons)
+		}
+		if tt.want != "" && !strings.Contains(reasons, tt.want) {
+			t.Errorf("nameViolations(%q) = %q, want a reason containing %q", tt.base, reasons, tt.want)
+		}
+	}
+
+	config.AllowSpaces = true
+	if reasons := nameViolations("Invoice ACME.pdf"); len(reasons) > 0 {
+		t.Errorf("nameViolations() with -allow-spaces = %v, want none", reasons)
+	}
+	if failed := validateNames([]string{"a/Invoice ACME.pdf", "b/Invoice--ACME.pdf", "c/docs.zip"}); failed != 1 {
+		t.Errorf("validateNames() = %d failures, want 1", failed)
+	}
+
+	// -min-name-length counts characters, not bytes
+	config.AllowSpaces = false
+	config.Charset = "unicode"
+	if reasons := strings.Join(nameViolations("東京.pdf"), "; "); !strings.Contains(reasons, "shorter than -min-name-length 3") {
+		t.Errorf("nameViolations(%q) = %q, want it shorter than -min-name-length", "東京.pdf", reasons)
+	}
+	if reasons := nameViolations("東京駅.pdf"); len(reasons) > 0 {
+		t.Errorf("nameViolations(%q) = %v, want none", "東京駅.pdf", reasons)
+	}
+	if err := validateGeneratedName("東京"); err == nil {
+		t.Errorf("validateGeneratedName(%q) = nil, want an error for 2 characters", "東京")
+	}
+}
+
+// TestReadGenerateStream verifies that streamed chunks are assembled up to the final record
+func TestReadGenerateStream(t *testing.T) {
+	stream := `{"response":"Invoice","done":false}
+{"response":"-ACME","done":false}
+
+{"response":"-2024","done":false}
+{"response":"","done":true,"total_duration":123}
+`
+	var echo bytes.Buffer
+	resp, err := readGenerateStream(strings.NewReader(stream), &echo)
+	if err != nil || resp.Response != "Invoice-ACME-2024" {
+		t.Errorf("readGenerateStream() = %q, %v, want %q", resp.Response, err, "Invoice-ACME-2024")
+	}
+	if echo.String() != "Invoice-ACME-2024\n" {
+		t.Errorf("echoed %q, want the fragments followed by a newline", echo.String())
+	}
+
+	resp, err = readGenerateStream(strings.NewReader(`{"error":"model \"llava\" not found"}`+"\n"), nil)
+	if err != nil || resp.Error != `model "llava" not found` {
+		t.Errorf("readGenerateStream() error record = %+v, %v", resp, err)
+	}
+	if _, err := readGenerateStream(strings.NewReader(`{"response":"Invo","done":false}`+"\n"), nil); err == nil {
+		t.Error("readGenerateStream() should fail when the stream ends without the final record")
+	}
+}
+
+// TestDedupeAgainstOutput verifies that inputs whose content is already in -output are skipped
+func TestDedupeAgainstOutput(t *testing.T) {
+	originalConfig := config
+	originalBatch := batch
+	originalRule := fallbackRule
+	originalHashes := outputHashes
+	defer func() {
+		config, batch, fallbackRule, outputHashes = originalConfig, originalBatch, originalRule, originalHashes
+	}()
+
+	rule, err := parsePatternRule(`^([a-z])$=>doc-$1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallbackRule = rule
+	config = getDefaultConfig()
+	config.FastMode = false
+	config.AutoRename = true
+	config.OutputDir = t.TempDir()
+	batch = batchState{}
+
+	if err := os.MkdirAll(filepath.Join(config.OutputDir, "2024", "03"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config.OutputDir, "2024", "03", "Invoice.pdf"), []byte("%PDF-1.4 A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if outputHashes, err = hashPDFs(config.OutputDir); err != nil || len(outputHashes) != 1 {
+		t.Fatalf("hashPDFs() = %v, %v, want one PDF", outputHashes, err)
+	}
+	if hashes, err := hashPDFs(filepath.Join(config.OutputDir, "missing")); err != nil || len(hashes) != 0 {
+		t.Errorf("hashPDFs() of a missing directory = %v, %v, want an empty set", hashes, err)
+	}
+
+	inputDir := t.TempDir()
+	for name, content := range map[string]string{"a.pdf": "%PDF-1.4 A", "b.pdf": "%PDF-1.4 B", "c.pdf": "%PDF-1.4 B"} {
+		if err := os.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		path := filepath.Join(inputDir, name)
+		processSource(path, path)
+	}
+
+	if batch.duplicate != 2 || batch.processed != 1 {
+		t.Errorf("duplicate = %d, processed = %d, want 2 and 1", batch.duplicate, batch.processed)
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "doc-b.pdf")); err != nil {
+		t.Errorf("b.pdf was not written: %v", err)
+	}
+	for _, name := range []string{"doc-a.pdf", "doc-c.pdf"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, name)); !os.IsNotExist(err) {
+			t.Errorf("duplicate %s should not be written", name)
+		}
+	}
+}
+
+// TestMaxWords verifies that -max-words keeps only the first words of a name
+func TestMaxWords(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+	config.MaxWords = 4
+
+	tests := []struct {
+		raw, want string
+	}{
+		{"Invoice ACME Corporation March 2024 Electricity", "Invoice-ACME-Corporation-March"},
+		{"Invoice -- ACME  Corporation, March 2024!", "Invoice-ACME-Corporation-March"},
+		{"Tax-Return-2023", "Tax-Return-2023"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.raw); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+
+	config.AllowSpaces = true
+	if got := sanitizeFilename("Invoice ACME Corporation March 2024 Electricity"); got != "Invoice ACME Corporation March" {
+		t.Errorf("sanitizeFilename() with -allow-spaces = %q, want %q", got, "Invoice ACME Corporation March")
+	}
+}
+
+// TestSettingsFile verifies saving, reading and applying the defaults written by -setup
+func TestSettingsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ai-pdf-renamer", "config")
+	if settings, err := readSettings(path); err != nil || settings != nil {
+		t.Fatalf("readSettings() of a missing file = %v, %v, want no settings", settings, err)
+	}
+
+	if err := saveSettings(path, []setting{{"model", "llava:7b"}, {"novision", "false"}}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, "# my own tweak\n-dpi = 150")
+	f.Close()
+	if err := saveSettings(path, []setting{{"model", "qwen2.5vl:7b"}}); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := readSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []setting{{"model", "qwen2.5vl:7b"}, {"novision", "false"}, {"dpi", "150"}}
+	if !slices.Equal(settings, want) {
+		t.Errorf("readSettings() = %v, want %v", settings, want)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	model := flags.String("model", "default", "")
+	dpi := flags.Int("dpi", 300, "")
+	flags.Bool("novision", false, "")
+	if err := flags.Parse([]string{"-dpi", "600"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applySettings(flags, settings, "settings file"); err != nil {
+		t.Fatal(err)
+	}
+	if *model != "qwen2.5vl:7b" || *dpi != 600 {
+		t.Errorf("after applySettings() model = %q, dpi = %d, want the saved model and the command-line DPI", *model, *dpi)
+	}
+	if err := applySettings(flags, []setting{{"no-such-option", "1"}}, "settings file"); err == nil {
+		t.Error("applySettings() should reject unknown options")
+	}
+
+	models := []string{"llama3.3:latest", "qwen2.5vl:7b"}
+	for answer, want := range map[string]string{"": "qwen2.5vl:7b", "1": "llama3.3:latest", "llama3.3:latest": "llama3.3:latest"} {
+		if got, ok := chooseModel(models, answer, "qwen2.5vl:7b"); !ok || got != want {
+			t.Errorf("chooseModel(%q) = %q, %v, want %q", answer, got, ok, want)
+		}
+	}
+	if _, ok := chooseModel(models, "3", "qwen2.5vl:7b"); ok {
+		t.Error("chooseModel() should reject numbers outside the list")
+	}
+}
+
+// TestAnnotatePageNumber verifies that the label is drawn and the image stays intact
+func TestAnnotatePageNumber(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 1000, 1400))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	annotated := annotatePageNumber(12, buf.Bytes())
+	if err := validatePNG(annotated); err != nil {
+		t.Fatalf("annotated page is not a valid PNG: %v", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(annotated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 1000 || b.Dy() != 1400 {
+		t.Errorf("annotated size = %dx%d, want 1000x1400", b.Dx(), b.Dy())
+	}
+	gray := func(x, y int) uint32 {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r >> 8
+	}
+	if gray(1, 1) != 255 {
+		t.Errorf("label background = %d, want white", gray(1, 1))
+	}
+	black := 0
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 200; x++ {
+			if gray(x, y) == 0 {
+				black++
+			}
+		}
+	}
+	if black == 0 {
+		t.Error("no label text drawn")
+	}
+	if gray(500, 700) != 200 {
+		t.Errorf("page content = %d, want it untouched outside the label", gray(500, 700))
+	}
+	if got := annotatePageNumber(1, []byte("not an image")); string(got) != "not an image" {
+		t.Error("annotatePageNumber() should return undecodable data unchanged")
+	}
+}
+
+// TestModelSwitchError verifies when -fail-on-model-switch accepts the requested model
+func TestModelSwitchError(t *testing.T) {
+	if err := modelSwitchError("llava:13b", []string{"completion", "vision"}, nil); err != nil {
+		t.Errorf("vision model rejected: %v", err)
+	}
+	tests := []struct {
+		capabilities []string
+		err          error
+		want         string
+	}{
+		{[]string{"completion"}, nil, "llama2 isn't a vision model"},
+		{nil, nil, "did not report capabilities"},
+		{nil, errors.New("connection refused"), "cannot verify"},
+	}
+	for _, tt := range tests {
+		err := modelSwitchError("llama2", tt.capabilities, tt.err)
+		if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), "-novision") {
+			t.Errorf("modelSwitchError(%v, %v) = %v, want an error containing %q and the -novision hint", tt.capabilities, tt.err, err, tt.want)
+		}
+	}
+}
+
+// TestSanitizeProfile verifies the presets, that individual options win, and their rules
+func TestSanitizeProfile(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	charset := flags.String("charset", "ascii", "")
+	flags.Bool("allow-spaces", false, "")
+	separator := flags.String("separator", "dash", "")
+	nameCase := flags.String("case", "keep", "")
+	maxWords := flags.Int("max-words", 0, "")
+	if err := flags.Parse([]string{"-max-words", "6"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applySanitizeProfile(flags, "strict"); err != nil {
+		t.Fatal(err)
+	}
+	if *charset != "ascii" || *separator != "dash" || *nameCase != "lower" || *maxWords != 6 {
+		t.Errorf("strict profile gave charset %q, separator %q, case %q, max-words %d; want ascii, dash, lower and the explicit 6", *charset, *separator, *nameCase, *maxWords)
+	}
+	if err := applySanitizeProfile(flags, "loose"); err == nil {
+		t.Error("applySanitizeProfile() should reject unknown profiles")
+	}
+	// This flag set has no -strip-stopwords, so the dms profile fails; the error names the profile
+	if err := applySanitizeProfile(flags, "dms"); err == nil || !strings.Contains(err.Error(), "in -sanitize-profile dms") || strings.Contains(err.Error(), "settings file") {
+		t.Errorf("applySanitizeProfile() error = %v, want it to name the profile", err)
+	}
+
+	config = getDefaultConfig()
+	config.Case = "lower"
+	config.MaxWords = 4
+	if got := sanitizeFilename("Quarterly Report ACME Corporation 2024"); got != "quarterly-report-acme-corporation" {
+		t.Errorf("strict sanitizeFilename() = %q", got)
+	}
+
+	config = getDefaultConfig()
+	config.Case = "lower"
+	config.Separator = "underscore"
+	config.StripStopwords = true
+	if got := sanitizeFilename("The Invoice of ACME for March 2024"); got != "invoice_acme_march_2024" {
+		t.Errorf("dms sanitizeFilename() = %q, want %q", got, "invoice_acme_march_2024")
+	}
+	if got := sanitizeFilename("The And"); got != "the_and" {
+		t.Errorf("sanitizeFilename() of stopwords only = %q, want them kept", got)
+	}
+	if reasons := nameViolations("invoice_acme.pdf"); len(reasons) > 0 {
+		t.Errorf("nameViolations() with -separator underscore = %v, want none", reasons)
+	}
+	if reasons := nameViolations("invoice-acme.pdf"); len(reasons) == 0 {
+		t.Error("nameViolations() should flag dashes with -separator underscore")
+	}
+
+	config = getDefaultConfig()
+	config.Case = "lower"
+	config.TitleCase = true
+	if name, err := newGeneratedName("ACME INVOICE March"); err != nil || name.Slug != "Acme-Invoice-March" {
+		t.Errorf("-case lower with -title-case = %q, %v, want %q", name.Slug, err, "Acme-Invoice-March")
+	}
+}
+
+// TestGSDeviceFallback verifies that a page failing with png16m is retried with the
+// -gs-device-fallback devices in order
+func TestGSDeviceFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as gs stand-in")
+	}
+	originalConfig, originalDevices := config, gsFallbackDevices
+	defer func() { config, gsFallbackDevices = originalConfig, originalDevices }()
+
+	binDir := t.TempDir()
+	pngFile := filepath.Join(binDir, "page.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pngFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only pnggray works; every call is logged
+	script := "#!/bin/sh\necho \"$2 $3\" >> " + filepath.Join(binDir, "calls") + "\ncase \"$*\" in *-sDEVICE=pnggray*) /bin/cat " + pngFile + ";; *) echo 'Error: /rangecheck' >&2; exit 1;; esac\n"
+	if err := os.WriteFile(filepath.Join(binDir, "gs"), []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write gs stand-in: %v", err)
+	}
+	t.Setenv("PATH", binDir)
+	config = getDefaultConfig()
+
+	gsFallbackDevices = nil
+	if _, err := extractPageAsPNG("doc.pdf", 1, 72); err == nil || !strings.Contains(err.Error(), "rangecheck") {
+		t.Errorf("without fallback devices extractPageAsPNG() error = %v, want the Ghostscript error", err)
+	}
+
+	var err error
+	if gsFallbackDevices, err = parseGSDevices("pngmono, pnggray"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := extractPageAsPNG("doc.pdf", 1, 72)
+	if err != nil || !bytes.Equal(data, buf.Bytes()) {
+		t.Errorf("extractPageAsPNG() with fallback = %d bytes, %v, want the pnggray rendering", len(data), err)
+	}
+	calls, _ := os.ReadFile(filepath.Join(binDir, "calls"))
+	if want := "-dNOPAUSE -sDEVICE=png16m\n-dNOPAUSE -sDEVICE=png16m\n-dNOPAUSE -sDEVICE=pngmono\n-dNOPAUSE -sDEVICE=pnggray\n"; string(calls) != want {
+		t.Errorf("gs calls = %q, want %q", calls, want)
+	}
+
+	if _, err := parseGSDevices("jpeg"); err == nil {
+		t.Error("parseGSDevices() should reject non-PNG devices")
+	}
+}
+
+// TestUsageStats verifies request accounting for -stats and the per-file manifest usage
+func TestUsageStats(t *testing.T) {
+	originalConfig := config
+	defer func() { config, usage, fileUsage = originalConfig, usageStats{}, usageStats{} }()
+	config = getDefaultConfig()
+	config.Stats = true
+	usage, fileUsage = usageStats{}, usageStats{}
+
+	images := []string{base64.StdEncoding.EncodeToString(make([]byte, 1000)), base64.StdEncoding.EncodeToString(make([]byte, 998))}
+	recordRequest(map[string]interface{}{"model": "qwen2.5vl:7b", "images": images}, 3*time.Second)
+	recordRequest(map[string]interface{}{"model": "gemma3:1b", "prompt": "text"}, time.Second)
+	fileUsage.ocrChars = 420
+
+	if usage.requests != 2 || usage.imageBytes != 1998 || usage.averageResponse() != 2*time.Second {
+		t.Errorf("usage = %d requests, %d bytes, average %v; want 2, 1998, 2s", usage.requests, usage.imageBytes, usage.averageResponse())
+	}
+	if m := usage.models["qwen2.5vl:7b"]; m == nil || m.requests != 1 || m.imageBytes != 1998 {
+		t.Errorf("per-model usage = %+v, want one request with the images", m)
+	}
+	entry := newManifestEntry("scan.pdf", FileResult{}, nil)
+	if entry.Usage == nil || *entry.Usage != (Usage{Requests: 2, ImageBytes: 1998, OCRChars: 420, OllamaMS: 4000}) {
+		t.Errorf("manifest usage = %+v", entry.Usage)
+	}
+
+	for n, want := range map[int64]string{512: "512 B", 2048: "2.0 KiB", 5 << 20: "5.0 MiB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+// TestConfirmDestructive verifies the startup interlock for -auto runs that change originals
+func TestConfirmDestructive(t *testing.T) {
+	originalInput := promptInput
+	defer func() { promptInput = originalInput }()
+
+	cfg := getDefaultConfig()
+	cfg.AutoRename = true
+	if actions := destructiveActions(cfg); len(actions) != 0 {
+		t.Errorf("plain -auto run reported as destructive: %v", actions)
+	}
+	cfg.OnFailure = "quarantine"
+	cfg.QuarantineDir = "failed"
+	cfg.CombineGlob = "scan_*.pdf"
+	cfg.CombineRemoveParts = true
+	if actions := destructiveActions(cfg); len(actions) != 2 {
+		t.Errorf("destructiveActions() = %v, want deleting parts and quarantining", actions)
+	}
+	dryRun := cfg
+	dryRun.DryRun = true
+	if !confirmDestructive(dryRun, 3, false) {
+		t.Error("a dry run changes nothing and needs no confirmation")
+	}
+
+	if confirmDestructive(cfg, 3, false) {
+		t.Error("without a terminal the run must require -yes")
+	}
+	for answer, want := range map[string]bool{"y\n": true, "YES\n": true, "\n": false, "n\n": false, "": false} {
+		promptInput = bufio.NewScanner(strings.NewReader(answer))
+		if got := confirmDestructive(cfg, 3, true); got != want {
+			t.Errorf("confirmDestructive() with answer %q = %v, want %v", answer, got, want)
+		}
+	}
+	cfg.Yes = true
+	if !confirmDestructive(cfg, 3, false) {
+		t.Error("-yes should skip the confirmation")
+	}
+	// -on-collision overwrite counts when given explicitly or when -output already has PDFs
+	overwrite := getDefaultConfig()
+	overwrite.AutoRename = true
+	overwrite.OutputDir = t.TempDir()
+	if actions := destructiveActions(overwrite); len(actions) != 0 {
+		t.Errorf("default overwrite into an empty -output reported as destructive: %v", actions)
+	}
+	overwrite.OnCollisionExplicit = true
+	if actions := destructiveActions(overwrite); len(actions) != 1 || !strings.Contains(actions[0], "-on-collision overwrite") {
+		t.Errorf("destructiveActions() with explicit -on-collision overwrite = %v, want the overwrite listed", actions)
+	}
+	overwrite.OnCollisionExplicit = false
+	if err := os.WriteFile(filepath.Join(overwrite.OutputDir, "Invoice.pdf"), []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if actions := destructiveActions(overwrite); len(actions) != 1 {
+		t.Errorf("destructiveActions() with PDFs in -output = %v, want the overwrite listed", actions)
+	}
+	if confirmDestructive(overwrite, 3, false) {
+		t.Error("overwriting existing outputs without a terminal must require -yes")
+	}
+	overwrite.OnCollision = "suffix"
+	if actions := destructiveActions(overwrite); len(actions) != 0 {
+		t.Errorf("-on-collision suffix reported as destructive: %v", actions)
+	}
+}
+
+func TestPageTextExtract(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses shell scripts as pdftotext and ocrmypdf stand-ins")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	binDir := t.TempDir()
+	layerFile := filepath.Join(binDir, "layer.txt")
+	pdftotext := "#!/bin/sh\n/bin/cat " + layerFile + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "pdftotext"), []byte(pdftotext), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The OCR stand-in writes its text to the sidecar file (argument 5)
+	ocrmypdf := "#!/bin/sh\necho 'OCR text' > \"$5\"\n"
+	if err := os.WriteFile(filepath.Join(binDir, "ocrmypdf"), []byte(ocrmypdf), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+	config = getDefaultConfig()
+	config.MinTextChars = 20
+
+	digital := "Invoice 2024-117 from ACME Corp for consulting services"
+	if err := os.WriteFile(layerFile, []byte(digital), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := extractText("doc.pdf"); err != nil || strings.TrimSpace(text) != "OCR text" {
+		t.Errorf("extractText() without -page-text-extract = %q, %v, want the OCR text", text, err)
+	}
+
+	config.PageTextExtract = true
+	if text, err := extractText("doc.pdf"); err != nil || text != digital {
+		t.Errorf("extractText() with a text layer = %q, %v, want the text layer", text, err)
+	}
+
+	// A scan has no or almost no text layer
+	if err := os.WriteFile(layerFile, []byte("  \f 1 \f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := extractText("doc.pdf"); err != nil || strings.TrimSpace(text) != "OCR text" {
+		t.Errorf("extractText() with a short text layer = %q, %v, want the OCR text", text, err)
+	}
+}
+
+func TestDirContext(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"/clients/acme/doc.pdf", "acme"},
+		{"/archive/Tax_Returns-2024/doc.pdf", "tax returns 2024"},
+		{"/docs/Müller GmbH/doc.pdf", "müller gmbh"},
+		{"/a/b-c-d-e-f-g-h-i/doc.pdf", "b c d e f g"},
+		{"/tmp/ai-pdf-renamer-entry-123/doc.pdf", ""},
+		{"/doc.pdf", ""},
+	}
+	for _, tt := range tests {
+		if got := dirHint(tt.file); got != tt.want {
+			t.Errorf("dirHint(%q) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+
+	if got := dirContext("/clients/acme/doc.pdf"); got != "" {
+		t.Errorf("dirContext() without -use-dir-context = %q, want empty", got)
+	}
+	config.UseDirContext = true
+	if got := textPrompt("/clients/acme/doc.pdf", "text"); !strings.Contains(got, "These files are filed under: acme.") || strings.Contains(got, "/clients") {
+		t.Errorf("textPrompt() = %q, want the folder name without the path", got)
+	}
+}
+
+func TestMaxRuntimePerFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses shell scripts as tool stand-ins")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	// A pathological PDF on which every tool hangs
+	binDir := t.TempDir()
+	for _, tool := range []string{"gs", "ocrmypdf", "pdfinfo", "exiftool"} {
+		if err := os.WriteFile(filepath.Join(binDir, tool), []byte("#!/bin/sh\nexec /bin/sleep 30\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", binDir)
+	config = getDefaultConfig()
+	config.FastMode = false
+	config.MaxRuntimePerFile = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err := processPDF(filepath.Join(binDir, "doc.pdf"))
+	if err == nil || !strings.Contains(err.Error(), "processing exceeded time budget of 200ms") {
+		t.Errorf("processPDF() error = %v, want the time budget error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("processPDF() took %v, want it abandoned after the budget", elapsed)
+	}
+	if fileCtx.Err() != nil {
+		t.Error("fileCtx still expired after processPDF(), want it reset for the next file")
+	}
+}
+
+func TestPromptHashInCacheKey(t *testing.T) {
+	originalConfig, originalDone, originalBatch := config, resumeDone, batch
+	defer func() { config, resumeDone, batch, fileCacheKey = originalConfig, originalDone, originalBatch, "" }()
+	config = getDefaultConfig()
+
+	src := filepath.Join(t.TempDir(), "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4 invoice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key, err := cacheKey(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := cacheKey(src); again != key {
+		t.Errorf("cacheKey() = %q, then %q, want it stable", key, again)
+	}
+
+	changes := map[string]func(){
+		"prompt":    func() { config.CustomPrompt = "Name this document." },
+		"model":     func() { config.Model = "llama3.3:latest" },
+		"mode":      func() { config.FastMode = false },
+		"separator": func() { config.Separator = "underscore" },
+		"budget":    func() { config.CharsBudget = 40 },
+		"content":   func() { os.WriteFile(src, []byte("%PDF-1.4 receipt"), 0644) },
+	}
+	for name, change := range changes {
+		saved, _ := os.ReadFile(src)
+		config = getDefaultConfig()
+		change()
+		if changed, _ := cacheKey(src); changed == key {
+			t.Errorf("cacheKey() unchanged after changing the %s", name)
+		}
+		os.WriteFile(src, saved, 0644)
+	}
+
+	// -resume skips the file only while the recorded key matches
+	config = getDefaultConfig()
+	config.PromptHashInCacheKey = true
+	batch = batchState{}
+	resumeDone = map[string]string{manifestKey(src): key}
+	processSource(src, src)
+	if batch.resumed != 1 || batch.processed != 0 {
+		t.Errorf("with a matching key resumed = %d, processed = %d, want the file skipped", batch.resumed, batch.processed)
+	}
+	if fileCacheKey != key {
+		t.Errorf("fileCacheKey = %q, want %q for the manifest", fileCacheKey, key)
+	}
+	if entry := newManifestEntry(src, FileResult{}, nil); entry.Key != key {
+		t.Errorf("manifest entry key = %q, want %q", entry.Key, key)
+	}
+
+	batch = batchState{}
+	config.AutoRename = true
+	resumeDone = map[string]string{manifestKey(src): ""} // Recorded before the flag was used
+	processSource(src, src)
+	if batch.resumed != 0 || batch.processed != 1 {
+		t.Errorf("without a recorded key resumed = %d, processed = %d, want the file processed again", batch.resumed, batch.processed)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	originalConfig, originalBatch, originalOutput := config, batch, errorOutput
+	defer func() { config, batch, errorOutput, filePhase = originalConfig, originalBatch, originalOutput, "" }()
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("error: %w of 5m0s", errTimeBudget), "time_budget"},
+		{fmt.Errorf("error: gs %w on doc.pdf after 2m0s", errToolTimeout), "tool_timeout"},
+		{fmt.Errorf("%w: no %%EOF", errInvalidSource), "invalid_pdf"},
+		{errAllPagesEmpty, "blank_pages"},
+		{fmt.Errorf("error calling Ollama API: %w", &url.Error{Op: "Post", URL: "http://localhost:11434/api/generate", Err: errors.New("connection refused")}), "ollama_unreachable"},
+		{fmt.Errorf("%w: model not found", errOllamaAPI), "ollama_error"},
+		{unusableAnswer(errors.New("error: Empty response from Ollama API")), "unusable_answer"},
+		{errors.New("error extracting entry: unexpected EOF"), "failed"},
+	}
+	for _, tt := range tests {
+		if got := errorCode(tt.err); got != tt.want {
+			t.Errorf("errorCode(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+
+	// A file failing during extraction is reported as one JSON line
+	config = getDefaultConfig()
+	config.QuietErrors = true
+	batch = batchState{}
+	var buf bytes.Buffer
+	errorOutput = &buf
+	filePhase = "start"
+	progress.update(progressExtracting, "", nil)
+	batch.recordFailure("scan.pdf", fmt.Errorf("error: ocrmypdf %w on scan.pdf after 10m0s", errToolTimeout))
+	var failure FileFailure
+	if err := json.Unmarshal(buf.Bytes(), &failure); err != nil {
+		t.Fatalf("invalid -json-errors line %q: %v", buf.String(), err)
+	}
+	want := FileFailure{File: "scan.pdf", Phase: "extracting", Code: "tool_timeout", Message: "error: ocrmypdf timed out on scan.pdf after 10m0s"}
+	if failure != want || strings.Count(buf.String(), "\n") != 1 {
+		t.Errorf("-json-errors line = %q, want %+v", buf.String(), want)
+	}
+}
+
+func TestAutoMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as pdftotext stand-in")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	// The stand-in logs its arguments and prints the text layer
+	binDir := t.TempDir()
+	layerFile := filepath.Join(binDir, "layer.txt")
+	script := "#!/bin/sh\necho \"$*\" >> " + filepath.Join(binDir, "calls") + "\n/bin/cat " + layerFile + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "pdftotext"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+	config = getDefaultConfig()
+
+	if !useVision("doc.pdf") {
+		t.Error("useVision() without -auto-mode = false, want the global vision mode")
+	}
+	if _, err := os.Stat(filepath.Join(binDir, "calls")); err == nil {
+		t.Error("useVision() without -auto-mode probed the text layer")
+	}
+
+	config.AutoMode = true
+	digital := strings.Repeat("Invoice 2024-117 from ACME Corp. ", 5)
+	if err := os.WriteFile(layerFile, []byte(digital), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if useVision("doc.pdf") {
+		t.Error("useVision() for a page with a text layer = true, want the text path")
+	}
+	if err := os.WriteFile(layerFile, []byte("\f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !useVision("scan.pdf") {
+		t.Error("useVision() for a scanned page = false, want vision")
+	}
+	calls, _ := os.ReadFile(filepath.Join(binDir, "calls"))
+	if want := "-enc UTF-8 -l 1 doc.pdf -\n-enc UTF-8 -l 1 scan.pdf -\n"; string(calls) != want {
+		t.Errorf("pdftotext calls = %q, want only page 1 read", calls)
+	}
+
+	os.Remove(filepath.Join(binDir, "pdftotext"))
+	if !useVision("doc.pdf") {
+		t.Error("useVision() without a readable text layer = false, want vision")
+	}
+}
+
+func TestNormalizeDates(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	tests := []struct {
+		order string
+		in    string
+		want  string
+	}{
+		{"mdy", "Invoice ACME 2023-01-05", "Invoice ACME 2023-01-05"},
+		{"mdy", "Invoice ACME 2023/1/5", "Invoice ACME 2023-01-05"},
+		{"mdy", "Invoice ACME Jan 5 2023", "Invoice ACME 2023-01-05"},
+		{"mdy", "Invoice ACME January 5th, 2023", "Invoice ACME 2023-01-05"},
+		{"mdy", "Invoice ACME 5 Jan. 2023", "Invoice ACME 2023-01-05"},
+		{"mdy", "Rechnung ACME 5. März 2023", "Rechnung ACME 2023-03-05"},
+		{"mdy", "Invoice ACME 05/01/23", "Invoice ACME 2023-05-01"},
+		{"dmy", "Invoice ACME 05/01/23", "Invoice ACME 2023-01-05"},
+		{"dmy", "Rechnung ACME 05.01.2023", "Rechnung ACME 2023-01-05"},
+		{"mdy", "Invoice ACME 25/01/2023", "Invoice ACME 2023-01-25"}, // Only valid as day/month
+		{"mdy", "Statement 12/31/99", "Statement 1999-12-31"},
+		{"mdy", "From 01/02/2023 to 02/03/2023", "From 2023-01-02 to 2023-02-03"},
+		// Not dates
+		{"mdy", "Manual v1.2.10", "Manual v1.2.10"},
+		{"mdy", "Address 10.0.0.1", "Address 10.0.0.1"},
+		{"mdy", "Invoice 2023-13-45", "Invoice 2023-13-45"},
+		{"mdy", "Order 12-34-5678", "Order 12-34-5678"},
+		{"mdy", "May Report 2023", "May Report 2023"},
+		{"mdy", "Invoice 31/02/2023", "Invoice 31/02/2023"},
+	}
+	for _, tt := range tests {
+		config.DateOrder = tt.order
+		if got := normalizeDates(tt.in); got != tt.want {
+			t.Errorf("normalizeDates(%q) with %s = %q, want %q", tt.in, tt.order, got, tt.want)
+		}
+	}
+
+	// The date is normalized before slugification
+	config.NormalizeInvoiceDates = true
+	config.DateOrder = "mdy"
+	name, err := newGeneratedName("Invoice ACME Jan 5 2023")
+	if err != nil || name.Slug != "Invoice-ACME-2023-01-05" || name.Readable != "Invoice ACME 2023-01-05" {
+		t.Errorf("newGeneratedName() = %+v, %v, want the ISO date in slug and readable name", name, err)
+	}
+}
+
+func TestCheckMaxFiles(t *testing.T) {
+	cfg := getDefaultConfig()
+	if err := checkMaxFiles(cfg, 1000); err != nil {
+		t.Errorf("checkMaxFiles() at the default cap = %v, want nil", err)
+	}
+	err := checkMaxFiles(cfg, 3412)
+	if err == nil || !strings.Contains(err.Error(), "3412 files matched, more than -max-files 1000") {
+		t.Errorf("checkMaxFiles() above the cap = %v, want the match count", err)
+	}
+
+	cfg.Yes = true
+	if err := checkMaxFiles(cfg, 3412); err != nil {
+		t.Errorf("checkMaxFiles() with -yes = %v, want nil", err)
+	}
+	cfg.Yes, cfg.MaxFiles = false, 5000
+	if err := checkMaxFiles(cfg, 3412); err != nil {
+		t.Errorf("checkMaxFiles() with a raised cap = %v, want nil", err)
+	}
+	cfg.MaxFiles = 0
+	if err := checkMaxFiles(cfg, 100000); err != nil {
+		t.Errorf("checkMaxFiles() with -max-files 0 = %v, want nil", err)
+	}
+}
+
+func TestTextSampling(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = getDefaultConfig()
+
+	text := "Dear Sir or Madam, the contract ends. Kind regards, Jane Doe, ACME GmbH"
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{"head", "Dear Sir or Madam, t"},
+		{"tail", " Jane Doe, ACME GmbH"},
+		{"head-tail", "Dear Sir o" + elisionMarker + " ACME GmbH"},
+	}
+	for _, tt := range tests {
+		config.MaxTextChars = 20
+		config.TextSampling = tt.strategy
+		got := prepareText(text)
+		if got != tt.want {
+			t.Errorf("prepareText() with -text-sampling %s = %q, want %q", tt.strategy, got, tt.want)
+		}
+		if n := utf8.RuneCountInString(strings.Replace(got, elisionMarker, "", 1)); n != 20 {
+			t.Errorf("prepareText() with -text-sampling %s kept %d characters, want 20", tt.strategy, n)
+		}
+	}
+
+	// Short text and an odd limit
+	config.TextSampling = "head-tail"
+	if got := prepareText("Invoice"); got != "Invoice" {
+		t.Errorf("prepareText() of text within the limit = %q, want it unchanged", got)
+	}
+	if got := sampleText([]rune("abcdefghij"), 5, "head-tail"); got != "abc"+elisionMarker+"ij" {
+		t.Errorf("sampleText() with an odd limit = %q, want 3 leading and 2 trailing characters", got)
+	}
+	if got := sampleText([]rune("Müller GmbH Köln"), 4, "tail"); got != "Köln" {
+		t.Errorf("sampleText() tail = %q, want whole characters", got)
+	}
+}
+
+func TestEmitThumbnail(t *testing.T) {
+	originalConfig, originalImage := config, firstPageImage
+	defer func() { config, firstPageImage = originalConfig, originalImage }()
+	config = getDefaultConfig()
+	config.EmitThumbnail = true
+
+	var page bytes.Buffer
+	if err := png.Encode(&page, image.NewGray(image.Rect(0, 0, 1000, 500))); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	output := filepath.Join(dir, "Invoice-ACME.pdf")
+
+	// The page rendered for the vision model is reused
+	firstPageImage = page.Bytes()
+	if err := emitThumbnail(output); err != nil {
+		t.Fatalf("emitThumbnail() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "Invoice-ACME.thumb.jpg"))
+	if err != nil {
+		t.Fatalf("thumbnail not written: %v", err)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "jpeg" || cfg.Width != 256 || cfg.Height != 128 {
+		t.Errorf("thumbnail = %s %dx%d (%v), want a 256x128 jpeg", format, cfg.Width, cfg.Height, err)
+	}
+
+	config.ThumbnailWidth, config.ThumbnailFormat = 100, "png"
+	if err := emitThumbnail(output); err != nil {
+		t.Fatalf("emitThumbnail() error = %v", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(dir, "Invoice-ACME.thumb.png"))
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != "png" || cfg.Width != 100 {
+		t.Errorf("thumbnail = %s %dx%d (%v), want a 100 pixel wide png", format, cfg.Width, cfg.Height, err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	// Without a vision rendering, page 1 of the written PDF is rendered
+	binDir := t.TempDir()
+	pngFile := filepath.Join(binDir, "page.png")
+	if err := os.WriteFile(pngFile, page.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\necho \"$*\" > " + filepath.Join(binDir, "args") + "\n/bin/cat " + pngFile + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "gs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+	firstPageImage = nil
+	if err := emitThumbnail(output); err != nil {
+		t.Fatalf("emitThumbnail() without a rendered page error = %v", err)
+	}
+	args, _ := os.ReadFile(filepath.Join(binDir, "args"))
+	if !strings.Contains(string(args), "-r72 -dFirstPage=1 -dLastPage=1") || !strings.HasSuffix(strings.TrimSpace(string(args)), output) {
+		t.Errorf("gs args = %q, want page 1 of the output at 72 DPI", args)
+	}
+}
+
+func TestGSPageRenderCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as gs stand-in")
+	}
+	originalConfig, originalDevices, originalRenders, originalBatch := config, gsFallbackDevices, pageRenders, batch
+	defer func() {
+		config, gsFallbackDevices, pageRenders, batch = originalConfig, originalDevices, originalRenders, originalBatch
+	}()
+
+	binDir := t.TempDir()
+	pngFile := filepath.Join(binDir, "page.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pngFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only pnggray works; every call is logged
+	calls := filepath.Join(binDir, "calls")
+	script := "#!/bin/sh\necho \"$3 $4\" >> " + calls + "\ncase \"$*\" in *-sDEVICE=pnggray*) /bin/cat " + pngFile + ";; *) echo 'Error: /rangecheck' >&2; exit 1;; esac\n"
+	if err := os.WriteFile(filepath.Join(binDir, "gs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+	config = getDefaultConfig()
+	gsFallbackDevices = []string{"pnggray"}
+	countCalls := func() int {
+		data, _ := os.ReadFile(calls)
+		return strings.Count(string(data), "\n")
+	}
+
+	// Without the cache every extraction calls Ghostscript
+	pageRenders = nil
+	extractPageAsPNG("doc.pdf", 1, 72)
+	extractPageAsPNG("doc.pdf", 1, 72)
+	if n := countCalls(); n != 4 {
+		t.Errorf("gs calls without the cache = %d, want 4 (png16m and pnggray twice)", n)
+	}
+
+	config.GSPageRenderCache = true
+	os.Remove(calls)
+	for i := 0; i < 3; i++ {
+		if data, err := extractPageAsPNG("doc.pdf", 1, 72); err != nil || !bytes.Equal(data, buf.Bytes()) {
+			t.Fatalf("extractPageAsPNG() = %d bytes, %v, want the pnggray rendering", len(data), err)
+		}
+	}
+	if n := countCalls(); n != 2 {
+		t.Errorf("gs calls with the cache = %d, want 2 (png16m and pnggray once)", n)
+	}
+	if _, ok := pageRenders[pageRenderKey{"doc.pdf", 1, 72, "pnggray"}]; !ok {
+		t.Errorf("pageRenders = %v, want the page keyed by its device", pageRenders)
+	}
+
+	// A different resolution or page is a new render
+	extractPageAsPNG("doc.pdf", 1, 150)
+	extractPageAsPNG("doc.pdf", 2, 72)
+	if n := countCalls(); n != 6 {
+		t.Errorf("gs calls after other pages = %d, want 6", n)
+	}
+
+	// The next file starts with an empty cache
+	config.AutoRename, config.DryRun = true, true
+	src := filepath.Join(t.TempDir(), "scan.pdf")
+	os.WriteFile(src, []byte("%PDF-1.4"), 0644)
+	processSource(src, src)
+	if _, ok := pageRenders[pageRenderKey{"doc.pdf", 1, 72, "pnggray"}]; ok {
+		t.Error("pageRenders kept the previous file's pages")
+	}
+}
+
+// TestCollisionSuffixHash verifies -collision-suffix hash names a collision after the
+// content, falls back to numbers for the same content written twice, and covers archives
+func TestCollisionSuffixHash(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "contract-v2.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-v2"), 0644); err != nil {
+		t.Fatalf("Failed to write source: %v", err)
+	}
+	hash, err := fileHash(src)
+	if err != nil {
+		t.Fatalf("fileHash() error = %v", err)
+	}
+	token := hash[:8]
+	outDir := filepath.Join(tmpDir, "out")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		t.Fatalf("Failed to create output dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "Agreement.pdf"), []byte("%PDF-v1"), 0644); err != nil {
+		t.Fatalf("Failed to write existing output: %v", err)
+	}
+
+	config = getDefaultConfig()
+	config.OutputDir = outDir
+	config.OnCollision = "suffix"
+	config.CollisionSuffix = "hash"
+
+	path, resolution, err := writeOutputFile(src, "Agreement", "")
+	if err != nil {
+		t.Fatalf("writeOutputFile() error = %v", err)
+	}
+	if want := filepath.Join(outDir, "Agreement-"+token+".pdf"); path != want || resolution != resolutionSuffixed {
+		t.Errorf("writeOutputFile() = %q, %q, want %q, %q", path, resolution, want, resolutionSuffixed)
+	}
+	path, _, err = writeOutputFile(src, "Agreement", "")
+	if err != nil {
+		t.Fatalf("writeOutputFile() error = %v", err)
+	}
+	if want := filepath.Join(outDir, "Agreement-"+token+"-1.pdf"); path != want {
+		t.Errorf("writeOutputFile() for the same content again = %q, want %q", path, want)
+	}
+
+	config.CollisionSuffix = "number"
+	if got := collisionPath(filepath.Join(outDir, "Agreement.pdf"), src); got != filepath.Join(outDir, "Agreement-1.pdf") {
+		t.Errorf("collisionPath() in number mode = %q, want Agreement-1.pdf", got)
+	}
+	config.Separator = "underscore"
+	if got := collisionPath(filepath.Join(outDir, "Agreement.pdf"), src); got != filepath.Join(outDir, "Agreement_1.pdf") {
+		t.Errorf("collisionPath() with -separator underscore = %q, want Agreement_1.pdf", got)
+	}
+	config.Separator = "dash"
+
+	config.CollisionSuffix = "hash"
+	archive, err := openArchive(filepath.Join(tmpDir, "out.zip"))
+	if err != nil {
+		t.Fatalf("openArchive() error = %v", err)
+	}
+	defer archive.close()
+	for _, want := range []string{"Agreement.pdf", "Agreement-" + token + ".pdf", "Agreement-" + token + "-1.pdf"} {
+		output, _, err := archive.add(src, "Agreement")
+		if err != nil {
+			t.Fatalf("archive.add() error = %v", err)
+		}
+		if !strings.HasSuffix(output, ":"+want) {
+			t.Errorf("archive.add() = %q, want entry %s", output, want)
+		}
+	}
+}
+
+// TestRequestDump verifies -dump-request shows the payload as sent, with the images
+// replaced by size placeholders
+func TestRequestDump(t *testing.T) {
+	image := base64.StdEncoding.EncodeToString(make([]byte, 1000))
+	payload := map[string]interface{}{
+		"model":   "qwen2.5vl:7b",
+		"prompt":  "Name this <document>",
+		"images":  []string{image, image},
+		"options": map[string]interface{}{"temperature": 0.2, "seed": 42},
+	}
+
+	dump := requestDump(payload)
+	for _, want := range []string{`"model": "qwen2.5vl:7b"`, `"prompt": "Name this <document>"`, `"<1000 bytes>"`, `"temperature": 0.2`, `"seed": 42`} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("requestDump() = %s, want it to contain %s", dump, want)
+		}
+	}
+	if strings.Contains(dump, image) {
+		t.Error("requestDump() contains the image data")
+	}
+	if images := payload["images"].([]string); images[0] != image {
+		t.Error("requestDump() modified the payload")
+	}
+}
+
+// TestAdaptPageSize verifies that only pages over -max-page-bytes are re-rendered at
+// -step-down-dpi, and that the check is off by default
+func TestAdaptPageSize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as gs stand-in")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	binDir := t.TempDir()
+	pngFile := filepath.Join(binDir, "small.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pngFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Every call logs its arguments and returns the small rendering
+	calls := filepath.Join(binDir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + calls + "\n/bin/cat " + pngFile + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "gs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir)
+	large := bytes.Repeat([]byte{0}, 2000)
+
+	config = getDefaultConfig()
+	if config.MaxPageBytes != 0 {
+		t.Errorf("default MaxPageBytes = %d, want 0 (off)", config.MaxPageBytes)
+	}
+	if got := adaptPageSize("doc.pdf", 1, 300, large); !bytes.Equal(got, large) {
+		t.Error("adaptPageSize() re-rendered a page with the check off")
+	}
+
+	config.MaxPageBytes = 1000
+	if got := adaptPageSize("doc.pdf", 1, 300, large[:1000]); !bytes.Equal(got, large[:1000]) {
+		t.Error("adaptPageSize() re-rendered a page within -max-page-bytes")
+	}
+	if _, err := os.Stat(calls); err == nil {
+		t.Error("Ghostscript was called for pages that need no re-render")
+	}
+
+	if got := adaptPageSize("doc.pdf", 2, 300, large); !bytes.Equal(got, buf.Bytes()) {
+		t.Errorf("adaptPageSize() over the limit = %d bytes, want the %d byte re-render", len(got), buf.Len())
+	}
+	data, _ := os.ReadFile(calls)
+	if !strings.Contains(string(data), fmt.Sprintf("-r%d", config.StepDownDPI)) {
+		t.Errorf("re-render arguments = %q, want -r%d", data, config.StepDownDPI)
+	}
+}
+
+// roundTripFunc lets a test answer HTTP requests in place of Ollama
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// TestModelCapabilities verifies the vision detection behind -fail-on-model-switch for
+// vision and text models and for a failed /api/show request
+func TestModelCapabilities(t *testing.T) {
+	originalTransport := http.DefaultTransport
+	defer func() { http.DefaultTransport = originalTransport }()
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		transport  error
+		wantErr    bool
+		wantVision bool
+	}{
+		{name: "vision model", status: http.StatusOK, body: `{"capabilities":["completion","vision"]}`, wantVision: true},
+		{name: "text model", status: http.StatusOK, body: `{"capabilities":["completion","tools"]}`},
+		{name: "unknown model", status: http.StatusNotFound, body: `{"error":"model 'nope' not found"}`, wantErr: true},
+		{name: "unreachable", transport: errors.New("connection refused"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			http.DefaultTransport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Path != "/api/show" {
+					t.Errorf("request path = %s, want /api/show", req.URL.Path)
+				}
+				if body, _ := io.ReadAll(req.Body); !strings.Contains(string(body), `"model":"llava:13b"`) {
+					t.Errorf("request body = %s, want the model", body)
+				}
+				if tt.transport != nil {
+					return nil, tt.transport
+				}
+				return &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body)), Header: http.Header{}}, nil
+			})
+
+			capabilities, err := modelCapabilities("llava:13b")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("modelCapabilities() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := hasCapability(capabilities, "vision"); got != tt.wantVision {
+				t.Errorf("hasCapability(%v, vision) = %v, want %v", capabilities, got, tt.wantVision)
+			}
+			if switchErr := modelSwitchError("llava:13b", capabilities, err); (switchErr == nil) != tt.wantVision {
+				t.Errorf("modelSwitchError() = %v, want an error unless the model supports vision", switchErr)
+			}
+		})
+	}
+}
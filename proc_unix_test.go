@@ -0,0 +1,72 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestToolCommandTimeout verifies that a timed out tool is killed together with its
+// children and reported as a timeout
+func TestToolCommandTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	cmd := newToolCommand(200*time.Millisecond, "sh", "-c", "sleep 30 & echo $! > "+pidFile+"; wait")
+	defer cmd.cancel()
+
+	start := time.Now()
+	err := cmd.Run()
+	if err == nil {
+		t.Fatal("Run() should fail when the timeout expires")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Run() returned after %v, want shortly after the timeout", elapsed)
+	}
+	timeoutErr := cmd.timeoutError("gs", "slow.pdf")
+	if timeoutErr == nil || !strings.Contains(timeoutErr.Error(), "gs timed out on slow.pdf") {
+		t.Errorf("timeoutError() = %v, want a gs timeout error", timeoutErr)
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("child process %d survived the timeout", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	fast := newToolCommand(time.Minute, "true")
+	defer fast.cancel()
+	if err := fast.Run(); err != nil || fast.timeoutError("gs", "a.pdf") != nil {
+		t.Errorf("a quick command should neither fail nor time out: %v", err)
+	}
+}
+
+// processAlive reports whether pid is running; zombies (killed but not yet reaped by
+// init) count as dead where /proc is available
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name, e.g. "123 (sleep) Z ..."
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
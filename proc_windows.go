@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows; cancellation kills the tool process itself
+func setProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+// setXattr is not supported on this platform
+func setXattr(path, key, value string) error {
+	return errXattrUnsupported
+}
+
+// getXattr is not supported on this platform
+func getXattr(path, key string) (string, error) {
+	return "", errXattrUnsupported
+}
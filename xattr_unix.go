@@ -0,0 +1,35 @@
+//go:build darwin || linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// setXattr stores value in the extended attribute key of path
+func setXattr(path, key, value string) error {
+	if err := unix.Setxattr(path, key, []byte(value), 0); err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return fmt.Errorf("%w: %v", errXattrUnsupported, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// getXattr reads the extended attribute key of path
+func getXattr(path, key string) (string, error) {
+	size, err := unix.Getxattr(path, key, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	n, err := unix.Getxattr(path, key, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}